@@ -363,7 +363,7 @@ func StartTestPeerExtra(numPeers int, numHosts int, numServices int, extraConfig
 		if err == nil {
 			peer.Lock.RLock()
 			peer.data.Lock.RLock()
-			gotPeers := len(peer.data.tables[TableStatus].Data)
+			gotPeers := len(peer.data.table(TableStatus).Data)
 			peer.data.Lock.RUnlock()
 			peer.Lock.RUnlock()
 			if gotPeers == numPeers {
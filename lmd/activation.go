@@ -0,0 +1,150 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// SystemdListenFDsStart is the first file descriptor passed by systemd socket activation
+const SystemdListenFDsStart = 3
+
+// ActivatedSocket is a listening socket inherited from systemd socket activation.
+type ActivatedSocket struct {
+	Name     string // FileDescriptorName from the socket unit
+	Listener net.Listener
+}
+
+// String returns the name and address of the socket.
+func (s *ActivatedSocket) String() string {
+	return fmt.Sprintf("%s (name: %s)", s.Listener.Addr().String(), s.Name)
+}
+
+// SystemdSockets returns the listening sockets passed by systemd socket activation, see sd_listen_fds(3).
+// It returns nil if lmd has not been socket activated. The environment variables are removed,
+// so they are not passed on to child processes.
+func SystemdSockets() (sockets []*ActivatedSocket, err error) {
+	pid := os.Getenv("LISTEN_PID")
+	numFDs := os.Getenv("LISTEN_FDS")
+	names := os.Getenv("LISTEN_FDNAMES")
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+	if pid == "" || numFDs == "" || pid != strconv.Itoa(os.Getpid()) {
+		return nil, nil
+	}
+	num, err := strconv.Atoi(numFDs)
+	if err != nil {
+		return nil, fmt.Errorf("systemd socket activation: cannot parse LISTEN_FDS %q: %w", numFDs, err)
+	}
+	return inheritSockets(SystemdListenFDsStart, num, names)
+}
+
+// inheritSystemdSockets returns the sockets passed by systemd by Listen entry.
+// Mismatches between the passed sockets and the configuration are fatal.
+func inheritSystemdSockets(listen []string) map[string]net.Listener {
+	sockets, err := SystemdSockets()
+	if err != nil {
+		log.Fatalf("%s", err)
+	}
+	matched, err := MatchActivatedSockets(listen, sockets)
+	if err != nil {
+		log.Fatalf("%s", err)
+	}
+	for entry, listener := range matched {
+		log.Infof("using socket %s from systemd socket activation for %s", listener.Addr().String(), entry)
+	}
+	return matched
+}
+
+// inheritSockets creates listeners from num file descriptors starting at start.
+func inheritSockets(start, num int, names string) (sockets []*ActivatedSocket, err error) {
+	fdNames := strings.Split(names, ":")
+	for i := 0; i < num; i++ {
+		fd := start + i
+		syscall.CloseOnExec(fd)
+		name := ""
+		if i < len(fdNames) {
+			name = fdNames[i]
+		}
+		file := os.NewFile(uintptr(fd), name)
+		listener, lErr := net.FileListener(file)
+		// the listener uses a duplicated file descriptor
+		file.Close()
+		if lErr != nil {
+			return nil, fmt.Errorf("systemd socket activation: file descriptor %d (name: %s) is no listening socket: %w", fd, name, lErr)
+		}
+		sockets = append(sockets, &ActivatedSocket{Name: name, Listener: listener})
+	}
+	return sockets, nil
+}
+
+// MatchActivatedSockets assigns the inherited sockets to the Listen entries, either by name
+// or by address. It returns the sockets by Listen entry and an error if any socket does not match.
+func MatchActivatedSockets(listen []string, sockets []*ActivatedSocket) (matched map[string]net.Listener, err error) {
+	matched = make(map[string]net.Listener)
+	for _, socket := range sockets {
+		entry := ""
+		for _, l := range listen {
+			if _, ok := matched[l]; ok {
+				continue
+			}
+			if socket.Name != "" && socket.Name == l {
+				entry = l
+				break
+			}
+			if entry == "" && activatedSocketMatches(l, socket) {
+				entry = l
+			}
+		}
+		if entry == "" {
+			return nil, fmt.Errorf("systemd socket activation: passed socket %s does not match any Listen entry, configured are: %s", socket.String(), strings.Join(listen, ", "))
+		}
+		matched[entry] = socket.Listener
+	}
+	return matched, nil
+}
+
+// activatedSocketMatches returns true if the socket address equals the address of the Listen entry.
+func activatedSocketMatches(listen string, socket *ActivatedSocket) bool {
+	network, address := listenAddress(listen)
+	switch addr := socket.Listener.Addr().(type) {
+	case *net.TCPAddr:
+		if network != "tcp" {
+			return false
+		}
+		tcpAddr, err := net.ResolveTCPAddr("tcp", address)
+		if err != nil || tcpAddr.Port != addr.Port {
+			return false
+		}
+		if tcpAddr.IP == nil || tcpAddr.IP.IsUnspecified() {
+			return addr.IP.IsUnspecified()
+		}
+		return tcpAddr.IP.Equal(addr.IP)
+	case *net.UnixAddr:
+		if network != "unix" {
+			return false
+		}
+		path1, err1 := filepath.Abs(address)
+		path2, err2 := filepath.Abs(addr.Name)
+		return err1 == nil && err2 == nil && path1 == path2
+	}
+	return false
+}
+
+// listenAddress returns the network and address of a Listen entry.
+func listenAddress(listen string) (network, address string) {
+	for _, prefix := range []string{"https://", "http://", "tls://"} {
+		if strings.HasPrefix(listen, prefix) {
+			return "tcp", strings.TrimPrefix(strings.TrimPrefix(listen, prefix), "*")
+		}
+	}
+	if strings.Contains(listen, ":") {
+		return "tcp", strings.TrimPrefix(listen, "*")
+	}
+	return "unix", listen
+}
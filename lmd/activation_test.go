@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func TestMatchActivatedSockets(t *testing.T) {
+	tcp, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tcp.Close()
+	port := tcp.Addr().(*net.TCPAddr).Port
+
+	dir := t.TempDir()
+	unix, err := net.Listen("unix", filepath.Join(dir, "a.sock"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unix.Close()
+
+	listen := []string{
+		"tls://*:1",
+		fmt.Sprintf("tls://127.0.0.1:%d", port),
+		filepath.Join(dir, "a.sock"),
+		"b.sock",
+	}
+
+	// matched by address
+	matched, err := MatchActivatedSockets(listen, []*ActivatedSocket{{Listener: tcp}, {Name: "lmd.socket", Listener: unix}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = assertEq(2, len(matched)); err != nil {
+		t.Error(err)
+	}
+	if err = assertEq(tcp, matched[listen[1]]); err != nil {
+		t.Error(err)
+	}
+	if err = assertEq(unix, matched[listen[2]]); err != nil {
+		t.Error(err)
+	}
+
+	// names take precedence
+	matched, err = MatchActivatedSockets(listen, []*ActivatedSocket{{Name: "b.sock", Listener: unix}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = assertEq(unix, matched["b.sock"]); err != nil {
+		t.Error(err)
+	}
+
+	// sockets must match a Listen entry
+	_, err = MatchActivatedSockets([]string{"127.0.0.1:1", "http://*:8080"}, []*ActivatedSocket{{Listener: tcp}})
+	if err == nil {
+		t.Fatalf("expected error for unmatched socket")
+	}
+	if err = assertLike("does not match any Listen entry", err.Error()); err != nil {
+		t.Error(err)
+	}
+
+	// not activated
+	matched, err = MatchActivatedSockets(listen, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = assertEq(0, len(matched)); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestInheritSockets(t *testing.T) {
+	tcp, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tcp.Close()
+	file, err := tcp.(*net.TCPListener).File()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the inherited file descriptor is closed by inheritSockets, so it must not be owned by file
+	fd, err := syscall.Dup(int(file.Fd()))
+	file.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sockets, err := inheritSockets(fd, 1, "lmd.socket")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = assertEq(1, len(sockets)); err != nil {
+		t.Fatal(err)
+	}
+	defer sockets[0].Listener.Close()
+	if err = assertEq("lmd.socket", sockets[0].Name); err != nil {
+		t.Error(err)
+	}
+	if err = assertEq(tcp.Addr().String(), sockets[0].Listener.Addr().String()); err != nil {
+		t.Error(err)
+	}
+}
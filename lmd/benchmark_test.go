@@ -5,8 +5,14 @@ import (
 	"bytes"
 	"context"
 	"fmt"
+	"io"
+	"net"
+	"slices"
+	"sort"
 	"strings"
 	"testing"
+
+	"github.com/sasha-s/go-deadlock"
 )
 
 func BenchmarkParseResultJSON(b *testing.B) {
@@ -15,8 +21,8 @@ func BenchmarkParseResultJSON(b *testing.B) {
 	PauseTestPeers(peer)
 
 	columns := make([]string, 0)
-	for i := range peer.data.tables[TableServices].Table.Columns {
-		col := peer.data.tables[TableServices].Table.Columns[i]
+	for i := range peer.data.table(TableServices).Table.Columns {
+		col := peer.data.table(TableServices).Table.Columns[i]
 		if col.StorageType == LocalStore && col.Optional == NoFlags {
 			columns = append(columns, col.Name)
 		}
@@ -60,8 +66,8 @@ func BenchmarkParseResultWrappedJSON(b *testing.B) {
 	PauseTestPeers(peer)
 
 	columns := make([]string, 0)
-	for i := range peer.data.tables[TableServices].Table.Columns {
-		col := peer.data.tables[TableServices].Table.Columns[i]
+	for i := range peer.data.table(TableServices).Table.Columns {
+		col := peer.data.table(TableServices).Table.Columns[i]
 		if col.StorageType == LocalStore && col.Optional == NoFlags {
 			columns = append(columns, col.Name)
 		}
@@ -123,7 +129,7 @@ func BenchmarkPeerUpdateServiceInsert(b *testing.B) {
 	peer, cleanup, _ := StartTestPeer(1, 1000, 10000)
 	PauseTestPeers(peer)
 
-	table := peer.data.tables[TableServices]
+	table := peer.data.table(TableServices)
 	req := &Request{
 		Table:           table.Table.Name,
 		Columns:         table.DynamicColumnNamesCache,
@@ -372,6 +378,30 @@ func BenchmarkRequestParser2(b *testing.B) {
 	}
 }
 
+func BenchmarkRequestColumnCache(b *testing.B) {
+	lmd := createTestLMDInstance()
+	defer func(cache *ColumnCache) { requestColumnCache = cache }(requestColumnCache)
+	for _, bench := range []struct {
+		name string
+		size int
+	}{
+		{"uncached", 0},
+		{"cached", ColumnCacheSize},
+	} {
+		b.Run(bench.name, func(b *testing.B) {
+			requestColumnCache = NewColumnCache(bench.size)
+			b.ReportAllocs()
+			for n := 0; n < b.N; n++ {
+				buf := bufio.NewReader(bytes.NewBufferString(servicesPageQuery))
+				_, _, err := NewRequest(context.TODO(), lmd, buf, ParseOptimize)
+				if err != nil {
+					panic(err.Error())
+				}
+			}
+		})
+	}
+}
+
 func BenchmarkServicesearchLimit_1k_svc_10Peer(b *testing.B) {
 	b.StopTimer()
 	peer, cleanup, _ := StartTestPeer(10, 10, 100)
@@ -618,3 +648,283 @@ Filter: host_display_name !~~ not
 And: 4
 Or: 6
 `
+
+func benchmarkResponse100k(b *testing.B, materialize bool) {
+	b.Helper()
+	b.StopTimer()
+	peer, cleanup, mocklmd := StartTestPeer(1, 1000, 10000)
+	PauseTestPeers(peer)
+
+	query := "GET services\nColumns: host_name description state plugin_output last_check\nOutputFormat: json\n\n"
+	req, _, err := NewRequest(context.TODO(), mocklmd, bufio.NewReader(bytes.NewBufferString(query)), ParseOptimize)
+	if err != nil {
+		panic(err.Error())
+	}
+	store, err := mocklmd.PeerMap[mocklmd.PeerMapOrder[0]].GetDataStore(TableServices)
+	if err != nil {
+		panic(err.Error())
+	}
+	// use each of the 10k services 10 times to get 100k result rows
+	rows := make([]*DataRow, 0, 10*len(store.Data))
+	for i := 0; i < 10; i++ {
+		rows = append(rows, store.Data...)
+	}
+
+	b.ReportAllocs()
+	b.StartTimer()
+	for n := 0; n < b.N; n++ {
+		res := &Response{Code: 200, Request: req, RawResults: &RawResultSet{DataResult: rows, Total: len(rows)}}
+		if materialize {
+			res.SetResultData()
+		}
+		buf, err := res.Buffer()
+		if err != nil {
+			panic(err.Error())
+		}
+		if buf.Len() == 0 {
+			b.Fatalf("empty response")
+		}
+	}
+	b.StopTimer()
+
+	if err := cleanup(); err != nil {
+		panic(err.Error())
+	}
+}
+
+// BenchmarkResponseRaw_100k_svc writes the response directly from the raw data rows.
+func BenchmarkResponseRaw_100k_svc(b *testing.B) {
+	benchmarkResponse100k(b, false)
+}
+
+// BenchmarkResponseResult_100k_svc copies all rows into the Result set first.
+func BenchmarkResponseResult_100k_svc(b *testing.B) {
+	benchmarkResponse100k(b, true)
+}
+
+func BenchmarkConcurrentSmallQueries_1k_svc_10Peer(b *testing.B) {
+	b.StopTimer()
+	peer, cleanup, mocklmd := StartTestPeer(10, 10, 100)
+	PauseTestPeers(peer)
+
+	query := "GET services\nColumns: host_name description state\nFilter: host_name = testhost_1\nOutputFormat: json\n\n"
+
+	b.ReportAllocs()
+	b.StartTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		req, _, err := NewRequest(context.TODO(), mocklmd, bufio.NewReader(bytes.NewBufferString(query)), ParseOptimize)
+		if err != nil {
+			panic(err.Error())
+		}
+		if err = req.ExpandRequestedBackends(); err != nil {
+			panic(err.Error())
+		}
+		server, client := net.Pipe()
+		go func() {
+			_, _ = io.Copy(io.Discard, client)
+		}()
+		for pb.Next() {
+			_, size, err := NewResponse(context.TODO(), req, server)
+			if err != nil {
+				panic(err.Error())
+			}
+			if size == 0 {
+				panic("empty response")
+			}
+		}
+		server.Close()
+	})
+	b.StopTimer()
+
+	if err := cleanup(); err != nil {
+		panic(err.Error())
+	}
+}
+
+func BenchmarkFullTable_10k_svc_10Peer(b *testing.B) {
+	b.StopTimer()
+	peer, cleanup, mocklmd := StartTestPeer(10, 100, 1000)
+	PauseTestPeers(peer)
+
+	query := "GET services\nColumns: host_name description state\nOutputFormat: json\n\n"
+	req, _, err := NewRequest(context.TODO(), mocklmd, bufio.NewReader(bytes.NewBufferString(query)), ParseOptimize)
+	if err != nil {
+		panic(err.Error())
+	}
+	if err = req.ExpandRequestedBackends(); err != nil {
+		panic(err.Error())
+	}
+
+	b.ReportAllocs()
+	b.StartTimer()
+	for n := 0; n < b.N; n++ {
+		res, _, err := NewResponse(context.TODO(), req, nil)
+		if err != nil {
+			panic(err.Error())
+		}
+		if len(res.RawResults.DataResult) != 10000 {
+			b.Fatalf("expected 10000 rows, got %d", len(res.RawResults.DataResult))
+		}
+	}
+	b.StopTimer()
+
+	if err := cleanup(); err != nil {
+		panic(err.Error())
+	}
+}
+
+func benchmarkSortedLimit(b *testing.B, query string) {
+	b.Helper()
+	b.StopTimer()
+	peer, cleanup, mocklmd := StartTestPeer(10, 100, 1000)
+	PauseTestPeers(peer)
+
+	req, _, err := NewRequest(context.TODO(), mocklmd, bufio.NewReader(bytes.NewBufferString(query)), ParseOptimize)
+	if err != nil {
+		panic(err.Error())
+	}
+	if err = req.ExpandRequestedBackends(); err != nil {
+		panic(err.Error())
+	}
+
+	b.ReportAllocs()
+	b.StartTimer()
+	for n := 0; n < b.N; n++ {
+		res, _, err := NewResponse(context.TODO(), req, nil)
+		if err != nil {
+			panic(err.Error())
+		}
+		if len(res.RawResults.DataResult) != 50 {
+			b.Fatalf("expected 50 rows, got %d", len(res.RawResults.DataResult))
+		}
+	}
+	b.StopTimer()
+
+	if err := cleanup(); err != nil {
+		panic(err.Error())
+	}
+}
+
+func BenchmarkSortedLimit_10k_svc_10Peer(b *testing.B) {
+	benchmarkSortedLimit(b, "GET services\nColumns: host_name description state\nSort: host_name asc\nLimit: 50\n\n")
+}
+
+func BenchmarkSortedLimitOffset_10k_svc_10Peer(b *testing.B) {
+	benchmarkSortedLimit(b, "GET services\nColumns: host_name description state\nSort: host_name asc\nSort: description asc\nLimit: 50\nOffset: 500\n\n")
+}
+
+func BenchmarkResponseGroupedStats_1k_svc(b *testing.B) {
+	b.StopTimer()
+	peer, cleanup, mocklmd := StartTestPeer(1, 100, 1000)
+	PauseTestPeers(peer)
+
+	query := "GET services\nColumns: host_name description\nStats: state = 0\nStats: avg latency\nStats: sum execution_time\nOutputFormat: json\n\n"
+	req, _, err := NewRequest(context.TODO(), mocklmd, bufio.NewReader(bytes.NewBufferString(query)), ParseOptimize)
+	if err != nil {
+		panic(err.Error())
+	}
+	if err = req.ExpandRequestedBackends(); err != nil {
+		panic(err.Error())
+	}
+	res, _, err := NewResponse(context.TODO(), req, nil)
+	if err != nil {
+		panic(err.Error())
+	}
+	if len(res.Result) != 1000 {
+		b.Fatalf("expected 1000 rows, got %d", len(res.Result))
+	}
+
+	b.ReportAllocs()
+	b.StartTimer()
+	for n := 0; n < b.N; n++ {
+		buf, err := res.Buffer()
+		if err != nil {
+			panic(err.Error())
+		}
+		if buf.Len() == 0 {
+			b.Fatalf("empty response")
+		}
+	}
+	b.StopTimer()
+
+	if err := cleanup(); err != nil {
+		panic(err.Error())
+	}
+}
+
+// BenchmarkCounterStats_200k_svc compares the generic stats path with the counter only fast path.
+func BenchmarkCounterStats_200k_svc(b *testing.B) {
+	b.StopTimer()
+	peer, cleanup, mocklmd := StartTestPeer(1, 100, 10000)
+	PauseTestPeers(peer)
+	mocklmd.Config.ParallelScanMinRows = 0
+
+	query := "GET services\n" +
+		"Stats: state = 0\nStats: state = 1\nStats: state = 2\nStats: state = 3\n" +
+		"Stats: has_been_checked = 0\nStats: acknowledged = 1\nStats: scheduled_downtime_depth > 0\nStats: is_flapping = 1\n\n"
+	req, _, err := NewRequest(context.TODO(), mocklmd, bufio.NewReader(bytes.NewBufferString(query)), ParseOptimize)
+	if err != nil {
+		panic(err.Error())
+	}
+	services, err := peer.GetDataStore(TableServices)
+	if err != nil {
+		panic(err.Error())
+	}
+	// starting a mock backend with 200k services takes too long, so repeat the rows instead
+	store := services.copyOnWrite()
+	for len(store.Data) < 200000 {
+		store.Data = append(store.Data, services.Data...)
+	}
+	res := &Response{Request: req, Lock: new(deadlock.RWMutex)}
+
+	b.Run("generic", func(b *testing.B) {
+		b.ReportAllocs()
+		for n := 0; n < b.N; n++ {
+			res.countStats(context.TODO(), func(fn func(row *DataRow) bool) {
+				forEachChunkRow(store.Data, fn)
+			})
+		}
+	})
+	b.Run("counter", func(b *testing.B) {
+		b.ReportAllocs()
+		for n := 0; n < b.N; n++ {
+			res.gatherCounterStats(context.TODO(), store)
+		}
+	})
+
+	if err := cleanup(); err != nil {
+		panic(err.Error())
+	}
+}
+
+// BenchmarkSortResult_100k compares sorting by converting values on every comparison with precomputed sort keys.
+func BenchmarkSortResult_100k(b *testing.B) {
+	lmd := createTestLMDInstance()
+	query := "GET services\nColumns: state description host_name\nSort: state desc\nSort: host_name asc\nSort: description asc\n\n"
+	req, _, err := NewRequest(context.TODO(), lmd, bufio.NewReader(bytes.NewBufferString(query)), ParseDefault)
+	if err != nil {
+		panic(err.Error())
+	}
+	for i, s := range req.Sort {
+		s.Index = []int{0, 2, 1}[i]
+	}
+	result := make(ResultSet, 0, 100000)
+	for i := 0; i < cap(result); i++ {
+		result = append(result, []interface{}{float64(i % 4), fmt.Sprintf("svc_%d", i), fmt.Sprintf("host_%d", i%1000)})
+	}
+
+	b.Run("compare", func(b *testing.B) {
+		b.ReportAllocs()
+		for n := 0; n < b.N; n++ {
+			res := &Response{Request: req, Result: slices.Clone(result)}
+			sort.Sort(res)
+		}
+	})
+	b.Run("keys", func(b *testing.B) {
+		b.ReportAllocs()
+		for n := 0; n < b.N; n++ {
+			res := &Response{Request: req, Result: slices.Clone(result)}
+			res.sortResult()
+		}
+	})
+}
@@ -1,14 +1,32 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
 	"context"
 	"errors"
 	"fmt"
 	"io"
 	"net"
+	"os"
+	"runtime/debug"
+	"slices"
+	"sort"
 	"strings"
-	"sync"
 	"time"
+
+	jsoniter "github.com/json-iterator/go"
+)
+
+var (
+	// errClientGone is the cancel cause of queries whose client closed the connection
+	errClientGone = errors.New("client closed the connection")
+
+	// errQueryDeadline is the cancel cause of queries running longer than the listener timeout
+	errQueryDeadline = errors.New("query exceeded the listener timeout")
+
+	// errCommandsDenied is returned for commands sent to listeners with DenyCommands
+	errCommandsDenied = errors.New("commands are not allowed on this listener")
 )
 
 // ClientConnection handles a single client connection
@@ -25,6 +43,14 @@ type ClientConnection struct {
 	logHugeQueryThreshold int
 	queryStats            *QueryStats
 	curRequest            *Request
+	readAhead             []byte           // data received while watching the client during a query
+	reader                *bufio.Reader    // kept for the whole connection to not lose pipelined requests
+	authUser              string           // AuthUser from the listener options or tls client certificate, overrides the AuthUser header
+	listener              *Listener        // listener which accepted this connection, used for the client limits
+	options               *ListenerOptions // options of the listener which accepted this connection
+	remoteIP              string           // ip address of the client, empty for unix sockets
+	idleSince             time.Time        // start of waiting for the next request
+	lastFixed16           bool             // last request used fixed16 response headers
 }
 
 // NewClientConnection creates a new client connection object
@@ -43,6 +69,7 @@ func NewClientConnection(lmd *LMDInstance, c net.Conn, listenTimeout int, logSlo
 	if cl.remoteAddr == "" {
 		cl.remoteAddr = "unknown"
 	}
+	cl.reader = bufio.NewReader(&readAheadConn{cl: cl})
 	return cl
 }
 
@@ -91,20 +118,37 @@ func (cl *ClientConnection) answer(ctx context.Context) error {
 			LogErrors(cl.connection.SetDeadline(time.Now().Add(RequestReadTimeout)))
 		}
 
-		reqs, err := ParseRequests(ctx, cl.lmd, cl.connection)
+		cl.setIdleDeadline()
+
+		if cl.listener != nil && cl.remoteIP != "" {
+			// wait for the next request before checking the rate limit
+			if _, err := cl.reader.Peek(1); err == nil && !cl.listener.limits.AllowQuery(cl.options, cl.remoteIP) {
+				cl.listener.rejectConnection(cl.connection, RejectRateLimit, cl.options)
+				return nil
+			}
+		}
+		reqs, err := ParseRequests(ctx, cl.lmd, cl.reader, cl.localAddr)
+		if cl.idleTimedOut(err) {
+			cl.closeIdle()
+			return nil
+		}
 		if err != nil {
-			return cl.sendErrorResponse(err)
+			return cl.sendErrorResponse(err, reqs)
 		}
 		switch {
 		case len(reqs) > 0:
+			// the idle timeout does not apply to running requests
+			cl.keepAliveTimer.Reset(time.Duration(cl.listenTimeout) * time.Second)
 			promFrontendQueries.WithLabelValues(cl.localAddr).Add(float64(len(reqs)))
 			err = cl.processRequests(ctx, reqs)
 
 			// keep open keepalive request until either the client closes the connection or the deadline timeout is hit
-			if cl.keepAlive {
+			// connections with incomplete responses are closed, the client would misparse the next response
+			if cl.keepAlive && !errors.Is(err, errResponseWrite) {
 				logWith(cl, reqs[len(reqs)-1]).Debugf("connection keepalive, waiting for more requests")
 				LogErrors(cl.connection.SetDeadline(time.Now().Add(RequestReadTimeout)))
 				cl.keepAliveTimer.Reset(time.Duration(cl.listenTimeout) * time.Second)
+				cl.idleSince = time.Now()
 				continue
 			}
 		case cl.keepAlive:
@@ -121,8 +165,73 @@ func (cl *ClientConnection) answer(ctx context.Context) error {
 	}
 }
 
-// sendErrorResponse creates response for all given requests
-func (cl *ClientConnection) sendErrorResponse(err error) error {
+// idleTimeout returns the ClientIdleTimeout of the listener which accepted this connection.
+func (cl *ClientConnection) idleTimeout() time.Duration {
+	if cl.options != nil {
+		return time.Duration(cl.options.ClientIdleTimeout) * time.Second
+	}
+	return time.Duration(cl.lmd.Config.ClientIdleTimeout) * time.Second
+}
+
+// setIdleDeadline limits reading the next request to the ClientIdleTimeout.
+func (cl *ClientConnection) setIdleDeadline() {
+	idleTimeout := cl.idleTimeout()
+	if idleTimeout <= 0 {
+		return
+	}
+	if cl.idleSince.IsZero() {
+		cl.idleSince = time.Now()
+	}
+	deadline := cl.idleSince.Add(idleTimeout)
+	if readDeadline := time.Now().Add(RequestReadTimeout); readDeadline.Before(deadline) {
+		deadline = readDeadline
+	}
+	LogErrors(cl.connection.SetReadDeadline(deadline))
+}
+
+// idleTimedOut returns true if reading the next request failed because of the ClientIdleTimeout.
+func (cl *ClientConnection) idleTimedOut(err error) bool {
+	idleTimeout := cl.idleTimeout()
+	return idleTimeout > 0 && errors.Is(err, os.ErrDeadlineExceeded) && time.Since(cl.idleSince) >= idleTimeout
+}
+
+// closeIdle closes connections which did not send a complete request within the ClientIdleTimeout.
+// Clients using fixed16 response headers get an error response before.
+func (cl *ClientConnection) closeIdle() {
+	idleTimeout := cl.idleTimeout()
+	logWith(cl).Debugf("closing idle connection after %s", idleTimeout)
+	promFrontendIdleClosedConnections.WithLabelValues(cl.localAddr).Inc()
+	if cl.lastFixed16 {
+		err := fmt.Errorf("closing idle connection after %s", idleTimeout)
+		LogErrors(cl.connection.SetWriteDeadline(time.Now().Add(RequestRejectTimeout)))
+		LogErrors((&Response{Code: 408, Request: &Request{ResponseFixed16: true}, Error: err}).Send(cl.connection))
+	}
+}
+
+// applyListenerOptions sets the default OutputFormat of the listener and checks if the request is allowed.
+// It returns an error if the listener does not allow the command or table.
+func (cl *ClientConnection) applyListenerOptions(req *Request) error {
+	opts := cl.options
+	if opts == nil {
+		return nil
+	}
+	if req.Command != "" {
+		if opts.DenyCommands {
+			return errCommandsDenied
+		}
+		return nil
+	}
+	if len(opts.AllowedTables) > 0 && !slices.Contains(opts.AllowedTables, req.Table.String()) {
+		return fmt.Errorf("table %s is not allowed on this listener", req.Table.String())
+	}
+	if req.OutputFormat == OutputFormatDefault && opts.OutputFormat != "" {
+		LogErrors(parseOutputFormat(&req.OutputFormat, []byte(opts.OutputFormat)))
+	}
+	return nil
+}
+
+// sendErrorResponse sends the error response for the last, failed request
+func (cl *ClientConnection) sendErrorResponse(err error, reqs []*Request) error {
 	if err, ok := err.(net.Error); ok {
 		if cl.keepAlive {
 			logWith(cl).Debugf("closing keepalive connection")
@@ -134,7 +243,17 @@ func (cl *ClientConnection) sendErrorResponse(err error) error {
 	if errors.Is(err, io.EOF) {
 		return nil
 	}
-	LogErrors((&Response{Code: 400, Request: &Request{}, Error: err}).Send(cl.connection))
+	req := &Request{}
+	if len(reqs) > 0 {
+		// keep the request id and the response header of the failed request, if parsed already
+		failed := reqs[len(reqs)-1]
+		req = &Request{id: failed.ID(), ResponseFixed16: failed.ResponseFixed16}
+	}
+	// the request has not been read completely, so the ResponseHeader may be missing
+	if errors.As(err, new(*RequestLimitError)) {
+		req.ResponseFixed16 = true
+	}
+	LogErrors((&Response{Code: 400, Request: req, Error: err}).Send(cl.connection))
 	return err
 }
 
@@ -146,21 +265,55 @@ func (cl *ClientConnection) processRequests(ctx context.Context, reqs []*Request
 	defer func() {
 		cl.curRequest = nil
 	}()
-	commandsByPeer := make(map[string][]string)
+	commands := newCommandQueue()
 	for _, req := range reqs {
 		cl.keepAlive = req.KeepAlive
+		cl.lastFixed16 = req.ResponseFixed16
 		cl.curRequest = req
+		if cl.authUser != "" {
+			req.AuthUser = cl.authUser
+		}
 		reqctx := context.WithValue(ctx, CtxRequest, req.ID())
 		t1 := time.Now()
+		if err = cl.applyListenerOptions(req); err != nil {
+			// rejected requests do not affect the following requests
+			LogErrors((&Response{Code: 403, Request: req, Error: err}).Send(cl.connection))
+			continue
+		}
+		if id, ok := ParseKillQueryCommand(req.Command); ok {
+			// handled locally, never sent to any backend, but answered after the commands queued so far
+			if sErr := cl.sendRemainingCommands(reqctx, commands); sErr != nil {
+				return sErr
+			}
+			err = cl.lmd.runningQueries.Kill(id, req.AuthUser)
+			switch {
+			case errors.Is(err, errQueryKillDenied):
+				LogErrors((&Response{Code: 403, Request: req, Error: err}).Send(cl.connection))
+			case err != nil:
+				err = fmt.Errorf("bad request: %w", err)
+				LogErrors((&Response{Code: 400, Request: req, Error: err}).Send(cl.connection))
+			case req.ResponseFixed16:
+				LogErrors((&CommandSummary{Code: 200}).SendAck(cl.connection))
+			}
+			continue
+		}
 		if req.Command != "" {
-			for _, pID := range req.BackendsMap {
-				commandsByPeer[pID] = append(commandsByPeer[pID], strings.TrimSpace(req.Command))
+			err = req.RouteCommand()
+			if err != nil {
+				// send commands queued so far before rejecting this one
+				if sErr := cl.sendRemainingCommands(reqctx, commands); sErr != nil {
+					return sErr
+				}
+				// failed commands do not affect the following requests
+				LogErrors((&Response{Code: 400, Request: req, Error: err}).Send(cl.connection))
+				continue
 			}
+			commands.add(req)
 			continue
 		}
 
 		// send all pending commands so far
-		err = cl.sendRemainingCommands(reqctx, &commandsByPeer)
+		err = cl.sendRemainingCommands(reqctx, commands)
 		if err != nil {
 			return
 		}
@@ -172,9 +325,8 @@ func (cl *ClientConnection) processRequests(ctx context.Context, reqs []*Request
 
 		duration := time.Since(t1)
 		logWith(reqctx).Infof("%s request finished in %s, response size: %s", req.Table.String(), duration.String(), ByteCountBinary(size))
-		if duration-time.Duration(req.WaitTimeout)*time.Millisecond > time.Duration(cl.logSlowQueryThreshold)*time.Second {
-			logWith(reqctx).Warnf("slow query finished after %s, response size: %s\n%s", duration.String(), ByteCountBinary(size), strings.TrimSpace(req.String()))
-		} else if size > int64(cl.logHugeQueryThreshold*1024*1024) {
+		// slow queries are logged by the response already
+		if duration-req.waitDuration() <= time.Duration(cl.logSlowQueryThreshold)*time.Second && size > int64(cl.logHugeQueryThreshold*1024*1024) {
 			logWith(reqctx).Warnf("huge query finished after %s, response size: %s\n%s", duration.String(), ByteCountBinary(size), strings.TrimSpace(req.String()))
 		}
 		if cl.queryStats != nil {
@@ -190,100 +342,371 @@ func (cl *ClientConnection) processRequests(ctx context.Context, reqs []*Request
 	}
 
 	// send all remaining commands
-	err = cl.sendRemainingCommands(ctx, &commandsByPeer)
-	if err != nil {
-		return
+	if sErr := cl.sendRemainingCommands(ctx, commands); sErr != nil {
+		return sErr
 	}
 
-	return nil
+	return err
 }
 
 func (cl *ClientConnection) processRequest(ctx context.Context, req *Request) (size int64, err error) {
+	cl.lmd.activeRequests.Add(1)
+	defer cl.lmd.activeRequests.Add(-1)
+	defer cl.recoverPanic(req, &err)
 	cl.curRequest = req
 	defer func() {
 		cl.curRequest = nil
 	}()
+
+	// abort the query if the client is gone or it takes longer than the listener timeout
+	ctx, cancelDeadline := context.WithDeadlineCause(ctx, time.Now().Add(time.Duration(cl.listenTimeout)*time.Second), errQueryDeadline)
+	defer cancelDeadline()
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+	stopWatching := cl.watchClient(req, cancel)
+
 	size, err = req.BuildResponseSend(ctx, cl.connection)
+	stopWatching()
+	cl.countQueryResult(ctx, err)
+	if errors.Is(err, errResponseWrite) {
+		// parts of the response have been sent already, an error response would be read as part of it
+		return
+	}
 	if err != nil {
-		if netErr, ok := err.(net.Error); ok {
-			LogErrors((&Response{Code: 502, Request: req, Error: netErr}).Send(cl.connection))
-			return
-		}
-		if peerErr, ok := err.(*PeerError); ok && peerErr.kind == ConnectionError {
-			LogErrors((&Response{Code: 502, Request: req, Error: peerErr}).Send(cl.connection))
-			return
-		}
-		LogErrors((&Response{Code: 400, Request: req, Error: err}).Send(cl.connection))
+		LogErrors((&Response{Code: responseErrorCode(err), Request: req, Error: err}).Send(cl.connection))
 		return
 	}
 
 	return
 }
 
+// recoverPanic recovers from a panic while answering the request. The client gets an error response
+// and the connection will be closed instead of taking down the whole daemon.
+func (cl *ClientConnection) recoverPanic(req *Request, err *error) {
+	r := recover()
+	if r == nil {
+		return
+	}
+	logWith(cl, req).Errorf("panic while processing query: %s\n%s\n%s", r, strings.TrimSpace(req.String()), debug.Stack())
+	*err = errQueryPanic
+	LogErrors(cl.connection.SetWriteDeadline(time.Now().Add(RequestRejectTimeout)))
+	LogErrors((&Response{Code: 500, Request: req, Error: errQueryPanic}).Send(cl.connection))
+}
+
+// watchClient reads from the client connection while the query is running and cancels
+// the query once the client is gone. Half-closed connections cannot be distinguished
+// from closed ones, so EOF only cancels keepalive requests which never half-close.
+// The returned function stops watching, data received meanwhile is kept for the next request.
+func (cl *ClientConnection) watchClient(req *Request, cancel context.CancelCauseFunc) (stop func()) {
+	conn := cl.connection
+	done := make(chan []byte, 1)
+	go func() {
+		// make sure we log panics properly
+		defer cl.lmd.logPanicExit()
+
+		buf := make([]byte, 1024)
+		n, err := conn.Read(buf)
+		switch {
+		case n > 0:
+			// pipelined request
+		case err == nil:
+		case errors.Is(err, os.ErrDeadlineExceeded), errors.Is(err, net.ErrClosed):
+			// stopped watching or connection closed by listener timeout
+		case errors.Is(err, io.EOF) && !req.KeepAlive:
+		default:
+			logWith(cl, req).Debugf("client connection lost: %s", err.Error())
+			cancel(errClientGone)
+		}
+		done <- buf[:n]
+	}()
+
+	return func() {
+		// unblock the pending read, deadlines are set again before reading the next request
+		LogErrors(conn.SetReadDeadline(time.Now()))
+		if pending := <-done; len(pending) > 0 {
+			cl.readAhead = pending
+		}
+	}
+}
+
+// countQueryResult updates the query result counters from the cancel cause of the query context
+// or the error of rejected queries.
+func (cl *ClientConnection) countQueryResult(ctx context.Context, err error) {
+	result := "completed"
+	switch cause := context.Cause(ctx); {
+	case errors.As(err, new(*QueryMemoryError)):
+		result = "memory_budget"
+	case errors.Is(err, errQueryKilled):
+		result = "killed"
+	case errors.Is(err, errQueryShutdown):
+		result = "shutdown"
+	case errors.Is(err, errQueryOverloaded):
+		result = "overloaded"
+	case cause == nil:
+	case errors.Is(cause, errClientGone):
+		result = "client_gone"
+	default:
+		result = "deadline"
+	}
+	if result != "completed" && result != "memory_budget" && result != "killed" && result != "shutdown" && result != "overloaded" {
+		logWith(ctx).Debugf("query canceled: %s", context.Cause(ctx).Error())
+	}
+	promFrontendQueryResults.WithLabelValues(cl.localAddr, result).Inc()
+}
+
+// readAheadConn returns data read while watching the client before reading from the connection.
+type readAheadConn struct {
+	cl *ClientConnection
+}
+
+func (c *readAheadConn) Read(b []byte) (int, error) {
+	if len(c.cl.readAhead) > 0 {
+		n := copy(b, c.cl.readAhead)
+		c.cl.readAhead = c.cl.readAhead[n:]
+		return n, nil
+	}
+	return c.cl.connection.Read(b)
+}
+
+// commandQueue collects the commands of a client connection until they are sent.
+type commandQueue struct {
+	byPeer  map[string][]string // commands by peer id in the order they have been received
+	failed  map[string]string   // requested backends which do not exist
+	summary bool                // client requested a wrapped_json summary
+	fixed16 bool                // client requested a fixed16 response header
+	mode    string              // CommandModeSync if any command requests it, CommandModeAsync only if all commands request it
+}
+
+func newCommandQueue() *commandQueue {
+	q := &commandQueue{}
+	q.clear()
+	return q
+}
+
+// add queues the command of the request for all requested backends.
+func (q *commandQueue) add(req *Request) {
+	switch {
+	case len(q.byPeer) == 0 && len(q.failed) == 0:
+		q.mode = req.CommandMode
+	case req.CommandMode == CommandModeSync:
+		q.mode = CommandModeSync
+	case req.CommandMode == "" && q.mode == CommandModeAsync:
+		q.mode = ""
+	}
+	cmd := strings.TrimSpace(req.Command)
+	for _, pID := range req.BackendsMap {
+		q.byPeer[pID] = append(q.byPeer[pID], cmd)
+	}
+	for b, msg := range req.BackendErrors {
+		q.failed[b] = msg
+	}
+	if req.OutputFormat == OutputFormatWrappedJSON {
+		q.summary = true
+	}
+	if req.ResponseFixed16 {
+		q.fixed16 = true
+	}
+}
+
+func (q *commandQueue) clear() {
+	q.byPeer = make(map[string][]string)
+	q.failed = make(map[string]string)
+	q.summary = false
+	q.fixed16 = false
+	q.mode = ""
+}
+
 // sendRemainingCommands sends all queued commands
-func (cl *ClientConnection) sendRemainingCommands(ctx context.Context, commandsByPeer *map[string][]string) (err error) {
-	if len(*commandsByPeer) == 0 {
+func (cl *ClientConnection) sendRemainingCommands(ctx context.Context, commands *commandQueue) (err error) {
+	if len(commands.byPeer) == 0 && len(commands.failed) == 0 {
 		return
 	}
 	t1 := time.Now()
-	code, msg := cl.SendCommands(ctx, *commandsByPeer)
+	summary := cl.SendCommands(ctx, commands.byPeer, commands.mode)
+	for b, msg := range commands.failed {
+		summary.Failed[b] = msg
+		if summary.Code == 200 {
+			summary.Code = 400
+			summary.Message = msg
+		}
+	}
+	sendSummary, fixed16 := commands.summary, commands.fixed16
 	// clear the commands queue
-	*commandsByPeer = make(map[string][]string)
-	if code != 200 {
-		_, err = fmt.Fprintf(cl.connection, "%d: %s\n", code, msg)
+	commands.clear()
+	switch {
+	case sendSummary:
+		err = summary.Send(cl.connection, fixed16)
+		return
+	case fixed16:
+		// acknowledge commands only if requested, clients might close the connection right after sending commands
+		err = summary.SendAck(cl.connection)
+		return
+	case summary.Code != 200:
+		_, err = fmt.Fprintf(cl.connection, "%d: %s\n", summary.Code, summary.Message)
 		return
 	}
 	logWith(ctx).Infof("incoming command request finished in %s", time.Since(t1))
 	return
 }
 
-// SendCommands sends commands for this request to all selected remote sites.
-// It returns any error encountered.
-func (cl *ClientConnection) SendCommands(ctx context.Context, commandsByPeer map[string][]string) (code int, msg string) {
-	code = 200
-	msg = "OK"
+// CommandSummary contains the overall and the per backend result of sending commands.
+type CommandSummary struct {
+	Code    int               `json:"code"`
+	Message string            `json:"message"`
+	Sent    []string          `json:"sent"`    // backends which received the commands
+	Failed  map[string]string `json:"failed"`  // errors by backend
+	Pending []string          `json:"pending"` // backends still sending in background
+}
+
+// Send writes the summary as json to the client connection.
+func (s *CommandSummary) Send(c net.Conn, fixed16 bool) (err error) {
+	sort.Strings(s.Sent)
+	sort.Strings(s.Pending)
+	data, err := jsoniter.Marshal(s)
+	if err != nil {
+		return fmt.Errorf("json error: %s", err.Error())
+	}
+	data = append(data, '\n')
+	if fixed16 {
+		return sendFixed16(c, s.Code, data)
+	}
+	_, err = c.Write(data)
+	return
+}
+
+// SendAck writes a fixed16 acknowledgement to the client connection. The body is empty
+// if the commands have been sent to all backends, otherwise it names the failed backends.
+func (s *CommandSummary) SendAck(c net.Conn) (err error) {
+	body := new(bytes.Buffer)
+	if s.Code != 200 {
+		body.WriteString(s.Message + "\n")
+		failed := make([]string, 0, len(s.Failed))
+		for id := range s.Failed {
+			failed = append(failed, id)
+		}
+		sort.Strings(failed)
+		for _, id := range failed {
+			fmt.Fprintf(body, "%s: %s\n", id, s.Failed[id])
+		}
+		sort.Strings(s.Pending)
+		for _, id := range s.Pending {
+			fmt.Fprintf(body, "%s: pending\n", id)
+		}
+	}
+	body.WriteString("\n")
+	return sendFixed16(c, s.Code, body.Bytes())
+}
+
+// sendFixed16 writes the fixed16 response header followed by the body.
+func sendFixed16(c net.Conn, code int, body []byte) (err error) {
+	header, err := fixed16Header(code, int64(len(body)))
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(c, "%s\n", header)
+	if err != nil {
+		return
+	}
+	_, err = c.Write(body)
+	return
+}
+
+// SendCommands queues the commands for all selected remote sites, which send them in parallel.
+// Unless the mode is CommandModeAsync, it waits till the commands have been sent (up to
+// PeerCommandTimeout without CommandModeSync).
+// It returns the result for each backend.
+func (cl *ClientConnection) SendCommands(ctx context.Context, commandsByPeer map[string][]string, mode string) (summary *CommandSummary) {
+	summary = &CommandSummary{
+		Code:    200,
+		Message: "OK",
+		Sent:    []string{},
+		Failed:  make(map[string]string),
+		Pending: []string{},
+	}
 	if cl.lmd.flags.flagImport != "" {
-		code = 500
-		msg = "lmd started with -import from file, cannot send commands without real backend connection."
+		summary.Code = 500
+		summary.Message = "lmd started with -import from file, cannot send commands without real backend connection."
 		return
 	}
-	resultChan := make(chan error, len(commandsByPeer))
-	wg := &sync.WaitGroup{}
+	batches := make(map[string]*CommandBatch)
 	for pID := range commandsByPeer {
 		cl.lmd.PeerMapLock.RLock()
 		p := cl.lmd.PeerMap[pID]
 		cl.lmd.PeerMapLock.RUnlock()
-		wg.Add(1)
-		go func(peer *Peer) {
-			defer logPanicExitPeer(peer)
-			defer wg.Done()
-			resultChan <- peer.SendCommandsWithRetry(ctx, commandsByPeer[peer.ID])
-		}(p)
-	}
-
-	// Wait up to 9.5 seconds for all commands being sent
-	if waitTimeout(ctx, wg, PeerCommandTimeout) {
-		code = 202
-		msg = "sending command timed out but will continue in background"
+		if p == nil {
+			summary.setError(pID, fmt.Errorf("bad request: backend %s does not exist", pID))
+			continue
+		}
+		// retries are meant for short interruptions, backends which are down already fail immediately
+		if p.hasPeerState([]PeerStatus{PeerStatusDown, PeerStatusBroken}) {
+			summary.setError(pID, fmt.Errorf("%s", p.StatusGet(LastError)))
+			continue
+		}
+		batch, err := p.QueueCommands(commandsByPeer[pID])
+		if err != nil {
+			summary.setError(pID, err)
+			continue
+		}
+		batches[pID] = batch
+	}
+
+	var timeout <-chan time.Time
+	switch mode {
+	case CommandModeAsync:
+		// fire and forget
+		for pID := range batches {
+			summary.Pending = append(summary.Pending, pID)
+		}
 		return
+	case CommandModeSync:
+		// wait till all commands have been sent
+	default:
+		// Wait up to 9.5 seconds for all commands being sent
+		timer := time.NewTimer(PeerCommandTimeout)
+		defer timer.Stop()
+		timeout = timer.C
 	}
 
-	// collect errors
-	for {
+	// collect results
+	timedOut := false
+	for pID, batch := range batches {
+		if !timedOut {
+			select {
+			case <-batch.Done():
+			case <-timeout:
+				timedOut = true
+			case <-ctx.Done():
+				timedOut = true
+			}
+		}
 		select {
-		case err := <-resultChan:
-			switch e := err.(type) {
-			case *PeerCommandError:
-				code = e.code
-				msg = e.Error()
-			default:
-				if err != nil {
-					code = 500
-					msg = err.Error()
-				}
+		case <-batch.Done():
+			if err := batch.Err(); err != nil {
+				summary.setError(pID, err)
+				continue
 			}
+			summary.Sent = append(summary.Sent, pID)
 		default:
-			return
+			summary.Pending = append(summary.Pending, pID)
 		}
 	}
+
+	// pending commands must not hide errors of other backends
+	if len(summary.Pending) > 0 && summary.Code == 200 {
+		summary.Code = 202
+		summary.Message = "sending command timed out but will continue in background"
+	}
+	return
+}
+
+// setError sets the error for given backend and updates the overall result.
+func (s *CommandSummary) setError(id string, err error) {
+	s.Failed[id] = err.Error()
+	switch e := err.(type) {
+	case *PeerCommandError:
+		s.Code = e.code
+	default:
+		s.Code = 500
+	}
+	s.Message = err.Error()
 }
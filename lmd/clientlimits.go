@@ -0,0 +1,124 @@
+package main
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// ClientLimitCleanupInterval sets the interval at which idle rate limits of client addresses are removed
+	ClientLimitCleanupInterval = time.Minute
+)
+
+// rejection reasons, used as prometheus label
+const (
+	RejectMaxConnections      = "max_connections"
+	RejectMaxConnectionsPerIP = "max_connections_per_ip"
+	RejectRateLimit           = "rate_limit"
+)
+
+// ClientLimits enforces the connection limits and query rate limits of a single listener.
+// Connections without ip address, ex.: from unix sockets, are only subject to the total limit.
+type ClientLimits struct {
+	noCopy      noCopy
+	lock        sync.Mutex
+	connections int
+	byIP        map[string]int
+	rates       map[string]*clientRate
+	lastCleanup time.Time
+}
+
+// clientRate is a token bucket which allows up to rate queries per second.
+type clientRate struct {
+	tokens float64
+	last   time.Time
+}
+
+// NewClientLimits creates a new ClientLimits object.
+func NewClientLimits() *ClientLimits {
+	return &ClientLimits{
+		byIP:        make(map[string]int),
+		rates:       make(map[string]*clientRate),
+		lastCleanup: time.Now(),
+	}
+}
+
+// Acquire registers a new connection from the given ip.
+// It returns the reason if the connection must be rejected, otherwise the connection must be freed with Release.
+func (c *ClientLimits) Acquire(conf *ListenerOptions, ip string) (reason string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if conf.MaxClientConnections > 0 && c.connections >= conf.MaxClientConnections {
+		return RejectMaxConnections
+	}
+	if ip != "" && conf.MaxClientConnectionsPerIP > 0 && c.byIP[ip] >= conf.MaxClientConnectionsPerIP {
+		return RejectMaxConnectionsPerIP
+	}
+	c.connections++
+	if ip != "" {
+		c.byIP[ip]++
+	}
+	return ""
+}
+
+// Release frees a connection registered by Acquire.
+func (c *ClientLimits) Release(ip string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.connections--
+	if ip == "" {
+		return
+	}
+	c.byIP[ip]--
+	if c.byIP[ip] <= 0 {
+		delete(c.byIP, ip)
+	}
+}
+
+// AllowQuery returns false if the client from the given ip exceeded the ClientQueryRateLimit.
+func (c *ClientLimits) AllowQuery(conf *ListenerOptions, ip string) bool {
+	rateLimit := float64(conf.ClientQueryRateLimit)
+	if ip == "" || rateLimit <= 0 {
+		return true
+	}
+	now := time.Now()
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if now.Sub(c.lastCleanup) > ClientLimitCleanupInterval {
+		c.cleanupRates(now, rateLimit)
+	}
+	rate, ok := c.rates[ip]
+	if !ok {
+		rate = &clientRate{tokens: rateLimit, last: now}
+		c.rates[ip] = rate
+	}
+	// refill the bucket, it holds up to one second of queries
+	rate.tokens = min(rateLimit, rate.tokens+now.Sub(rate.last).Seconds()*rateLimit)
+	rate.last = now
+	if rate.tokens < 1 {
+		return false
+	}
+	rate.tokens--
+	return true
+}
+
+// cleanupRates removes all rates which are completely refilled, the lock must be held.
+func (c *ClientLimits) cleanupRates(now time.Time, rateLimit float64) {
+	c.lastCleanup = now
+	for ip, rate := range c.rates {
+		if rate.tokens+now.Sub(rate.last).Seconds()*rateLimit >= rateLimit {
+			delete(c.rates, ip)
+		}
+	}
+}
+
+// clientIP returns the ip address of the remote side or an empty string for unix sockets.
+func clientIP(addr net.Addr) string {
+	switch addr := addr.(type) {
+	case *net.TCPAddr:
+		return addr.IP.String()
+	default:
+		return ""
+	}
+}
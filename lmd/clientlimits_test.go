@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestClientLimitsConnections(t *testing.T) {
+	conf := &ListenerOptions{MaxClientConnections: 3, MaxClientConnectionsPerIP: 2}
+	limits := NewClientLimits()
+
+	if err := assertEq("", limits.Acquire(conf, "10.0.0.1")); err != nil {
+		t.Error(err)
+	}
+	if err := assertEq("", limits.Acquire(conf, "10.0.0.1")); err != nil {
+		t.Error(err)
+	}
+	if err := assertEq(RejectMaxConnectionsPerIP, limits.Acquire(conf, "10.0.0.1")); err != nil {
+		t.Error(err)
+	}
+	// unix sockets are not limited per ip
+	if err := assertEq("", limits.Acquire(conf, "")); err != nil {
+		t.Error(err)
+	}
+	if err := assertEq(RejectMaxConnections, limits.Acquire(conf, "10.0.0.2")); err != nil {
+		t.Error(err)
+	}
+
+	limits.Release("10.0.0.1")
+	if err := assertEq("", limits.Acquire(conf, "10.0.0.2")); err != nil {
+		t.Error(err)
+	}
+	limits.Release("10.0.0.1")
+	if _, ok := limits.byIP["10.0.0.1"]; ok {
+		t.Errorf("released addresses should be removed")
+	}
+}
+
+func TestClientLimitsRate(t *testing.T) {
+	conf := &ListenerOptions{ClientQueryRateLimit: 2}
+	limits := NewClientLimits()
+
+	if err := assertEq(true, limits.AllowQuery(conf, "10.0.0.1")); err != nil {
+		t.Error(err)
+	}
+	if err := assertEq(true, limits.AllowQuery(conf, "10.0.0.1")); err != nil {
+		t.Error(err)
+	}
+	if err := assertEq(false, limits.AllowQuery(conf, "10.0.0.1")); err != nil {
+		t.Error(err)
+	}
+	// other addresses and unix sockets are not affected
+	if err := assertEq(true, limits.AllowQuery(conf, "10.0.0.2")); err != nil {
+		t.Error(err)
+	}
+	if err := assertEq(true, limits.AllowQuery(conf, "")); err != nil {
+		t.Error(err)
+	}
+
+	// refilled after half a second
+	limits.rates["10.0.0.1"].last = limits.rates["10.0.0.1"].last.Add(-500 * time.Millisecond)
+	if err := assertEq(true, limits.AllowQuery(conf, "10.0.0.1")); err != nil {
+		t.Error(err)
+	}
+
+	// idle rates are removed
+	limits.rates["10.0.0.2"].last = time.Now().Add(-time.Minute)
+	limits.lastCleanup = time.Now().Add(-2 * ClientLimitCleanupInterval)
+	limits.AllowQuery(conf, "10.0.0.1")
+	if _, ok := limits.rates["10.0.0.2"]; ok {
+		t.Errorf("idle rate should have been removed")
+	}
+}
+
+func TestClientLimitsListener(t *testing.T) {
+	listen := "127.0.0.1:50995"
+	extraConfig := fmt.Sprintf(`
+Listen = ["test.sock", "%s"]
+MaxClientConnectionsPerIP = 1
+ClientQueryRateLimit = 2
+`, listen)
+	peer, cleanup, mocklmd := StartTestPeerExtra(1, 10, 10, extraConfig)
+	PauseTestPeers(peer)
+
+	readResponse := func(reader *bufio.Reader) (code int) {
+		t.Helper()
+		header := make([]byte, 16)
+		if _, err := io.ReadFull(reader, header); err != nil {
+			t.Fatalf("reading response header failed: %s", err)
+		}
+		var size int
+		if _, err := fmt.Sscanf(string(header), "%d %d", &code, &size); err != nil {
+			t.Fatalf("parsing response header %q failed: %s", header, err)
+		}
+		if _, err := io.ReadFull(reader, make([]byte, size)); err != nil {
+			t.Fatalf("reading response body failed: %s", err)
+		}
+		return code
+	}
+
+	conn, err := net.Dial("tcp", listen)
+	if err != nil {
+		t.Fatal(err)
+	}
+	LogErrors(conn.SetDeadline(time.Now().Add(5 * time.Second)))
+	reader := bufio.NewReader(conn)
+
+	// second connection from the same ip is rejected
+	conn2, err := net.Dial("tcp", listen)
+	if err != nil {
+		t.Fatal(err)
+	}
+	LogErrors(conn2.SetDeadline(time.Now().Add(5 * time.Second)))
+	if err = assertEq(429, readResponse(bufio.NewReader(conn2))); err != nil {
+		t.Error(err)
+	}
+	conn2.Close()
+
+	// connections are closed without response if too many rejections are in progress already
+	mocklmd.ListenersLock.Lock()
+	listener := mocklmd.Listeners[listen]
+	mocklmd.ListenersLock.Unlock()
+	// wait for the previous rejection to finish
+	for listener.rejections.InUse() > 0 {
+		time.Sleep(10 * time.Millisecond)
+	}
+	for i := 0; i < MaxConcurrentRejections; i++ {
+		listener.rejections.TryAcquire()
+	}
+	conn2, err = net.Dial("tcp", listen)
+	if err != nil {
+		t.Fatal(err)
+	}
+	LogErrors(conn2.SetDeadline(time.Now().Add(5 * time.Second)))
+	data, err := io.ReadAll(conn2)
+	if err != nil {
+		t.Errorf("expected closed connection, got: %s", err)
+	}
+	if err = assertEq("", string(data)); err != nil {
+		t.Error(err)
+	}
+	conn2.Close()
+	for i := 0; i < MaxConcurrentRejections; i++ {
+		listener.rejections.Release()
+	}
+
+	// third query within a second exceeds the rate limit
+	query := "GET hosts\nColumns: name\nKeepAlive: on\nResponseHeader: fixed16\n\n"
+	for _, expect := range []int{200, 200, 429} {
+		if _, err = conn.Write([]byte(query)); err != nil {
+			t.Fatal(err)
+		}
+		if err = assertEq(expect, readResponse(reader)); err != nil {
+			t.Error(err)
+		}
+	}
+	conn.Close()
+
+	// unix sockets are not limited per ip
+	for i := 0; i < 3; i++ {
+		if _, _, err = peer.QueryString("GET hosts\nColumns: name\n\n"); err != nil {
+			t.Error(err)
+		}
+	}
+
+	if err := cleanup(); err != nil {
+		panic(err.Error())
+	}
+}
@@ -26,11 +26,18 @@ var VirtualColumnList = []VirtualColumnMapEntry{
 	{Name: "status", StatusKey: PeerState},
 	{Name: "bytes_send", StatusKey: BytesSend},
 	{Name: "bytes_received", StatusKey: BytesReceived},
+	{Name: "bytes_received_wire", StatusKey: BytesReceivedWire},
+	{Name: "last_full_update_duration", StatusKey: LastFullUpdateDuration},
+	{Name: "last_delta_update_duration", StatusKey: LastDeltaUpdateDuration},
+	{Name: "last_delta_updated_objects", StatusKey: LastDeltaUpdatedObjects},
+	{Name: "source_index", StatusKey: CurPeerAddrNum},
 	{Name: "queries", StatusKey: Queries},
 	{Name: "last_error", StatusKey: LastError},
 	{Name: "last_online", StatusKey: LastOnline},
 	{Name: "last_update", StatusKey: LastUpdate},
 	{Name: "response_time", StatusKey: ResponseTime},
+	{Name: "client_queries", StatusKey: ClientQueries},
+	{Name: "update_queries", StatusKey: UpdateQueries},
 	{Name: "idling", StatusKey: Idling},
 	{Name: "last_query", StatusKey: LastQuery},
 	{Name: "section", StatusKey: Section},
@@ -43,7 +50,7 @@ var VirtualColumnList = []VirtualColumnMapEntry{
 	{Name: "federation_type", StatusKey: SubType},
 
 	// calculated columns by ResolveFunc
-	{Name: "lmd_last_cache_update", ResolveFunc: func(d *DataRow, _ *Column) interface{} { return d.LastUpdate }},
+	{Name: "lmd_last_cache_update", ResolveFunc: func(d *DataRow, _ *Column) interface{} { return d.vals().LastUpdate }},
 	{Name: "lmd_version", ResolveFunc: func(_ *DataRow, _ *Column) interface{} { return fmt.Sprintf("%s-%s", NAME, Version()) }},
 	{Name: "state_order", ResolveFunc: VirtualColStateOrder},
 	{Name: "last_state_change_order", ResolveFunc: VirtualColLastStateChangeOrder},
@@ -57,6 +64,22 @@ var VirtualColumnList = []VirtualColumnMapEntry{
 	{Name: "total_services", ResolveFunc: VirtualColTotalServices},
 	{Name: "flags", ResolveFunc: VirtualColFlags},
 	{Name: "localtime", ResolveFunc: VirtualColLocaltime},
+	{Name: "last_errors", ResolveFunc: VirtualColLastErrors},
+	{Name: "last_errors_hour", ResolveFunc: VirtualColLastErrorsHour},
+	{Name: "avg_response_time", ResolveFunc: VirtualColAvgResponseTime},
+	{Name: "last_update_age", ResolveFunc: VirtualColLastUpdateAge},
+	{Name: "queries_in_flight", ResolveFunc: VirtualColQueriesInFlight},
+	{Name: "queries_queued", ResolveFunc: func(d *DataRow, _ *Column) interface{} { return d.DataStore.Peer.QueriesQueued() }},
+	{Name: "passthrough_in_flight", ResolveFunc: func(d *DataRow, _ *Column) interface{} { return d.DataStore.Peer.PassthroughsInFlight() }},
+	{Name: "rows_scanned", ResolveFunc: func(d *DataRow, _ *Column) interface{} { return d.DataStore.Peer.RowsScanned() }},
+	{Name: "command_queue_depth", ResolveFunc: func(d *DataRow, _ *Column) interface{} { return d.DataStore.Peer.commandQueue.Depth() }},
+	{Name: "commands_dropped", ResolveFunc: func(d *DataRow, _ *Column) interface{} { return d.DataStore.Peer.commandQueue.Dropped() }},
+	{Name: "commands_retried", ResolveFunc: func(d *DataRow, _ *Column) interface{} { return d.DataStore.Peer.commandQueue.Retried() }},
+	{Name: "sources", ResolveFunc: func(d *DataRow, _ *Column) interface{} { return d.DataStore.Peer.Source }},
+	{Name: "lmd_data_age", ResolveFunc: VirtualColLastUpdateAge},
+	{Name: "node", ResolveFunc: func(d *DataRow, _ *Column) interface{} {
+		return d.DataStore.Peer.lmd.nodeAccessor.BackendOwner(d.DataStore.Peer.ID)
+	}},
 	{Name: "empty", ResolveFunc: func(_ *DataRow, _ *Column) interface{} { return "" }}, // return empty string as placeholder for nonexisting columns
 }
 
@@ -117,6 +140,16 @@ const (
 	StringLargeCol
 )
 
+// sortable returns true if result rows can be sorted by columns of this type.
+func (t DataType) sortable() bool {
+	switch t {
+	case StringCol, StringListCol, IntCol, Int64Col, Int64ListCol, FloatCol, JSONCol,
+		CustomVarCol, ServiceMemberListCol, InterfaceListCol, StringLargeCol:
+		return true
+	}
+	return false
+}
+
 // StorageType defines how this column is stored
 //
 //go:generate stringer -type=StorageType
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"container/list"
+	"slices"
+	"sync"
+)
+
+// ColumnCacheSize sets the maximum number of cached column headers
+const ColumnCacheSize = 1000
+
+// requestColumnCache caches resolved Columns headers, clients usually send the same queries over and over
+var requestColumnCache = NewColumnCache(ColumnCacheSize)
+
+// ColumnCache is a LRU cache for resolved Columns headers keyed by table and header.
+// Entries are immutable and shared between requests, they must not be modified.
+// The cache is cleared whenever the table definitions change.
+type ColumnCache struct {
+	noCopy  noCopy
+	lock    sync.Mutex
+	entries map[string]*list.Element
+	lru     *list.List
+	maxSize int
+	objects *ObjectsType // table definitions used to resolve the cached columns
+}
+
+// columnCacheEntry contains the expanded column names and resolved columns of a Columns header.
+type columnCacheEntry struct {
+	key     string
+	names   []string
+	columns []*Column
+}
+
+// NewColumnCache creates a new ColumnCache.
+func NewColumnCache(maxSize int) *ColumnCache {
+	return &ColumnCache{
+		entries: make(map[string]*list.Element),
+		lru:     list.New(),
+		maxSize: maxSize,
+	}
+}
+
+// Get returns the cached entry for the given table and Columns header or nil.
+func (c *ColumnCache) Get(table *Table, header []byte) *columnCacheEntry {
+	// build the key on the stack, map lookups with converted byte slices do not allocate
+	var buf [256]byte
+	key := columnCacheKey(buf[:0], table, header)
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.objects != Objects {
+		c.clear()
+		return nil
+	}
+	elem, ok := c.entries[string(key)]
+	if !ok {
+		return nil
+	}
+	c.lru.MoveToFront(elem)
+	entry, _ := elem.Value.(*columnCacheEntry)
+	return entry
+}
+
+// Add resolves the expanded column names for the given table and Columns header and stores them in the cache.
+func (c *ColumnCache) Add(table *Table, header []byte, names []string) *columnCacheEntry {
+	entry := &columnCacheEntry{
+		key:     string(columnCacheKey(nil, table, header)),
+		names:   slices.Clip(names),
+		columns: make([]*Column, len(names)),
+	}
+	for i, name := range names {
+		entry.columns[i] = table.GetColumnWithFallback(name)
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.objects != Objects {
+		c.clear()
+		c.objects = Objects
+	}
+	if elem, ok := c.entries[entry.key]; ok {
+		c.lru.MoveToFront(elem)
+		elem.Value = entry
+		return entry
+	}
+	c.entries[entry.key] = c.lru.PushFront(entry)
+	for c.lru.Len() > c.maxSize {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		if old, ok := oldest.Value.(*columnCacheEntry); ok {
+			delete(c.entries, old.key)
+		}
+	}
+	return entry
+}
+
+// Len returns the number of cached entries.
+func (c *ColumnCache) Len() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.lru.Len()
+}
+
+func (c *ColumnCache) clear() {
+	clear(c.entries)
+	c.lru.Init()
+}
+
+// columnCacheKey appends the cache key for the table and Columns header to buf.
+func columnCacheKey(buf []byte, table *Table, header []byte) []byte {
+	buf = append(buf, table.Name.String()...)
+	buf = append(buf, 0)
+	return append(buf, header...)
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"testing"
+)
+
+func TestColumnCache(t *testing.T) {
+	lmd := createTestLMDInstance()
+	query := "GET hosts\nColumns: name state latency\n\n"
+	req1, _, err := NewRequest(context.TODO(), lmd, bufio.NewReader(bytes.NewBufferString(query)), ParseOptimize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req2, _, err := NewRequest(context.TODO(), lmd, bufio.NewReader(bytes.NewBufferString(query)), ParseOptimize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := assertEq([]string{"name", "state", "latency"}, req2.Columns); err != nil {
+		t.Error(err)
+	}
+	if err := assertEq(3, len(req2.RequestColumns)); err != nil {
+		t.Error(err)
+	}
+	if err := assertEq(true, req1.RequestColumns[0] == req2.RequestColumns[0]); err != nil {
+		t.Error(err)
+	}
+
+	// cached entries must not be changed by requests
+	table := Objects.Tables[TableHosts]
+	req2.Columns[0] = "address"
+	req2.RequestColumns[0] = table.GetColumn("address")
+	entry := requestColumnCache.Get(table, []byte("name state latency"))
+	if entry == nil {
+		t.Fatalf("expected cached entry")
+	}
+	if err := assertEq("name", entry.names[0]); err != nil {
+		t.Error(err)
+	}
+	if err := assertEq("name", entry.columns[0].Name); err != nil {
+		t.Error(err)
+	}
+	if err := assertEq("name", req1.RequestColumns[0].Name); err != nil {
+		t.Error(err)
+	}
+
+	// sort fields are not shared
+	query = "GET hosts\nColumns: name state latency\nSort: name asc\n\n"
+	req3, _, err := NewRequest(context.TODO(), lmd, bufio.NewReader(bytes.NewBufferString(query)), ParseOptimize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := assertEq("name", req3.Sort[0].Column.Name); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestColumnCacheEviction(t *testing.T) {
+	InitObjects()
+	cache := NewColumnCache(2)
+	table := Objects.Tables[TableHosts]
+	cache.Add(table, []byte("name"), []string{"name"})
+	cache.Add(table, []byte("state"), []string{"state"})
+	cache.Get(table, []byte("name"))
+	cache.Add(table, []byte("latency"), []string{"latency"})
+
+	if err := assertEq(2, cache.Len()); err != nil {
+		t.Error(err)
+	}
+	if err := assertEq(true, cache.Get(table, []byte("state")) == nil); err != nil {
+		t.Error(err)
+	}
+	if err := assertEq("name", cache.Get(table, []byte("name")).columns[0].Name); err != nil {
+		t.Error(err)
+	}
+
+	// changed table definitions clear the cache
+	cache.objects = &ObjectsType{}
+	if err := assertEq(true, cache.Get(table, []byte("name")) == nil); err != nil {
+		t.Error(err)
+	}
+	if err := assertEq(0, cache.Len()); err != nil {
+		t.Error(err)
+	}
+}
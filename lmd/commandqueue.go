@@ -0,0 +1,251 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/sasha-s/go-deadlock"
+)
+
+const (
+	// DefaultCommandQueueSize sets the default maximum number of queued commands per peer
+	DefaultCommandQueueSize = 10000
+
+	// DefaultCommandRetryTimeout sets the default number of seconds commands are retried while a peer is unavailable
+	DefaultCommandRetryTimeout = 60
+
+	// CommandRetryInterval sets the initial interval between retries, it doubles after each retry
+	CommandRetryInterval = 1 * time.Second
+
+	// CommandRetryIntervalMax sets the maximum interval between retries
+	CommandRetryIntervalMax = 30 * time.Second
+
+	// CommandModeSync makes clients wait till all commands have been sent
+	CommandModeSync = "sync"
+
+	// CommandModeAsync makes clients return as soon as all commands have been queued
+	CommandModeAsync = "async"
+)
+
+// CommandBatch is a list of commands which have been queued together.
+type CommandBatch struct {
+	commands []string
+	done     chan struct{}
+	err      error
+}
+
+// Done returns a channel which is closed once the batch has been sent or dropped.
+func (b *CommandBatch) Done() <-chan struct{} {
+	return b.done
+}
+
+// Err returns the error of a finished batch.
+func (b *CommandBatch) Err() error {
+	return b.err
+}
+
+func (b *CommandBatch) finish(err error) {
+	b.err = err
+	close(b.done)
+}
+
+// PeerCommandQueue sends the commands of a peer in order, limits the rate of sent commands
+// and retries them while the peer is temporarily unavailable.
+// Commands are sent by a worker which runs as long as there are queued commands.
+type PeerCommandQueue struct {
+	noCopy   noCopy
+	peer     *Peer
+	lock     *deadlock.Mutex
+	batches  []*CommandBatch
+	depth    int       // number of queued commands
+	running  bool      // worker is running
+	nextSend time.Time // earliest time to send the next commands when rate limited
+	dropped  int64     // number of dropped commands
+	retried  int64     // number of retried commands
+}
+
+// NewPeerCommandQueue creates a new command queue for given peer.
+func NewPeerCommandQueue(peer *Peer) *PeerCommandQueue {
+	return &PeerCommandQueue{
+		peer: peer,
+		lock: new(deadlock.Mutex),
+	}
+}
+
+// Add queues the commands and starts the worker if required.
+// It returns an error if the queue is full.
+func (q *PeerCommandQueue) Add(commands []string) (*CommandBatch, error) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	maxSize := q.peer.lmd.Config.CommandQueueSize
+	if maxSize > 0 && q.depth+len(commands) > maxSize {
+		q.drop(len(commands))
+		return nil, fmt.Errorf("command queue full, %d commands queued already", q.depth)
+	}
+	batch := &CommandBatch{commands: commands, done: make(chan struct{})}
+	q.batches = append(q.batches, batch)
+	q.setDepth(q.depth + len(commands))
+	if !q.running {
+		q.running = true
+		go q.run()
+	}
+	return batch, nil
+}
+
+// Depth returns the number of queued commands.
+func (q *PeerCommandQueue) Depth() int {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	return q.depth
+}
+
+// Dropped returns the number of dropped commands.
+func (q *PeerCommandQueue) Dropped() int64 {
+	return atomic.LoadInt64(&q.dropped)
+}
+
+// Retried returns the number of retried commands.
+func (q *PeerCommandQueue) Retried() int64 {
+	return atomic.LoadInt64(&q.retried)
+}
+
+// run sends all queued batches until the queue is empty.
+func (q *PeerCommandQueue) run() {
+	// make sure we log panics properly
+	defer logPanicExitPeer(q.peer)
+
+	for {
+		q.lock.Lock()
+		if len(q.batches) == 0 {
+			q.running = false
+			q.lock.Unlock()
+			return
+		}
+		batch := q.batches[0]
+		q.lock.Unlock()
+
+		gaveUp, err := q.send(batch.commands)
+
+		q.lock.Lock()
+		q.batches = q.batches[1:]
+		q.setDepth(q.depth - len(batch.commands))
+		batch.finish(err)
+		if gaveUp {
+			// peer is still unavailable, do not wait again for all remaining commands
+			q.drop(len(batch.commands))
+			for _, b := range q.batches {
+				q.drop(len(b.commands))
+				b.finish(err)
+			}
+			q.batches = nil
+			q.setDepth(0)
+		}
+		q.lock.Unlock()
+	}
+}
+
+// send sends the commands in chunks according to the rate limit.
+// It returns true if the peer stayed unavailable for longer than the retry timeout.
+func (q *PeerCommandQueue) send(commands []string) (gaveUp bool, err error) {
+	rateLimit := q.peer.lmd.Config.CommandRateLimit
+	chunkSize := len(commands)
+	if rateLimit > 0 && rateLimit < chunkSize {
+		chunkSize = rateLimit
+	}
+	for start := 0; start < len(commands); start += chunkSize {
+		end := start + chunkSize
+		if end > len(commands) {
+			end = len(commands)
+		}
+		if rateLimit > 0 {
+			if wait := time.Until(q.nextSend); wait > 0 {
+				time.Sleep(wait)
+			}
+		}
+		gaveUp, err = q.sendWithRetry(commands[start:end])
+		if err != nil {
+			return gaveUp, err
+		}
+		if rateLimit > 0 {
+			if q.nextSend.Before(time.Now()) {
+				q.nextSend = time.Now()
+			}
+			q.nextSend = q.nextSend.Add(time.Duration(end-start) * time.Second / time.Duration(rateLimit))
+		}
+	}
+	return false, nil
+}
+
+// sendWithRetry sends the commands and retries with increasing intervals while the peer is
+// unavailable. It returns true if the peer stayed unavailable for longer than the retry timeout.
+func (q *PeerCommandQueue) sendWithRetry(commands []string) (gaveUp bool, err error) {
+	p := q.peer
+	ctx := context.WithValue(context.Background(), CtxPeer, p.Name)
+	retryTimeout := time.Duration(p.lmd.Config.CommandRetryTimeout) * time.Second
+	interval := CommandRetryInterval
+	connectionRetried := false
+	var unavailableSince time.Time
+	for {
+		var unavailable bool
+		unavailable, err = p.sendCommandsOnce(ctx, commands)
+		if err == nil {
+			return false, nil
+		}
+		switch e := err.(type) {
+		case *PeerCommandError:
+			return false, err
+		case *PeerError:
+			if !unavailable && e.kind == ConnectionError {
+				if connectionRetried {
+					/* this indicates a problem with the command itself:
+					   the peer is up, we send a command -> peer is down
+					   then peer comes up again, we send the command again
+					   and the peer is immediately down again. This means
+					   the command probably worked, but something else failed,
+					   so don't repeat the command in an endless loop
+					*/
+					return false, fmt.Errorf("sending command failed, number of retries exceeded")
+				}
+				connectionRetried = true
+				unavailable = true
+			}
+		}
+		if !unavailable {
+			return false, fmt.Errorf("%s", p.StatusGet(LastError))
+		}
+
+		if unavailableSince.IsZero() {
+			unavailableSince = time.Now()
+		}
+		elapsed := time.Since(unavailableSince)
+		if elapsed >= retryTimeout {
+			if retryTimeout > 0 {
+				err = fmt.Errorf("peer unavailable for %s, giving up: %s", elapsed.Truncate(time.Second), err.Error())
+			}
+			logWith(ctx).Warnf("dropping %d commands: %s", len(commands), err.Error())
+			return true, err
+		}
+		atomic.AddInt64(&q.retried, int64(len(commands)))
+		promPeerCommandsRetried.WithLabelValues(p.Name).Add(float64(len(commands)))
+		logWith(ctx).Debugf("sending %d commands failed, retrying in %s: %s", len(commands), interval, err.Error())
+		time.Sleep(interval)
+		interval *= 2
+		if interval > CommandRetryIntervalMax {
+			interval = CommandRetryIntervalMax
+		}
+	}
+}
+
+// setDepth updates the number of queued commands. It must be called with the lock held.
+func (q *PeerCommandQueue) setDepth(depth int) {
+	q.depth = depth
+	promPeerCommandQueueDepth.WithLabelValues(q.peer.Name).Set(float64(depth))
+}
+
+// drop counts dropped commands.
+func (q *PeerCommandQueue) drop(num int) {
+	atomic.AddInt64(&q.dropped, int64(num))
+	promPeerCommandsDropped.WithLabelValues(q.peer.Name).Add(float64(num))
+}
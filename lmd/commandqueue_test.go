@@ -0,0 +1,88 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPeerCommandQueueRateLimit(t *testing.T) {
+	peer, cleanup, mocklmd := StartTestPeer(1, 10, 10)
+	PauseTestPeers(peer)
+
+	mocklmd.Config.CommandRateLimit = 4
+	p := mocklmd.PeerMap[mocklmd.PeerMapOrder[0]]
+	started := time.Now()
+	batch, err := p.QueueCommands([]string{"COMMAND [0] test_ok", "COMMAND [0] test_ok", "COMMAND [0] test_ok", "COMMAND [0] test_ok", "COMMAND [0] test_ok", "COMMAND [0] test_ok"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-batch.Done()
+	if err = batch.Err(); err != nil {
+		t.Error(err)
+	}
+	// 4 commands are sent immediately, the remaining 2 after one second
+	elapsed := time.Since(started)
+	if elapsed < 900*time.Millisecond || elapsed > 3*time.Second {
+		t.Errorf("expected rate limited commands to be sent after a second, took %s", elapsed)
+	}
+	if err = assertEq(0, p.commandQueue.Depth()); err != nil {
+		t.Error(err)
+	}
+
+	if err := cleanup(); err != nil {
+		panic(err.Error())
+	}
+}
+
+func TestPeerCommandQueueRetry(t *testing.T) {
+	peer, cleanup, mocklmd := StartTestPeer(1, 10, 10)
+	PauseTestPeers(peer)
+
+	mocklmd.Config.CommandQueueSize = 2
+	mocklmd.Config.CommandRetryTimeout = 1
+	p := mocklmd.PeerMap[mocklmd.PeerMapOrder[0]]
+	p.StatusSet(PeerState, PeerStatusDown)
+	p.StatusSet(LastError, "connection refused")
+
+	batch, err := p.QueueCommands([]string{"COMMAND [0] test_ok", "COMMAND [0] test_ok"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// queue is full
+	_, err = p.QueueCommands([]string{"COMMAND [0] test_ok"})
+	if err == nil {
+		t.Errorf("expected queue full error")
+	}
+
+	// commands are dropped once the peer stays down longer than the retry timeout
+	<-batch.Done()
+	if err = batch.Err(); err == nil || !strings.Contains(err.Error(), "giving up: connection refused") {
+		t.Errorf("expected giving up error, got: %v", err)
+	}
+
+	res, _, err := peer.QueryString("GET sites\nColumns: command_queue_depth commands_dropped commands_retried\n\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = assertEq(ResultSet{{0.0, 3.0, 2.0}}, res); err != nil {
+		t.Error(err)
+	}
+
+	// commands are sent as soon as the peer is back
+	p.StatusSet(PeerState, PeerStatusDown)
+	batch, err = p.QueueCommands([]string{"COMMAND [0] test_ok"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.StatusSet(PeerState, PeerStatusUp)
+	<-batch.Done()
+	if err = batch.Err(); err != nil {
+		t.Error(err)
+	}
+
+	if err := cleanup(); err != nil {
+		panic(err.Error())
+	}
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/sasha-s/go-deadlock"
+)
+
+// CommandTarget contains the host and service affected by an external command.
+type CommandTarget struct {
+	Host        string
+	Service     string
+	AllServices bool // command affects all services of the host
+}
+
+// commandTargetTypes maps external commands to the kind of object they affect.
+var commandTargetTypes = map[string]TableName{
+	"ACKNOWLEDGE_HOST_PROBLEM":             TableHosts,
+	"ADD_HOST_COMMENT":                     TableHosts,
+	"CHANGE_CUSTOM_HOST_VAR":               TableHosts,
+	"DISABLE_HOST_CHECK":                   TableHosts,
+	"DISABLE_HOST_NOTIFICATIONS":           TableHosts,
+	"ENABLE_HOST_CHECK":                    TableHosts,
+	"ENABLE_HOST_NOTIFICATIONS":            TableHosts,
+	"PROCESS_HOST_CHECK_RESULT":            TableHosts,
+	"REMOVE_HOST_ACKNOWLEDGEMENT":          TableHosts,
+	"SCHEDULE_FORCED_HOST_CHECK":           TableHosts,
+	"SCHEDULE_HOST_CHECK":                  TableHosts,
+	"SCHEDULE_HOST_DOWNTIME":               TableHosts,
+	"SCHEDULE_AND_PROPAGATE_HOST_DOWNTIME": TableHosts,
+	"SEND_CUSTOM_HOST_NOTIFICATION":        TableHosts,
+	"ACKNOWLEDGE_SVC_PROBLEM":              TableServices,
+	"ADD_SVC_COMMENT":                      TableServices,
+	"CHANGE_CUSTOM_SVC_VAR":                TableServices,
+	"DISABLE_SVC_CHECK":                    TableServices,
+	"DISABLE_SVC_NOTIFICATIONS":            TableServices,
+	"ENABLE_SVC_CHECK":                     TableServices,
+	"ENABLE_SVC_NOTIFICATIONS":             TableServices,
+	"PROCESS_SERVICE_CHECK_RESULT":         TableServices,
+	"REMOVE_SVC_ACKNOWLEDGEMENT":           TableServices,
+	"SCHEDULE_FORCED_SVC_CHECK":            TableServices,
+	"SCHEDULE_SVC_CHECK":                   TableServices,
+	"SCHEDULE_SVC_DOWNTIME":                TableServices,
+	"SEND_CUSTOM_SVC_NOTIFICATION":         TableServices,
+	"SCHEDULE_FORCED_HOST_SVC_CHECKS":      TableServices,
+	"SCHEDULE_HOST_SVC_CHECKS":             TableServices,
+	"SCHEDULE_HOST_SVC_DOWNTIME":           TableServices,
+	"ACKNOWLEDGE_HOST_SVC_PROBLEMS":        TableServices,
+	"DISABLE_HOST_SVC_CHECKS":              TableServices,
+	"ENABLE_HOST_SVC_CHECKS":               TableServices,
+	"DISABLE_HOST_SVC_NOTIFICATIONS":       TableServices,
+	"ENABLE_HOST_SVC_NOTIFICATIONS":        TableServices,
+}
+
+// ParseCommandTarget extracts the affected host and service from an external command
+// like "COMMAND [1234567890] SCHEDULE_FORCED_SVC_CHECK;host;service;1234567890".
+// It returns false if the command is unknown or does not affect a single host.
+func ParseCommandTarget(command string) (target CommandTarget, ok bool) {
+	args, ok := splitCommand(command)
+	if !ok {
+		return target, false
+	}
+	table, known := commandTargetTypes[args[0]]
+	if !known || len(args) < 2 || args[1] == "" {
+		return target, false
+	}
+	switch {
+	case table == TableHosts:
+		return CommandTarget{Host: args[1]}, true
+	case strings.Contains(args[0], "_HOST_SVC_"):
+		return CommandTarget{Host: args[1], AllServices: true}, true
+	case len(args) < 3 || args[2] == "":
+		return target, false
+	}
+	return CommandTarget{Host: args[1], Service: args[2]}, true
+}
+
+// splitCommand removes the COMMAND keyword and timestamp from an external command
+// and returns the command name followed by its arguments.
+func splitCommand(command string) (args []string, ok bool) {
+	command = strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(command), "COMMAND"))
+	if strings.HasPrefix(command, "[") {
+		end := strings.Index(command, "]")
+		if end == -1 {
+			return nil, false
+		}
+		command = strings.TrimSpace(command[end+1:])
+	}
+	return strings.Split(command, ";"), true
+}
+
+// ParseCommandTargets returns the targets of all known commands.
+func ParseCommandTargets(commands []string) []CommandTarget {
+	targets := make([]CommandTarget, 0, len(commands))
+	for _, cmd := range commands {
+		if target, ok := ParseCommandTarget(cmd); ok {
+			targets = append(targets, target)
+		}
+	}
+	return targets
+}
+
+// commandWaiter is a single wait query waiting for changes of its wait objects.
+type commandWaiter struct {
+	table   TableName
+	objects []string
+}
+
+// CommandNotifier wakes up wait queries as soon as commands affecting their wait objects have
+// been sent, so they do not have to wait for the next poll interval.
+// It uses its own lock, so it can be accessed while the peer lock is held.
+type CommandNotifier struct {
+	noCopy  noCopy
+	lock    *deadlock.Mutex
+	waiters map[chan struct{}]*commandWaiter
+}
+
+// NewCommandNotifier creates a new command notifier.
+func NewCommandNotifier() *CommandNotifier {
+	return &CommandNotifier{
+		lock:    new(deadlock.Mutex),
+		waiters: make(map[chan struct{}]*commandWaiter),
+	}
+}
+
+// Register adds a wait query for given table and wait objects. The returned channel receives
+// a value whenever a command for one of the objects has been sent.
+func (n *CommandNotifier) Register(table TableName, objects []string) chan struct{} {
+	wake := make(chan struct{}, 1)
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	n.waiters[wake] = &commandWaiter{table: table, objects: objects}
+	return wake
+}
+
+// Unregister removes a wait query added by Register.
+func (n *CommandNotifier) Unregister(wake chan struct{}) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	delete(n.waiters, wake)
+}
+
+// Notify wakes up all wait queries affected by given command targets.
+func (n *CommandNotifier) Notify(targets []CommandTarget) {
+	if len(targets) == 0 {
+		return
+	}
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	for wake, waiter := range n.waiters {
+		if !waiter.affectedBy(targets) {
+			continue
+		}
+		select {
+		case wake <- struct{}{}:
+		default:
+			// already woken up
+		}
+	}
+}
+
+// affectedBy returns true if any of the targets changes one of the wait objects.
+// Waits without wait objects or on other tables are always affected.
+func (w *commandWaiter) affectedBy(targets []CommandTarget) bool {
+	if len(w.objects) == 0 || (w.table != TableHosts && w.table != TableServices) {
+		return true
+	}
+	for _, obj := range w.objects {
+		for _, target := range targets {
+			switch w.table {
+			case TableHosts:
+				if target.Service == "" && !target.AllServices && obj == target.Host {
+					return true
+				}
+			case TableServices:
+				parts := strings.SplitN(obj, ";", 2)
+				if parts[0] != target.Host {
+					continue
+				}
+				if target.AllServices || (len(parts) == 2 && parts[1] == target.Service) {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// RouteCommand limits the backends of a host or service command without Backends header
+// to the backends which own the host (and service).
+// It returns an error if none of the backends knows the host.
+func (req *Request) RouteCommand() error {
+	if !req.lmd.Config.CommandRouting || len(req.Backends) > 0 {
+		return nil
+	}
+	target, ok := ParseCommandTarget(req.Command)
+	if !ok {
+		return nil
+	}
+
+	owners, complete := req.lmd.commandOwners(target)
+	if len(owners) == 0 {
+		if !complete {
+			// host might exist on a backend which is down, send command everywhere
+			return nil
+		}
+		if target.Service != "" {
+			return fmt.Errorf("bad request: unknown service %s on host %s", target.Service, target.Host)
+		}
+		return fmt.Errorf("bad request: unknown host %s", target.Host)
+	}
+	if req.lmd.Config.CommandRoutingMultiple == CommandRoutingFirst {
+		owners = owners[:1]
+	}
+	req.BackendsMap = make(map[string]string, len(owners))
+	for _, id := range owners {
+		req.BackendsMap[id] = id
+	}
+	return nil
+}
+
+// commandOwners returns the ids of all peers which contain the host (and service) of the
+// command target in the configured order. complete is false if not all peers could be
+// checked, ex. because they are down.
+func (lmd *LMDInstance) commandOwners(target CommandTarget) (owners []string, complete bool) {
+	lmd.PeerMapLock.RLock()
+	peers := make([]*Peer, 0, len(lmd.PeerMapOrder))
+	for _, id := range lmd.PeerMapOrder {
+		if p, ok := lmd.PeerMap[id]; ok {
+			peers = append(peers, p)
+		}
+	}
+	lmd.PeerMapLock.RUnlock()
+
+	complete = true
+	for _, p := range peers {
+		data, err := p.GetDataStoreSet()
+		if err != nil {
+			complete = false
+			continue
+		}
+		table := TableHosts
+		name := target.Host
+		if target.Service != "" {
+			table = TableServices
+			name = target.Host + ";" + target.Service
+		}
+		store := data.Get(table)
+		if store == nil {
+			complete = false
+			continue
+		}
+		data.Lock.RLock()
+		_, found := store.GetWaitObject(name)
+		data.Lock.RUnlock()
+		if found {
+			owners = append(owners, p.ID)
+		}
+	}
+	return owners, complete
+}
@@ -0,0 +1,304 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"testing"
+
+	jsoniter "github.com/json-iterator/go"
+)
+
+func TestParseCommandTarget(t *testing.T) {
+	tests := []struct {
+		command string
+		target  CommandTarget
+		ok      bool
+	}{
+		{"COMMAND [1473627610] SCHEDULE_FORCED_SVC_CHECK;demo;Ping;1473627610", CommandTarget{Host: "demo", Service: "Ping"}, true},
+		{"[1473627610] SCHEDULE_FORCED_HOST_CHECK;demo;1473627610", CommandTarget{Host: "demo"}, true},
+		{"COMMAND [1473627610] PROCESS_SERVICE_CHECK_RESULT;demo;Disk /;0;OK", CommandTarget{Host: "demo", Service: "Disk /"}, true},
+		{"COMMAND [1473627610] SCHEDULE_FORCED_HOST_SVC_CHECKS;demo;1473627610", CommandTarget{Host: "demo", AllServices: true}, true},
+		{"COMMAND [1473627610] DISABLE_NOTIFICATIONS", CommandTarget{}, false},
+		{"COMMAND [1473627610] SCHEDULE_SVC_CHECK;demo", CommandTarget{}, false},
+		{"COMMAND [1473627610 SCHEDULE_SVC_CHECK;demo;Ping", CommandTarget{}, false},
+	}
+	for _, test := range tests {
+		target, ok := ParseCommandTarget(test.command)
+		if err := assertEq(test.ok, ok); err != nil {
+			t.Errorf("%s: %s", test.command, err)
+		}
+		if err := assertEq(test.target, target); err != nil {
+			t.Errorf("%s: %s", test.command, err)
+		}
+	}
+}
+
+func TestCommandNotifier(t *testing.T) {
+	notifier := NewCommandNotifier()
+	hostWait := notifier.Register(TableHosts, []string{"demo"})
+	serviceWait := notifier.Register(TableServices, []string{"demo;Ping", "other;Load"})
+	tableWait := notifier.Register(TableServices, nil)
+
+	woken := func(wake chan struct{}) bool {
+		select {
+		case <-wake:
+			return true
+		default:
+			return false
+		}
+	}
+
+	// service command only wakes up waits for that service
+	notifier.Notify(ParseCommandTargets([]string{"COMMAND [1473627610] SCHEDULE_FORCED_SVC_CHECK;demo;Ping;1473627610"}))
+	if err := assertEq([]bool{false, true, true}, []bool{woken(hostWait), woken(serviceWait), woken(tableWait)}); err != nil {
+		t.Error(err)
+	}
+
+	notifier.Notify(ParseCommandTargets([]string{"COMMAND [1473627610] SCHEDULE_FORCED_HOST_CHECK;demo;1473627610"}))
+	if err := assertEq([]bool{true, false, true}, []bool{woken(hostWait), woken(serviceWait), woken(tableWait)}); err != nil {
+		t.Error(err)
+	}
+
+	notifier.Notify(ParseCommandTargets([]string{"COMMAND [1473627610] SCHEDULE_FORCED_HOST_SVC_CHECKS;other;1473627610"}))
+	if err := assertEq([]bool{false, true, true}, []bool{woken(hostWait), woken(serviceWait), woken(tableWait)}); err != nil {
+		t.Error(err)
+	}
+
+	// unregistered waits are not woken up anymore
+	notifier.Unregister(serviceWait)
+	notifier.Notify(ParseCommandTargets([]string{"COMMAND [1473627610] SCHEDULE_FORCED_SVC_CHECK;demo;Ping;1473627610"}))
+	if err := assertEq(false, woken(serviceWait)); err != nil {
+		t.Error(err)
+	}
+}
+
+func testSendCommands(t *testing.T, lmd *LMDInstance, query string) string {
+	t.Helper()
+	buf := bufio.NewReader(bytes.NewBufferString(query))
+	reqs := []*Request{}
+	for {
+		req, _, err := NewRequest(context.TODO(), lmd, buf, ParseDefault)
+		if req == nil {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = req.ExpandRequestedBackends(); err != nil {
+			t.Fatal(err)
+		}
+		reqs = append(reqs, req)
+	}
+	server, client := net.Pipe()
+	output := make(chan string, 1)
+	go func() {
+		data, _ := io.ReadAll(client)
+		output <- string(data)
+	}()
+	cl := NewClientConnection(lmd, server, 10, 10, 10, nil)
+	// errors are sent to the client as well
+	_ = cl.processRequests(context.WithValue(context.Background(), CtxClient, "test"), reqs)
+	server.Close()
+	return <-output
+}
+
+func TestSendCommandsSummary(t *testing.T) {
+	peer, cleanup, mocklmd := StartTestPeer(2, 10, 10)
+	PauseTestPeers(peer)
+
+	id1, id2 := mocklmd.PeerMapOrder[0], mocklmd.PeerMapOrder[1]
+
+	// commands without backends are sent to all backends
+	res := testSendCommands(t, mocklmd, "COMMAND [0] test_ok\nOutputFormat: wrapped_json\n\n")
+	expect := fmt.Sprintf(`{"code":200,"message":"OK","sent":[%q,%q],"failed":{},"pending":[]}`+"\n", id1, id2)
+	if id2 < id1 {
+		expect = fmt.Sprintf(`{"code":200,"message":"OK","sent":[%q,%q],"failed":{},"pending":[]}`+"\n", id2, id1)
+	}
+	if err := assertEq(expect, res); err != nil {
+		t.Error(err)
+	}
+
+	// plain commands do not return anything unless they fail
+	res = testSendCommands(t, mocklmd, "COMMAND [0] test_ok\n\n")
+	if err := assertEq("", res); err != nil {
+		t.Error(err)
+	}
+	res = testSendCommands(t, mocklmd, fmt.Sprintf("COMMAND [0] test_broken\nBackends: %s\n\n", id1))
+	if err := assertEq("400: command broken\n", res); err != nil {
+		t.Error(err)
+	}
+
+	// failed, unknown and down backends are reported, down backends are not retried
+	mocklmd.PeerMap[id2].StatusSet(PeerState, PeerStatusDown)
+	mocklmd.PeerMap[id2].StatusSet(LastError, "connection refused")
+	res = testSendCommands(t, mocklmd, fmt.Sprintf("COMMAND [0] test_broken\nBackends: %s\nOutputFormat: wrapped_json\n\nCOMMAND [0] test_ok\nBackends: %s unknown\n\n", id1, id2))
+	summary := &CommandSummary{}
+	if err := jsoniter.Unmarshal([]byte(res), summary); err != nil {
+		t.Fatalf("%s: %s", err, res)
+	}
+	if err := assertEq(map[string]string{
+		id1:       "command broken",
+		id2:       "connection refused",
+		"unknown": "bad request: backend unknown does not exist",
+	}, summary.Failed); err != nil {
+		t.Error(err)
+	}
+	if err := assertEq(0, len(summary.Sent)); err != nil {
+		t.Error(err)
+	}
+	if summary.Code == 200 {
+		t.Errorf("expected error code, got: %s", res)
+	}
+
+	if err := cleanup(); err != nil {
+		panic(err.Error())
+	}
+}
+
+func TestSendCommandsPending(t *testing.T) {
+	peer, cleanup, mocklmd := StartTestPeer(1, 10, 10)
+	PauseTestPeers(peer)
+
+	id := mocklmd.PeerMapOrder[0]
+
+	// commands for backends which are not ready stay queued
+	mocklmd.Config.CommandRetryTimeout = 60
+	mocklmd.PeerMap[id].StatusSet(PeerState, PeerStatusWarning)
+	server, client := net.Pipe()
+	defer client.Close()
+	cl := NewClientConnection(mocklmd, server, 10, 10, 10, nil)
+	ctx, cancel := context.WithCancel(context.WithValue(context.Background(), CtxClient, "test"))
+	cancel()
+	summary := cl.SendCommands(ctx, map[string][]string{id: {"COMMAND [0] test_ok"}}, "")
+	if err := assertEq(202, summary.Code); err != nil {
+		t.Error(err)
+	}
+	if err := assertEq([]string{id}, summary.Pending); err != nil {
+		t.Error(err)
+	}
+
+	// pending backends must not hide errors of other backends
+	summary = cl.SendCommands(ctx, map[string][]string{id: {"COMMAND [0] test_ok"}, "unknown": {"COMMAND [0] test_ok"}}, "")
+	if err := assertEq(500, summary.Code); err != nil {
+		t.Error(err)
+	}
+	if err := assertEq("bad request: backend unknown does not exist", summary.Message); err != nil {
+		t.Error(err)
+	}
+	if err := assertEq([]string{id}, summary.Pending); err != nil {
+		t.Error(err)
+	}
+
+	// backends which are down already fail immediately
+	mocklmd.PeerMap[id].StatusSet(PeerState, PeerStatusDown)
+	mocklmd.PeerMap[id].StatusSet(LastError, "connection refused")
+	summary = cl.SendCommands(ctx, map[string][]string{id: {"COMMAND [0] test_ok"}}, "")
+	if err := assertEq(map[string]string{id: "connection refused"}, summary.Failed); err != nil {
+		t.Error(err)
+	}
+	if err := assertEq(0, len(summary.Pending)); err != nil {
+		t.Error(err)
+	}
+
+	// let the queued commands finish
+	mocklmd.PeerMap[id].StatusSet(PeerState, PeerStatusUp)
+	if err := cleanup(); err != nil {
+		panic(err.Error())
+	}
+}
+
+func TestSendCommandsAck(t *testing.T) {
+	peer, cleanup, mocklmd := StartTestPeer(2, 10, 10)
+	PauseTestPeers(peer)
+
+	id1 := mocklmd.PeerMapOrder[0]
+
+	res := testSendCommands(t, mocklmd, "COMMAND [0] test_ok\nResponseHeader: fixed16\n\n")
+	if err := assertEq("200           1\n\n", res); err != nil {
+		t.Error(err)
+	}
+
+	// failed backends are named in the body
+	res = testSendCommands(t, mocklmd, fmt.Sprintf("COMMAND [0] test_broken\nBackends: %s unknown\nResponseHeader: fixed16\n\n", id1))
+	body := fmt.Sprintf("command broken\n%s: command broken\nunknown: bad request: backend unknown does not exist\n\n", id1)
+	if err := assertEq(fmt.Sprintf("400 %11d\n%s", len(body), body), res); err != nil {
+		t.Error(err)
+	}
+
+	if err := cleanup(); err != nil {
+		panic(err.Error())
+	}
+}
+
+func TestRouteCommand(t *testing.T) {
+	peer, cleanup, mocklmd := StartTestPeer(2, 10, 10)
+	PauseTestPeers(peer)
+
+	// disabled by default
+	if err := assertEq(false, mocklmd.Config.CommandRouting); err != nil {
+		t.Error(err)
+	}
+	mocklmd.Config.CommandRouting = true
+
+	id1, id2 := mocklmd.PeerMapOrder[0], mocklmd.PeerMapOrder[1]
+	sent := func(query string) []string {
+		t.Helper()
+		res := testSendCommands(t, mocklmd, query+"OutputFormat: wrapped_json\n\n")
+		summary := &CommandSummary{}
+		if err := jsoniter.Unmarshal([]byte(res), summary); err != nil {
+			t.Fatalf("%s: %s", err, res)
+		}
+		sort.Strings(summary.Sent)
+		return summary.Sent
+	}
+	both := []string{id1, id2}
+	sort.Strings(both)
+
+	// hosts existing on both backends
+	if err := assertEq(both, sent("COMMAND [0] SCHEDULE_FORCED_HOST_CHECK;testhost_1;0\n")); err != nil {
+		t.Error(err)
+	}
+	mocklmd.Config.CommandRoutingMultiple = CommandRoutingFirst
+	if err := assertEq([]string{id1}, sent("COMMAND [0] SCHEDULE_FORCED_SVC_CHECK;testhost_1;testsvc_1;0\n")); err != nil {
+		t.Error(err)
+	}
+
+	// backends header disables routing, unknown commands are sent everywhere
+	if err := assertEq([]string{id2}, sent(fmt.Sprintf("COMMAND [0] SCHEDULE_FORCED_HOST_CHECK;testhost_1;0\nBackends: %s\n", id2))); err != nil {
+		t.Error(err)
+	}
+	if err := assertEq(both, sent("COMMAND [0] test_ok\n")); err != nil {
+		t.Error(err)
+	}
+
+	// unknown hosts and services are rejected
+	res := testSendCommands(t, mocklmd, "COMMAND [0] SCHEDULE_FORCED_HOST_CHECK;nohost;0\n\n")
+	if err := assertLike(`^bad request: unknown host nohost \(request id: r:\w+\)\n$`, res); err != nil {
+		t.Error(err)
+	}
+	res = testSendCommands(t, mocklmd, "COMMAND [0] SCHEDULE_FORCED_SVC_CHECK;testhost_1;nosvc;0\n\n")
+	if err := assertLike(`^bad request: unknown service nosvc on host testhost_1 \(request id: r:\w+\)\n$`, res); err != nil {
+		t.Error(err)
+	}
+
+	// following requests are still processed
+	res = testSendCommands(t, mocklmd, "COMMAND [0] SCHEDULE_FORCED_HOST_CHECK;nohost;0\n\nGET hosts\nColumns: name\nFilter: name = testhost_1\nLimit: 1\n\n")
+	if err := assertLike(`^bad request: unknown host nohost \(request id: r:\w+\)\n\[\["testhost_1"\]\]\n$`, res); err != nil {
+		t.Error(err)
+	}
+
+	// host might exist on a backend without data
+	mocklmd.PeerMap[id2].SetDataStoreSet(nil, true)
+	if err := assertEq(both, sent("COMMAND [0] SCHEDULE_FORCED_HOST_CHECK;nohost;0\n")); err != nil {
+		t.Error(err)
+	}
+
+	if err := cleanup(); err != nil {
+		panic(err.Error())
+	}
+}
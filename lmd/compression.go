@@ -0,0 +1,28 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+)
+
+// gzipMagic are the first bytes of gzip compressed data
+var gzipMagic = []byte{0x1f, 0x8b}
+
+// gunzipBytes returns the decompressed data.
+func gunzipBytes(data []byte) ([]byte, error) {
+	gz, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("gunzip error: %w", err)
+	}
+	res, err := io.ReadAll(gz)
+	if err != nil {
+		return nil, fmt.Errorf("gunzip error: %w", err)
+	}
+	err = gz.Close()
+	if err != nil {
+		return nil, fmt.Errorf("gunzip error: %w", err)
+	}
+	return res, nil
+}
@@ -7,7 +7,10 @@ import (
 	"os"
 	"path/filepath"
 	"regexp"
+	"runtime"
+	"slices"
 	"strings"
+	"time"
 
 	"github.com/BurntSushi/toml"
 	jsoniter "github.com/json-iterator/go"
@@ -15,19 +18,23 @@ import (
 
 // Connection defines a single connection configuration.
 type Connection struct {
-	Name           string
-	ID             string
-	Source         []string
-	Auth           string
-	RemoteName     string `toml:"remote_name"`
-	Section        string
-	TLSCertificate string
-	TLSKey         string
-	TLSCA          string
-	TLSSkipVerify  int
-	TLSServerName  string
-	Proxy          string
-	Flags          []string
+	Name               string
+	ID                 string
+	Source             []string
+	Auth               string
+	RemoteName         string `toml:"remote_name"`
+	Section            string
+	TLSCertificate     string
+	TLSKey             string
+	TLSCA              string
+	TLSSkipVerify      int
+	TLSServerName      string
+	Proxy              string
+	Flags              []string
+	Compression        bool
+	LogCacheWindow     int
+	LogCacheRetention  int
+	LogCacheMaxEntries int
 }
 
 // Equals checks if two connection objects are identical.
@@ -44,9 +51,46 @@ func (c *Connection) Equals(other *Connection) bool {
 	equal = equal && c.TLSSkipVerify == other.TLSSkipVerify
 	equal = equal && strings.Join(c.Source, ":") == strings.Join(other.Source, ":")
 	equal = equal && strings.Join(c.Flags, ":") == strings.Join(other.Flags, ":")
+	equal = equal && c.Compression == other.Compression
+	equal = equal && c.LogCacheWindow == other.LogCacheWindow
+	equal = equal && c.LogCacheRetention == other.LogCacheRetention
+	equal = equal && c.LogCacheMaxEntries == other.LogCacheMaxEntries
 	return equal
 }
 
+// TLSListener defines the tls settings of a single tls or https listener.
+// Unset values fall back to the global tls settings.
+type TLSListener struct {
+	Listen            string
+	TLSCertificate    string
+	TLSKey            string
+	TLSClientPems     []string
+	TLSMinVersion     string
+	TLSClientAuthUser string
+}
+
+// ListenerOptions defines the options of a single livestatus listener.
+// Unset limits fall back to the global settings.
+type ListenerOptions struct {
+	Listen                    string
+	OutputFormat              string   // OutputFormat used if the request does not set one
+	AuthUser                  string   // AuthUser used for all requests, overrides the AuthUser header
+	AllowedTables             []string // tables which may be queried, empty allows all tables
+	DenyCommands              bool     // reject all commands
+	MaxClientConnections      int
+	MaxClientConnectionsPerIP int
+	ClientQueryRateLimit      int
+	ClientIdleTimeout         int
+}
+
+const (
+	// TLSClientAuthUserCN uses the common name of the client certificate as AuthUser
+	TLSClientAuthUserCN = "cn"
+
+	// TLSClientAuthUserSAN uses the first subject alternative name of the client certificate as AuthUser
+	TLSClientAuthUserSAN = "san"
+)
+
 type configFiles []string
 
 // String returns the config files list as string.
@@ -70,20 +114,35 @@ func (c *configFiles) Set(value string) (err error) {
 type Config struct {
 	Listen                     []string
 	Nodes                      []string
+	NodeFailoverThreshold      int
 	TLSCertificate             string
 	TLSKey                     string
 	TLSClientPems              []string
+	TLSClientAuthUser          string
+	TLSListener                []TLSListener
+	ListenerOptions            []ListenerOptions
+	HTTPAuthToken              string
+	HTTPAuthBasic              []string
+	HTTPAuthUser               bool
 	Updateinterval             int64
 	FullUpdateInterval         int64
 	Connections                []Connection
 	LogFile                    string
 	LogLevel                   string
+	LogJSON                    bool
 	LogSlowQueryThreshold      int
 	LogHugeQueryThreshold      int
+	SlowQueryLogSize           int
+	SlowQueryMaskHeaders       []string
 	LogQueryStats              bool
 	ConnectTimeout             int
 	NetTimeout                 int
 	ListenTimeout              int
+	ShutdownDrainTimeout       int
+	ClientIdleTimeout          int
+	MaxClientConnections       int
+	MaxClientConnectionsPerIP  int
+	ClientQueryRateLimit       int
 	SaveTempRequests           bool
 	ListenPrometheus           string
 	SkipSSLCheck               int
@@ -91,6 +150,7 @@ type Config struct {
 	IdleInterval               int64
 	StaleBackendTimeout        int
 	BackendKeepAlive           bool
+	ClearErrorHistoryOnRecover bool
 	ServiceAuthorization       string
 	GroupAuthorization         string
 	SyncIsExecuting            bool
@@ -101,6 +161,39 @@ type Config struct {
 	TLSMinVersion              string
 	MaxParallelPeerConnections int
 	MaxQueryFilter             int
+	MaxQueryColumns            int
+	MaxRequestSize             int
+	MaxRequestHeaders          int
+	MaxParallelResponseWorkers int
+	MaxParallelScanWorkers     int
+	ParallelScanMinRows        int
+	CancelCheckLatency         int
+	ResponseSpillThreshold     int
+	ResponseSpillDir           string
+	MaxQueryMemory             int
+	MaxStaleAge                int
+	MaxParallelQueries         int
+	MaxConcurrentQueries       int
+	MaxQueuedQueries           int
+	QueryQueueTimeout          int
+	HostStateOrder             []int
+	ServiceStateOrder          []int
+	StateOrderHardSoft         bool
+	StateOrderHandled          bool
+	PassThroughExactTotal      bool
+	PassThroughTimeout         int
+	PassThroughTimeFilter      string
+	PassThroughLookback        int
+	PassThroughDedup           bool
+	PassThroughDedupColumns    []string
+	PassThroughDedupMaxEntries int
+	DefaultWaitTimeout         int
+	MaxWaitTimeout             int
+	CommandRouting             bool
+	CommandQueueSize           int
+	CommandRateLimit           int
+	CommandRetryTimeout        int
+	CommandRoutingMultiple     string
 }
 
 // NewConfig reads all config files.
@@ -112,9 +205,12 @@ func NewConfig(files []string) *Config {
 		LogLevel:                   "Info",
 		LogSlowQueryThreshold:      5,
 		LogHugeQueryThreshold:      100,
+		SlowQueryLogSize:           DefaultSlowQueryLogSize,
 		ConnectTimeout:             30,
 		NetTimeout:                 120,
 		ListenTimeout:              60,
+		NodeFailoverThreshold:      DefaultNodeFailoverThreshold,
+		ShutdownDrainTimeout:       DefaultShutdownDrainTimeout,
 		SaveTempRequests:           true,
 		IdleTimeout:                120,
 		IdleInterval:               1800,
@@ -130,11 +226,35 @@ func NewConfig(files []string) *Config {
 		TLSMinVersion:              "tls1.1",
 		MaxParallelPeerConnections: 3,
 		MaxQueryFilter:             DefaultMaxQueryFilter,
+		MaxQueryColumns:            DefaultMaxQueryColumns,
+		MaxRequestSize:             DefaultMaxRequestSize,
+		MaxRequestHeaders:          DefaultMaxRequestHeaders,
+		MaxParallelResponseWorkers: runtime.NumCPU() * DefaultResponseWorkersPerCPU,
+		MaxParallelScanWorkers:     runtime.NumCPU(),
+		ParallelScanMinRows:        DefaultParallelScanMinRows,
+		CancelCheckLatency:         DefaultCancelCheckLatency,
+		ResponseSpillThreshold:     DefaultResponseSpillThreshold,
+		MaxQueryMemory:             DefaultMaxQueryMemory,
+		MaxQueuedQueries:           DefaultMaxQueuedQueries,
+		QueryQueueTimeout:          DefaultQueryQueueTimeout,
+		HostStateOrder:             []int{0, 2, 1},
+		ServiceStateOrder:          []int{0, 1, 4, 3},
+		PassThroughTimeFilter:      TimeFilterPolicyNone,
+		PassThroughLookback:        DefaultPassThroughLookback,
+		PassThroughDedupColumns:    []string{"time", "class", "host_name", "service_description", "message"},
+		PassThroughDedupMaxEntries: DefaultPassThroughDedupMaxEntries,
+		DefaultWaitTimeout:         WaitTimeoutDefault,
+		MaxWaitTimeout:             WaitTimeoutMax,
+		CommandQueueSize:           DefaultCommandQueueSize,
+		CommandRetryTimeout:        DefaultCommandRetryTimeout,
+		CommandRoutingMultiple:     CommandRoutingAll,
 	}
 
 	// combine listeners from all files
 	allListeners := make([]string, 0)
 	allConnections := make([]Connection, 0)
+	allTLSListeners := make([]TLSListener, 0)
+	allListenerOptions := make([]ListenerOptions, 0)
 	for _, pattern := range files {
 		configFiles, errGlob := filepath.Glob(pattern)
 		if errGlob != nil {
@@ -158,10 +278,16 @@ func NewConfig(files []string) *Config {
 			conf.Listen = []string{}
 			allConnections = append(allConnections, conf.Connections...)
 			conf.Connections = []Connection{}
+			allTLSListeners = append(allTLSListeners, conf.TLSListener...)
+			conf.TLSListener = []TLSListener{}
+			allListenerOptions = append(allListenerOptions, conf.ListenerOptions...)
+			conf.ListenerOptions = []ListenerOptions{}
 		}
 	}
 	conf.Listen = allListeners
 	conf.Connections = allConnections
+	conf.TLSListener = allTLSListeners
+	conf.ListenerOptions = allListenerOptions
 
 	for i := range conf.Connections {
 		for j := range conf.Connections[i].Source {
@@ -176,6 +302,11 @@ func NewConfig(files []string) *Config {
 
 func (conf *Config) ValidateConfig() {
 	DefaultConfig := NewConfig([]string{})
+	for _, entry := range conf.HTTPAuthBasic {
+		if !strings.Contains(entry, ":") {
+			log.Warnf("config: HTTPAuthBasic entry invalid, value must be user:password")
+		}
+	}
 	if conf.NetTimeout <= 0 {
 		log.Warnf("config: NetTimeout invalid, value must be greater than 0")
 		conf.NetTimeout = DefaultConfig.NetTimeout
@@ -216,6 +347,10 @@ func (conf *Config) ValidateConfig() {
 		log.Warnf("config: LogHugeQueryThreshold invalid, value must be greater than 0")
 		conf.LogHugeQueryThreshold = DefaultConfig.LogHugeQueryThreshold
 	}
+	if conf.SlowQueryLogSize < 0 {
+		log.Warnf("config: SlowQueryLogSize invalid, value must be greater or equal 0")
+		conf.SlowQueryLogSize = DefaultConfig.SlowQueryLogSize
+	}
 	if conf.CompressionMinimumSize <= 0 {
 		log.Warnf("config: CompressionMinimumSize invalid, value must be greater than 0")
 		conf.CompressionMinimumSize = DefaultConfig.CompressionMinimumSize
@@ -228,10 +363,303 @@ func (conf *Config) ValidateConfig() {
 		log.Warnf("config: UpdateOffset invalid, value must be greater than 0")
 		conf.UpdateOffset = 3
 	}
+	if conf.MaxStaleAge < 0 {
+		log.Warnf("config: MaxStaleAge invalid, value must be greater or equal 0")
+		conf.MaxStaleAge = 0
+	}
+	if conf.MaxParallelQueries < 0 {
+		log.Warnf("config: MaxParallelQueries invalid, value must be greater or equal 0")
+		conf.MaxParallelQueries = 0
+	}
+	if conf.PassThroughTimeout < 0 {
+		log.Warnf("config: PassThroughTimeout invalid, value must be greater or equal 0")
+		conf.PassThroughTimeout = 0
+	}
+	switch strings.ToLower(conf.PassThroughTimeFilter) {
+	case TimeFilterPolicyNone, TimeFilterPolicyReject, TimeFilterPolicyLookback:
+		conf.PassThroughTimeFilter = strings.ToLower(conf.PassThroughTimeFilter)
+	default:
+		log.Warnf("config: PassThroughTimeFilter invalid, must be one of: %s, %s, %s", TimeFilterPolicyNone, TimeFilterPolicyReject, TimeFilterPolicyLookback)
+		conf.PassThroughTimeFilter = TimeFilterPolicyNone
+	}
+	if conf.PassThroughLookback <= 0 {
+		log.Warnf("config: PassThroughLookback invalid, value must be greater than 0")
+		conf.PassThroughLookback = DefaultPassThroughLookback
+	}
+	if conf.PassThroughDedupMaxEntries <= 0 {
+		log.Warnf("config: PassThroughDedupMaxEntries invalid, value must be greater than 0")
+		conf.PassThroughDedupMaxEntries = DefaultPassThroughDedupMaxEntries
+	}
+	if conf.DefaultWaitTimeout <= 0 {
+		log.Warnf("config: DefaultWaitTimeout invalid, value must be greater than 0")
+		conf.DefaultWaitTimeout = WaitTimeoutDefault
+	}
+	if conf.MaxWaitTimeout <= 0 {
+		log.Warnf("config: MaxWaitTimeout invalid, value must be greater than 0")
+		conf.MaxWaitTimeout = WaitTimeoutMax
+	}
+	if conf.DefaultWaitTimeout > conf.MaxWaitTimeout {
+		log.Warnf("config: DefaultWaitTimeout invalid, value must not exceed MaxWaitTimeout")
+		conf.DefaultWaitTimeout = conf.MaxWaitTimeout
+	}
+	switch strings.ToLower(conf.CommandRoutingMultiple) {
+	case CommandRoutingAll, CommandRoutingFirst:
+		conf.CommandRoutingMultiple = strings.ToLower(conf.CommandRoutingMultiple)
+	default:
+		log.Warnf("config: CommandRoutingMultiple invalid, must be one of: %s, %s", CommandRoutingAll, CommandRoutingFirst)
+		conf.CommandRoutingMultiple = CommandRoutingAll
+	}
+	if conf.CommandQueueSize <= 0 {
+		log.Warnf("config: CommandQueueSize invalid, value must be greater than 0")
+		conf.CommandQueueSize = DefaultCommandQueueSize
+	}
+	if conf.CommandRateLimit < 0 {
+		log.Warnf("config: CommandRateLimit invalid, value must be greater or equal 0")
+		conf.CommandRateLimit = 0
+	}
+	if conf.MaxQueryColumns < 0 {
+		log.Warnf("config: MaxQueryColumns invalid, value must be greater or equal 0")
+		conf.MaxQueryColumns = DefaultMaxQueryColumns
+	}
+	if conf.MaxRequestSize < 0 {
+		log.Warnf("config: MaxRequestSize invalid, value must be greater or equal 0")
+		conf.MaxRequestSize = DefaultMaxRequestSize
+	}
+	if conf.MaxRequestHeaders < 0 {
+		log.Warnf("config: MaxRequestHeaders invalid, value must be greater or equal 0")
+		conf.MaxRequestHeaders = DefaultMaxRequestHeaders
+	}
+	if conf.NodeFailoverThreshold <= 0 {
+		log.Warnf("config: NodeFailoverThreshold invalid, value must be greater than 0")
+		conf.NodeFailoverThreshold = DefaultNodeFailoverThreshold
+	}
+	if conf.ClientIdleTimeout < 0 {
+		log.Warnf("config: ClientIdleTimeout invalid, value must be greater or equal 0")
+		conf.ClientIdleTimeout = 0
+	}
+	if conf.ShutdownDrainTimeout < 0 {
+		log.Warnf("config: ShutdownDrainTimeout invalid, value must be greater or equal 0")
+		conf.ShutdownDrainTimeout = DefaultShutdownDrainTimeout
+	}
+	if conf.MaxClientConnections < 0 {
+		log.Warnf("config: MaxClientConnections invalid, value must be greater or equal 0")
+		conf.MaxClientConnections = 0
+	}
+	if conf.MaxClientConnectionsPerIP < 0 {
+		log.Warnf("config: MaxClientConnectionsPerIP invalid, value must be greater or equal 0")
+		conf.MaxClientConnectionsPerIP = 0
+	}
+	if conf.ClientQueryRateLimit < 0 {
+		log.Warnf("config: ClientQueryRateLimit invalid, value must be greater or equal 0")
+		conf.ClientQueryRateLimit = 0
+	}
+	if conf.CommandRetryTimeout < 0 {
+		log.Warnf("config: CommandRetryTimeout invalid, value must be greater or equal 0")
+		conf.CommandRetryTimeout = DefaultCommandRetryTimeout
+	}
+	if len(conf.HostStateOrder) != 3 {
+		log.Warnf("config: HostStateOrder invalid, must contain exactly 3 values (up, down, unreachable)")
+		conf.HostStateOrder = DefaultConfig.HostStateOrder
+	}
+	if len(conf.ServiceStateOrder) != 4 {
+		log.Warnf("config: ServiceStateOrder invalid, must contain exactly 4 values (ok, warning, critical, unknown)")
+		conf.ServiceStateOrder = DefaultConfig.ServiceStateOrder
+	}
+	if conf.MaxConcurrentQueries < 0 {
+		log.Warnf("config: MaxConcurrentQueries invalid, value must be greater or equal 0")
+		conf.MaxConcurrentQueries = 0
+	}
+	if conf.MaxQueuedQueries < 0 {
+		log.Warnf("config: MaxQueuedQueries invalid, value must be greater or equal 0")
+		conf.MaxQueuedQueries = DefaultMaxQueuedQueries
+	}
+	if conf.QueryQueueTimeout < 0 {
+		log.Warnf("config: QueryQueueTimeout invalid, value must be greater or equal 0")
+		conf.QueryQueueTimeout = DefaultQueryQueueTimeout
+	}
+	if conf.MaxParallelResponseWorkers < 0 {
+		log.Warnf("config: MaxParallelResponseWorkers invalid, value must be greater or equal 0")
+		conf.MaxParallelResponseWorkers = DefaultConfig.MaxParallelResponseWorkers
+	}
+	if conf.MaxParallelScanWorkers < 0 {
+		log.Warnf("config: MaxParallelScanWorkers invalid, value must be greater or equal 0")
+		conf.MaxParallelScanWorkers = DefaultConfig.MaxParallelScanWorkers
+	}
+	if conf.ParallelScanMinRows < 0 {
+		log.Warnf("config: ParallelScanMinRows invalid, value must be greater or equal 0")
+		conf.ParallelScanMinRows = DefaultConfig.ParallelScanMinRows
+	}
+	if conf.CancelCheckLatency < 0 {
+		log.Warnf("config: CancelCheckLatency invalid, value must be greater or equal 0")
+		conf.CancelCheckLatency = DefaultConfig.CancelCheckLatency
+	}
+	if conf.ResponseSpillThreshold < 0 {
+		log.Warnf("config: ResponseSpillThreshold invalid, value must be greater or equal 0")
+		conf.ResponseSpillThreshold = DefaultConfig.ResponseSpillThreshold
+	}
+	if conf.MaxQueryMemory < 0 {
+		log.Warnf("config: MaxQueryMemory invalid, value must be greater or equal 0")
+		conf.MaxQueryMemory = DefaultConfig.MaxQueryMemory
+	}
 	_, err := parseTLSMinVersion(conf.TLSMinVersion)
 	if err != nil {
 		log.Warnf("%s", err)
 	}
+	if !validTLSClientAuthUser(conf.TLSClientAuthUser) {
+		log.Warnf("config: TLSClientAuthUser invalid, value must be one of: %s, %s", TLSClientAuthUserCN, TLSClientAuthUserSAN)
+		conf.TLSClientAuthUser = ""
+	}
+	for i := range conf.TLSListener {
+		listener := &conf.TLSListener[i]
+		if !slices.Contains(conf.Listen, listener.Listen) {
+			log.Warnf("config: TLSListener %s invalid, listen address must match one of the Listen entries", listener.Listen)
+		}
+		if _, err := parseTLSMinVersion(listener.TLSMinVersion); err != nil {
+			log.Warnf("config: TLSListener %s: %s", listener.Listen, err)
+			listener.TLSMinVersion = ""
+		}
+		if !validTLSClientAuthUser(listener.TLSClientAuthUser) {
+			log.Warnf("config: TLSListener %s: TLSClientAuthUser invalid, value must be one of: %s, %s", listener.Listen, TLSClientAuthUserCN, TLSClientAuthUserSAN)
+			listener.TLSClientAuthUser = ""
+		}
+	}
+	for i := range conf.ListenerOptions {
+		conf.ListenerOptions[i].validate(conf.Listen)
+	}
+}
+
+// validate checks the listener options and resets invalid values.
+func (opts *ListenerOptions) validate(listen []string) {
+	if !slices.Contains(listen, opts.Listen) {
+		log.Warnf("config: ListenerOptions %s invalid, listen address must match one of the Listen entries", opts.Listen)
+	}
+	if strings.HasPrefix(opts.Listen, "http://") || strings.HasPrefix(opts.Listen, "https://") {
+		log.Warnf("config: ListenerOptions %s are ignored, http listeners do not support listener options", opts.Listen)
+	}
+	if opts.OutputFormat != "" {
+		var format OutputFormat
+		if err := parseOutputFormat(&format, []byte(opts.OutputFormat)); err != nil {
+			log.Warnf("config: ListenerOptions %s: OutputFormat invalid: %s", opts.Listen, err)
+			opts.OutputFormat = ""
+		}
+	}
+	for i, name := range opts.AllowedTables {
+		// invalid names are kept, so they never match instead of allowing all tables
+		table, err := NewTableName(name)
+		if err != nil {
+			log.Warnf("config: ListenerOptions %s: AllowedTables invalid: %s", opts.Listen, err)
+			continue
+		}
+		opts.AllowedTables[i] = table.String()
+	}
+	if opts.MaxClientConnections < 0 {
+		log.Warnf("config: ListenerOptions %s: MaxClientConnections invalid, value must be greater or equal 0", opts.Listen)
+		opts.MaxClientConnections = 0
+	}
+	if opts.MaxClientConnectionsPerIP < 0 {
+		log.Warnf("config: ListenerOptions %s: MaxClientConnectionsPerIP invalid, value must be greater or equal 0", opts.Listen)
+		opts.MaxClientConnectionsPerIP = 0
+	}
+	if opts.ClientQueryRateLimit < 0 {
+		log.Warnf("config: ListenerOptions %s: ClientQueryRateLimit invalid, value must be greater or equal 0", opts.Listen)
+		opts.ClientQueryRateLimit = 0
+	}
+	if opts.ClientIdleTimeout < 0 {
+		log.Warnf("config: ListenerOptions %s: ClientIdleTimeout invalid, value must be greater or equal 0", opts.Listen)
+		opts.ClientIdleTimeout = 0
+	}
+}
+
+func validTLSClientAuthUser(value string) bool {
+	switch value {
+	case "", TLSClientAuthUserCN, TLSClientAuthUserSAN:
+		return true
+	}
+	return false
+}
+
+// TLSListenerSettings returns the tls settings for the given listen address.
+// Settings not set for the listener are taken from the global tls settings.
+func (conf *Config) TLSListenerSettings(listen string) TLSListener {
+	settings := TLSListener{
+		Listen:            listen,
+		TLSCertificate:    conf.TLSCertificate,
+		TLSKey:            conf.TLSKey,
+		TLSClientPems:     conf.TLSClientPems,
+		TLSMinVersion:     conf.TLSMinVersion,
+		TLSClientAuthUser: conf.TLSClientAuthUser,
+	}
+	for i := range conf.TLSListener {
+		listener := &conf.TLSListener[i]
+		if listener.Listen != listen {
+			continue
+		}
+		if listener.TLSCertificate != "" {
+			settings.TLSCertificate = listener.TLSCertificate
+			settings.TLSKey = listener.TLSKey
+		}
+		if len(listener.TLSClientPems) > 0 {
+			settings.TLSClientPems = listener.TLSClientPems
+		}
+		if listener.TLSMinVersion != "" {
+			settings.TLSMinVersion = listener.TLSMinVersion
+		}
+		if listener.TLSClientAuthUser != "" {
+			settings.TLSClientAuthUser = listener.TLSClientAuthUser
+		}
+	}
+	return settings
+}
+
+// ListenerSettings returns the options for the given listen address.
+// Limits not set for the listener are taken from the global settings.
+func (conf *Config) ListenerSettings(listen string) *ListenerOptions {
+	settings := &ListenerOptions{
+		Listen:                    listen,
+		MaxClientConnections:      conf.MaxClientConnections,
+		MaxClientConnectionsPerIP: conf.MaxClientConnectionsPerIP,
+		ClientQueryRateLimit:      conf.ClientQueryRateLimit,
+		ClientIdleTimeout:         conf.ClientIdleTimeout,
+	}
+	for i := range conf.ListenerOptions {
+		opts := &conf.ListenerOptions[i]
+		if opts.Listen != listen {
+			continue
+		}
+		settings.OutputFormat = opts.OutputFormat
+		settings.AuthUser = opts.AuthUser
+		settings.AllowedTables = opts.AllowedTables
+		settings.DenyCommands = opts.DenyCommands
+		if opts.MaxClientConnections > 0 {
+			settings.MaxClientConnections = opts.MaxClientConnections
+		}
+		if opts.MaxClientConnectionsPerIP > 0 {
+			settings.MaxClientConnectionsPerIP = opts.MaxClientConnectionsPerIP
+		}
+		if opts.ClientQueryRateLimit > 0 {
+			settings.ClientQueryRateLimit = opts.ClientQueryRateLimit
+		}
+		if opts.ClientIdleTimeout > 0 {
+			settings.ClientIdleTimeout = opts.ClientIdleTimeout
+		}
+	}
+	return settings
+}
+
+// GetWaitTimeout returns the effective timeout for the requested WaitTimeout in milliseconds.
+// The default is used if nothing is requested and larger values are capped by MaxWaitTimeout.
+func (conf *Config) GetWaitTimeout(requested int) time.Duration {
+	timeout := requested
+	if timeout <= 0 {
+		timeout = conf.DefaultWaitTimeout
+	}
+	if conf.MaxWaitTimeout > 0 && timeout > conf.MaxWaitTimeout {
+		timeout = conf.MaxWaitTimeout
+	}
+	if timeout <= 0 {
+		timeout = WaitTimeoutDefault
+	}
+	return time.Duration(timeout) * time.Millisecond
 }
 
 func (conf *Config) SetServiceAuthorization() {
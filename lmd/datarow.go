@@ -1,12 +1,14 @@
 package main
 
 import (
-	"crypto/sha256"
 	"encoding/json"
 	"fmt"
+	"slices"
 	"strconv"
 	"strings"
 	"sync/atomic"
+	"time"
+	"unsafe"
 
 	jsoniter "github.com/json-iterator/go"
 )
@@ -15,29 +17,57 @@ const ListSepChar1 = "\x00"
 
 // DataRow represents a single entry in a DataTable
 type DataRow struct {
-	noCopy                noCopy                 // we don't want to make copies, use references
-	DataStore             *DataStore             // reference to the datastore itself
-	Refs                  map[TableName]*DataRow // contains references to other objects, ex.: hosts from the services table
-	LastUpdate            float64                // timestamp when this row has been updated
-	dataString            []string               // stores string data
-	dataInt               []int                  // stores integers
-	dataInt64             []int64                // stores large integers
-	dataFloat             []float64              // stores floats
-	dataStringList        [][]string             // stores stringlists
-	dataInt64List         [][]int64              // stores lists of integers
-	dataServiceMemberList [][]ServiceMember      // stores list of servicemembers
-	dataStringLarge       []StringContainer      // stores large strings
+	noCopy    noCopy                    // we don't want to make copies, use references
+	DataStore *DataStore                // reference to the datastore itself
+	Refs      map[TableName]*DataRow    // contains references to other objects, ex.: hosts from the services table
+	values    atomic.Pointer[rowValues] // current values, replaced as a whole on updates
+}
+
+// rowValues contains the values of a DataRow.
+// Published values are never modified, updates store a changed copy instead. So queries
+// can read rows without locking and old values are released once the last reader is done.
+type rowValues struct {
+	LastUpdate            float64           // timestamp when this row has been updated
+	dataString            []string          // stores string data
+	dataInt               []int             // stores integers
+	dataInt64             []int64           // stores large integers
+	dataFloat             []float64         // stores floats
+	dataStringList        [][]string        // stores stringlists
+	dataInt64List         [][]int64         // stores lists of integers
+	dataServiceMemberList [][]ServiceMember // stores list of servicemembers
+	dataStringLarge       []StringContainer // stores large strings
 	dataInterfaceList     [][]interface{}
 }
 
+// cloneNumbers returns a copy which can be changed, string values are shared with the original.
+func (v *rowValues) cloneNumbers() *rowValues {
+	clone := *v
+	clone.dataInt = slices.Clone(v.dataInt)
+	clone.dataInt64 = slices.Clone(v.dataInt64)
+	clone.dataFloat = slices.Clone(v.dataFloat)
+	clone.dataInt64List = slices.Clone(v.dataInt64List)
+	clone.dataInterfaceList = slices.Clone(v.dataInterfaceList)
+	return &clone
+}
+
+// clone returns a copy which can be changed.
+func (v *rowValues) clone() *rowValues {
+	clone := v.cloneNumbers()
+	clone.dataString = slices.Clone(v.dataString)
+	clone.dataStringList = slices.Clone(v.dataStringList)
+	clone.dataServiceMemberList = slices.Clone(v.dataServiceMemberList)
+	clone.dataStringLarge = slices.Clone(v.dataStringLarge)
+	return clone
+}
+
 // NewDataRow creates a new DataRow
 func NewDataRow(store *DataStore, raw []interface{}, columns ColumnList, timestamp float64, setReferences bool) (d *DataRow, err error) {
 	d = &DataRow{
-		LastUpdate: timestamp,
-		DataStore:  store,
+		DataStore: store,
 	}
 	if raw == nil {
 		// virtual tables without data have no references or ids
+		d.values.Store(&rowValues{LastUpdate: timestamp})
 		return
 	}
 
@@ -50,14 +80,44 @@ func NewDataRow(store *DataStore, raw []interface{}, columns ColumnList, timesta
 		return
 	}
 
-	d.setLowerCaseCache()
-
 	if setReferences {
 		err = d.SetReferences()
 	}
 	return
 }
 
+// vals returns the current values of this row, they must not be modified.
+func (d *DataRow) vals() *rowValues {
+	return d.values.Load()
+}
+
+// RowSnapshotBatch sets the number of row snapshots allocated at once.
+const RowSnapshotBatch = 256
+
+// rowSnapshots pins the values of rows while scanning a store, so filter, sort and output of a query
+// all use the same values, even if a row is updated meanwhile.
+type rowSnapshots struct {
+	views []DataRow
+}
+
+// pin returns a view of the row with its current values. The view is reused by the next call to pin
+// unless it has been kept.
+func (s *rowSnapshots) pin(row *DataRow) *DataRow {
+	if len(s.views) == cap(s.views) {
+		s.views = make([]DataRow, 0, RowSnapshotBatch)
+	}
+	view := &s.views[:len(s.views)+1][len(s.views)]
+	view.DataStore = row.DataStore
+	view.Refs = row.Refs
+	view.values.Store(row.values.Load())
+	return view
+}
+
+// keep keeps the last pinned view, ex.: because it is part of the result.
+func (s *rowSnapshots) keep() {
+	s.views = s.views[:len(s.views)+1]
+}
+
 // GetID calculates and returns the ID value (nul byte concatenated primary key values)
 func (d *DataRow) GetID() string {
 	if len(d.DataStore.Table.PrimaryKey) == 0 {
@@ -100,22 +160,31 @@ func (d *DataRow) GetID2() (string, string) {
 
 // SetData creates initial data
 func (d *DataRow) SetData(raw []interface{}, columns ColumnList, timestamp float64) error {
-	d.dataString = make([]string, d.DataStore.Table.DataSizes[StringCol])
-	d.dataStringList = make([][]string, d.DataStore.Table.DataSizes[StringListCol])
-	d.dataInt = make([]int, d.DataStore.Table.DataSizes[IntCol])
-	d.dataInt64 = make([]int64, d.DataStore.Table.DataSizes[Int64Col])
-	d.dataInt64List = make([][]int64, d.DataStore.Table.DataSizes[Int64ListCol])
-	d.dataFloat = make([]float64, d.DataStore.Table.DataSizes[FloatCol])
-	d.dataServiceMemberList = make([][]ServiceMember, d.DataStore.Table.DataSizes[ServiceMemberListCol])
-	d.dataInterfaceList = make([][]interface{}, d.DataStore.Table.DataSizes[InterfaceListCol])
-	d.dataStringLarge = make([]StringContainer, d.DataStore.Table.DataSizes[StringLargeCol])
-	return d.UpdateValues(0, raw, columns, timestamp)
+	sizes := d.DataStore.Table.DataSizes
+	values := &rowValues{
+		dataString:            make([]string, sizes[StringCol]),
+		dataStringList:        make([][]string, sizes[StringListCol]),
+		dataInt:               make([]int, sizes[IntCol]),
+		dataInt64:             make([]int64, sizes[Int64Col]),
+		dataInt64List:         make([][]int64, sizes[Int64ListCol]),
+		dataFloat:             make([]float64, sizes[FloatCol]),
+		dataServiceMemberList: make([][]ServiceMember, sizes[ServiceMemberListCol]),
+		dataInterfaceList:     make([][]interface{}, sizes[InterfaceListCol]),
+		dataStringLarge:       make([]StringContainer, sizes[StringLargeCol]),
+	}
+	err := d.setValues(values, 0, raw, columns, timestamp)
+	if err != nil {
+		return err
+	}
+	d.setLowerCaseCache(values)
+	d.values.Store(values)
+	return nil
 }
 
 // setLowerCaseCache sets lowercase columns
-func (d *DataRow) setLowerCaseCache() {
+func (d *DataRow) setLowerCaseCache(values *rowValues) {
 	for from, to := range d.DataStore.LowerCaseColumns {
-		d.dataString[to] = strings.ToLower(d.dataString[from])
+		values.dataString[to] = strings.ToLower(values.dataString[from])
 	}
 }
 
@@ -125,8 +194,8 @@ func (d *DataRow) SetReferences() (err error) {
 	for i := range store.Table.RefTables {
 		ref := &store.Table.RefTables[i]
 		tableName := ref.Table.Name
-		refsByName := store.DataSet.tables[tableName].Index
-		refsByName2 := store.DataSet.tables[tableName].Index2
+		refsByName := store.DataSet.table(tableName).Index
+		refsByName2 := store.DataSet.table(tableName).Index2
 
 		switch len(ref.Columns) {
 		case 1:
@@ -152,32 +221,35 @@ func (d *DataRow) GetColumn(name string) *Column {
 
 // GetString returns the string value for given column
 func (d *DataRow) GetString(col *Column) string {
+	if col.Optional != NoFlags && !d.DataStore.Peer.HasFlag(col.Optional) {
+		return interface2stringNoDedup(col.GetEmptyValue())
+	}
 	switch col.StorageType {
 	case LocalStore:
 		switch col.DataType {
 		case StringCol:
-			return d.dataString[col.Index]
+			return d.vals().dataString[col.Index]
 		case IntCol:
-			val := fmt.Sprintf("%d", d.dataInt[col.Index])
+			val := fmt.Sprintf("%d", d.vals().dataInt[col.Index])
 			return val
 		case Int64Col:
-			val := strconv.FormatInt(d.dataInt64[col.Index], 10)
+			val := strconv.FormatInt(d.vals().dataInt64[col.Index], 10)
 			return val
 		case FloatCol:
-			val := fmt.Sprintf("%v", d.dataFloat[col.Index])
+			val := fmt.Sprintf("%v", d.vals().dataFloat[col.Index])
 			return val
 		case StringLargeCol:
-			return d.dataStringLarge[col.Index].String()
+			return d.vals().dataStringLarge[col.Index].String()
 		case StringListCol:
-			return joinStringlist(d.dataStringList[col.Index], ListSepChar1)
+			return joinStringlist(d.vals().dataStringList[col.Index], ListSepChar1)
 		case ServiceMemberListCol:
-			val := fmt.Sprintf("%v", d.dataServiceMemberList[col.Index])
+			val := fmt.Sprintf("%v", d.vals().dataServiceMemberList[col.Index])
 			return val
 		case InterfaceListCol:
-			val := fmt.Sprintf("%v", d.dataInterfaceList[col.Index])
+			val := fmt.Sprintf("%v", d.vals().dataInterfaceList[col.Index])
 			return val
 		case Int64ListCol:
-			val := strings.Join(strings.Fields(fmt.Sprint(d.dataInt64List[col.Index])), ListSepChar1)
+			val := strings.Join(strings.Fields(fmt.Sprint(d.vals().dataInt64List[col.Index])), ListSepChar1)
 			return val
 		default:
 			log.Panicf("unsupported type: %s", col.DataType)
@@ -204,7 +276,7 @@ func (d *DataRow) GetStringList(col *Column) []string {
 	switch col.StorageType {
 	case LocalStore:
 		if col.DataType == StringListCol {
-			return d.dataStringList[col.Index]
+			return d.vals().dataStringList[col.Index]
 		}
 		log.Panicf("unsupported type: %s", col.DataType)
 	case RefStore:
@@ -226,17 +298,21 @@ func (d *DataRow) GetStringListByName(name string) []string {
 
 // GetFloat returns the float64 value for given column
 func (d *DataRow) GetFloat(col *Column) float64 {
+	if col.Optional != NoFlags && !d.DataStore.Peer.HasFlag(col.Optional) {
+		return interface2float64(col.GetEmptyValue())
+	}
 	switch col.StorageType {
 	case LocalStore:
 		switch col.DataType {
 		case FloatCol:
-			return d.dataFloat[col.Index]
+			return d.vals().dataFloat[col.Index]
 		case IntCol:
-			return float64(d.dataInt[col.Index])
+			return float64(d.vals().dataInt[col.Index])
 		case Int64Col:
-			return float64(d.dataInt64[col.Index])
+			return float64(d.vals().dataInt64[col.Index])
 		default:
-			log.Panicf("unsupported type: %s", col.DataType)
+			// non numeric columns count as zero, ex.: Stats: sum name
+			return 0
 		}
 	case RefStore:
 		ref := d.Refs[col.RefColTableName]
@@ -256,9 +332,9 @@ func (d *DataRow) GetInt(col *Column) int {
 	case LocalStore:
 		switch col.DataType {
 		case IntCol:
-			return d.dataInt[col.Index]
+			return d.vals().dataInt[col.Index]
 		case FloatCol:
-			return int(d.dataFloat[col.Index])
+			return int(d.vals().dataFloat[col.Index])
 		default:
 			log.Panicf("unsupported type: %s", col.DataType)
 		}
@@ -280,11 +356,11 @@ func (d *DataRow) GetInt64(col *Column) int64 {
 	case LocalStore:
 		switch col.DataType {
 		case Int64Col:
-			return d.dataInt64[col.Index]
+			return d.vals().dataInt64[col.Index]
 		case IntCol:
-			return int64(d.dataInt[col.Index])
+			return int64(d.vals().dataInt[col.Index])
 		case FloatCol:
-			return int64(d.dataFloat[col.Index])
+			return int64(d.vals().dataFloat[col.Index])
 		default:
 			log.Panicf("unsupported type: %s", col.DataType)
 		}
@@ -315,7 +391,7 @@ func (d *DataRow) GetInt64List(col *Column) []int64 {
 	switch col.StorageType {
 	case LocalStore:
 		if col.DataType == Int64ListCol {
-			return d.dataInt64List[col.Index]
+			return d.vals().dataInt64List[col.Index]
 		}
 		log.Panicf("unsupported type: %s", col.DataType)
 	case RefStore:
@@ -357,7 +433,7 @@ func (d *DataRow) GetServiceMemberList(col *Column) []ServiceMember {
 	switch col.StorageType {
 	case LocalStore:
 		if col.DataType == ServiceMemberListCol {
-			return d.dataServiceMemberList[col.Index]
+			return d.vals().dataServiceMemberList[col.Index]
 		}
 		log.Panicf("unsupported type: %s", col.DataType)
 	case RefStore:
@@ -382,7 +458,7 @@ func (d *DataRow) GetInterfaceList(col *Column) []interface{} {
 	switch col.StorageType {
 	case LocalStore:
 		if col.DataType == InterfaceListCol {
-			return d.dataInterfaceList[col.Index]
+			return d.vals().dataInterfaceList[col.Index]
 		}
 		log.Panicf("unsupported type: %s", col.DataType)
 	case RefStore:
@@ -406,23 +482,23 @@ func (d *DataRow) GetValueByColumn(col *Column) interface{} {
 	case LocalStore:
 		switch col.DataType {
 		case StringCol:
-			return d.dataString[col.Index]
+			return d.vals().dataString[col.Index]
 		case StringListCol:
-			return d.dataStringList[col.Index]
+			return d.vals().dataStringList[col.Index]
 		case StringLargeCol:
-			return d.dataStringLarge[col.Index].StringRef()
+			return d.vals().dataStringLarge[col.Index].StringRef()
 		case IntCol:
-			return d.dataInt[col.Index]
+			return d.vals().dataInt[col.Index]
 		case Int64ListCol:
-			return d.dataInt64List[col.Index]
+			return d.vals().dataInt64List[col.Index]
 		case Int64Col:
-			return d.dataInt64[col.Index]
+			return d.vals().dataInt64[col.Index]
 		case FloatCol:
-			return d.dataFloat[col.Index]
+			return d.vals().dataFloat[col.Index]
 		case InterfaceListCol:
-			return d.dataInterfaceList[col.Index]
+			return d.vals().dataInterfaceList[col.Index]
 		case ServiceMemberListCol:
-			return d.dataServiceMemberList[col.Index]
+			return d.vals().dataServiceMemberList[col.Index]
 		default:
 			log.Panicf("unsupported column %s (type %s) in table %s", col.Name, col.DataType.String(), d.DataStore.Table.Name.String())
 		}
@@ -439,7 +515,8 @@ func (d *DataRow) getVirtualRowValue(col *Column) interface{} {
 	var value interface{}
 	if col.VirtualMap.StatusKey > 0 {
 		if d.DataStore.Peer == nil {
-			log.Panicf("requesting column '%s' from table '%s' with peer", col.Name, d.DataStore.Table.Name)
+			// stores built without any backend, ex.: the tables table without peers
+			return cast2Type(nil, col)
 		}
 		p := d.DataStore.Peer
 		ok := false
@@ -473,16 +550,19 @@ func (d *DataRow) getVirtualRowValue(col *Column) interface{} {
 func (d *DataRow) GetCustomVarValue(col *Column, name string) string {
 	if col.StorageType == RefStore {
 		ref := d.Refs[col.RefColTableName]
+		if ref == nil {
+			return ""
+		}
 		return ref.GetCustomVarValue(col.RefCol, name)
 	}
 	namesCol := d.DataStore.GetColumn("custom_variable_names")
-	names := d.dataStringList[namesCol.Index]
+	names := d.vals().dataStringList[namesCol.Index]
 	for i, n := range names {
 		if n != name {
 			continue
 		}
 		valuesCol := d.DataStore.GetColumn("custom_variable_values")
-		values := d.dataStringList[valuesCol.Index]
+		values := d.vals().dataStringList[valuesCol.Index]
 		if i >= len(values) {
 			return ""
 		}
@@ -506,15 +586,36 @@ func VirtualColLastStateChangeOrder(d *DataRow, _ *Column) interface{} {
 	return lastStateChange
 }
 
-// VirtualColStateOrder returns sortable state
+// VirtualColStateOrder returns the state mapped to its severity rank, suitable for sorting
 func VirtualColStateOrder(d *DataRow, _ *Column) interface{} {
-	// return 4 instead of 2, which makes critical come first
-	// this way we can use this column to sort by state
 	state := d.GetIntByName("state")
-	if state == 2 {
-		return 4
+	if d.DataStore.Peer == nil {
+		return state
+	}
+	conf := d.DataStore.Peer.lmd.Config
+
+	// by default critical comes before unknown, unknown before warning and warning before ok
+	ranking := conf.ServiceStateOrder
+	if d.DataStore.Table.Name == TableHosts {
+		ranking = conf.HostStateOrder
+	}
+	if state < 0 || state >= len(ranking) {
+		return state
+	}
+	order := ranking[state]
+	if order == 0 || (!conf.StateOrderHardSoft && !conf.StateOrderHandled) {
+		return order
+	}
+
+	// leave room to rank hard before soft and unhandled before handled problems
+	order *= 4
+	if conf.StateOrderHardSoft && d.GetIntByName("state_type") == 1 {
+		order += 2
+	}
+	if conf.StateOrderHandled && d.GetIntByName("acknowledged") == 0 && d.GetIntByName("scheduled_downtime_depth") == 0 {
+		order++
 	}
-	return state
+	return order
 }
 
 // VirtualColHasLongPluginOutput returns 1 if there is long plugin output, 0 if not
@@ -530,7 +631,7 @@ func VirtualColHasLongPluginOutput(d *DataRow, _ *Column) interface{} {
 func VirtualColServicesWithInfo(d *DataRow, col *Column) interface{} {
 	services := d.GetStringListByName("services")
 	hostName := d.GetStringByName("name")
-	servicesStore := d.DataStore.DataSet.tables[TableServices]
+	servicesStore := d.DataStore.DataSet.table(TableServices)
 	stateCol := servicesStore.Table.GetColumn("state")
 	checkedCol := servicesStore.Table.GetColumn("has_been_checked")
 	outputCol := servicesStore.Table.GetColumn("plugin_output")
@@ -555,7 +656,7 @@ func VirtualColMembersWithState(d *DataRow, _ *Column) interface{} {
 	switch d.DataStore.Table.Name {
 	case TableHostgroups:
 		members := d.GetStringListByName("members")
-		hostsStore := d.DataStore.DataSet.tables[TableHosts]
+		hostsStore := d.DataStore.DataSet.table(TableHosts)
 		stateCol := hostsStore.Table.GetColumn("state")
 		checkedCol := hostsStore.Table.GetColumn("has_been_checked")
 
@@ -572,7 +673,7 @@ func VirtualColMembersWithState(d *DataRow, _ *Column) interface{} {
 	case TableServicegroups:
 		membersCol := d.DataStore.GetColumn("members")
 		members := d.GetServiceMemberList(membersCol)
-		servicesStore := d.DataStore.DataSet.tables[TableServices]
+		servicesStore := d.DataStore.DataSet.table(TableServices)
 		stateCol := servicesStore.Table.GetColumn("state")
 		checkedCol := servicesStore.Table.GetColumn("has_been_checked")
 
@@ -595,7 +696,7 @@ func VirtualColMembersWithState(d *DataRow, _ *Column) interface{} {
 
 // VirtualColCommentsWithInfo returns list of comment IDs with additional information
 func VirtualColCommentsWithInfo(d *DataRow, _ *Column) interface{} {
-	commentsStore := d.DataStore.DataSet.tables[TableComments]
+	commentsStore := d.DataStore.DataSet.table(TableComments)
 	commentsTable := commentsStore.Table
 	authorCol := commentsTable.GetColumn("author")
 	commentCol := commentsTable.GetColumn("comment")
@@ -619,7 +720,7 @@ func VirtualColCommentsWithInfo(d *DataRow, _ *Column) interface{} {
 
 // VirtualColDowntimesWithInfo returns list of downtimes IDs with additional information
 func VirtualColDowntimesWithInfo(d *DataRow, _ *Column) interface{} {
-	downtimesStore := d.DataStore.DataSet.tables[TableDowntimes]
+	downtimesStore := d.DataStore.DataSet.table(TableDowntimes)
 	downtimesTable := downtimesStore.Table
 	authorCol := downtimesTable.GetColumn("author")
 	commentCol := downtimesTable.GetColumn("comment")
@@ -645,8 +746,8 @@ func VirtualColDowntimesWithInfo(d *DataRow, _ *Column) interface{} {
 func VirtualColCustomVariables(d *DataRow, _ *Column) interface{} {
 	namesCol := d.DataStore.GetColumn("custom_variable_names")
 	valuesCol := d.DataStore.GetColumn("custom_variable_values")
-	names := d.dataStringList[namesCol.Index]
-	values := d.dataStringList[valuesCol.Index]
+	names := d.vals().dataStringList[namesCol.Index]
+	values := d.vals().dataStringList[valuesCol.Index]
 	res := make(map[string]string, len(names))
 	for i := range names {
 		res[names[i]] = values[i]
@@ -666,6 +767,87 @@ func VirtualColFlags(d *DataRow, _ *Column) interface{} {
 	return peerflags.List()
 }
 
+// VirtualColLastErrors returns the error history of a peer
+func VirtualColLastErrors(d *DataRow, _ *Column) interface{} {
+	list := d.DataStore.Peer.errorHistory.List()
+	if len(list) == 0 {
+		return emptyInterfaceList
+	}
+	res := make([]interface{}, 0, len(list))
+	for i := range list {
+		res = append(res, []interface{}{list[i].Time, list[i].Message})
+	}
+	return res
+}
+
+// VirtualColLastErrorsHour returns the number of errors during the last hour
+func VirtualColLastErrorsHour(d *DataRow, _ *Column) interface{} {
+	return d.DataStore.Peer.errorHistory.CountSince(time.Now().Unix() - PeerErrorHistoryRecentSeconds)
+}
+
+// VirtualColAvgResponseTime returns the average response time of all backend queries
+func VirtualColAvgResponseTime(d *DataRow, _ *Column) interface{} {
+	p := d.DataStore.Peer
+	var queries int64
+	var duration float64
+	if d.DataStore.PeerLockMode == PeerLockModeFull {
+		queries = p.Status[Queries].(int64)
+		duration = p.Status[QueryDuration].(float64)
+	} else {
+		queries = p.StatusGet(Queries).(int64)
+		duration = p.StatusGet(QueryDuration).(float64)
+	}
+	if queries == 0 {
+		return float64(0)
+	}
+	return duration / float64(queries)
+}
+
+// VirtualColLastUpdateAge returns the seconds since the last successful update
+func VirtualColLastUpdateAge(d *DataRow, _ *Column) interface{} {
+	return d.DataStore.Peer.DataAge()
+}
+
+// VirtualColQueriesInFlight returns the number of currently running on-demand queries
+func VirtualColQueriesInFlight(d *DataRow, _ *Column) interface{} {
+	return d.DataStore.Peer.QueriesInFlight()
+}
+
+// SizeEstimate returns the estimated memory usage of this row in bytes.
+func (d *DataRow) SizeEstimate() (size int64) {
+	const sliceHeader = 24
+	const stringHeader = 16
+	values := d.vals()
+	size = int64(unsafe.Sizeof(*d)) + int64(unsafe.Sizeof(*values))
+	for i := range values.dataString {
+		size += stringHeader + int64(len(values.dataString[i]))
+	}
+	size += int64(len(values.dataInt)) * int64(unsafe.Sizeof(int(0)))
+	size += int64(len(values.dataInt64)+len(values.dataFloat)) * 8
+	for i := range values.dataStringList {
+		size += sliceHeader
+		for j := range values.dataStringList[i] {
+			size += stringHeader + int64(len(values.dataStringList[i][j]))
+		}
+	}
+	for i := range values.dataInt64List {
+		size += sliceHeader + int64(len(values.dataInt64List[i]))*8
+	}
+	for i := range values.dataServiceMemberList {
+		size += sliceHeader
+		for j := range values.dataServiceMemberList[i] {
+			size += 2*stringHeader + int64(len(values.dataServiceMemberList[i][j][0])+len(values.dataServiceMemberList[i][j][1]))
+		}
+	}
+	for i := range values.dataStringLarge {
+		size += stringHeader + sliceHeader + int64(len(values.dataStringLarge[i].StringData)+len(values.dataStringLarge[i].CompressedData))
+	}
+	for i := range values.dataInterfaceList {
+		size += sliceHeader + int64(len(values.dataInterfaceList[i]))*stringHeader
+	}
+	return size
+}
+
 // getVirtualSubLMDValue returns status values for LMDSub backends
 func (d *DataRow) getVirtualSubLMDValue(col *Column) (val interface{}, ok bool) {
 	ok = true
@@ -759,15 +941,26 @@ func (d *DataRow) getStatsKey(res *Response) string {
 	if len(res.Request.RequestColumns) == 0 {
 		return ""
 	}
-	keyValues := []string{}
+	key := strings.Builder{}
 	for i := range res.Request.RequestColumns {
-		keyValues = append(keyValues, d.GetString(res.Request.RequestColumns[i]))
+		appendStatsKey(&key, d.GetString(res.Request.RequestColumns[i]))
 	}
-	return strings.Join(keyValues, ListSepChar1)
+	return key.String()
 }
 
 // UpdateValues updates this datarow with new values
 func (d *DataRow) UpdateValues(dataOffset int, data []interface{}, columns ColumnList, timestamp float64) error {
+	values := d.vals().clone()
+	err := d.setValues(values, dataOffset, data, columns, timestamp)
+	if err != nil {
+		return err
+	}
+	d.values.Store(values)
+	return nil
+}
+
+// setValues sets given data into values which must not be published yet
+func (d *DataRow) setValues(values *rowValues, dataOffset int, data []interface{}, columns ColumnList, timestamp float64) error {
 	if len(columns) != len(data)-dataOffset {
 		return fmt.Errorf("table %s update failed, data size mismatch, expected %d columns and got %d", d.DataStore.Table.Name.String(), len(columns), len(data))
 	}
@@ -779,28 +972,28 @@ func (d *DataRow) UpdateValues(dataOffset int, data []interface{}, columns Colum
 		resIndex := i + dataOffset
 		switch col.DataType {
 		case StringCol:
-			d.dataString[localIndex] = *(interface2string(data[resIndex]))
+			values.dataString[localIndex] = *(interface2string(data[resIndex]))
 		case StringListCol:
 			if col.FetchType == Static {
-				// deduplicate string lists
-				d.dataStringList[localIndex] = d.deduplicateStringlist(interface2stringlist(data[resIndex]))
+				// share identical string lists between all backends
+				values.dataStringList[localIndex] = stringListDedup.Intern(interface2stringlist(data[resIndex]))
 			} else {
-				d.dataStringList[localIndex] = interface2stringlist(data[resIndex])
+				values.dataStringList[localIndex] = interface2stringlist(data[resIndex])
 			}
 		case StringLargeCol:
-			d.dataStringLarge[localIndex] = *interface2stringlarge(data[resIndex])
+			values.dataStringLarge[localIndex] = *interface2stringlarge(data[resIndex])
 		case IntCol:
-			d.dataInt[localIndex] = interface2int(data[resIndex])
+			values.dataInt[localIndex] = interface2int(data[resIndex])
 		case Int64Col:
-			d.dataInt64[localIndex] = interface2int64(data[resIndex])
+			values.dataInt64[localIndex] = interface2int64(data[resIndex])
 		case Int64ListCol:
-			d.dataInt64List[localIndex] = interface2int64list(data[resIndex])
+			values.dataInt64List[localIndex] = interface2int64list(data[resIndex])
 		case FloatCol:
-			d.dataFloat[localIndex] = interface2float64(data[resIndex])
+			values.dataFloat[localIndex] = interface2float64(data[resIndex])
 		case ServiceMemberListCol:
-			d.dataServiceMemberList[localIndex] = interface2servicememberlist(data[resIndex])
+			values.dataServiceMemberList[localIndex] = interface2servicememberlist(data[resIndex])
 		case InterfaceListCol:
-			d.dataInterfaceList[localIndex] = interface2interfacelist(data[resIndex])
+			values.dataInterfaceList[localIndex] = interface2interfacelist(data[resIndex])
 		default:
 			log.Panicf("unsupported column %s (type %d) in table %s", col.Name, col.DataType, d.DataStore.Table.Name)
 		}
@@ -808,7 +1001,7 @@ func (d *DataRow) UpdateValues(dataOffset int, data []interface{}, columns Colum
 	if timestamp == 0 {
 		timestamp = currentUnixTime()
 	}
-	d.LastUpdate = timestamp
+	values.LastUpdate = timestamp
 	return nil
 }
 
@@ -817,38 +1010,55 @@ func (d *DataRow) UpdateValuesNumberOnly(dataOffset int, data []interface{}, col
 	if len(columns) != len(data)-dataOffset {
 		return fmt.Errorf("table %s update failed, data size mismatch, expected %d columns and got %d", d.DataStore.Table.Name.String(), len(columns), len(data))
 	}
+	values := d.vals().cloneNumbers()
 	for i, col := range columns {
 		localIndex := col.Index
 		resIndex := i + dataOffset
 		switch col.DataType {
 		case IntCol:
-			d.dataInt[localIndex] = interface2int(data[resIndex])
+			values.dataInt[localIndex] = interface2int(data[resIndex])
 		case Int64Col:
-			d.dataInt64[localIndex] = interface2int64(data[resIndex])
+			values.dataInt64[localIndex] = interface2int64(data[resIndex])
 		case Int64ListCol:
-			d.dataInt64List[localIndex] = interface2int64list(data[resIndex])
+			values.dataInt64List[localIndex] = interface2int64list(data[resIndex])
 		case FloatCol:
-			d.dataFloat[localIndex] = interface2float64(data[resIndex])
+			values.dataFloat[localIndex] = interface2float64(data[resIndex])
 		case InterfaceListCol:
-			d.dataInterfaceList[localIndex] = interface2interfacelist(data[resIndex])
+			values.dataInterfaceList[localIndex] = interface2interfacelist(data[resIndex])
 		}
 	}
-	d.LastUpdate = timestamp
+	values.LastUpdate = timestamp
+	d.values.Store(values)
 	return nil
 }
 
+// setInt64List replaces a single int64 list value, the row values are only copied if the list changed.
+func (d *DataRow) setInt64List(index int, list []int64) {
+	if list == nil {
+		list = emptyInt64List
+	}
+	current := d.vals()
+	if slices.Equal(current.dataInt64List[index], list) {
+		return
+	}
+	values := *current
+	values.dataInt64List = slices.Clone(current.dataInt64List)
+	values.dataInt64List[index] = list
+	d.values.Store(&values)
+}
+
 // CheckChangedIntValues returns true if the given data results in an update
 func (d *DataRow) CheckChangedIntValues(dataOffset int, data []interface{}, columns ColumnList) bool {
 	for j, col := range columns {
 		switch col.DataType {
 		case IntCol:
-			if interface2int(data[j+dataOffset]) != d.dataInt[col.Index] {
-				log.Tracef("CheckChangedIntValues: int value %s changed: local: %d remote: %d", col.Name, d.dataInt[col.Index], interface2int(data[j+dataOffset]))
+			if interface2int(data[j+dataOffset]) != d.vals().dataInt[col.Index] {
+				log.Tracef("CheckChangedIntValues: int value %s changed: local: %d remote: %d", col.Name, d.vals().dataInt[col.Index], interface2int(data[j+dataOffset]))
 				return true
 			}
 		case Int64Col:
-			if interface2int64(data[j+dataOffset]) != d.dataInt64[col.Index] {
-				log.Tracef("CheckChangedIntValues: int64 value %s changed: local: %d remote: %d", col.Name, d.dataInt64[col.Index], interface2int64(data[j+dataOffset]))
+			if interface2int64(data[j+dataOffset]) != d.vals().dataInt64[col.Index] {
+				log.Tracef("CheckChangedIntValues: int64 value %s changed: local: %d remote: %d", col.Name, d.vals().dataInt64[col.Index], interface2int64(data[j+dataOffset]))
 				return true
 			}
 		}
@@ -1145,16 +1355,6 @@ func interface2jsonstring(in interface{}) string {
 	}
 }
 
-// deduplicateStringlist store duplicate string lists only once
-func (d *DataRow) deduplicateStringlist(list []string) []string {
-	sum := sha256.Sum256([]byte(joinStringlist(list, ListSepChar1)))
-	if l, ok := d.DataStore.dupStringList[sum]; ok {
-		return l
-	}
-	d.DataStore.dupStringList[sum] = list
-	return list
-}
-
 // joinStringlist joins list with given character
 func joinStringlist(list []string, join string) string {
 	var joined strings.Builder
@@ -1232,12 +1432,12 @@ func (d *DataRow) WriteJSONColumn(jsonwriter *jsoniter.Stream, col *Column) {
 func (d *DataRow) WriteJSONLocalColumn(jsonwriter *jsoniter.Stream, col *Column) {
 	switch col.DataType {
 	case StringCol:
-		jsonwriter.WriteString(d.dataString[col.Index])
+		jsonwriter.WriteString(d.vals().dataString[col.Index])
 	case StringLargeCol:
-		jsonwriter.WriteString(d.dataStringLarge[col.Index].String())
+		jsonwriter.WriteString(d.vals().dataStringLarge[col.Index].String())
 	case StringListCol:
 		jsonwriter.WriteArrayStart()
-		for i, s := range d.dataStringList[col.Index] {
+		for i, s := range d.vals().dataStringList[col.Index] {
 			if i > 0 {
 				jsonwriter.WriteMore()
 			}
@@ -1245,14 +1445,14 @@ func (d *DataRow) WriteJSONLocalColumn(jsonwriter *jsoniter.Stream, col *Column)
 		}
 		jsonwriter.WriteArrayEnd()
 	case IntCol:
-		jsonwriter.WriteInt(d.dataInt[col.Index])
+		jsonwriter.WriteInt(d.vals().dataInt[col.Index])
 	case Int64Col:
-		jsonwriter.WriteInt64(d.dataInt64[col.Index])
+		jsonwriter.WriteInt64(d.vals().dataInt64[col.Index])
 	case FloatCol:
-		jsonwriter.WriteFloat64(d.dataFloat[col.Index])
+		jsonwriter.WriteFloat64(d.vals().dataFloat[col.Index])
 	case Int64ListCol:
 		jsonwriter.WriteArrayStart()
-		for i, v := range d.dataInt64List[col.Index] {
+		for i, v := range d.vals().dataInt64List[col.Index] {
 			if i > 0 {
 				jsonwriter.WriteMore()
 			}
@@ -1261,7 +1461,7 @@ func (d *DataRow) WriteJSONLocalColumn(jsonwriter *jsoniter.Stream, col *Column)
 		jsonwriter.WriteArrayEnd()
 	case ServiceMemberListCol:
 		jsonwriter.WriteArrayStart()
-		members := d.dataServiceMemberList[col.Index]
+		members := d.vals().dataServiceMemberList[col.Index]
 		for i := range members {
 			if i > 0 {
 				jsonwriter.WriteMore()
@@ -1275,12 +1475,12 @@ func (d *DataRow) WriteJSONLocalColumn(jsonwriter *jsoniter.Stream, col *Column)
 		jsonwriter.WriteArrayEnd()
 	case InterfaceListCol:
 		jsonwriter.WriteArrayStart()
-		list := d.dataInterfaceList[col.Index]
+		list := d.vals().dataInterfaceList[col.Index]
 		for i := range list {
 			if i > 0 {
 				jsonwriter.WriteMore()
 			}
-			jsonwriter.WriteVal(list[i])
+			writeJSONValue(jsonwriter, list[i])
 		}
 		jsonwriter.WriteArrayEnd()
 	default:
@@ -1341,7 +1541,7 @@ func (d *DataRow) WriteJSONVirtualColumn(jsonwriter *jsoniter.Stream, col *Colum
 			if i > 0 {
 				jsonwriter.WriteMore()
 			}
-			jsonwriter.WriteVal(v)
+			writeJSONValue(jsonwriter, v)
 		}
 		jsonwriter.WriteArrayEnd()
 	case CustomVarCol:
@@ -1351,8 +1551,8 @@ func (d *DataRow) WriteJSONVirtualColumn(jsonwriter *jsoniter.Stream, col *Colum
 			jsonwriter.WriteObjectStart()
 			jsonwriter.WriteObjectEnd()
 		} else {
-			names := d.dataStringList[namesCol.Index]
-			values := d.dataStringList[valuesCol.Index]
+			names := d.vals().dataStringList[namesCol.Index]
+			values := d.vals().dataStringList[valuesCol.Index]
 			jsonwriter.WriteObjectStart()
 			for i := range names {
 				if i > 0 {
@@ -1379,8 +1579,8 @@ func (d *DataRow) isAuthorizedFor(authUser string, host string, service string)
 	// get contacts for host, if we are checking a host or
 	// if this is a service and ServiceAuthorization is loose
 	if (service != "" && p.lmd.Config.ServiceAuthorization == AuthLoose) || service == "" {
-		hostObj, ok := ds.tables[TableHosts].Index[host]
-		contactsColumn := ds.tables[TableHosts].GetColumn("contacts")
+		hostObj, ok := ds.table(TableHosts).Index[host]
+		contactsColumn := ds.table(TableHosts).GetColumn("contacts")
 		// Make sure the host we found is actually valid
 		if !ok {
 			return
@@ -1395,8 +1595,8 @@ func (d *DataRow) isAuthorizedFor(authUser string, host string, service string)
 
 	// get contacts on services
 	if service != "" {
-		serviceObj, ok := ds.tables[TableServices].Index2[host][service]
-		contactsColumn := ds.tables[TableServices].GetColumn("contacts")
+		serviceObj, ok := ds.table(TableServices).Index2[host][service]
+		contactsColumn := ds.table(TableServices).GetColumn("contacts")
 		if !ok {
 			return
 		}
@@ -1416,8 +1616,8 @@ func (d *DataRow) isAuthorizedForHostGroup(authUser string, hostgroup string) (c
 	ds := d.DataStore.DataSet
 	canView = false
 
-	hostgroupObj, ok := ds.tables[TableHostgroups].Index[hostgroup]
-	membersColumn := ds.tables[TableHostgroups].GetColumn("members")
+	hostgroupObj, ok := ds.table(TableHostgroups).Index[hostgroup]
+	membersColumn := ds.table(TableHostgroups).GetColumn("members")
 	if !ok {
 		return
 	}
@@ -1456,8 +1656,8 @@ func (d *DataRow) isAuthorizedForServiceGroup(authUser string, servicegroup stri
 	ds := d.DataStore.DataSet
 	canView = false
 
-	servicegroupObj, ok := ds.tables[TableServicegroups].Index[servicegroup]
-	membersColumn := ds.tables[TableServicegroups].GetColumn("members")
+	servicegroupObj, ok := ds.table(TableServicegroups).Index[servicegroup]
+	membersColumn := ds.table(TableServicegroups).GetColumn("members")
 	if !ok {
 		return
 	}
@@ -1503,49 +1703,49 @@ func (d *DataRow) checkAuth(authUser string) (canView bool) {
 	switch table.Name {
 	case TableHosts:
 		hostNameIndex := table.GetColumn("name").Index
-		hostName := d.dataString[hostNameIndex]
+		hostName := d.vals().dataString[hostNameIndex]
 		canView = d.isAuthorizedFor(authUser, hostName, "")
 	case TableServices:
 		hostNameIndex := table.GetColumn("host_name").Index
-		hostName := d.dataString[hostNameIndex]
+		hostName := d.vals().dataString[hostNameIndex]
 		serviceIndex := table.GetColumn("description").Index
-		serviceDescription := d.dataString[serviceIndex]
+		serviceDescription := d.vals().dataString[serviceIndex]
 		canView = d.isAuthorizedFor(authUser, hostName, serviceDescription)
 	case TableHostgroups:
 		nameIndex := table.GetColumn("name").Index
-		hostgroupName := d.dataString[nameIndex]
+		hostgroupName := d.vals().dataString[nameIndex]
 		canView = d.isAuthorizedForHostGroup(authUser, hostgroupName)
 	case TableServicegroups:
 		nameIndex := table.GetColumn("name").Index
-		servicegroupName := d.dataString[nameIndex]
+		servicegroupName := d.vals().dataString[nameIndex]
 		canView = d.isAuthorizedForServiceGroup(authUser, servicegroupName)
 	case TableHostsbygroup:
 		hostNameIndex := table.GetColumn("name").Index
-		hostName := d.dataString[hostNameIndex]
+		hostName := d.vals().dataString[hostNameIndex]
 		hostGroupIndex := table.GetColumn("hostgroup_name").Index
-		hostGroupName := d.dataString[hostGroupIndex]
+		hostGroupName := d.vals().dataString[hostGroupIndex]
 		canView = d.isAuthorizedFor(authUser, hostName, "") &&
 			d.isAuthorizedForHostGroup(authUser, hostGroupName)
 	case TableServicesbygroup, TableServicesbyhostgroup:
 		hostNameIndex := table.GetColumn("host_name").Index
-		hostName := d.dataString[hostNameIndex]
+		hostName := d.vals().dataString[hostNameIndex]
 		serviceIndex := table.GetColumn("description").Index
-		serviceDescription := d.dataString[serviceIndex]
+		serviceDescription := d.vals().dataString[serviceIndex]
 
 		if table.Name == TableServicesbygroup {
 			servicegroupIndex := table.GetColumn("servicegroup_name").Index
-			servicegroupName := d.dataString[servicegroupIndex]
+			servicegroupName := d.vals().dataString[servicegroupIndex]
 			canView = d.isAuthorizedFor(authUser, hostName, serviceDescription) && d.isAuthorizedForServiceGroup(authUser, servicegroupName)
 		} else {
 			hostgroupIndex := table.GetColumn("hostgroup_name").Index
-			hostgroupName := d.dataString[hostgroupIndex]
+			hostgroupName := d.vals().dataString[hostgroupIndex]
 			canView = d.isAuthorizedFor(authUser, hostName, serviceDescription) && d.isAuthorizedForHostGroup(authUser, hostgroupName)
 		}
 	case TableDowntimes, TableComments:
 		hostIndex := table.GetColumn("host_name").Index
 		serviceIndex := table.GetColumn("service_description").Index
-		hostName := d.dataString[hostIndex]
-		serviceDescription := d.dataString[serviceIndex]
+		hostName := d.vals().dataString[hostIndex]
+		serviceDescription := d.vals().dataString[serviceIndex]
 		canView = d.isAuthorizedFor(authUser, hostName, serviceDescription)
 	default:
 		canView = true
@@ -1577,3 +1777,22 @@ func (d *DataRow) CountStats(stats []*Filter, result []*Filter) {
 		}
 	}
 }
+
+// CountCounterStats counts the matching counter stats into plain counters.
+// It is the fast path of CountStats for stats without any avg/sum/min/max stats.
+func (d *DataRow) CountCounterStats(stats []*Filter, counts []int) {
+	for i, s := range stats {
+		resultPos := i
+		if s.StatsPos > 0 {
+			resultPos = s.StatsPos
+		}
+		if !d.MatchFilter(s, false) {
+			continue
+		}
+		if s.StatsType == StatsGroup {
+			d.CountCounterStats(s.Filter, counts)
+			continue
+		}
+		counts[resultPos]++
+	}
+}
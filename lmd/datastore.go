@@ -2,6 +2,8 @@ package main
 
 import (
 	"fmt"
+	"maps"
+	"slices"
 	"sort"
 	"strings"
 )
@@ -21,8 +23,8 @@ type DataStore struct {
 	Index2                  map[string]map[string]*DataRow // access data rows from 2 primary keys, ex.: host and service
 	Table                   *Table                         // reference to table definition
 	Columns                 ColumnList                     // reference to the used columns
-	dupStringList           map[[32]byte][]string          // lookup pointer to other stringlists during initialization
 	LowerCaseColumns        map[int]int                    // list of string column indexes with their coresponding lower case index
+	rowGenerator            func(fn func(*DataRow) bool)   // optional generator for lazy stores which create their rows on the fly
 }
 
 // NewDataStore creates a new datastore with columns based on given flags
@@ -33,7 +35,6 @@ func NewDataStore(table *Table, peer interface{}) (d *DataStore) {
 		Index2:                  make(map[string]map[string]*DataRow),
 		DynamicColumnCache:      make(ColumnList, 0),
 		DynamicColumnNamesCache: make([]string, 0),
-		dupStringList:           make(map[[32]byte][]string),
 		Table:                   table,
 		PeerLockMode:            table.PeerLockMode,
 		LowerCaseColumns:        make(map[int]int),
@@ -95,6 +96,25 @@ func NewDataStore(table *Table, peer interface{}) (d *DataStore) {
 	return
 }
 
+// IsEmpty returns true if the store has no data rows. Lazy stores are never considered empty.
+func (d *DataStore) IsEmpty() bool {
+	return d.rowGenerator == nil && len(d.Data) == 0
+}
+
+// ForEachRow calls fn for all (pre-filtered) data rows until fn returns false.
+// Rows of lazy stores are generated on the fly from the current source table.
+func (d *DataStore) ForEachRow(filter []*Filter, fn func(row *DataRow) bool) {
+	if d.rowGenerator != nil {
+		d.rowGenerator(fn)
+		return
+	}
+	for _, row := range d.GetPreFilteredData(filter) {
+		if !fn(row) {
+			return
+		}
+	}
+}
+
 // InsertData adds a list of results and initializes the store table
 func (d *DataStore) InsertData(rows ResultSet, columns ColumnList, setReferences bool) error {
 	now := currentUnixTime()
@@ -124,12 +144,10 @@ func (d *DataStore) InsertData(rows ResultSet, columns ColumnList, setReferences
 		}
 		d.InsertItem(i, row)
 	}
-	// only required during initial setup
-	d.dupStringList = nil
 	return nil
 }
 
-// AppendData append a list of results and initializes the store table
+// AppendData append a list of results to a copy of this store which then replaces it in the DataSet.
 func (d *DataStore) AppendData(data ResultSet, columns ColumnList) error {
 	d.DataSet.Lock.Lock()
 	defer d.DataSet.Lock.Unlock()
@@ -139,17 +157,44 @@ func (d *DataStore) AppendData(data ResultSet, columns ColumnList) error {
 		// should not happen but might indicate a recent restart or backend issue
 		return fmt.Errorf("index not ready, cannot append data")
 	}
+	updated := d.copyOnWrite()
 	for i := range data {
 		resRow := data[i]
-		row, nErr := NewDataRow(d, resRow, columns, 0, true)
+		row, nErr := NewDataRow(updated, resRow, columns, 0, true)
 		if nErr != nil {
 			return nErr
 		}
-		d.AddItem(row)
+		updated.AddItem(row)
 	}
+	d.DataSet.set(d.Table.Name, updated)
 	return nil
 }
 
+// copyOnWrite returns a copy of this store with its own list of rows and indexes, the rows itself are shared.
+// Published stores must not be changed, so items are added or removed on the copy which then replaces the store.
+func (d *DataStore) copyOnWrite() *DataStore {
+	index2 := make(map[string]map[string]*DataRow, len(d.Index2))
+	for id1, rows := range d.Index2 {
+		index2[id1] = maps.Clone(rows)
+	}
+	return &DataStore{
+		DynamicColumnCache:      d.DynamicColumnCache,
+		DynamicColumnNamesCache: d.DynamicColumnNamesCache,
+		Peer:                    d.Peer,
+		PeerName:                d.PeerName,
+		PeerKey:                 d.PeerKey,
+		PeerLockMode:            d.PeerLockMode,
+		DataSet:                 d.DataSet,
+		Data:                    slices.Clone(d.Data),
+		Index:                   maps.Clone(d.Index),
+		Index2:                  index2,
+		Table:                   d.Table,
+		Columns:                 d.Columns,
+		LowerCaseColumns:        d.LowerCaseColumns,
+		rowGenerator:            d.rowGenerator,
+	}
+}
+
 // InsertItem adds an new DataRow to a DataStore at given Index.
 func (d *DataStore) InsertItem(index int, row *DataRow) {
 	d.Data[index] = row
@@ -242,13 +287,17 @@ func (d *DataStore) GetInitialColumns() ([]string, ColumnList) {
 	return keys, columns
 }
 
-func (d *DataStore) GetWaitObject(req *Request) (*DataRow, bool) {
-	if req.Table == TableServices {
-		parts := strings.SplitN(req.WaitObject, ";", 2)
+// GetWaitObject returns the row for the given WaitObject name, services use "host;description".
+func (d *DataStore) GetWaitObject(name string) (*DataRow, bool) {
+	if d.Table.Name == TableServices {
+		parts := strings.SplitN(name, ";", 2)
+		if len(parts) < 2 {
+			return nil, false
+		}
 		obj, ok := d.Index2[parts[0]][parts[1]]
 		return obj, ok
 	}
-	obj, ok := d.Index[req.WaitObject]
+	obj, ok := d.Index[name]
 	return obj, ok
 }
 
@@ -362,7 +411,7 @@ func (d *DataStore) prepareDataUpdateSet(dataOffset int, res ResultSet, columns
 		}
 
 		// compare last check date and prepare deduped strings if the last check date has changed
-		if lastCheckCol == nil || interface2int64(resRow[lastCheckResIndex]) != prepared.DataRow.dataInt64[lastCheckDataIndex] {
+		if lastCheckCol == nil || interface2int64(resRow[lastCheckResIndex]) != prepared.DataRow.vals().dataInt64[lastCheckDataIndex] {
 			prepared.FullUpdate = true
 			for i, col := range columns {
 				res[rowNum][i+dataOffset] = cast2Type(res[rowNum][i+dataOffset], col)
@@ -430,7 +479,7 @@ func appendIndexHostsFromHostColumns(d *DataStore, uniqHosts map[string]bool, f
 		switch f.Operator {
 		// groups >= <value>
 		case GreaterThan:
-			store := d.DataSet.tables[TableHostgroups]
+			store := d.DataSet.table(TableHostgroups)
 			group, ok := store.Index[f.StrValue]
 			if ok {
 				members := group.GetStringListByName("members")
@@ -440,7 +489,7 @@ func appendIndexHostsFromHostColumns(d *DataStore, uniqHosts map[string]bool, f
 			}
 			return true
 		case RegexMatch, RegexNoCaseMatch, Contains, ContainsNoCase:
-			store := d.DataSet.tables[TableHostgroups]
+			store := d.DataSet.table(TableHostgroups)
 			for groupname, group := range store.Index {
 				if f.MatchString(groupname) {
 					members := group.GetStringListByName("members")
@@ -467,7 +516,7 @@ func appendIndexHostsFromServiceColumns(d *DataStore, uniqHosts map[string]bool,
 			return true
 		// host_name ~~ <value>
 		case RegexMatch, RegexNoCaseMatch, Contains, ContainsNoCase, EqualNocase:
-			store := d.DataSet.tables[TableHosts]
+			store := d.DataSet.table(TableHosts)
 			for hostname := range store.Index {
 				if f.MatchString(hostname) {
 					uniqHosts[hostname] = true
@@ -480,7 +529,7 @@ func appendIndexHostsFromServiceColumns(d *DataStore, uniqHosts map[string]bool,
 		switch f.Operator {
 		// groups >= <value>
 		case GreaterThan:
-			store := d.DataSet.tables[TableHostgroups]
+			store := d.DataSet.table(TableHostgroups)
 			group, ok := store.Index[f.StrValue]
 			if ok {
 				members := group.GetStringListByName("members")
@@ -490,7 +539,7 @@ func appendIndexHostsFromServiceColumns(d *DataStore, uniqHosts map[string]bool,
 			}
 			return true
 		case RegexMatch, RegexNoCaseMatch, Contains, ContainsNoCase:
-			store := d.DataSet.tables[TableHostgroups]
+			store := d.DataSet.table(TableHostgroups)
 			for groupname, group := range store.Index {
 				if f.MatchString(groupname) {
 					members := group.GetStringListByName("members")
@@ -506,7 +555,7 @@ func appendIndexHostsFromServiceColumns(d *DataStore, uniqHosts map[string]bool,
 		switch f.Operator {
 		// groups >= <value>
 		case GreaterThan:
-			store := d.DataSet.tables[TableServicegroups]
+			store := d.DataSet.table(TableServicegroups)
 			group, ok := store.Index[f.StrValue]
 			if ok {
 				members := group.GetServiceMemberListByName("members")
@@ -516,7 +565,7 @@ func appendIndexHostsFromServiceColumns(d *DataStore, uniqHosts map[string]bool,
 			}
 			return true
 		case RegexMatch, RegexNoCaseMatch, Contains, ContainsNoCase:
-			store := d.DataSet.tables[TableServicegroups]
+			store := d.DataSet.table(TableServicegroups)
 			for groupname, group := range store.Index {
 				if f.MatchString(groupname) {
 					members := group.GetServiceMemberListByName("members")
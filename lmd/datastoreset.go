@@ -5,6 +5,7 @@ import (
 	"sort"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/sasha-s/go-deadlock"
@@ -14,32 +15,48 @@ const missedTimestampMaxFilter = 150
 
 // DataStoreSet is the handle to a peers datastores
 type DataStoreSet struct {
-	peer   *Peer
-	Lock   *deadlock.RWMutex
-	tables map[TableName]*DataStore
+	peer           *Peer
+	Lock           *deadlock.RWMutex                        // serializes updates, readers do not need it
+	tables         atomic.Pointer[map[TableName]*DataStore] // published map is never modified, Set replaces it
+	updatedObjects int64                                    // number of objects updated by delta updates, accessed atomically
 }
 
 func NewDataStoreSet(peer *Peer) *DataStoreSet {
 	dataset := DataStoreSet{
-		Lock:   new(deadlock.RWMutex),
-		tables: make(map[TableName]*DataStore),
-		peer:   peer,
+		Lock: new(deadlock.RWMutex),
+		peer: peer,
 	}
+	dataset.tables.Store(&map[TableName]*DataStore{})
 	return &dataset
 }
 
+// Set adds or replaces the store for given table.
 func (ds *DataStoreSet) Set(name TableName, store *DataStore) {
 	ds.Lock.Lock()
-	ds.tables[name] = store
-	store.DataSet = ds
+	ds.set(name, store)
 	ds.Lock.Unlock()
 }
 
+// set replaces the tables map with an updated copy, must be called with the lock held.
+func (ds *DataStoreSet) set(name TableName, store *DataStore) {
+	store.DataSet = ds
+	current := ds.tables.Load()
+	tables := make(map[TableName]*DataStore, len(*current)+1)
+	for n, s := range *current {
+		tables[n] = s
+	}
+	tables[name] = store
+	ds.tables.Store(&tables)
+}
+
+// Get returns the current store for given table.
 func (ds *DataStoreSet) Get(name TableName) *DataStore {
-	ds.Lock.RLock()
-	store := ds.tables[name]
-	ds.Lock.RUnlock()
-	return store
+	return ds.table(name)
+}
+
+// table returns the current store for given table without locking.
+func (ds *DataStoreSet) table(name TableName) *DataStore {
+	return (*ds.tables.Load())[name]
 }
 
 // CreateObjectByType fetches all static and dynamic data from the remote site and creates the initial table.
@@ -115,7 +132,7 @@ func (ds *DataStoreSet) CreateObjectByType(table *Table) (store *DataStore, err
 
 // SetReferences creates reference entries for all tables
 func (ds *DataStoreSet) SetReferences() (err error) {
-	for _, t := range ds.tables {
+	for _, t := range *ds.tables.Load() {
 		t := t
 		err = t.SetReferences()
 		if err != nil {
@@ -131,14 +148,10 @@ func (ds *DataStoreSet) hasChanged() (changed bool) {
 	tablenames := []TableName{TableCommands, TableContactgroups, TableContacts, TableHostgroups, TableHosts, TableServicegroups, TableTimeperiods}
 	for _, name := range tablenames {
 		counter := ds.peer.countFromServer(name.String(), "name !=")
-		ds.Lock.RLock()
-		changed = changed || (counter != len(ds.tables[name].Data))
-		ds.Lock.RUnlock()
+		changed = changed || (counter != len(ds.table(name).Data))
 	}
 	counter := ds.peer.countFromServer("services", "host_name !=")
-	ds.Lock.RLock()
-	changed = changed || (counter != len(ds.tables[TableServices].Data))
-	ds.Lock.RUnlock()
+	changed = changed || (counter != len(ds.table(TableServices).Data))
 	ds.peer.clearLastRequest()
 
 	return
@@ -163,6 +176,7 @@ func (ds *DataStoreSet) UpdateFull(tables []TableName) (err error) {
 	p.Lock.Lock()
 	p.resetErrors()
 	p.Status[ResponseTime] = duration.Seconds()
+	p.Status[LastFullUpdateDuration] = duration.Seconds()
 	p.Status[LastUpdate] = currentUnixTime()
 	p.Status[LastFullUpdate] = currentUnixTime()
 	p.Lock.Unlock()
@@ -189,6 +203,7 @@ func (ds *DataStoreSet) UpdateFullTablesList(tables []TableName) (err error) {
 // It returns true if the update was successful or false otherwise.
 func (ds *DataStoreSet) UpdateDelta(from, to float64) (err error) {
 	t1 := time.Now()
+	atomic.StoreInt64(&ds.updatedObjects, 0)
 
 	err = ds.UpdateFullTablesList(Objects.StatusTables)
 	if err != nil {
@@ -238,6 +253,8 @@ func (ds *DataStoreSet) UpdateDelta(from, to float64) (err error) {
 	p.resetErrors()
 	p.Status[LastUpdate] = to
 	p.Status[ResponseTime] = duration.Seconds()
+	p.Status[LastDeltaUpdateDuration] = duration.Seconds()
+	p.Status[LastDeltaUpdatedObjects] = atomic.LoadInt64(&ds.updatedObjects)
 	p.Lock.Unlock()
 
 	if peerStatus != PeerStatusUp && peerStatus != PeerStatusPending {
@@ -339,6 +356,7 @@ func (ds *DataStoreSet) insertDeltaDataResult(dataOffset int, res ResultSet, res
 	ds.Lock.Unlock()
 
 	durationInsert := time.Since(t3).Truncate(time.Millisecond)
+	atomic.AddInt64(&ds.updatedObjects, int64(len(updateSet)))
 
 	p := ds.peer
 	tableName := table.Table.Name.String()
@@ -453,11 +471,9 @@ func (ds *DataStoreSet) UpdateDeltaFullScan(store *DataStore, statusKey PeerStat
 
 // getMissingTimestamps returns list of last_check dates which can be used to delta update
 func (ds *DataStoreSet) getMissingTimestamps(store *DataStore, res ResultSet, columns ColumnList, updateThreshold int64) (missing []int64, err error) {
-	ds.Lock.RLock()
 	p := ds.peer
 	data := store.Data
 	if len(data) < len(res) {
-		ds.Lock.RUnlock()
 		if p.HasFlag(Icinga2) || len(data) == 0 {
 			err = ds.reloadIfNumberOfObjectsChanged()
 			return
@@ -478,7 +494,6 @@ func (ds *DataStoreSet) getMissingTimestamps(store *DataStore, res ResultSet, co
 			missedUnique[ts] = true
 		}
 	}
-	ds.Lock.RUnlock()
 
 	// return uniq sorted keys
 	missing = make([]int64, len(missedUnique))
@@ -540,15 +555,22 @@ func (ds *DataStoreSet) UpdateDeltaCommentsOrDowntimes(name TableName) (err erro
 		resIndex[id] = true
 	}
 
-	// remove old comments / downtimes
+	// remove old comments / downtimes from a copy of the store, running queries keep the old one
+	var updated *DataStore
 	for id := range idIndex {
 		_, ok := resIndex[id]
 		if !ok {
 			logWith(ds, req).Debugf("removing %s with id %s", name.String(), id)
-			tmp := idIndex[id]
-			store.RemoveItem(tmp)
+			if updated == nil {
+				updated = store.copyOnWrite()
+			}
+			updated.RemoveItem(idIndex[id])
 		}
 	}
+	if updated != nil {
+		ds.set(name, updated)
+		store = updated
+	}
 	ds.Lock.Unlock()
 
 	if len(missingIds) > 0 {
@@ -608,12 +630,10 @@ func (ds *DataStoreSet) maxIDOrSizeChanged(name TableName) (changed bool, err er
 
 	store := ds.Get(name)
 	var maxID int64
-	ds.Lock.RLock()
 	entries := len(store.Data)
 	if entries > 0 {
 		maxID = store.Data[entries-1].GetInt64ByName("id")
 	}
-	ds.Lock.RUnlock()
 
 	if len(res) == 0 || float64(entries) == interface2float64(res[0][0]) && (entries == 0 || interface2float64(res[0][1]) == float64(maxID)) {
 		logWith(p, req).Tracef("%s did not change", name.String())
@@ -656,9 +676,7 @@ func (ds *DataStoreSet) UpdateFullTable(tableName TableName) (err error) {
 	res = res.SortByPrimaryKey(store.Table, req)
 	durationSort := time.Since(t1).Truncate(time.Millisecond)
 
-	ds.Lock.RLock()
 	data := store.Data
-	ds.Lock.RUnlock()
 	if len(res) != len(data) {
 		err = fmt.Errorf("site returned different number of objects, assuming backend has been restarted, table: %s, expected: %d, received: %d", store.Table.Name.String(), len(data), len(res))
 		logWith(p).Debugf("%s", err.Error())
@@ -777,17 +795,17 @@ func (ds *DataStoreSet) buildDowntimeCommentsList(name TableName) (err error) {
 	ds.Lock.Lock()
 	defer ds.Lock.Unlock()
 
-	store := ds.tables[name]
+	store := ds.table(name)
 	if store == nil {
 		return fmt.Errorf("cannot build id list, peer is down: %s", ds.peer.getError())
 	}
-	hostStore := ds.tables[TableHosts]
+	hostStore := ds.table(TableHosts)
 	if hostStore == nil {
 		return fmt.Errorf("cannot build id list, peer is down: %s", ds.peer.getError())
 	}
 	hostIdx := hostStore.Table.GetColumn(name.String()).Index
 
-	serviceStore := ds.tables[TableServices]
+	serviceStore := ds.table(TableServices)
 	if serviceStore == nil {
 		return fmt.Errorf("cannot build id list, peer is down: %s", ds.peer.getError())
 	}
@@ -802,9 +820,9 @@ func (ds *DataStoreSet) buildDowntimeCommentsList(name TableName) (err error) {
 	serviceIndex := serviceStore.Index2
 	for i := range store.Data {
 		row := store.Data[i]
-		key := row.dataString[hostNameIndex]
-		serviceName := row.dataString[serviceDescIndex]
-		id := row.dataInt64[idIndex]
+		key := row.vals().dataString[hostNameIndex]
+		serviceName := row.vals().dataString[serviceDescIndex]
+		id := row.vals().dataInt64[idIndex]
 		if serviceName != "" {
 			if obj, ok := serviceIndex[key][serviceName]; ok {
 				serviceResult[obj] = append(serviceResult[obj], id)
@@ -817,20 +835,12 @@ func (ds *DataStoreSet) buildDowntimeCommentsList(name TableName) (err error) {
 	}
 	promObjectCount.WithLabelValues(ds.peer.Name, name.String()).Set(float64(len(store.Data)))
 
-	// empty current lists
+	// store updated lists, only changed rows are replaced
 	for _, d := range hostStore.Data {
-		d.dataInt64List[hostIdx] = emptyInt64List
+		d.setInt64List(hostIdx, hostResult[d])
 	}
 	for _, d := range serviceStore.Data {
-		d.dataInt64List[serviceIdx] = emptyInt64List
-	}
-
-	// store updated lists
-	for d, ids := range serviceResult {
-		d.dataInt64List[serviceIdx] = ids
-	}
-	for d, ids := range hostResult {
-		d.dataInt64List[hostIdx] = ids
+		d.setInt64List(serviceIdx, serviceResult[d])
 	}
 
 	return
@@ -157,9 +157,12 @@ func (f *Filter) String(prefix string) (str string) {
 	strNegate := ""
 
 	if f.Negate {
-		if f.StatsType == NoStats {
+		switch {
+		case prefix == "WaitCondition":
+			strNegate = fmt.Sprintf("%s\n", "WaitConditionNegate:")
+		case f.StatsType == NoStats:
 			strNegate = fmt.Sprintf("%s\n", "Negate:")
-		} else {
+		default:
 			strNegate = fmt.Sprintf("%s\n", "StatsNegate:")
 		}
 	}
@@ -291,7 +294,8 @@ func (f *Filter) ApplyValue(val float64, count int) {
 			f.Stats = value
 		}
 	default:
-		panic("not implemented stats type")
+		// other stats types are rejected when parsing the request
+		return
 	}
 	f.StatsCount += count
 }
@@ -431,7 +435,7 @@ func (f *Filter) setFilterValue(strVal string) (err error) {
 	case StringCol:
 		return
 	}
-	log.Panicf("not implemented column type: %v", colType)
+	err = fmt.Errorf("filter on column %s of type %s is not supported", f.Column.Name, colType.String())
 	return
 }
 
@@ -559,20 +563,27 @@ func ParseStats(value []byte, table TableName, stack *[]*Filter, options ParseOp
 		return
 	}
 
-	col := Objects.Tables[table].GetColumnWithFallback(string(tmp[1]))
-	stats := &Filter{
-		Column:         col,
-		StatsType:      op,
-		Stats:          startWith,
-		StatsCount:     0,
-		ColumnIndex:    -1,
-		ColumnOptional: col.Optional,
-	}
-	if !stats.IsEmpty && col.Optional == NoFlags && col.StorageType == LocalStore {
-		stats.ColumnIndex = col.Index
+	// wildcard patterns add one stats entry for each matching column
+	names, err := Objects.Tables[table].ExpandColumnPattern(string(tmp[1]))
+	if err != nil {
+		return
 	}
+	for _, name := range names {
+		col := Objects.Tables[table].GetColumnWithFallback(name)
+		stats := &Filter{
+			Column:         col,
+			StatsType:      op,
+			Stats:          startWith,
+			StatsCount:     0,
+			ColumnIndex:    -1,
+			ColumnOptional: col.Optional,
+		}
+		if !stats.IsEmpty && col.Optional == NoFlags && col.StorageType == LocalStore {
+			stats.ColumnIndex = col.Index
+		}
 
-	*stack = append(*stack, stats)
+		*stack = append(*stack, stats)
+	}
 	return
 }
 
@@ -620,7 +631,7 @@ func (f *Filter) Match(row *DataRow) bool {
 	switch f.Column.DataType {
 	case StringCol:
 		if f.ColumnIndex != -1 {
-			return f.MatchString(row.dataString[f.ColumnIndex])
+			return f.MatchString(row.vals().dataString[f.ColumnIndex])
 		}
 		return f.MatchString(row.GetString(f.Column))
 	case StringLargeCol, JSONCol:
@@ -629,7 +640,7 @@ func (f *Filter) Match(row *DataRow) bool {
 		return f.MatchStringList(row.GetStringList(f.Column))
 	case IntCol:
 		if f.ColumnIndex != -1 {
-			return f.MatchInt(row.dataInt[f.ColumnIndex])
+			return f.MatchInt(row.vals().dataInt[f.ColumnIndex])
 		}
 		if f.IsEmpty {
 			return matchEmptyFilter(f.Operator)
@@ -637,7 +648,7 @@ func (f *Filter) Match(row *DataRow) bool {
 		return f.MatchInt(row.GetInt(f.Column))
 	case Int64Col:
 		if f.ColumnIndex != -1 {
-			return f.MatchInt64(row.dataInt64[f.ColumnIndex])
+			return f.MatchInt64(row.vals().dataInt64[f.ColumnIndex])
 		}
 		if f.IsEmpty {
 			return matchEmptyFilter(f.Operator)
@@ -645,7 +656,7 @@ func (f *Filter) Match(row *DataRow) bool {
 		return f.MatchInt64(row.GetInt64(f.Column))
 	case FloatCol:
 		if f.ColumnIndex != -1 {
-			return f.MatchFloat(row.dataFloat[f.ColumnIndex])
+			return f.MatchFloat(row.vals().dataFloat[f.ColumnIndex])
 		}
 		if f.IsEmpty {
 			return matchEmptyFilter(f.Operator)
@@ -1,25 +1,36 @@
 package main
 
 import (
+	"bufio"
 	"context"
+	"crypto/subtle"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
+	"strconv"
 	"strings"
 
 	"github.com/julienschmidt/httprouter"
 )
 
+// HTTPMaxRequestSize sets the maximum size of livestatus queries sent to the /livestatus endpoint
+const HTTPMaxRequestSize = 10 * 1024 * 1024
+
 // HTTPServerController is the container object for the rest interface's server.
 type HTTPServerController struct {
 	lmd *LMDInstance
 }
 
 func (c *HTTPServerController) errorOutput(err error, w http.ResponseWriter) {
+	c.errorOutputCode(err, http.StatusBadRequest, w)
+}
+
+func (c *HTTPServerController) errorOutputCode(err error, code int, w http.ResponseWriter) {
 	j := make(map[string]interface{})
 	j["error"] = err.Error()
 	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusBadRequest)
+	w.WriteHeader(code)
 	err = json.NewEncoder(w).Encode(j)
 	if err != nil {
 		log.Debugf("encoder failed: %e", err)
@@ -41,7 +52,7 @@ func (c *HTTPServerController) queryTable(ctx context.Context, w http.ResponseWr
 		return
 	}
 
-	req, err := parseRequestDataToRequest(requestData)
+	req, err := parseRequestDataToRequest(c.lmd, requestData)
 	if err != nil {
 		c.errorOutput(err, w)
 		return
@@ -57,6 +68,7 @@ func (c *HTTPServerController) queryTable(ctx context.Context, w http.ResponseWr
 	var res *Response
 	if d, exists := requestData["distributed"]; exists && d.(bool) {
 		// force local answer to avoid recursion
+		req.distributed = true
 		res, _, err = NewResponse(ctx, req, nil)
 	} else {
 		// Ask request object to send query, get response, might get distributed
@@ -93,6 +105,7 @@ func (c *HTTPServerController) table(w http.ResponseWriter, request *http.Reques
 	if tableName := ps.ByName("name"); tableName != "" {
 		requestData["table"] = tableName
 	}
+	c.setAuthUser(request, requestData)
 
 	c.queryTable(request.Context(), w, requestData)
 }
@@ -115,8 +128,10 @@ func (c *HTTPServerController) queryPing(w http.ResponseWriter, _ map[string]int
 	id := c.lmd.nodeAccessor.ID
 	j := make(map[string]interface{})
 	j["identifier"] = id
-	j["peers"] = c.lmd.nodeAccessor.assignedBackends
+	j["peers"] = c.lmd.nodeAccessor.AssignedBackends()
+	j["ready"] = c.lmd.nodeAccessor.ReadyBackends()
 	j["version"] = Version()
+	j["started"] = c.lmd.nodeAccessor.started.Unix()
 
 	// Send data
 	err := json.NewEncoder(w).Encode(j)
@@ -146,15 +161,159 @@ func (c *HTTPServerController) query(w http.ResponseWriter, request *http.Reques
 	case "ping":
 		c.queryPing(w, requestData)
 	case "table":
+		c.setAuthUser(request, requestData)
 		c.queryTable(request.Context(), w, requestData)
 	default:
 		c.errorOutput(fmt.Errorf("unknown request: %s", requestedFunction), w)
 	}
 }
 
-func parseRequestDataToRequest(requestData map[string]interface{}) (req *Request, err error) {
+// livestatus runs a single livestatus query and returns the wrapped_json result. The query is either
+// sent as raw livestatus query text or as json object just like for the /table endpoint.
+func (c *HTTPServerController) livestatus(w http.ResponseWriter, request *http.Request, _ httprouter.Params) {
+	defer request.Body.Close()
+	user, _ := request.Context().Value(CtxHTTPUser).(string)
+	ctx := context.WithValue(request.Context(), CtxClient, request.RemoteAddr)
+	req, err := c.parseLivestatusRequest(ctx, w, request)
+	if err != nil {
+		c.livestatusError(w, req, http.StatusBadRequest, err)
+		return
+	}
+	if req.Command != "" {
+		c.livestatusError(w, req, http.StatusBadRequest, fmt.Errorf("bad request: commands are not supported"))
+		return
+	}
+	// the response is always sent as wrapped_json with the size in the http header
+	req.OutputFormat = OutputFormatWrappedJSON
+	req.ResponseFixed16 = false
+	req.ResponseCompression = false
+	req.KeepAlive = false
+	if user != "" && c.lmd.Config.HTTPAuthUser {
+		req.AuthUser = user
+	}
+	err = req.ExpandRequestedBackends()
+	if err != nil {
+		c.livestatusError(w, req, http.StatusBadRequest, err)
+		return
+	}
+
+	res, _, err := NewResponse(ctx, req, nil)
+	if err != nil {
+		c.livestatusError(w, req, httpStatusCode(responseErrorCode(err)), err)
+		return
+	}
+	defer res.releaseResult()
+	buf, err := res.Buffer()
+	if err != nil {
+		c.livestatusError(w, req, http.StatusInternalServerError, err)
+		return
+	}
+	logWith(ctx, req).Infof("%s request finished, response size: %s", req.Table.String(), ByteCountBinary(int64(buf.Len())))
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Length", strconv.Itoa(buf.Len()))
+	w.WriteHeader(httpStatusCode(res.Code))
+	_, err = buf.WriteTo(w)
+	if err != nil {
+		logWith(ctx, req).Debugf("writeto failed: %e", err)
+	}
+}
+
+// parseLivestatusRequest parses the livestatus request from a raw query text or json body.
+func (c *HTTPServerController) parseLivestatusRequest(ctx context.Context, w http.ResponseWriter, request *http.Request) (*Request, error) {
+	body := http.MaxBytesReader(w, request.Body, HTTPMaxRequestSize)
+	if request.Header.Get("Content-Type") == "application/json" {
+		requestData := make(map[string]interface{})
+		if err := json.NewDecoder(body).Decode(&requestData); err != nil {
+			return nil, fmt.Errorf("request not understood")
+		}
+		return parseRequestDataToRequest(c.lmd, requestData)
+	}
+
+	req, _, err := NewRequest(ctx, c.lmd, bufio.NewReader(body), c.lmd.defaultReqestParseOption)
+	if err != nil {
+		return req, err
+	}
+	if req == nil {
+		return nil, fmt.Errorf("bad request: empty request")
+	}
+	return req, nil
+}
+
+// livestatusError sends the error response for a failed livestatus query including the request id if available.
+func (c *HTTPServerController) livestatusError(w http.ResponseWriter, req *Request, code int, err error) {
+	if req != nil {
+		logWith(req).Warnf("sending error response: %d - %s", code, err.Error())
+		err = errors.New((&Response{Request: req, Error: err}).errorMessage())
+	}
+	c.errorOutputCode(err, code, w)
+}
+
+// authenticate checks the bearer token or basic auth credentials if authentication is configured.
+// It returns the name of the authenticated basic auth user.
+func (c *HTTPServerController) authenticate(request *http.Request) (user string, ok bool) {
+	conf := c.lmd.Config
+	if conf.HTTPAuthToken == "" && len(conf.HTTPAuthBasic) == 0 {
+		return "", true
+	}
+	if token, found := strings.CutPrefix(request.Header.Get("Authorization"), "Bearer "); found && conf.HTTPAuthToken != "" {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(conf.HTTPAuthToken)) == 1 {
+			return "", true
+		}
+	}
+	name, password, found := request.BasicAuth()
+	if !found {
+		return "", false
+	}
+	for _, entry := range conf.HTTPAuthBasic {
+		entryUser, entryPassword, _ := strings.Cut(entry, ":")
+		if entryUser == name && subtle.ConstantTimeCompare([]byte(entryPassword), []byte(password)) == 1 {
+			return name, true
+		}
+	}
+	return "", false
+}
+
+// requireAuth wraps a route handler and rejects requests which fail the configured authentication.
+// The authenticated basic auth user is stored in the request context.
+func (c *HTTPServerController) requireAuth(handle httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, request *http.Request, ps httprouter.Params) {
+		user, ok := c.authenticate(request)
+		if !ok {
+			request.Body.Close()
+			if len(c.lmd.Config.HTTPAuthBasic) > 0 {
+				w.Header().Set("WWW-Authenticate", `Basic realm="lmd"`)
+			}
+			c.errorOutputCode(fmt.Errorf("authentication required"), http.StatusUnauthorized, w)
+			return
+		}
+		if user != "" {
+			request = request.WithContext(context.WithValue(request.Context(), CtxHTTPUser, user))
+		}
+		handle(w, request, ps)
+	}
+}
+
+// setAuthUser replaces the auth_user of json requests with the authenticated basic auth user if HTTPAuthUser is set.
+func (c *HTTPServerController) setAuthUser(request *http.Request, requestData map[string]interface{}) {
+	if !c.lmd.Config.HTTPAuthUser {
+		return
+	}
+	if user, ok := request.Context().Value(CtxHTTPUser).(string); ok && user != "" {
+		requestData["auth_user"] = user
+	}
+}
+
+// httpStatusCode returns the http status code for a livestatus response code.
+func httpStatusCode(code int) int {
+	if http.StatusText(code) == "" {
+		return http.StatusInternalServerError
+	}
+	return code
+}
+
+func parseRequestDataToRequest(lmd *LMDInstance, requestData map[string]interface{}) (req *Request, err error) {
 	// New request object for specified table
-	req = &Request{}
+	req = &Request{lmd: lmd}
 	table, err := NewTableName(interface2stringNoDedup(requestData["table"]))
 	if err != nil {
 		return
@@ -230,6 +389,11 @@ func parseRequestDataToRequest(requestData map[string]interface{}) (req *Request
 		}
 	}
 
+	// AuthUser
+	if val, ok := requestData["auth_user"]; ok {
+		req.AuthUser = interface2stringNoDedup(val)
+	}
+
 	// Backends
 	var backends []string
 	if val, ok := requestData["backends"]; ok {
@@ -238,6 +402,9 @@ func parseRequestDataToRequest(requestData map[string]interface{}) (req *Request
 		}
 	}
 	req.Backends = backends
+
+	req.SetRequestColumns()
+	err = req.SetSortColumns()
 	return
 }
 
@@ -277,12 +444,18 @@ func initializeHTTPRouter(lmd *LMDInstance) (handler http.Handler) {
 	}
 
 	// Routes
-	router.GET("/", controller.index)
-	router.GET("/table/:name", controller.table)
-	router.POST("/table/:name", controller.table)
-	router.POST("/ping", controller.ping)
-	router.POST("/query", controller.query)
-
-	handler = router
+	router.GET("/", controller.requireAuth(controller.index))
+	router.GET("/table/:name", controller.requireAuth(controller.table))
+	router.POST("/table/:name", controller.requireAuth(controller.table))
+	router.POST("/ping", controller.requireAuth(controller.ping))
+	router.POST("/query", controller.requireAuth(controller.query))
+	router.POST("/livestatus", controller.requireAuth(controller.livestatus))
+
+	// count running requests, so they can finish on shutdown
+	handler = http.HandlerFunc(func(w http.ResponseWriter, request *http.Request) {
+		lmd.activeRequests.Add(1)
+		defer lmd.activeRequests.Add(-1)
+		router.ServeHTTP(w, request)
+	})
 	return
 }
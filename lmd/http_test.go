@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+)
+
+func TestHTTPLivestatus(t *testing.T) {
+	peer, cleanup, mocklmd := StartTestPeer(2, 10, 10)
+	PauseTestPeers(peer)
+
+	server := httptest.NewServer(initializeHTTPRouter(mocklmd))
+	defer server.Close()
+
+	query := func(contentType, body string) (*http.Response, map[string]interface{}) {
+		t.Helper()
+		request, err := http.NewRequest(http.MethodPost, server.URL+"/livestatus", bytes.NewBufferString(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if contentType != "" {
+			request.Header.Set("Content-Type", contentType)
+		}
+		response, err := http.DefaultClient.Do(request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer response.Body.Close()
+		result := make(map[string]interface{})
+		if err = json.NewDecoder(response.Body).Decode(&result); err != nil {
+			t.Fatal(err)
+		}
+		return response, result
+	}
+
+	// raw livestatus query
+	response, result := query("", "GET hosts\nColumns: name\nFilter: name = testhost_1\n\n")
+	if err := assertEq(http.StatusOK, response.StatusCode); err != nil {
+		t.Fatal(err)
+	}
+	if err := assertEq("application/json", response.Header.Get("Content-Type")); err != nil {
+		t.Error(err)
+	}
+	if _, err := strconv.Atoi(response.Header.Get("Content-Length")); err != nil {
+		t.Errorf("content length missing: %s", err)
+	}
+	if err := assertEq(2.0, result["total_count"]); err != nil {
+		t.Error(err)
+	}
+
+	// json query
+	response, result = query("application/json", `{"table": "hosts", "columns": ["name"], "filter": ["name = testhost_1"]}`)
+	if err := assertEq(http.StatusOK, response.StatusCode); err != nil {
+		t.Fatal(err)
+	}
+	if err := assertEq(2, len(result["data"].([]interface{}))); err != nil {
+		t.Error(err)
+	}
+
+	// errors are returned with the request id
+	response, result = query("", "GET hosts\nRequestID: http-1\nLimit: x\n\n")
+	if err := assertEq(http.StatusBadRequest, response.StatusCode); err != nil {
+		t.Error(err)
+	}
+	if err := assertLike(`Limit: x \(request id: http-1\)`, result["error"].(string)); err != nil {
+		t.Error(err)
+	}
+	response, _ = query("", "COMMAND [0] test_ok\n\n")
+	if err := assertEq(http.StatusBadRequest, response.StatusCode); err != nil {
+		t.Error(err)
+	}
+
+	if err := cleanup(); err != nil {
+		panic(err.Error())
+	}
+}
+
+func TestHTTPLivestatusAuth(t *testing.T) {
+	peer, cleanup, mocklmd := StartTestPeer(1, 10, 10)
+	PauseTestPeers(peer)
+
+	mocklmd.Config.HTTPAuthToken = "secret"
+	mocklmd.Config.HTTPAuthBasic = []string{"thruk:pass"}
+	mocklmd.Config.HTTPAuthUser = true
+
+	server := httptest.NewServer(initializeHTTPRouter(mocklmd))
+	defer server.Close()
+
+	query := func(auth func(request *http.Request)) (int, map[string]interface{}) {
+		t.Helper()
+		request, err := http.NewRequest(http.MethodPost, server.URL+"/livestatus", bytes.NewBufferString("GET hosts\nColumns: name\n\n"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		auth(request)
+		response, err := http.DefaultClient.Do(request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer response.Body.Close()
+		result := make(map[string]interface{})
+		if err = json.NewDecoder(response.Body).Decode(&result); err != nil {
+			t.Fatal(err)
+		}
+		return response.StatusCode, result
+	}
+
+	code, _ := query(func(_ *http.Request) {})
+	if err := assertEq(http.StatusUnauthorized, code); err != nil {
+		t.Error(err)
+	}
+	code, _ = query(func(r *http.Request) { r.Header.Set("Authorization", "Bearer wrong") })
+	if err := assertEq(http.StatusUnauthorized, code); err != nil {
+		t.Error(err)
+	}
+	code, _ = query(func(r *http.Request) { r.SetBasicAuth("thruk", "wrong") })
+	if err := assertEq(http.StatusUnauthorized, code); err != nil {
+		t.Error(err)
+	}
+
+	code, result := query(func(r *http.Request) { r.Header.Set("Authorization", "Bearer secret") })
+	if err := assertEq(http.StatusOK, code); err != nil {
+		t.Error(err)
+	}
+	if err := assertEq(10.0, result["total_count"]); err != nil {
+		t.Error(err)
+	}
+
+	// basic auth users are used as AuthUser, unknown contacts see nothing
+	code, result = query(func(r *http.Request) { r.SetBasicAuth("thruk", "pass") })
+	if err := assertEq(http.StatusOK, code); err != nil {
+		t.Error(err)
+	}
+	if err := assertEq(0.0, result["total_count"]); err != nil {
+		t.Error(err)
+	}
+
+	if err := cleanup(); err != nil {
+		panic(err.Error())
+	}
+}
+
+func TestHTTPTableAuth(t *testing.T) {
+	peer, cleanup, mocklmd := StartTestPeer(1, 10, 10)
+	PauseTestPeers(peer)
+
+	mocklmd.Config.HTTPAuthToken = "secret"
+
+	server := httptest.NewServer(initializeHTTPRouter(mocklmd))
+	defer server.Close()
+
+	query := func(method, path, token string) int {
+		t.Helper()
+		request, err := http.NewRequest(method, server.URL+path, bytes.NewBufferString(`{"_name": "table", "table": "hosts", "columns": ["name"]}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		request.Header.Set("Content-Type", "application/json")
+		if token != "" {
+			request.Header.Set("Authorization", "Bearer "+token)
+		}
+		response, err := http.DefaultClient.Do(request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		response.Body.Close()
+		return response.StatusCode
+	}
+
+	if err := assertEq(http.StatusUnauthorized, query(http.MethodGet, "/table/hosts", "")); err != nil {
+		t.Error(err)
+	}
+	if err := assertEq(http.StatusUnauthorized, query(http.MethodPost, "/query", "")); err != nil {
+		t.Error(err)
+	}
+	if err := assertEq(http.StatusUnauthorized, query(http.MethodPost, "/table/hosts", "wrong")); err != nil {
+		t.Error(err)
+	}
+	if err := assertEq(http.StatusOK, query(http.MethodGet, "/table/hosts", "secret")); err != nil {
+		t.Error(err)
+	}
+	if err := assertEq(http.StatusOK, query(http.MethodPost, "/query", "secret")); err != nil {
+		t.Error(err)
+	}
+
+	if err := cleanup(); err != nil {
+		panic(err.Error())
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"time"
+)
+
+// Limiter is a counting semaphore which limits the number of concurrent workers.
+// A nil Limiter does not limit anything.
+type Limiter struct {
+	noCopy noCopy
+	slots  chan bool
+}
+
+// NewLimiter creates a new limiter with the given number of slots.
+// It returns nil if size is not positive, which means unlimited.
+func NewLimiter(size int) *Limiter {
+	if size <= 0 {
+		return nil
+	}
+	return &Limiter{
+		slots: make(chan bool, size),
+	}
+}
+
+// Acquire waits for a free slot or till the context is canceled.
+// It returns the time spent waiting and false if no slot has been acquired.
+func (l *Limiter) Acquire(ctx context.Context) (waited time.Duration, ok bool) {
+	if l == nil {
+		return 0, true
+	}
+	t1 := time.Now()
+	select {
+	case l.slots <- true:
+		return time.Since(t1), true
+	case <-ctx.Done():
+		return time.Since(t1), false
+	}
+}
+
+// TryAcquire takes a free slot without waiting.
+// It returns false if all slots are in use.
+func (l *Limiter) TryAcquire() bool {
+	if l == nil {
+		return true
+	}
+	select {
+	case l.slots <- true:
+		return true
+	default:
+		return false
+	}
+}
+
+// Release frees a slot acquired by Acquire.
+func (l *Limiter) Release() {
+	if l == nil {
+		return
+	}
+	<-l.slots
+}
+
+// InUse returns the number of currently acquired slots.
+func (l *Limiter) InUse() int {
+	if l == nil {
+		return 0
+	}
+	return len(l.slots)
+}
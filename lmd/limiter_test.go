@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestLimiter(t *testing.T) {
+	l := NewLimiter(2)
+	ctx := context.TODO()
+
+	_, ok := l.Acquire(ctx)
+	if err := assertEq(true, ok); err != nil {
+		t.Error(err)
+	}
+	_, ok = l.Acquire(ctx)
+	if err := assertEq(true, ok); err != nil {
+		t.Error(err)
+	}
+	if err := assertEq(2, l.InUse()); err != nil {
+		t.Error(err)
+	}
+
+	// all slots taken, must time out
+	tctx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	waited, ok := l.Acquire(tctx)
+	if err := assertEq(false, ok); err != nil {
+		t.Error(err)
+	}
+	if err := assertEq(true, waited >= 50*time.Millisecond); err != nil {
+		t.Error(err)
+	}
+
+	l.Release()
+	if err := assertEq(1, l.InUse()); err != nil {
+		t.Error(err)
+	}
+	_, ok = l.Acquire(ctx)
+	if err := assertEq(true, ok); err != nil {
+		t.Error(err)
+	}
+	l.Release()
+	l.Release()
+	if err := assertEq(0, l.InUse()); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestLimiterUnlimited(t *testing.T) {
+	l := NewLimiter(0)
+	if err := assertEq((*Limiter)(nil), l); err != nil {
+		t.Error(err)
+	}
+
+	_, ok := l.Acquire(context.TODO())
+	if err := assertEq(true, ok); err != nil {
+		t.Error(err)
+	}
+	l.Release()
+	if err := assertEq(0, l.InUse()); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestLimiterTryAcquire(t *testing.T) {
+	l := NewLimiter(1)
+	if err := assertEq(true, l.TryAcquire()); err != nil {
+		t.Error(err)
+	}
+	if err := assertEq(false, l.TryAcquire()); err != nil {
+		t.Error(err)
+	}
+	l.Release()
+	if err := assertEq(true, l.TryAcquire()); err != nil {
+		t.Error(err)
+	}
+	l.Release()
+
+	// unlimited
+	if err := assertEq(true, (*Limiter)(nil).TryAcquire()); err != nil {
+		t.Error(err)
+	}
+}
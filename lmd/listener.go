@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"crypto/tls"
 	"crypto/x509"
 	"fmt"
@@ -21,6 +22,13 @@ const (
 	// RequestReadTimeout sets the read timeout when listening to incoming requests
 	RequestReadTimeout = 2 * time.Minute
 
+	// RequestRejectTimeout sets the write timeout when sending the error to rejected connections
+	RequestRejectTimeout = 5 * time.Second
+
+	// MaxConcurrentRejections sets the number of rejected connections per listener which get an error response
+	// at the same time, further connections are closed right away.
+	MaxConcurrentRejections = 16
+
 	// KeepAliveWaitInterval sets the interval at which the listeners checks for new requests in keepalive connections
 	KeepAliveWaitInterval = 100 * time.Millisecond
 
@@ -39,6 +47,9 @@ type Listener struct {
 	waitGroupInit    *sync.WaitGroup
 	openConnections  int64
 	queryStats       *QueryStats
+	limits           *ClientLimits
+	rejections       *Limiter     // limits the number of connections being rejected concurrently
+	activated        net.Listener // socket inherited from systemd socket activation
 	cleanup          func()
 }
 
@@ -52,8 +63,13 @@ func NewListener(lmd *LMDInstance, listen string, qStat *QueryStats) *Listener {
 		waitGroupInit:    lmd.waitGroupInit,
 		Connection:       nil,
 		queryStats:       qStat,
+		limits:           NewClientLimits(),
+		rejections:       NewLimiter(MaxConcurrentRejections),
+		activated:        lmd.activatedSockets[listen],
 		cleanup:          nil,
 	}
+	// inherited sockets can be used only once
+	delete(lmd.activatedSockets, listen)
 	go func() {
 		defer lmd.logPanicExit()
 		l.handle()
@@ -98,15 +114,20 @@ func (l *Listener) localListenerLivestatus(connType ConnectionType, listen strin
 	switch connType {
 	case ConnTypeTLS:
 		l.Lock.RLock()
-		tlsConfig, tErr := GetTLSListenerConfig(l.lmd.Config)
+		tlsConfig, tErr := GetTLSListenerConfig(l.lmd.Config, l.connectionString)
 		l.Lock.RUnlock()
 		if tErr != nil {
 			log.Fatalf("failed to initialize tls %s", tErr.Error())
 		}
-		c, err = tls.Listen("tcp", listen, tlsConfig)
+		c, err = l.listen("tcp", listen, tlsConfig)
 	case ConnTypeTCP:
-		c, err = net.Listen("tcp", listen)
+		c, err = l.listen("tcp", listen, nil)
 	case ConnTypeUnix:
+		if l.activated != nil {
+			// socket file is managed by systemd
+			c, err = l.listen("unix", listen, nil)
+			break
+		}
 		// remove stale sockets on start
 		_, sErr := os.Stat(listen)
 		if sErr == nil {
@@ -127,7 +148,7 @@ func (l *Listener) localListenerLivestatus(connType ConnectionType, listen strin
 		return
 	}
 	defer c.Close()
-	if connType == ConnTypeUnix {
+	if connType == ConnTypeUnix && l.activated == nil {
 		l.cleanup = func() {
 			os.Remove(listen)
 		}
@@ -147,9 +168,33 @@ func (l *Listener) localListenerLivestatus(connType ConnectionType, listen strin
 			return
 		}
 
+		ip := clientIP(fd.RemoteAddr())
+		opts := l.lmd.Config.ListenerSettings(l.connectionString)
+		if reason := l.limits.Acquire(opts, ip); reason != "" {
+			if !l.rejections.TryAcquire() {
+				// do not pile up rejections during connection floods
+				promFrontendRejectedConnections.WithLabelValues(l.connectionString, reason).Inc()
+				fd.Close()
+				continue
+			}
+			go func() {
+				// make sure we log panics properly
+				defer l.lmd.logPanicExit()
+				defer l.rejections.Release()
+
+				l.rejectConnection(fd, reason, opts)
+			}()
+			continue
+		}
+
 		l.Lock.Lock()
 		l.openConnections++
 		cl := NewClientConnection(l.lmd, fd, l.lmd.Config.ListenTimeout, l.lmd.Config.LogSlowQueryThreshold, l.lmd.Config.LogHugeQueryThreshold, l.queryStats)
+		cl.listener = l
+		cl.options = opts
+		cl.authUser = opts.AuthUser
+		cl.remoteIP = ip
+		authUserMode := l.lmd.Config.TLSListenerSettings(l.connectionString).TLSClientAuthUser
 		promFrontendOpenConnections.WithLabelValues(l.connectionString).Set(float64(l.openConnections))
 		l.Lock.Unlock()
 
@@ -158,7 +203,21 @@ func (l *Listener) localListenerLivestatus(connType ConnectionType, listen strin
 			// make sure we log panics properly
 			defer l.lmd.logPanicExit()
 
-			cl.Handle()
+			var hErr error
+			if tlsConn, ok := fd.(*tls.Conn); ok {
+				var certUser string
+				certUser, hErr = l.tlsHandshake(tlsConn, authUserMode)
+				// the AuthUser forced by the listener options takes precedence
+				if certUser != "" && cl.authUser == "" {
+					cl.authUser = certUser
+				}
+			}
+			if hErr == nil {
+				cl.Handle()
+			} else {
+				fd.Close()
+			}
+			l.limits.Release(ip)
 			l.Lock.Lock()
 			l.openConnections--
 			promFrontendOpenConnections.WithLabelValues(l.connectionString).Set(float64(l.openConnections))
@@ -167,6 +226,31 @@ func (l *Listener) localListenerLivestatus(connType ConnectionType, listen strin
 	}
 }
 
+// rejectConnection sends a fixed16 error to clients exceeding the connection or rate limits and closes the connection.
+func (l *Listener) rejectConnection(conn net.Conn, reason string, opts *ListenerOptions) {
+	promFrontendRejectedConnections.WithLabelValues(l.connectionString, reason).Inc()
+	code := 429
+	var err error
+	switch reason {
+	case RejectMaxConnections:
+		code = 503
+		err = fmt.Errorf("too many connections (limit: %d)", opts.MaxClientConnections)
+	case RejectMaxConnectionsPerIP:
+		err = fmt.Errorf("too many connections from %s (limit: %d)", clientIP(conn.RemoteAddr()), opts.MaxClientConnectionsPerIP)
+	default:
+		err = fmt.Errorf("too many queries from %s (limit: %d per second)", clientIP(conn.RemoteAddr()), opts.ClientQueryRateLimit)
+	}
+	log.Debugf("rejecting connection from %s on %s: %s", conn.RemoteAddr().String(), l.connectionString, err.Error())
+
+	// the request has not been parsed, so there is no way to tell if the client expects a fixed16 header
+	LogErrors(conn.SetDeadline(time.Now().Add(RequestRejectTimeout)))
+	_, sErr := (&Response{Code: code, Request: &Request{ResponseFixed16: true}, Error: err}).Send(conn)
+	if sErr != nil {
+		log.Tracef("sending rejection to %s failed: %s", conn.RemoteAddr().String(), sErr.Error())
+	}
+	conn.Close()
+}
+
 // localListenerHTTP starts a listening socket with http protocol.
 func (l *Listener) localListenerHTTP(httpType string, listen string) {
 	// Parse listener address
@@ -176,19 +260,19 @@ func (l *Listener) localListenerHTTP(httpType string, listen string) {
 	var c net.Listener
 	if httpType == "https" {
 		l.Lock.RLock()
-		tlsConfig, err := GetTLSListenerConfig(l.lmd.Config)
+		tlsConfig, err := GetTLSListenerConfig(l.lmd.Config, l.connectionString)
 		l.Lock.RUnlock()
 		if err != nil {
 			log.Fatalf("failed to initialize https %s", err.Error())
 		}
-		ln, err := tls.Listen("tcp", listen, tlsConfig)
+		ln, err := l.listen("tcp", listen, tlsConfig)
 		if err != nil {
 			log.Fatalf("listen error: %s", err.Error())
 			return
 		}
 		c = ln
 	} else {
-		ln, err := net.Listen("tcp", listen)
+		ln, err := l.listen("tcp", listen, nil)
 		if err != nil {
 			log.Fatalf("listen error: %s", err.Error())
 			return
@@ -215,6 +299,22 @@ func (l *Listener) localListenerHTTP(httpType string, listen string) {
 	}
 }
 
+// listen returns the socket inherited from systemd or opens a new listening socket.
+func (l *Listener) listen(network, address string, tlsConfig *tls.Config) (net.Listener, error) {
+	listener := l.activated
+	if listener == nil {
+		var err error
+		listener, err = net.Listen(network, address)
+		if err != nil {
+			return nil, fmt.Errorf("listen %s %s: %w", network, address, err)
+		}
+	}
+	if tlsConfig != nil {
+		listener = tls.NewListener(listener, tlsConfig)
+	}
+	return listener, nil
+}
+
 func (l *Listener) Stop() {
 	if l.Connection != nil {
 		l.Connection.Close()
@@ -226,19 +326,70 @@ func (l *Listener) Stop() {
 	}
 }
 
-func GetTLSListenerConfig(localConfig *Config) (config *tls.Config, err error) {
-	if localConfig.TLSCertificate == "" || localConfig.TLSKey == "" {
+// tlsHandshake runs the tls handshake of a new client connection. Failed handshakes are logged and counted.
+// It returns the AuthUser from the client certificate if mapping certificates to users is enabled.
+func (l *Listener) tlsHandshake(conn *tls.Conn, authUserMode string) (authUser string, err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), RequestReadTimeout)
+	defer cancel()
+	err = conn.HandshakeContext(ctx)
+	if err == nil && authUserMode != "" {
+		authUser, err = tlsClientAuthUser(conn.ConnectionState(), authUserMode)
+	}
+	if err != nil {
+		log.Infof("tls handshake from %s on %s failed: %s", conn.RemoteAddr().String(), l.connectionString, err.Error())
+		promFrontendTLSHandshakeErrors.WithLabelValues(l.connectionString).Inc()
+		return "", err
+	}
+	return authUser, nil
+}
+
+// tlsClientAuthUser returns the user name from the verified client certificate.
+func tlsClientAuthUser(state tls.ConnectionState, authUserMode string) (string, error) {
+	if len(state.PeerCertificates) == 0 {
+		return "", fmt.Errorf("no client certificate")
+	}
+	cert := state.PeerCertificates[0]
+	user := ""
+	switch authUserMode {
+	case TLSClientAuthUserCN:
+		user = cert.Subject.CommonName
+	case TLSClientAuthUserSAN:
+		switch {
+		case len(cert.DNSNames) > 0:
+			user = cert.DNSNames[0]
+		case len(cert.EmailAddresses) > 0:
+			user = cert.EmailAddresses[0]
+		case len(cert.URIs) > 0:
+			user = cert.URIs[0].String()
+		}
+	}
+	if user == "" {
+		return "", fmt.Errorf("client certificate %s contains no %s", cert.Subject.String(), authUserMode)
+	}
+	return user, nil
+}
+
+// GetTLSListenerConfig returns the tls config for the given listener.
+func GetTLSListenerConfig(localConfig *Config, listen string) (config *tls.Config, err error) {
+	settings := localConfig.TLSListenerSettings(listen)
+	if settings.TLSCertificate == "" || settings.TLSKey == "" {
 		log.Fatalf("TLSCertificate and TLSKey configuration items are required for tls connections")
 	}
-	cer, err := tls.LoadX509KeyPair(localConfig.TLSCertificate, localConfig.TLSKey)
+	cer, err := tls.LoadX509KeyPair(settings.TLSCertificate, settings.TLSKey)
 	if err != nil {
-		return nil, fmt.Errorf("tls.LoadX509KeyPair: %s / %s: %w", localConfig.TLSCertificate, localConfig.TLSKey, err)
+		return nil, fmt.Errorf("tls.LoadX509KeyPair: %s / %s: %w", settings.TLSCertificate, settings.TLSKey, err)
 	}
 	config = getMinimalTLSConfig(localConfig)
 	config.Certificates = []tls.Certificate{cer}
-	if len(localConfig.TLSClientPems) > 0 {
+	if tlsMinVersion, vErr := parseTLSMinVersion(settings.TLSMinVersion); vErr == nil {
+		config.MinVersion = tlsMinVersion
+	}
+	if settings.TLSClientAuthUser != "" && len(settings.TLSClientPems) == 0 {
+		log.Warnf("TLSClientAuthUser requires TLSClientPems, all connections on %s will be rejected", listen)
+	}
+	if len(settings.TLSClientPems) > 0 {
 		caCertPool := x509.NewCertPool()
-		for _, file := range localConfig.TLSClientPems {
+		for _, file := range settings.TLSClientPems {
 			caCert, err := os.ReadFile(file)
 			if err != nil {
 				return nil, fmt.Errorf("os.ReadFile: %w", err)
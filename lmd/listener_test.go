@@ -0,0 +1,295 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	jsoniter "github.com/json-iterator/go"
+)
+
+// createTestCertificate creates a certificate signed by the given parent and writes cert and key to dir/name.pem and dir/name.key.
+func createTestCertificate(t *testing.T, dir, name string, template *x509.Certificate, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template.SerialNumber = big.NewInt(time.Now().UnixNano())
+	template.Subject = pkix.Name{CommonName: name}
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = time.Now().Add(time.Hour)
+	if parent == nil {
+		parent = template
+		parentKey = key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_checkErr(os.WriteFile(filepath.Join(dir, name+".pem"), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o644))
+	_checkErr(os.WriteFile(filepath.Join(dir, name+".key"), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0o600))
+	return cert, key
+}
+
+func TestTLSListenerClientAuthUser(t *testing.T) {
+	dir := t.TempDir()
+	caCert, caKey := createTestCertificate(t, dir, "ca", &x509.Certificate{
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}, nil, nil)
+	createTestCertificate(t, dir, "server", &x509.Certificate{
+		IPAddresses: []net.IP{net.ParseIP("127.0.0.1")},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, caCert, caKey)
+	createTestCertificate(t, dir, "authuser", &x509.Certificate{
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, caCert, caKey)
+
+	listen := "127.0.0.1:50996"
+	forcedListen := "127.0.0.1:50994"
+	extraConfig := fmt.Sprintf(`
+Listen = ["test.sock", "tls://%s", "tls://%s"]
+
+TLSCertificate    = "%s/server.pem"
+TLSKey            = "%s/server.key"
+TLSClientPems     = ["%s/ca.pem"]
+TLSMinVersion     = "tls1.2"
+
+[[TLSListener]]
+Listen            = "tls://%s"
+TLSClientAuthUser = "cn"
+
+[[TLSListener]]
+Listen            = "tls://%s"
+TLSClientAuthUser = "cn"
+
+[[ListenerOptions]]
+Listen   = "tls://%s"
+AuthUser = "otheruser"
+
+`, listen, forcedListen, dir, dir, dir, listen, forcedListen, forcedListen)
+	peer, cleanup, mocklmd := StartTestPeerExtra(1, 2, 2, extraConfig)
+	PauseTestPeers(peer)
+
+	// plain text listener is not affected
+	res, _, err := peer.QueryString("GET hosts\nColumns: name\n\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = assertEq(2, len(res)); err != nil {
+		t.Error(err)
+	}
+
+	clientCert, err := tls.LoadX509KeyPair(filepath.Join(dir, "authuser.pem"), filepath.Join(dir, "authuser.key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	caPool := x509.NewCertPool()
+	caPool.AddCert(caCert)
+
+	query := func(addr string, certs []tls.Certificate, query string) ([]byte, error) {
+		t.Helper()
+		conn, err := tls.Dial("tcp", addr, &tls.Config{
+			RootCAs:      caPool,
+			Certificates: certs,
+			MinVersion:   tls.VersionTLS12,
+		})
+		if err != nil {
+			return nil, err
+		}
+		defer conn.Close()
+		LogErrors(conn.SetDeadline(time.Now().Add(5 * time.Second)))
+		if _, err = conn.Write([]byte(query)); err != nil {
+			return nil, err
+		}
+		return io.ReadAll(conn)
+	}
+
+	// the AuthUser header is replaced with the certificate cn
+	data, err := query(listen, []tls.Certificate{clientCert}, "GET hosts\nColumns: name\nAuthUser: otheruser\nOutputFormat: json\n\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var rows [][]interface{}
+	if err = jsoniter.Unmarshal(data, &rows); err != nil {
+		t.Fatalf("%s: %s", err, data)
+	}
+	if err = assertEq(1, len(rows)); err != nil {
+		t.Error(err)
+	}
+
+	// the AuthUser of the listener options is not replaced by the certificate cn
+	data, err = query(forcedListen, []tls.Certificate{clientCert}, "GET hosts\nColumns: name\nOutputFormat: json\n\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = jsoniter.Unmarshal(data, &rows); err != nil {
+		t.Fatalf("%s: %s", err, data)
+	}
+	if err = assertEq(0, len(rows)); err != nil {
+		t.Error(err)
+	}
+
+	// connections without client certificate are rejected
+	data, err = query(listen, nil, "GET hosts\nColumns: name\nOutputFormat: json\n\n")
+	if err == nil && len(data) > 0 {
+		t.Errorf("expected failed handshake, got: %s", data)
+	}
+
+	settings := mocklmd.Config.TLSListenerSettings("tls://" + listen)
+	if err = assertEq(TLSClientAuthUserCN, settings.TLSClientAuthUser); err != nil {
+		t.Error(err)
+	}
+	// other listeners use the global settings
+	if err = assertEq("", mocklmd.Config.TLSListenerSettings("https://"+listen).TLSClientAuthUser); err != nil {
+		t.Error(err)
+	}
+
+	if err := cleanup(); err != nil {
+		panic(err.Error())
+	}
+}
+
+func TestTLSClientAuthUser(t *testing.T) {
+	cert := &x509.Certificate{
+		Subject:        pkix.Name{CommonName: "cnuser"},
+		EmailAddresses: []string{"mail@example.com"},
+	}
+	state := tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}}
+
+	user, err := tlsClientAuthUser(state, TLSClientAuthUserCN)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = assertEq("cnuser", user); err != nil {
+		t.Error(err)
+	}
+	user, err = tlsClientAuthUser(state, TLSClientAuthUserSAN)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = assertEq("mail@example.com", user); err != nil {
+		t.Error(err)
+	}
+
+	cert.Subject.CommonName = ""
+	if _, err = tlsClientAuthUser(state, TLSClientAuthUserCN); err == nil {
+		t.Errorf("expected error for certificate without cn")
+	}
+	if _, err = tlsClientAuthUser(tls.ConnectionState{}, TLSClientAuthUserCN); err == nil {
+		t.Errorf("expected error without client certificate")
+	}
+}
+
+func TestListenerOptions(t *testing.T) {
+	listen := "127.0.0.1:50997"
+	extraConfig := fmt.Sprintf(`
+Listen = ["test.sock", "%s"]
+
+[[ListenerOptions]]
+Listen        = "%s"
+OutputFormat  = "wrapped_json"
+AuthUser      = "authuser"
+AllowedTables = ["hosts", "lmd_queries"]
+DenyCommands  = true
+
+`, listen, listen)
+	peer, cleanup, mocklmd := StartTestPeerExtra(1, 2, 2, extraConfig)
+	PauseTestPeers(peer)
+
+	query := func(query string) []byte {
+		t.Helper()
+		conn, err := net.Dial("tcp", listen)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		LogErrors(conn.SetDeadline(time.Now().Add(5 * time.Second)))
+		if _, err = conn.Write([]byte(query)); err != nil {
+			t.Fatal(err)
+		}
+		data, err := io.ReadAll(conn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return data
+	}
+
+	// services are allowed on the unix socket
+	res, _, err := peer.QueryString("GET services\nColumns: description\n\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = assertEq(2, len(res)); err != nil {
+		t.Error(err)
+	}
+
+	// but not on the tcp listener
+	data := query("GET services\nColumns: description\nResponseHeader: fixed16\n\n")
+	if err = assertLike(`^403\s+\d+\n.*table services is not allowed on this listener`, string(data)); err != nil {
+		t.Error(err)
+	}
+
+	// allowed tables use the forced AuthUser and the default OutputFormat
+	data = query("GET hosts\nColumns: name\nAuthUser: otheruser\n\n")
+	var wrapped struct {
+		Data [][]interface{} `json:"data"`
+	}
+	if err = jsoniter.Unmarshal(data, &wrapped); err != nil {
+		t.Fatalf("%s: %s", err, data)
+	}
+	if err = assertEq(1, len(wrapped.Data)); err != nil {
+		t.Error(err)
+	}
+
+	// requested output formats are kept
+	data = query("GET hosts\nColumns: name\nOutputFormat: json\n\n")
+	var rows [][]interface{}
+	if err = jsoniter.Unmarshal(data, &rows); err != nil {
+		t.Fatalf("%s: %s", err, data)
+	}
+	if err = assertEq(1, len(rows)); err != nil {
+		t.Error(err)
+	}
+
+	// commands are rejected
+	data = query("COMMAND [0] test_ok\nResponseHeader: fixed16\n\n")
+	if err = assertLike(`^403\s+\d+\n.*commands are not allowed`, string(data)); err != nil {
+		t.Error(err)
+	}
+
+	opts := mocklmd.Config.ListenerSettings(listen)
+	if err = assertEq(true, opts.DenyCommands); err != nil {
+		t.Error(err)
+	}
+	// other listeners have no restrictions
+	if err = assertEq(0, len(mocklmd.Config.ListenerSettings("test.sock").AllowedTables)); err != nil {
+		t.Error(err)
+	}
+
+	if err := cleanup(); err != nil {
+		panic(err.Error())
+	}
+}
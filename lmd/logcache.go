@@ -0,0 +1,342 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/sasha-s/go-deadlock"
+)
+
+const (
+	// LogCachePartitionSize sets the time range in seconds of a single log cache partition
+	LogCachePartitionSize = 3600
+
+	// DefaultLogCacheMaxEntries sets the default number of log entries kept per peer
+	DefaultLogCacheMaxEntries = 500000
+)
+
+// LogCacheFetchFunc fetches all log entries with a timestamp greater or equal than since
+// using the given columns.
+type LogCacheFetchFunc func(columns []string, since int64) (ResultSet, error)
+
+// LogCache keeps the recent log entries of a peer in time partitioned buckets,
+// so log queries for a time range fully covered by the cache do not have to be
+// passed through to the remote core.
+type LogCache struct {
+	noCopy       noCopy
+	lock         *deadlock.Mutex
+	store        *DataStore
+	columns      ColumnList
+	fetch        LogCacheFetchFunc
+	window       int64                // seconds of history fetched when filling an empty cache
+	retention    int64                // seconds of history kept in the cache
+	maxEntries   int                  // maximum number of cached entries
+	partitions   map[int64][]*DataRow // cached entries sorted by time, keyed by partition start
+	entries      int                  // total number of cached entries
+	coveredFrom  int64                // oldest timestamp which is fully covered by the cache
+	coveredTo    int64                // timestamp of the last fetch
+	descending   bool                 // remote core returns newest entries first
+	programStart int64                // program start of the core when the cache was filled
+}
+
+// NewLogCache creates a new log cache for given peer.
+func NewLogCache(peer *Peer, fetch LogCacheFetchFunc) *LogCache {
+	table := Objects.Tables[TableLog]
+	cache := &LogCache{
+		lock:       new(deadlock.Mutex),
+		store:      NewDataStore(table, peer),
+		fetch:      fetch,
+		window:     int64(peer.Config.LogCacheWindow),
+		retention:  int64(peer.Config.LogCacheRetention),
+		maxEntries: peer.Config.LogCacheMaxEntries,
+	}
+	if cache.retention < cache.window {
+		cache.retention = cache.window
+	}
+	if cache.maxEntries <= 0 {
+		cache.maxEntries = DefaultLogCacheMaxEntries
+	}
+	for _, col := range table.Columns {
+		if col.StorageType != VirtualStore {
+			cache.columns = append(cache.columns, col)
+		}
+	}
+	cache.clear()
+	return cache
+}
+
+// Query answers a passed through log request from the cache.
+// It returns false if the request cannot be answered from the cache, ex. because
+// the requested time range is not covered.
+func (c *LogCache) Query(req *Request, programStart int64) (ResultSet, bool) {
+	if req.AuthUser != "" || (len(req.Stats) > 0 && len(req.Columns) > 0) {
+		return nil, false
+	}
+	since := logRequestTimeLowerBound(req.Filter)
+	if since <= 0 {
+		return nil, false
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	now := time.Now().Unix()
+	if programStart != c.programStart {
+		// core restarted, log files might have been rotated or rewritten
+		c.clear()
+		c.programStart = programStart
+	}
+	if err := c.update(now); err != nil {
+		log.Debugf("log cache update failed: %s", err.Error())
+		c.clear()
+		return nil, false
+	}
+	if since < c.coveredFrom {
+		return nil, false
+	}
+
+	columns := make(ColumnList, 0, len(req.Columns))
+	for _, name := range req.Columns {
+		col := c.store.Table.GetColumn(name)
+		if col == nil {
+			return nil, false
+		}
+		columns = append(columns, col)
+	}
+
+	if len(req.Stats) > 0 {
+		stats := createLocalStatsCopy(req.Stats)
+		c.forEachEntry(since, func(row *DataRow) bool {
+			if logCacheMatchFilter(row, req.Filter) {
+				row.CountStats(req.Stats, stats)
+			}
+			return true
+		})
+		result := make([]interface{}, len(stats))
+		for i := range stats {
+			value, err := finalStatsApply(stats[i])
+			if err != nil {
+				return nil, false
+			}
+			result[i] = value
+		}
+		return ResultSet{result}, true
+	}
+
+	result := make(ResultSet, 0)
+	c.forEachEntry(since, func(row *DataRow) bool {
+		// sorted results are limited after sorting by the caller
+		if req.Limit != nil && *req.Limit >= 0 && len(req.Sort) == 0 && len(result) >= *req.Limit {
+			return false
+		}
+		if !logCacheMatchFilter(row, req.Filter) {
+			return true
+		}
+		values := make([]interface{}, len(columns))
+		for i, col := range columns {
+			values[i] = row.GetValueByColumn(col)
+		}
+		result = append(result, values)
+		return true
+	})
+	return result, true
+}
+
+// clear removes all cached entries.
+func (c *LogCache) clear() {
+	c.partitions = make(map[int64][]*DataRow)
+	c.entries = 0
+	c.coveredFrom = 0
+	c.coveredTo = 0
+}
+
+// update fetches all entries since the last update and expires old entries.
+// It must be called with the lock held.
+func (c *LogCache) update(now int64) error {
+	since := c.coveredTo
+	if since == 0 {
+		since = now - c.window
+		c.coveredFrom = since
+	}
+
+	names := make([]string, 0, len(c.columns))
+	for _, col := range c.columns {
+		names = append(names, col.Name)
+	}
+	data, err := c.fetch(names, since)
+	if err != nil {
+		return err
+	}
+	if len(data) > 1 && interface2int64(data[0][c.timeIndex()]) > interface2int64(data[len(data)-1][c.timeIndex()]) {
+		// remember the order of the core to return entries the same way
+		c.descending = true
+	}
+	if c.descending {
+		for i, j := 0, len(data)-1; i < j; i, j = i+1, j-1 {
+			data[i], data[j] = data[j], data[i]
+		}
+	}
+	timeIndex := c.timeIndex()
+	sort.SliceStable(data, func(i, j int) bool {
+		return interface2int64(data[i][timeIndex]) < interface2int64(data[j][timeIndex])
+	})
+
+	// entries of the last fetched second might have been incomplete, so they have been fetched again
+	c.removeSince(since)
+	for i := range data {
+		for j, col := range c.columns {
+			data[i][j] = cast2Type(data[i][j], col)
+		}
+		row, err := NewDataRow(c.store, data[i], c.columns, float64(now), false)
+		if err != nil {
+			return fmt.Errorf("adding log entry failed: %s", err.Error())
+		}
+		part := c.partitionStart(row.GetInt64ByName("time"))
+		c.partitions[part] = append(c.partitions[part], row)
+		c.entries++
+	}
+	c.coveredTo = now
+
+	c.expire(now - c.retention)
+	return nil
+}
+
+// removeSince removes all entries with a timestamp greater or equal than since.
+func (c *LogCache) removeSince(since int64) {
+	for part, rows := range c.partitions {
+		if part+LogCachePartitionSize <= since {
+			continue
+		}
+		keep := sort.Search(len(rows), func(i int) bool { return rows[i].GetInt64ByName("time") >= since })
+		c.entries -= len(rows) - keep
+		if keep == 0 {
+			delete(c.partitions, part)
+			continue
+		}
+		c.partitions[part] = rows[:keep]
+	}
+}
+
+// expire removes entries older than the given timestamp and the oldest entries
+// once the cache exceeds its maximum number of entries.
+func (c *LogCache) expire(oldest int64) {
+	for part := range c.partitions {
+		if part+LogCachePartitionSize <= oldest {
+			c.entries -= len(c.partitions[part])
+			delete(c.partitions, part)
+		}
+	}
+	if c.coveredFrom < oldest {
+		// partitions are removed as a whole, so older entries may remain but are not served
+		c.coveredFrom = oldest
+	}
+
+	for _, part := range c.sortedPartitions() {
+		if c.entries <= c.maxEntries {
+			break
+		}
+		rows := c.partitions[part]
+		drop := c.entries - c.maxEntries
+		if drop >= len(rows) {
+			drop = len(rows)
+		}
+		lastDropped := rows[drop-1].GetInt64ByName("time")
+		if lastDropped+1 > c.coveredFrom {
+			c.coveredFrom = lastDropped + 1
+		}
+		c.entries -= drop
+		if drop == len(rows) {
+			delete(c.partitions, part)
+			continue
+		}
+		c.partitions[part] = rows[drop:]
+	}
+}
+
+// forEachEntry calls fn for all entries newer or equal than since in the order
+// of the remote core until fn returns false.
+func (c *LogCache) forEachEntry(since int64, fn func(row *DataRow) bool) {
+	parts := c.sortedPartitions()
+	if c.descending {
+		for i := len(parts) - 1; i >= 0; i-- {
+			rows := c.partitions[parts[i]]
+			for j := len(rows) - 1; j >= 0; j-- {
+				if rows[j].GetInt64ByName("time") < since {
+					return
+				}
+				if !fn(rows[j]) {
+					return
+				}
+			}
+		}
+		return
+	}
+	for _, part := range parts {
+		if part+LogCachePartitionSize <= since {
+			continue
+		}
+		for _, row := range c.partitions[part] {
+			if row.GetInt64ByName("time") < since {
+				continue
+			}
+			if !fn(row) {
+				return
+			}
+		}
+	}
+}
+
+// sortedPartitions returns the partition keys, oldest first.
+func (c *LogCache) sortedPartitions() []int64 {
+	parts := make([]int64, 0, len(c.partitions))
+	for part := range c.partitions {
+		parts = append(parts, part)
+	}
+	sort.Slice(parts, func(i, j int) bool { return parts[i] < parts[j] })
+	return parts
+}
+
+func (c *LogCache) partitionStart(timestamp int64) int64 {
+	return timestamp - timestamp%LogCachePartitionSize
+}
+
+func (c *LogCache) timeIndex() int {
+	for i, col := range c.columns {
+		if col.Name == "time" {
+			return i
+		}
+	}
+	return 0
+}
+
+func logCacheMatchFilter(row *DataRow, filter []*Filter) bool {
+	for _, f := range filter {
+		if !row.MatchFilter(f, false) {
+			return false
+		}
+	}
+	return true
+}
+
+// logRequestTimeLowerBound returns the lowest timestamp requested by the
+// (and combined) filters or 0 if the time range is not limited.
+func logRequestTimeLowerBound(filter []*Filter) (since int64) {
+	for _, f := range filter {
+		var val int64
+		switch {
+		case f.GroupOperator == And:
+			val = logRequestTimeLowerBound(f.Filter)
+		case f.Column == nil || f.Column.Name != "time" || f.Negate:
+			continue
+		case f.Operator == GreaterThan:
+			val = int64(f.FloatValue)
+		case f.Operator == Greater:
+			val = int64(f.FloatValue) + 1
+		}
+		if val > since {
+			since = val
+		}
+	}
+	return since
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"testing"
+	"time"
+)
+
+type testLogSource struct {
+	entries []map[string]interface{} // newest first, like the core returns them
+	fetches []int64
+}
+
+func (s *testLogSource) add(timestamp int64, msg string) {
+	entry := map[string]interface{}{
+		"attempt":                  1,
+		"class":                    1,
+		"contact_name":             "",
+		"host_name":                "localhost",
+		"lineno":                   len(s.entries) + 1,
+		"message":                  fmt.Sprintf("[%d] SERVICE ALERT: %s", timestamp, msg),
+		"options":                  msg,
+		"plugin_output":            msg,
+		"service_description":      "Load",
+		"state":                    0,
+		"state_type":               "HARD",
+		"time":                     timestamp,
+		"type":                     "SERVICE ALERT",
+		"command_name":             "",
+		"current_service_contacts": []interface{}{},
+		"current_host_contacts":    []interface{}{},
+	}
+	s.entries = append([]map[string]interface{}{entry}, s.entries...)
+}
+
+func (s *testLogSource) fetch(columns []string, since int64) (ResultSet, error) {
+	s.fetches = append(s.fetches, since)
+	res := make(ResultSet, 0)
+	for _, entry := range s.entries {
+		if interface2int64(entry["time"]) < since {
+			continue
+		}
+		row := make([]interface{}, 0, len(columns))
+		for _, col := range columns {
+			row = append(row, entry[col])
+		}
+		res = append(res, row)
+	}
+	return res, nil
+}
+
+func testLogCacheRequest(t *testing.T, lmd *LMDInstance, query string) *Request {
+	t.Helper()
+	buf := bufio.NewReader(bytes.NewBufferString(query))
+	req, _, err := NewRequest(context.TODO(), lmd, buf, ParseOptimize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return req
+}
+
+func TestLogCache(t *testing.T) {
+	lmd := createTestLMDInstance()
+	peer := NewPeer(lmd, &Connection{Source: []string{"test.sock"}, Name: "TestPeer", ID: "testid", LogCacheWindow: 3600})
+	now := time.Now().Unix()
+	source := &testLogSource{}
+	source.add(now-7000, "old")
+	source.add(now-300, "first")
+	source.add(now-200, "second")
+	source.add(now-100, "third")
+	cache := NewLogCache(peer, source.fetch)
+
+	req := testLogCacheRequest(t, lmd, fmt.Sprintf("GET log\nColumns: time plugin_output\nFilter: time >= %d\n\n", now-250))
+	res, ok := cache.Query(req, 1)
+	if err := assertEq(true, ok); err != nil {
+		t.Fatal(err)
+	}
+	if err := assertEq(2, len(res)); err != nil {
+		t.Fatal(err)
+	}
+	// same order as returned by the core
+	if err := assertEq("third", res[0][1]); err != nil {
+		t.Error(err)
+	}
+	if source.fetches[0] < now-3600 || source.fetches[0] > now-3599 {
+		t.Errorf("expected initial fetch of the last hour, got fetch since %d", source.fetches[0])
+	}
+
+	// limits and filters are applied
+	req = testLogCacheRequest(t, lmd, fmt.Sprintf("GET log\nColumns: plugin_output\nFilter: time > %d\nFilter: plugin_output != third\nLimit: 1\n\n", now-1000))
+	res, ok = cache.Query(req, 1)
+	if err := assertEq(true, ok); err != nil {
+		t.Fatal(err)
+	}
+	if err := assertEq(ResultSet{{"second"}}, res); err != nil {
+		t.Error(err)
+	}
+
+	// stats are calculated locally
+	req = testLogCacheRequest(t, lmd, fmt.Sprintf("GET log\nFilter: time >= %d\nStats: state = 0\nStats: max time\n\n", now-1000))
+	res, ok = cache.Query(req, 1)
+	if err := assertEq(true, ok); err != nil {
+		t.Fatal(err)
+	}
+	if err := assertEq(ResultSet{{3.0, float64(now - 100)}}, res); err != nil {
+		t.Error(err)
+	}
+
+	// new entries are fetched incrementally without duplicates
+	source.add(time.Now().Unix(), "fourth")
+	req = testLogCacheRequest(t, lmd, fmt.Sprintf("GET log\nColumns: plugin_output\nFilter: time >= %d\n\n", now-1000))
+	res, _ = cache.Query(req, 1)
+	if err := assertEq(4, len(res)); err != nil {
+		t.Error(err)
+	}
+	if source.fetches[len(source.fetches)-1] < now {
+		t.Errorf("expected incremental fetch, got full fetch since %d", source.fetches[len(source.fetches)-1])
+	}
+
+	// older time ranges and unlimited queries are passed through
+	for _, query := range []string{
+		fmt.Sprintf("GET log\nColumns: time\nFilter: time >= %d\n\n", now-7200),
+		"GET log\nColumns: time\n\n",
+		fmt.Sprintf("GET log\nColumns: time\nFilter: time >= %d\nFilter: time < %d\nOr: 2\n\n", now-100, now-7200),
+		fmt.Sprintf("GET log\nColumns: time\nFilter: time >= %d\nAuthUser: test\n\n", now-100),
+	} {
+		_, ok = cache.Query(testLogCacheRequest(t, lmd, query), 1)
+		if err := assertEq(false, ok); err != nil {
+			t.Errorf("%s: %s", query, err)
+		}
+	}
+
+	// core restart invalidates the cache
+	numFetches := len(source.fetches)
+	_, ok = cache.Query(req, 2)
+	if err := assertEq(true, ok); err != nil {
+		t.Fatal(err)
+	}
+	if err := assertEq(numFetches+1, len(source.fetches)); err != nil {
+		t.Error(err)
+	}
+	if source.fetches[numFetches] > now-3599 {
+		t.Errorf("expected full fetch after restart, got fetch since %d", source.fetches[numFetches])
+	}
+}
+
+func TestLogCacheMaxEntries(t *testing.T) {
+	lmd := createTestLMDInstance()
+	peer := NewPeer(lmd, &Connection{Source: []string{"test.sock"}, Name: "TestPeer", ID: "testid", LogCacheWindow: 3600, LogCacheMaxEntries: 2})
+	now := time.Now().Unix()
+	source := &testLogSource{}
+	source.add(now-300, "first")
+	source.add(now-200, "second")
+	source.add(now-100, "third")
+	cache := NewLogCache(peer, source.fetch)
+
+	req := testLogCacheRequest(t, lmd, fmt.Sprintf("GET log\nColumns: plugin_output\nFilter: time >= %d\n\n", now-250))
+	res, ok := cache.Query(req, 1)
+	if err := assertEq(true, ok); err != nil {
+		t.Fatal(err)
+	}
+	if err := assertEq(ResultSet{{"third"}, {"second"}}, res); err != nil {
+		t.Error(err)
+	}
+
+	// dropped entries are no longer covered
+	req = testLogCacheRequest(t, lmd, fmt.Sprintf("GET log\nColumns: plugin_output\nFilter: time >= %d\n\n", now-300))
+	_, ok = cache.Query(req, 1)
+	if err := assertEq(false, ok); err != nil {
+		t.Error(err)
+	}
+}
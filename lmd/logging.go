@@ -5,10 +5,14 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"path/filepath"
 	"reflect"
 	"runtime/debug"
 	"strings"
+	"sync/atomic"
+	"time"
 
+	jsoniter "github.com/json-iterator/go"
 	"github.com/kdar/factorlog"
 )
 
@@ -46,6 +50,9 @@ const (
 // initialize standard logger which will be configured later from the configuration file options
 var log = factorlog.New(os.Stdout, factorlog.NewStdFormatter(LogFormat))
 
+// logStructured is set if every log record is written as json object, see LogJSON
+var logStructured atomic.Bool
+
 // InitLogging initializes the logging system.
 func InitLogging(conf *Config) {
 	var logFormatter factorlog.Formatter
@@ -68,6 +75,10 @@ func InitLogging(conf *Config) {
 	if err != nil {
 		panic(fmt.Sprintf("failed to initialize logger: %s", err.Error()))
 	}
+	if conf.LogJSON {
+		logFormatter = &jsonLogFormatter{}
+	}
+	logStructured.Store(conf.LogJSON)
 	var LogLevel = "Warn"
 	if conf.LogLevel != "" {
 		LogLevel = conf.LogLevel
@@ -119,46 +130,68 @@ func NewLogWriter(level string) *LogWriter {
 }
 
 type LogPrefixer struct {
-	pre []interface{}
+	pre    []interface{}
+	fields map[string]interface{} // additional fields, only used for structured logging
 }
 
 const LoggerCalldepth = 2
 
 func (l *LogPrefixer) Panicf(format string, v ...interface{}) {
-	log.Output(factorlog.PANIC, LoggerCalldepth, fmt.Sprintf(l.prefix()+" "+format, v...))
+	log.Output(factorlog.PANIC, LoggerCalldepth, l.message(format, v))
 }
 
 func (l *LogPrefixer) Fatalf(format string, v ...interface{}) {
-	log.Output(factorlog.FATAL, LoggerCalldepth, fmt.Sprintf(l.prefix()+" "+format, v...))
+	log.Output(factorlog.FATAL, LoggerCalldepth, l.message(format, v))
 }
 
 func (l *LogPrefixer) Errorf(format string, v ...interface{}) {
-	log.Output(factorlog.ERROR, LoggerCalldepth, fmt.Sprintf(l.prefix()+" "+format, v...))
+	log.Output(factorlog.ERROR, LoggerCalldepth, l.message(format, v))
 }
 
 func (l *LogPrefixer) Warnf(format string, v ...interface{}) {
-	log.Output(factorlog.WARN, LoggerCalldepth, fmt.Sprintf(l.prefix()+" "+format, v...))
+	log.Output(factorlog.WARN, LoggerCalldepth, l.message(format, v))
 }
 
 func (l *LogPrefixer) Infof(format string, v ...interface{}) {
 	if !log.IsV(LogVerbosityDefault) {
 		return
 	}
-	log.Output(factorlog.INFO, LoggerCalldepth, fmt.Sprintf(l.prefix()+" "+format, v...))
+	log.Output(factorlog.INFO, LoggerCalldepth, l.message(format, v))
 }
 
 func (l *LogPrefixer) Debugf(format string, v ...interface{}) {
 	if !log.IsV(LogVerbosityDebug) {
 		return
 	}
-	log.Output(factorlog.DEBUG, LoggerCalldepth, fmt.Sprintf(l.prefix()+" "+format, v...))
+	log.Output(factorlog.DEBUG, LoggerCalldepth, l.message(format, v))
 }
 
 func (l *LogPrefixer) Tracef(format string, v ...interface{}) {
 	if !log.IsV(LogVerbosityTrace) {
 		return
 	}
-	log.Output(factorlog.TRACE, LoggerCalldepth, fmt.Sprintf(l.prefix()+" "+format, v...))
+	log.Output(factorlog.TRACE, LoggerCalldepth, l.message(format, v))
+}
+
+// message returns the prefixed log message or a log record with all fields in structured mode.
+func (l *LogPrefixer) message(format string, v []interface{}) interface{} {
+	if !logStructured.Load() {
+		return fmt.Sprintf(l.prefix()+" "+format, v...)
+	}
+	return &logRecord{
+		prefix:  l.prefix(),
+		message: fmt.Sprintf(format, v...),
+		fields:  l.structuredFields(),
+	}
+}
+
+// withField adds a field to structured log records.
+func (l *LogPrefixer) withField(key string, value interface{}) *LogPrefixer {
+	if l.fields == nil {
+		l.fields = make(map[string]interface{})
+	}
+	l.fields[key] = value
+	return l
 }
 
 // LogErrors can be used as generic logger with a prefix
@@ -222,6 +255,130 @@ func (l *LogPrefixer) prefix() (prefix string) {
 	return prefix
 }
 
+// structuredFields returns the same information as prefix as fields for structured log records.
+func (l *LogPrefixer) structuredFields() map[string]interface{} {
+	fields := make(map[string]interface{}, len(l.fields)+4)
+	for key, value := range l.fields {
+		fields[key] = value
+	}
+	prefixes := make([]string, 0)
+	for _, p := range l.pre {
+		if v, ok := p.(string); ok {
+			prefixes = append(prefixes, v)
+			continue
+		}
+		if p == nil || reflect.ValueOf(p).Pointer() == 0 {
+			continue
+		}
+		switch v := p.(type) {
+		case *Peer:
+			fields["peer_id"] = v.ID
+			fields["peer_name"] = v.Name
+		case *Request:
+			setRequestFields(fields, v)
+		case *Response:
+			setRequestFields(fields, v.Request)
+		case *ClientConnection:
+			fields["client"] = v.remoteAddr
+			fields["listener"] = v.localAddr
+		case *DataRow:
+			fields["peer_id"] = v.DataStore.PeerKey
+			fields["peer_name"] = v.DataStore.PeerName
+		case *DataStore:
+			fields["peer_id"] = v.PeerKey
+			fields["peer_name"] = v.PeerName
+		case *DataStoreSet:
+			fields["peer_id"] = v.peer.ID
+			fields["peer_name"] = v.peer.Name
+		case context.Context:
+			if value := v.Value(CtxPeer); value != nil {
+				fields["peer_name"] = value
+			}
+			if value, ok := v.Value(CtxClient).(string); ok {
+				// client contexts contain the remote and the listener address
+				client, listener, found := strings.Cut(value, "->")
+				fields["client"] = client
+				if found {
+					fields["listener"] = listener
+				}
+			}
+			if value := v.Value(CtxRequest); value != nil {
+				fields["request_id"] = value
+			}
+		default:
+			log.Panicf("unsupported prefix type: %#v (%T)", p, p)
+		}
+	}
+	if len(prefixes) > 0 {
+		fields["prefix"] = strings.Join(prefixes, " ")
+	}
+	return fields
+}
+
+func setRequestFields(fields map[string]interface{}, req *Request) {
+	if req == nil {
+		return
+	}
+	fields["request_id"] = req.ID()
+	if req.Command == "" {
+		fields["table"] = req.Table.String()
+	}
+}
+
+// logRecord is a single structured log message along with its fields.
+type logRecord struct {
+	prefix  string
+	message string
+	fields  map[string]interface{}
+}
+
+// String returns the prefixed message, ex.: if structured logging has been disabled meanwhile.
+func (r *logRecord) String() string {
+	return r.prefix + " " + r.message
+}
+
+// jsonLogFormatter writes every log message as single line json object.
+type jsonLogFormatter struct{}
+
+// ShouldRuntimeCaller returns true, the caller is always added to the log record.
+func (f *jsonLogFormatter) ShouldRuntimeCaller() bool {
+	return true
+}
+
+// Format returns the json object for a log message.
+func (f *jsonLogFormatter) Format(context factorlog.LogContext) []byte {
+	fields := make(map[string]interface{})
+	var message string
+	switch {
+	case len(context.Args) == 1 && isLogRecord(context.Args[0]):
+		record, _ := context.Args[0].(*logRecord)
+		for key, value := range record.fields {
+			fields[key] = value
+		}
+		message = record.message
+	case context.Format != nil:
+		message = fmt.Sprintf(*context.Format, context.Args...)
+	default:
+		message = fmt.Sprint(context.Args...)
+	}
+	fields["timestamp"] = context.Time.Format(time.RFC3339Nano)
+	fields["level"] = factorlog.LcSeverityStrings[factorlog.SeverityToIndex(context.Severity)]
+	fields["pid"] = context.Pid
+	fields["caller"] = fmt.Sprintf("%s:%d", filepath.Base(context.File), context.Line)
+	fields["message"] = strings.TrimSpace(message)
+
+	buf, err := jsoniter.ConfigCompatibleWithStandardLibrary.Marshal(fields)
+	if err != nil {
+		return []byte(fmt.Sprintf("{\"level\":\"error\",\"message\":%q}\n", "failed to format log message: "+err.Error()))
+	}
+	return append(buf, '\n')
+}
+
+func isLogRecord(arg interface{}) bool {
+	_, ok := arg.(*logRecord)
+	return ok
+}
+
 // return logger with prefixed strings from given objects
 func logWith(pre ...interface{}) *LogPrefixer {
 	return &LogPrefixer{pre: pre}
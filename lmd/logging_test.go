@@ -5,6 +5,8 @@ import (
 	"context"
 	"os"
 	"testing"
+
+	jsoniter "github.com/json-iterator/go"
 )
 
 func TestLogger(t *testing.T) {
@@ -31,3 +33,44 @@ func TestLogger(t *testing.T) {
 		t.Error(err)
 	}
 }
+
+func TestLoggerJSON(t *testing.T) {
+	InitLogging(&Config{LogLevel: "Info", LogFile: "stdout", LogJSON: true})
+	defer InitLogging(&Config{LogLevel: testLogLevel, LogFile: testLogTarget})
+	buf := new(bytes.Buffer)
+	log.SetOutput(buf)
+	defer log.SetOutput(os.Stdout)
+
+	p := &Peer{ID: "id1", Name: "peer1"}
+	c := context.WithValue(context.Background(), CtxClient, "testclient->:6557")
+	logWith(p, c).withField("extra", 5).Warnf("test %s", "message")
+
+	record := make(map[string]interface{})
+	if err := jsoniter.Unmarshal(buf.Bytes(), &record); err != nil {
+		t.Fatalf("failed to parse log output: %s\n%s", err, buf.String())
+	}
+	expect := map[string]interface{}{
+		"level":     "warn",
+		"message":   "test message",
+		"peer_id":   "id1",
+		"peer_name": "peer1",
+		"client":    "testclient",
+		"listener":  ":6557",
+		"extra":     5.0,
+	}
+	for key, value := range expect {
+		if err := assertEq(value, record[key]); err != nil {
+			t.Errorf("%s: %s", key, err)
+		}
+	}
+	if _, ok := record["timestamp"]; !ok {
+		t.Errorf("timestamp missing in log record")
+	}
+
+	// messages from the plain logger are formatted as json as well
+	buf.Reset()
+	log.Errorf("plain %d", 1)
+	if err := assertLike(`"message":"plain 1"`, buf.String()); err != nil {
+		t.Error(err)
+	}
+}
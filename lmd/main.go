@@ -27,9 +27,11 @@ import (
 	"runtime"
 	"runtime/debug"
 	"runtime/pprof"
+	"slices"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
@@ -54,6 +56,21 @@ const (
 	// AuthStrict is used for strict authorization when host contacts are not granted all services
 	AuthStrict = "strict"
 
+	// TimeFilterPolicyNone passes log queries without time filter to the backends unchanged
+	TimeFilterPolicyNone = "none"
+
+	// TimeFilterPolicyReject rejects log queries without time filter
+	TimeFilterPolicyReject = "reject"
+
+	// TimeFilterPolicyLookback limits log queries without time filter to the default lookback
+	TimeFilterPolicyLookback = "lookback"
+
+	// CommandRoutingAll sends routed commands to all backends owning the host
+	CommandRoutingAll = "all"
+
+	// CommandRoutingFirst sends routed commands to the first backend owning the host only
+	CommandRoutingFirst = "first"
+
 	// ExitCritical is used to non-ok exits
 	ExitCritical = 2
 
@@ -81,6 +98,48 @@ const (
 	// DefaultMaxQueryFilter sets the default number of max query filters
 	DefaultMaxQueryFilter = 1000
 
+	// DefaultMaxQueryColumns sets the default number of max query columns
+	DefaultMaxQueryColumns = 1000
+
+	// DefaultMaxRequestSize sets the default max size of a single request in bytes
+	DefaultMaxRequestSize = 10 * 1024 * 1024
+
+	// DefaultMaxRequestHeaders sets the default number of max header lines of a single request
+	DefaultMaxRequestHeaders = 10000
+
+	// DefaultMaxQueuedQueries sets the default number of queries waiting for a free slot if MaxConcurrentQueries is reached
+	DefaultMaxQueuedQueries = 100
+
+	// DefaultQueryQueueTimeout sets the default time in seconds queries wait for a free slot
+	DefaultQueryQueueTimeout = 10
+
+	// DefaultNodeFailoverThreshold sets the default number of missed heartbeats after which a cluster node is considered down
+	DefaultNodeFailoverThreshold = 3
+
+	// DefaultPassThroughLookback sets the default lookback in seconds for log queries without time filter
+	DefaultPassThroughLookback = 86400
+
+	// DefaultPassThroughDedupMaxEntries sets the default number of rows tracked by the passthrough deduplication
+	DefaultPassThroughDedupMaxEntries = 1000000
+
+	// DefaultResponseWorkersPerCPU sets the default number of parallel response workers per cpu
+	DefaultResponseWorkersPerCPU = 4
+
+	// DefaultParallelScanMinRows sets the default minimum number of rows of a single table before it is scanned in parallel
+	DefaultParallelScanMinRows = 50000
+
+	// DefaultCancelCheckLatency sets the default target latency in milliseconds to notice canceled queries
+	DefaultCancelCheckLatency = 100
+
+	// DefaultResponseSpillThreshold sets the default size in megabytes of buffered responses before they are spilled to a temporary file
+	DefaultResponseSpillThreshold = 100
+
+	// DefaultMaxQueryMemory sets the default memory budget in megabytes of a single query, zero disables the limit
+	DefaultMaxQueryMemory = 0
+
+	// DefaultSlowQueryLogSize sets the default number of slow queries kept in memory for the slowqueries table
+	DefaultSlowQueryLogSize = 100
+
 	// ThrukMultiBackendMinVersion is the minimum required thruk version
 	ThrukMultiBackendMinVersion = 2.23
 )
@@ -90,9 +149,10 @@ type ContextKey string
 
 // available ContextKeys
 const (
-	CtxPeer    ContextKey = "peer"
-	CtxClient  ContextKey = "client"
-	CtxRequest ContextKey = "request"
+	CtxPeer     ContextKey = "peer"
+	CtxClient   ContextKey = "client"
+	CtxRequest  ContextKey = "request"
+	CtxHTTPUser ContextKey = "httpuser"
 )
 
 // https://github.com/golang/go/issues/8005#issuecomment-190753527
@@ -137,6 +197,9 @@ type LMDInstance struct {
 	Listeners         map[string]*Listener // Listeners stores if we started a listener
 	ListenersLock     *deadlock.RWMutex    // ListenersLock is the lock for the Listeners map
 	nodeAccessor      *Nodes               // nodeAccessor manages cluster nodes and starts/stops peers.
+	responseWorkers   *Limiter             // responseWorkers limits the number of parallel response workers.
+	queryLimiter      *Limiter             // queryLimiter limits the number of concurrently executing queries.
+	queuedQueries     atomic.Int32         // queuedQueries counts the queries waiting for a free queryLimiter slot.
 	waitGroupInit     *sync.WaitGroup
 	waitGroupListener *sync.WaitGroup
 	waitGroupPeers    *sync.WaitGroup
@@ -161,6 +224,10 @@ type LMDInstance struct {
 	initChannel              chan bool
 	lastMainRestart          float64
 	cpuProfileHandler        *os.File
+	slowQueries              *SlowQueryLog           // slowQueries keeps the most recent slow queries
+	runningQueries           *QueryRegistry          // runningQueries keeps track of all queries in progress
+	activeRequests           atomic.Int64            // activeRequests counts client requests in progress including sending the response
+	activatedSockets         map[string]net.Listener // activatedSockets contains the sockets inherited from systemd by Listen entry
 	defaultReqestParseOption ParseOptions
 }
 
@@ -204,6 +271,8 @@ func NewLMDInstance() (lmd *LMDInstance) {
 		waitGroupListener:        &sync.WaitGroup{},
 		waitGroupPeers:           &sync.WaitGroup{},
 		shutdownChannel:          make(chan bool),
+		slowQueries:              NewSlowQueryLog(),
+		runningQueries:           NewQueryRegistry(),
 		defaultReqestParseOption: ParseOptimize,
 	}
 	return
@@ -262,6 +331,8 @@ func (lmd *LMDInstance) mainLoop() (exitCode int) {
 
 	CompressionLevel = localConfig.CompressionLevel
 	CompressionMinimumSize = localConfig.CompressionMinimumSize
+	lmd.responseWorkers = NewLimiter(localConfig.MaxParallelResponseWorkers)
+	lmd.queryLimiter = NewLimiter(localConfig.MaxConcurrentQueries)
 
 	// put some configuration settings into metrics
 	promPeerUpdateInterval.Set(float64(localConfig.Updateinterval))
@@ -305,6 +376,11 @@ func (lmd *LMDInstance) mainLoop() (exitCode int) {
 		qStat = NewQueryStats()
 	}
 
+	// take over the sockets from systemd socket activation once on startup
+	if lmd.activatedSockets == nil {
+		lmd.activatedSockets = inheritSystemdSockets(localConfig.Listen)
+	}
+
 	// start local listeners
 	lmd.initializeListeners(qStat)
 
@@ -431,6 +507,34 @@ func (lmd *LMDInstance) initializeListeners(qStat *QueryStats) {
 	lmd.ListenersLock.Unlock()
 }
 
+// drainRequests waits up to ShutdownDrainTimeout for all in-flight client requests to finish.
+func (lmd *LMDInstance) drainRequests() {
+	timeout := time.Duration(lmd.Config.ShutdownDrainTimeout) * time.Second
+	lmd.runningQueries.Drain(timeout, nil, func() int {
+		return int(lmd.activeRequests.Load())
+	})
+}
+
+// drainRemovedPeers waits up to ShutdownDrainTimeout for all queries using peers which are no longer
+// part of the configuration. Queries not touching these peers are not affected.
+func (lmd *LMDInstance) drainRemovedPeers() {
+	removed := make(map[string]bool)
+	lmd.PeerMapLock.RLock()
+	for id := range lmd.PeerMap {
+		if !slices.ContainsFunc(lmd.Config.Connections, func(c Connection) bool { return c.ID == id }) {
+			removed[id] = true
+		}
+	}
+	lmd.PeerMapLock.RUnlock()
+	if len(removed) == 0 {
+		return
+	}
+	timeout := time.Duration(lmd.Config.ShutdownDrainTimeout) * time.Second
+	lmd.runningQueries.Drain(timeout, func(query *RunningQuery) bool {
+		return slices.ContainsFunc(query.Backends, func(id string) bool { return removed[id] })
+	}, nil)
+}
+
 func (lmd *LMDInstance) initializePeers() {
 	// This node's http address (http://*:1234), to be used as address pattern
 	var nodeListenAddress string
@@ -444,6 +548,7 @@ func (lmd *LMDInstance) initializePeers() {
 	}
 
 	// Get rid of obsolete peers (removed from config)
+	lmd.drainRemovedPeers()
 	lmd.PeerMapLock.Lock()
 	for id := range lmd.PeerMap {
 		found := false // id exists
@@ -719,7 +824,6 @@ func (lmd *LMDInstance) mainSignalHandler(sig os.Signal, prometheusListener io.C
 	switch sig {
 	case syscall.SIGTERM:
 		log.Infof("got sigterm, quiting gracefully")
-		close(lmd.shutdownChannel)
 		lmd.ListenersLock.Lock()
 		for con, l := range lmd.Listeners {
 			delete(lmd.Listeners, con)
@@ -729,6 +833,9 @@ func (lmd *LMDInstance) mainSignalHandler(sig os.Signal, prometheusListener io.C
 		if prometheusListener != nil {
 			prometheusListener.Close()
 		}
+		// no new connections are accepted anymore, let running requests finish before stopping the peers
+		lmd.drainRequests()
+		close(lmd.shutdownChannel)
 		lmd.waitGroupListener.Wait()
 		lmd.waitGroupPeers.Wait()
 		lmd.onExit(qStat)
@@ -789,11 +896,16 @@ func (lmd *LMDInstance) mainSignalHandler(sig os.Signal, prometheusListener io.C
 
 func logThreaddump() {
 	log.Errorf("*** full thread dump:")
+	log.Errorf("%s", threadDump())
+}
+
+// threadDump returns the stacktraces of all goroutines.
+func threadDump() []byte {
 	buf := make([]byte, 1<<16)
 	if n := runtime.Stack(buf, true); n < len(buf) {
 		buf = buf[:n]
 	}
-	log.Errorf("%s", buf)
+	return buf
 }
 
 // waitTimeout waits for the waitgroup for the specified max timeout.
@@ -826,6 +938,15 @@ func (lmd *LMDInstance) PrintVersion() {
 
 func (lmd *LMDInstance) logPanicExit() {
 	if r := recover(); r != nil {
+		if logStructured.Load() {
+			logWith().
+				withField("panic", fmt.Sprintf("%s", r)).
+				withField("version", Version()).
+				withField("stack", string(debug.Stack())).
+				Errorf("panic: %s", r)
+			deletePidFile(lmd.flags.flagPidfile)
+			os.Exit(ExitCritical)
+		}
 		log.Errorf("Panic: %s", r)
 		log.Errorf("Version: %s", Version())
 		log.Errorf("%s", debug.Stack())
@@ -851,6 +972,9 @@ func (lmd *LMDInstance) PeerMapRemove(peerID string) {
 			break
 		}
 	}
+	if p, ok := lmd.PeerMap[peerID]; ok {
+		removePeerMetrics(p.Name)
+	}
 	delete(lmd.PeerMap, peerID)
 }
 
@@ -879,9 +1003,20 @@ func ByteCountBinary(b int64) string {
 
 func updateStatistics(qStat *QueryStats) {
 	size := dedup.Size()
+	stats := dedup.Statistics()
 	promStringDedupCount.Set(float64(size))
-	promStringDedupBytes.Set(float64(dedup.Statistics().BytesInMemory))
+	promStringDedupBytes.Set(float64(stats.BytesInMemory))
 	promStringDedupIndexBytes.Set(float64(32 * size))
+	if stats.ItemsAdded+stats.ItemsSaved > 0 {
+		promStringDedupHitRate.Set(float64(stats.ItemsSaved) / float64(stats.ItemsAdded+stats.ItemsSaved))
+	}
+
+	removed := stringListDedup.Compact(StringListPoolMaxAge)
+	if removed > 0 {
+		log.Debugf("removed %d unused string lists from pool", removed)
+	}
+	promStringListDedupCount.Set(float64(stringListDedup.Size()))
+	promStringListDedupHitRate.Set(stringListDedup.HitRate())
 	if qStat != nil {
 		qStat.LogTrigger <- true
 	}
@@ -893,7 +1028,7 @@ func getMinimalTLSConfig(localConfig *Config) *tls.Config {
 	}
 	if localConfig.TLSMinVersion != "" {
 		tlsMinVersion, err := parseTLSMinVersion(localConfig.TLSMinVersion)
-		if err != nil {
+		if err == nil {
 			config.MinVersion = tlsMinVersion
 		}
 	}
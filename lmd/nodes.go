@@ -5,9 +5,11 @@ import (
 	"context"
 	"crypto/rand"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"regexp"
+	"slices"
 	"sort"
 	"strconv"
 	"strings"
@@ -17,6 +19,14 @@ import (
 
 var reNodeAddress = regexp.MustCompile(`^(https?)?(://)?(.*?)(:(\d+))?(/.*)?$`)
 
+var (
+	// errBackendNotHandled is reported for requested backends which are not answered by any cluster node
+	errBackendNotHandled = errors.New("backend is not handled by any cluster node")
+
+	// errBackendNotThisNode is reported by a cluster node for requested backends it does not answer
+	errBackendNotThisNode = errors.New("backend is not handled by this cluster node")
+)
+
 // Nodes is the cluster management object.
 type Nodes struct {
 	noCopy           noCopy
@@ -26,23 +36,58 @@ type Nodes struct {
 	ShutdownChannel  chan bool
 	loopInterval     int
 	heartbeatTimeout int
+	failoverLimit    int // number of missed heartbeats after which a node is considered down
 	backends         []string
 	thisNode         *NodeAddress
 	nodeAddresses    NodeAddressList
 	onlineNodes      NodeAddressList
-	assignedBackends []string
-	nodeBackends     map[string][]string
+	started          time.Time
+	lock             sync.RWMutex        // protects assignedBackends, nodeBackends and the node states
+	assignedBackends []string            // backends started on this node
+	nodeBackends     map[string][]string // backends answered by each online node, used to route queries
 	stopChannel      chan bool
 	lmd              *LMDInstance
 }
 
 // NodeAddress contains the ip of a node (plus url/port, if necessary)
 type NodeAddress struct {
-	id   string
-	ip   string
-	port int
-	url  string
-	isMe bool
+	id       string
+	ip       string
+	port     int
+	url      string
+	isMe     bool
+	online   bool      // node answered within the last failoverLimit heartbeats
+	missed   int       // number of consecutive missed heartbeats
+	claimed  []string  // backends started on this node as reported by its last heartbeat
+	ready    []string  // claimed backends which finished their initial sync
+	lastSeen time.Time // time of the last answered heartbeat
+	version  string    // lmd version reported by the node
+	started  int64     // unix timestamp when the node started
+}
+
+// nodePing contains the result of a single heartbeat.
+type nodePing struct {
+	node    *NodeAddress
+	online  bool
+	id      string
+	version string
+	started int64
+	claimed []string
+	ready   []string
+}
+
+// NodeInfo contains the state of a cluster node, used for the nodes table.
+type NodeInfo struct {
+	ID       string
+	Address  string
+	URL      string
+	IsMe     bool
+	Online   bool
+	Missed   int
+	LastSeen time.Time
+	Version  string
+	Started  int64
+	Backends []string
 }
 
 // String returns the node address.
@@ -75,6 +120,7 @@ func NewNodes(lmd *LMDInstance, addresses []string, listen string) *Nodes {
 		ShutdownChannel: lmd.shutdownChannel,
 		stopChannel:     make(chan bool),
 		nodeBackends:    make(map[string][]string),
+		failoverLimit:   lmd.Config.NodeFailoverThreshold,
 		lmd:             lmd,
 	}
 	tlsConfig := getMinimalTLSConfig(lmd.Config)
@@ -154,10 +200,14 @@ func (n *Nodes) Initialize() {
 	if n.heartbeatTimeout == 0 {
 		n.heartbeatTimeout = 3
 	}
+	if n.failoverLimit <= 0 {
+		n.failoverLimit = DefaultNodeFailoverThreshold
+	}
 
 	// Generate identifier
 	ownIdentifier := &n.ID
-	*ownIdentifier = strconv.FormatInt(time.Now().Unix(), 10)
+	n.started = time.Now()
+	*ownIdentifier = strconv.FormatInt(n.started.Unix(), 10)
 	*ownIdentifier += ":" + generateUUID()
 
 	// Wait for own listener(s) to initialize
@@ -223,6 +273,7 @@ func (n *Nodes) loop() {
 
 // checkNodeAvailability pings all partner nodes to determine which ones are online.
 // When called for the first time during initialization, it also identifies this node.
+// Nodes are considered down after failoverLimit consecutive missed heartbeats.
 func (n *Nodes) checkNodeAvailability() {
 	// Send ping to all nodes
 	// First ping (initializing) detects and assigns own address.
@@ -231,12 +282,9 @@ func (n *Nodes) checkNodeAvailability() {
 	if ownIdentifier == "" {
 		panic("not initialized")
 	}
-	var newOnlineNodes NodeAddressList
 	initializing := n.thisNode == nil
-	if !initializing {
-		newOnlineNodes = append(newOnlineNodes, n.thisNode)
-	}
-	redistribute := false
+	ourBackends := strings.Join(n.AssignedBackends(), ";")
+	results := make(chan *nodePing, len(n.nodeAddresses))
 	for _, node := range n.nodeAddresses {
 		if !initializing && node.isMe {
 			// Skip this node unless we're initializing
@@ -244,19 +292,15 @@ func (n *Nodes) checkNodeAvailability() {
 		}
 		requestData := make(map[string]interface{})
 		requestData["identifier"] = ownIdentifier
-		requestData["peers"] = strings.Join(n.nodeBackends[node.id], ";")
+		requestData["peers"] = ourBackends
 		log.Tracef("pinging node %s...", node)
 		wg.Add(1)
 		go func(wg *sync.WaitGroup, node *NodeAddress) {
 			defer n.lmd.logPanicExit()
-			isOnline, forceRedistribute := n.sendPing(node, initializing, requestData)
-			if forceRedistribute {
-				redistribute = true
+			defer wg.Done()
+			if ping := n.sendPing(node, initializing, requestData); ping != nil {
+				results <- ping
 			}
-			if isOnline {
-				newOnlineNodes = append(newOnlineNodes, node)
-			}
-			wg.Done()
 		}(&wg, node)
 	}
 	// Handle timeout
@@ -273,70 +317,171 @@ func (n *Nodes) checkNodeAvailability() {
 		}
 	}
 
-	// Redistribute backends
-	if redistribute || n.onlineNodes.String() != newOnlineNodes.String() {
-		n.onlineNodes = newOnlineNodes
-		n.redistribute()
+	// late responses count as missed heartbeats
+	pings := make(map[*NodeAddress]*nodePing)
+	for len(results) > 0 {
+		ping := <-results
+		pings[ping.node] = ping
+	}
+	var newOnlineNodes NodeAddressList
+	n.lock.Lock()
+	for _, node := range n.nodeAddresses {
+		if node.isMe {
+			node.online = true
+			node.lastSeen = time.Now()
+			node.version = Version()
+			node.started = n.started.Unix()
+		} else {
+			n.updateNodeStatus(node, pings[node])
+		}
+		if node.online {
+			newOnlineNodes = append(newOnlineNodes, node)
+		}
+	}
+	n.lock.Unlock()
+	if n.onlineNodes.String() != newOnlineNodes.String() {
+		log.Infof("redistributing peers within cluster, %d/%d nodes online", len(newOnlineNodes), len(n.nodeAddresses))
+	}
+	n.onlineNodes = newOnlineNodes
+
+	// backends are redistributed on every check, so they are handed back once the returning node is warm
+	n.redistribute()
+}
+
+// updateNodeStatus updates the state of a partner node from the result of its heartbeat, nil means no response.
+// The caller must hold the nodes lock.
+func (n *Nodes) updateNodeStatus(node *NodeAddress, ping *nodePing) {
+	if ping != nil {
+		if ping.id != "" && node.id != ping.id {
+			if node.id != "" {
+				log.Infof("partner node %s restarted", node)
+			}
+			node.id = ping.id
+		}
+		node.lastSeen = time.Now()
+		node.version = ping.version
+		node.started = ping.started
+	}
+	if ping != nil && ping.online {
+		if !node.online && node.missed > 0 {
+			log.Infof("partner node %s is back online", node)
+		}
+		node.online = true
+		node.missed = 0
+		node.claimed = ping.claimed
+		node.ready = ping.ready
+		return
+	}
+	node.missed++
+	if ping != nil {
+		// answered, but cannot be used, ex.: version mismatch
+		node.missed = n.failoverLimit
+	}
+	if node.online && node.missed >= n.failoverLimit {
+		log.Warnf("partner node %s missed %d heartbeats, taking over its backends", node, node.missed)
+	}
+	if node.missed >= n.failoverLimit {
+		node.online = false
+		node.claimed = nil
+		node.ready = nil
 	}
 }
 
 // redistribute assigns the peers to the available nodes.
 // It starts peers assigned to this node and stops other peers.
 func (n *Nodes) redistribute() {
-	// Nodes and backends
-	numberBackends := len(n.backends)
-	ownIndex, nodeOnline, numberAllNodes, numberAvailableNodes := n.getOnlineNodes()
-	allNodes := n.nodeAddresses
-	log.Infof("redistributing peers within cluster, %d/%d nodes online", numberAvailableNodes, numberAllNodes)
-
-	// Assign items to nodes
-	assignedNumberBackends := make([]int, numberAllNodes) // for each node
-	if numberAvailableNodes >= numberBackends {
-		// No node has more than one backend
-		for i := range allNodes {
-			if !nodeOnline[i] {
-				continue
-			}
-			assignedNumberBackends[i] = 1
+	ownIndex := -1
+	for i, node := range n.nodeAddresses {
+		if node.isMe {
+			ownIndex = i
 		}
-	} else {
-		for i := range allNodes {
-			if !nodeOnline[i] {
-				continue
-			}
-			numberPerNode := numberBackends / numberAvailableNodes
-			if numberBackends%numberAvailableNodes != 0 {
-				numberPerNode++
-			}
-			assignedNumberBackends[i] = numberPerNode
+	}
+	if ownIndex == -1 {
+		return
+	}
+	n.updateBackends(assignBackends(n.backends, n.nodeAddresses, ownIndex))
+
+	// route queries to the nodes which started the backends
+	claims := make(map[string][]string)
+	for _, node := range n.nodeAddresses {
+		switch {
+		case node.isMe:
+			claims[node.id] = n.AssignedBackends()
+		case node.online:
+			claims[node.id] = node.claimed
 		}
 	}
+	nodeBackends := resolveBackends(claims)
+	n.lock.Lock()
+	n.nodeBackends = nodeBackends
+	n.lock.Unlock()
+}
 
-	// List backends that we're responsible for
-	assignedBackends := make([][]string, numberAllNodes) // for each node
-	nodeBackends := make(map[string][]string)
-	distributedCount := 0
-	for i, number := range assignedNumberBackends {
-		if number <= 0 {
+// assignBackends returns the backends owned by the node with index self.
+// Each node owns a fixed slice of the backends by its position in the node list. Backends
+// of offline nodes and backends which are not synced yet on a returning node are taken over
+// round-robin by the remaining online nodes. The result is the same on all nodes which agree
+// on the online nodes.
+func assignBackends(backends []string, nodes NodeAddressList, self int) (owned []string) {
+	numNodes := len(nodes)
+	if numNodes == 0 {
+		return nil
+	}
+	perNode := len(backends) / numNodes
+	if len(backends)%numNodes != 0 {
+		perNode++
+	}
+	perNode = max(perNode, 1)
+	for i, backend := range backends {
+		if backend == "" {
 			continue
 		}
-		list := make([]string, 0)
-		for j := 0; j < number; j++ {
-			if len(n.backends) > distributedCount+j {
-				if n.backends[distributedCount+j] != "" {
-					list = append(list, n.backends[distributedCount+j])
-				}
+		owner := min(i/perNode, numNodes-1)
+		switch {
+		case owner == self:
+			// own backends are always started, queries are routed elsewhere till they are synced
+			owned = append(owned, backend)
+			continue
+		case nodes[owner].online && slices.Contains(nodes[owner].ready, backend):
+			continue
+		}
+
+		// failover to the other online nodes
+		candidates := make([]int, 0, numNodes)
+		for j, node := range nodes {
+			if j != owner && (node.online || j == self) {
+				candidates = append(candidates, j)
 			}
 		}
-		distributedCount += number
-		assignedBackends[i] = list
-		id := allNodes[i].id
-		nodeBackends[id] = list
+		if len(candidates) > 0 && candidates[i%len(candidates)] == self {
+			owned = append(owned, backend)
+		}
 	}
-	n.nodeBackends = nodeBackends
-	ourBackends := assignedBackends[ownIndex]
+	return owned
+}
 
-	n.updateBackends(ourBackends)
+// resolveBackends assigns each backend to exactly one node. Backends claimed by multiple nodes,
+// ex.: while a returning node syncs its backends or after a split brain, are assigned to the node
+// with the lowest id, which is the node running the longest.
+func resolveBackends(claims map[string][]string) map[string][]string {
+	owner := make(map[string]string)
+	for id, backends := range claims {
+		for _, backend := range backends {
+			if current, ok := owner[backend]; !ok || id < current {
+				owner[backend] = id
+			}
+		}
+	}
+	resolved := make(map[string][]string, len(claims))
+	for id, backends := range claims {
+		resolved[id] = make([]string, 0, len(backends))
+		for _, backend := range backends {
+			if owner[backend] == id {
+				resolved[id] = append(resolved[id], backend)
+			}
+		}
+	}
+	return resolved
 }
 
 func (n *Nodes) updateBackends(ourBackends []string) {
@@ -357,24 +502,15 @@ func (n *Nodes) updateBackends(ourBackends []string) {
 	n.lmd.PeerMapLock.RUnlock()
 
 	// Determine backends this node is now (not anymore) responsible for
+	assignedBackends := n.AssignedBackends()
 	var addBackends []string
 	var rmvBackends []string
 	for _, backend := range n.backends {
 		// Check if assigned now
-		assignedNow := false
-		for _, newBackend := range ourBackends {
-			if newBackend == backend {
-				assignedNow = true
-			}
-		}
+		assignedNow := slices.Contains(ourBackends, backend)
 
 		// Check if assigned previously
-		assignedBefore := false
-		for _, oldBackend := range n.assignedBackends {
-			if oldBackend == backend {
-				assignedBefore = true
-			}
-		}
+		assignedBefore := slices.Contains(assignedBackends, backend)
 
 		// Compare
 		if assignedNow && !assignedBefore {
@@ -385,7 +521,13 @@ func (n *Nodes) updateBackends(ourBackends []string) {
 	}
 
 	// Store assigned backends
+	n.lock.Lock()
 	n.assignedBackends = ourBackends
+	n.lock.Unlock()
+
+	if len(addBackends) > 0 || len(rmvBackends) > 0 {
+		log.Infof("cluster backends changed, starting: %s, stopping: %s", strings.Join(addBackends, ", "), strings.Join(rmvBackends, ", "))
+	}
 
 	// Start/stop backends
 	n.lmd.PeerMapLock.RLock()
@@ -401,28 +543,93 @@ func (n *Nodes) updateBackends(ourBackends []string) {
 	n.lmd.PeerMapLock.RUnlock()
 }
 
-func (n *Nodes) getOnlineNodes() (ownIndex int, nodeOnline []bool, numberAllNodes int, numberAvailableNodes int) {
-	allNodes := n.nodeAddresses
-	numberAllNodes = len(allNodes)
-	numberAvailableNodes = 0
-	nodeOnline = make([]bool, numberAllNodes)
-	ownIndex = -1
-	for i, node := range allNodes {
-		isOnline := false
-		for _, otherNode := range n.onlineNodes {
-			if otherNode.url == node.url {
-				isOnline = true
-			}
+// AssignedBackends returns the backends started on this node.
+func (n *Nodes) AssignedBackends() []string {
+	n.lock.RLock()
+	defer n.lock.RUnlock()
+	return slices.Clone(n.assignedBackends)
+}
+
+// addAssignedBackend adds a sub peer of an assigned backend.
+func (n *Nodes) addAssignedBackend(id string) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	n.assignedBackends = append(n.assignedBackends, id)
+	if n.thisNode != nil {
+		n.nodeBackends[n.thisNode.id] = append(n.nodeBackends[n.thisNode.id], id)
+	}
+}
+
+// ReadyBackends returns the assigned backends which finished their initial sync.
+func (n *Nodes) ReadyBackends() []string {
+	ready := make([]string, 0)
+	n.lmd.PeerMapLock.RLock()
+	defer n.lmd.PeerMapLock.RUnlock()
+	for _, id := range n.AssignedBackends() {
+		peer, ok := n.lmd.PeerMap[id]
+		if !ok || peer.StatusGet(Paused).(bool) || peer.hasPeerState([]PeerStatus{PeerStatusPending, PeerStatusSyncing}) {
+			continue
 		}
-		if node.isMe {
-			ownIndex = i
+		ready = append(ready, id)
+	}
+	return ready
+}
+
+// NodeBackends returns a copy of the backends answered by each online node.
+func (n *Nodes) NodeBackends() map[string][]string {
+	n.lock.RLock()
+	defer n.lock.RUnlock()
+	nodeBackends := make(map[string][]string, len(n.nodeBackends))
+	for id, backends := range n.nodeBackends {
+		nodeBackends[id] = slices.Clone(backends)
+	}
+	return nodeBackends
+}
+
+// BackendOwner returns the address of the node answering queries for the given backend.
+// It returns an empty string in single mode.
+func (n *Nodes) BackendOwner(backend string) string {
+	if n == nil || !n.IsClustered() {
+		return ""
+	}
+	n.lock.RLock()
+	defer n.lock.RUnlock()
+	for id, backends := range n.nodeBackends {
+		if slices.Contains(backends, backend) {
+			node := n.Node(id)
+			return fmt.Sprintf("%s:%d", node.ip, node.port)
+		}
+	}
+	return ""
+}
+
+// Nodes returns the state of all cluster nodes.
+func (n *Nodes) Nodes() []NodeInfo {
+	if n == nil {
+		return nil
+	}
+	n.lock.RLock()
+	defer n.lock.RUnlock()
+	list := make([]NodeInfo, 0, len(n.nodeAddresses))
+	for _, node := range n.nodeAddresses {
+		info := NodeInfo{
+			ID:       node.id,
+			Address:  fmt.Sprintf("%s:%d", node.ip, node.port),
+			URL:      node.url,
+			IsMe:     node.isMe,
+			Online:   node.online,
+			Missed:   node.missed,
+			LastSeen: node.lastSeen,
+			Version:  node.version,
+			Started:  node.started,
+			Backends: make([]string, 0),
 		}
-		if isOnline {
-			nodeOnline[i] = true
-			numberAvailableNodes++
+		if node.id != "" {
+			info.Backends = append(info.Backends, n.nodeBackends[node.id]...)
 		}
+		list = append(list, info)
 	}
-	return
+	return list
 }
 
 // IsOurBackend checks if backend is managed by this node.
@@ -430,13 +637,12 @@ func (n *Nodes) IsOurBackend(backend string) bool {
 	if !n.lmd.nodeAccessor.IsClustered() {
 		return true
 	}
-	ourBackends := n.assignedBackends
-	for _, ourBackend := range ourBackends {
-		if ourBackend == backend {
-			return true
-		}
+	if n.thisNode == nil {
+		return false
 	}
-	return false
+	n.lock.RLock()
+	defer n.lock.RUnlock()
+	return slices.Contains(n.nodeBackends[n.thisNode.id], backend)
 }
 
 // SendQuery sends a query to a node.
@@ -465,6 +671,9 @@ func (n *Nodes) SendQuery(node *NodeAddress, name string, parameters map[string]
 	ctx := context.Background()
 	req, _ := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewBuffer(rawRequest))
 	req.Header.Set("Content-Type", contentType)
+	if n.lmd.Config.HTTPAuthToken != "" {
+		req.Header.Set("Authorization", "Bearer "+n.lmd.Config.HTTPAuthToken)
+	}
 	res, err := n.HTTPClient.Do(req)
 	if err != nil {
 		log.Debugf("error sending query (%s) to node (%s): %s", name, node, err.Error())
@@ -516,9 +725,11 @@ func generateUUID() (uuid string) {
 	return
 }
 
-func (n *Nodes) sendPing(node *NodeAddress, initializing bool, requestData map[string]interface{}) (isOnline bool, forceRedistribute bool) {
+// sendPing sends a heartbeat to the given node and returns its result or nil if the node did not respond.
+func (n *Nodes) sendPing(node *NodeAddress, initializing bool, requestData map[string]interface{}) (ping *nodePing) {
 	done := make(chan bool)
 	ownIdentifier := n.ID
+	ping = &nodePing{node: node}
 	err := n.SendQuery(node, "ping", requestData, func(responseData interface{}) {
 		defer func() { done <- true }()
 		// Parse response
@@ -529,61 +740,49 @@ func (n *Nodes) sendPing(node *NodeAddress, initializing bool, requestData map[s
 		}
 
 		// Node id
-		responseIdentifier := dataMap["identifier"].(string)
-		if node.id == "" {
-			node.id = responseIdentifier
-		} else if node.id != responseIdentifier {
-			log.Infof("partner node %s restarted", node)
-			delete(n.nodeBackends, node.id)
-			node.id = responseIdentifier
-			forceRedistribute = true
+		responseIdentifier, _ := dataMap["identifier"].(string)
+		ping.id = responseIdentifier
+		ping.version, _ = dataMap["version"].(string)
+		if started, ok := dataMap["started"].(float64); ok {
+			ping.started = int64(started)
 		}
 
 		// check version
-		versionMismatch := false
-		if _, exists := dataMap["version"]; !exists {
-			versionMismatch = true
-		} else {
-			v := dataMap["version"].(string)
-			if v != Version() {
-				versionMismatch = true
-			}
-		}
-		if versionMismatch {
+		if ping.version != Version() {
 			log.Debugf("version mismatch with node %s, deactivating", node)
-			forceRedistribute = true
-			delete(n.nodeBackends, node.id)
+			return
 		}
 
 		// Check whose response it is
 		if responseIdentifier == ownIdentifier {
 			// This node
 			if initializing {
+				node.id = responseIdentifier
 				n.thisNode = node
 				node.isMe = true
-				isOnline = true
+				ping.online = true
 				log.Debugf("identified this node as %s", node)
 			}
-		} else if !versionMismatch {
-			// Partner node
-			isOnline = true
-			log.Tracef("discovered partner node: %s", node)
-
-			// receive and update remote peer list
-			if _, exists := dataMap["peers"]; exists && dataMap["peers"] != nil {
-				peers := dataMap["peers"].([]interface{})
-				nodeList := []string{}
-				for _, id := range peers {
-					nodeList = append(nodeList, id.(string))
-				}
-				n.nodeBackends[node.id] = nodeList
-			}
+			return
+		}
+
+		// Partner node
+		ping.online = true
+		log.Tracef("discovered partner node: %s", node)
+
+		// receive remote peer lists
+		if peers, ok := dataMap["peers"].([]interface{}); ok {
+			ping.claimed = interface2stringlist(peers)
+		}
+		if ready, ok := dataMap["ready"].([]interface{}); ok {
+			ping.ready = interface2stringlist(ready)
 		}
 	})
 	if err != nil {
 		log.Debugf("node sendquery failed: %e", err)
+		return nil
 	}
 
 	<-done
-	return
+	return ping
 }
@@ -1,7 +1,18 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
 	"testing"
+	"time"
 )
 
 func TestNodeManager(t *testing.T) {
@@ -83,7 +94,472 @@ func TestNodeManager(t *testing.T) {
 		t.Error(err)
 	}
 
+	// test nodes table
+	res, _, err = peer.QueryString("GET nodes\nColumns: address this_node online num_backends version\n\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = assertEq(2, len(res)); err != nil {
+		t.Fatal(err)
+	}
+	if err = assertEq([]interface{}{"127.0.0.1:8901", 1.0, 1.0, 4.0, Version()}, res[0]); err != nil {
+		t.Error(err)
+	}
+	if err = assertEq([]interface{}{"127.0.0.2:8902", 0.0, 0.0, 0.0, ""}, res[1]); err != nil {
+		t.Error(err)
+	}
+
 	if err := cleanup(); err != nil {
 		panic(err.Error())
 	}
 }
+
+func TestNodeAssignBackends(t *testing.T) {
+	backends := []string{"a", "b", "c", "d", "e", "f"}
+	nodes := NodeAddressList{
+		{id: "1", online: true},
+		{id: "2", online: true},
+		{id: "3", online: true},
+	}
+	for _, node := range nodes {
+		node.ready = backends
+	}
+
+	// all nodes online
+	expect := [][]string{{"a", "b"}, {"c", "d"}, {"e", "f"}}
+	for i := range nodes {
+		if err := assertEq(expect[i], assignBackends(backends, nodes, i)); err != nil {
+			t.Error(err)
+		}
+	}
+
+	// backends of the second node are taken over by the remaining nodes
+	nodes[1].online = false
+	expect = [][]string{{"a", "b", "c"}, {"c", "d"}, {"d", "e", "f"}}
+	for i := range nodes {
+		if err := assertEq(expect[i], assignBackends(backends, nodes, i)); err != nil {
+			t.Error(err)
+		}
+	}
+
+	// returning node keeps its backends, the others hand them back once they are ready
+	nodes[1].online = true
+	nodes[1].ready = []string{"c"}
+	expect = [][]string{{"a", "b"}, {"c", "d"}, {"d", "e", "f"}}
+	for i := range nodes {
+		if err := assertEq(expect[i], assignBackends(backends, nodes, i)); err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func TestNodeResolveBackends(t *testing.T) {
+	claims := map[string][]string{
+		"100:a": {"a", "b", "d"},
+		"200:b": {"c", "d"},
+		"150:c": {"e", "f", "c"},
+	}
+	expect := map[string][]string{
+		"100:a": {"a", "b", "d"},
+		"200:b": {},
+		"150:c": {"e", "f", "c"},
+	}
+	if err := assertEq(expect, resolveBackends(claims)); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestNodeHeartbeats(t *testing.T) {
+	n := &Nodes{failoverLimit: 3}
+	node := &NodeAddress{id: "1"}
+
+	n.updateNodeStatus(node, &nodePing{node: node, online: true, claimed: []string{"a"}, ready: []string{"a"}})
+	if err := assertEq(true, node.online); err != nil {
+		t.Error(err)
+	}
+
+	// node is kept online till the threshold is reached
+	for i := 1; i <= 3; i++ {
+		n.updateNodeStatus(node, nil)
+		if err := assertEq(i < 3, node.online); err != nil {
+			t.Errorf("after %d missed heartbeats: %s", i, err)
+		}
+	}
+	if err := assertEq([]string(nil), node.claimed); err != nil {
+		t.Error(err)
+	}
+
+	n.updateNodeStatus(node, &nodePing{node: node, online: true})
+	if err := assertEq(0, node.missed); err != nil {
+		t.Error(err)
+	}
+
+	// unusable nodes are offline immediately
+	n.updateNodeStatus(node, &nodePing{node: node})
+	if err := assertEq(false, node.online); err != nil {
+		t.Error(err)
+	}
+}
+
+// fakeClusterNode answers the node api like a partner lmd which owns the given backends.
+type fakeClusterNode struct {
+	lock     sync.Mutex
+	backends []string
+	requests []map[string]interface{}
+	fail     bool
+	version  string
+	forward  http.Handler // forward table requests to this handler instead of answering them
+}
+
+func (f *fakeClusterNode) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	requestData := make(map[string]interface{})
+	if err := json.NewDecoder(r.Body).Decode(&requestData); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	switch requestData["_name"] {
+	case "ping":
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{
+			"identifier": "1:fakenode",
+			"version":    f.version,
+			"started":    time.Now().Unix(),
+			"peers":      f.backends,
+			"ready":      f.backends,
+		})
+	case "table":
+		f.requests = append(f.requests, requestData)
+		if f.forward != nil {
+			body, _ := json.Marshal(requestData)
+			forwarded := httptest.NewRequest(http.MethodPost, "/query", bytes.NewReader(body))
+			forwarded.Header.Set("Content-Type", "application/json")
+			f.forward.ServeHTTP(w, forwarded)
+			return
+		}
+		if f.fail {
+			w.WriteHeader(http.StatusInternalServerError)
+			_ = json.NewEncoder(w).Encode(map[string]interface{}{"error": "node is broken"})
+			return
+		}
+		// one row per backend with the requested columns
+		tableName, _ := NewTableName(interface2stringNoDedup(requestData["table"]))
+		table := Objects.Tables[tableName]
+		rows := []interface{}{}
+		columns, _ := requestData["columns"].([]interface{})
+		backends, _ := requestData["backends"].([]interface{})
+		for _, backend := range backends {
+			row := []interface{}{}
+			for _, name := range columns {
+				col := table.GetColumn(interface2stringNoDedup(name))
+				switch {
+				case col.Name == "peer_key":
+					row = append(row, backend)
+				case col.DataType == StringCol:
+					row = append(row, "remote")
+				case col.DataType == IntCol, col.DataType == Int64Col, col.DataType == FloatCol:
+					row = append(row, 1)
+				default:
+					row = append(row, nil)
+				}
+			}
+			rows = append(rows, row)
+		}
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{
+			"data":        rows,
+			"failed":      map[string]interface{}{},
+			"total_count": len(rows),
+		})
+	}
+}
+
+// startTestCluster starts a test lmd clustered with a fake partner node, which owns the last two of four backends.
+func startTestCluster(t *testing.T) (mocklmd *LMDInstance, fake *fakeClusterNode, cleanup func()) {
+	t.Helper()
+	fake = &fakeClusterNode{backends: []string{"mockid2", "mockid3"}, version: Version()}
+	listener, err := net.Listen("tcp", "127.0.0.2:8902")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &http.Server{Handler: fake, ReadHeaderTimeout: 5 * time.Second}
+	go func() { _ = server.Serve(listener) }()
+
+	extraConfig := `
+		Listen = ['test.sock', 'http://127.0.0.1:8901']
+		Nodes = ['http://127.0.0.1:8901', 'http://127.0.0.2:8902']
+	`
+	peer, cleanupPeer, mocklmd := StartTestPeerExtra(4, 10, 10, extraConfig)
+	PauseTestPeers(peer)
+
+	if err = assertEq(map[string][]string{
+		mocklmd.nodeAccessor.ID: {"mockid0", "mockid1"},
+		"1:fakenode":            {"mockid2", "mockid3"},
+	}, mocklmd.nodeAccessor.NodeBackends()); err != nil {
+		t.Fatal(err)
+	}
+
+	cleanup = func() {
+		// unusable node is offline right away, so its backends are taken over and can be stopped
+		fake.lock.Lock()
+		fake.version = "0"
+		fake.lock.Unlock()
+		mocklmd.nodeAccessor.checkNodeAvailability()
+		if err := assertEq(4, len(mocklmd.nodeAccessor.AssignedBackends())); err != nil {
+			t.Error(err)
+		}
+		server.Close()
+		if err := cleanupPeer(); err != nil {
+			panic(err.Error())
+		}
+	}
+	return mocklmd, fake, cleanup
+}
+
+// testClusterQuery runs the query on the given lmd like a client connection would.
+func testClusterQuery(t *testing.T, lmd *LMDInstance, text string) *Response {
+	t.Helper()
+	req, _, err := NewRequest(context.TODO(), lmd, bufio.NewReader(bytes.NewBufferString(text)), ParseDefault)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = req.ExpandRequestedBackends(); err != nil {
+		t.Fatal(err)
+	}
+	res, err := req.BuildResponse(context.TODO())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return res
+}
+
+func TestNodePassthroughForward(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping nodes test in short mode")
+	}
+	mocklmd, fake, cleanup := startTestCluster(t)
+	defer cleanup()
+	var err error
+	query := func(text string) *Response {
+		t.Helper()
+		return testClusterQuery(t, mocklmd, text)
+	}
+
+	// the mock backends only support a single set of log columns
+	local := query("GET log\nColumns: peer_key message time\nBackends: mockid0 mockid1\n\n")
+	numLocal := len(local.Result)
+
+	// log query covering the backends of both nodes, remote rows sort first
+	res := query("GET log\nColumns: peer_key message\nSort: time asc\n\n")
+	if err = assertEq(map[string]string{}, res.Failed); err != nil {
+		t.Error(err)
+	}
+	if err = assertEq(numLocal+2, len(res.Result)); err != nil {
+		t.Fatal(err)
+	}
+	for i, backend := range []string{"mockid2", "mockid3"} {
+		if err = assertEq(backend, interface2stringNoDedup(res.Result[i][0])); err != nil {
+			t.Error(err)
+		}
+		if err = assertEq("remote", res.Result[i][1]); err != nil {
+			t.Error(err)
+		}
+	}
+	keys := map[string]int{}
+	for _, row := range res.Result {
+		keys[interface2stringNoDedup(row[0])]++
+	}
+	if err = assertEq(4, len(keys)); err != nil {
+		t.Error(err)
+	}
+
+	// forwarded request contains the sort column and is answered locally by the other node
+	fake.lock.Lock()
+	forwarded := fake.requests[len(fake.requests)-1]
+	fake.lock.Unlock()
+	if err = assertEq([]interface{}{"peer_key", "message", "time"}, forwarded["columns"]); err != nil {
+		t.Error(err)
+	}
+	if err = assertEq([]interface{}{"mockid2", "mockid3"}, forwarded["backends"]); err != nil {
+		t.Error(err)
+	}
+	if err = assertEq(true, forwarded["distributed"]); err != nil {
+		t.Error(err)
+	}
+	if _, ok := forwarded["auth_user"]; ok {
+		t.Errorf("expected no auth_user in forwarded request")
+	}
+
+	// the AuthUser is forwarded and applied by the other node
+	query("GET log\nColumns: peer_key message\nAuthUser: authuser\n\n")
+	fake.lock.Lock()
+	forwarded = fake.requests[len(fake.requests)-1]
+	fake.lock.Unlock()
+	if err = assertEq("authuser", forwarded["auth_user"]); err != nil {
+		t.Error(err)
+	}
+	forwardedReq, err := parseRequestDataToRequest(mocklmd, map[string]interface{}{"table": "log", "auth_user": forwarded["auth_user"]})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = assertEq("authuser", forwardedReq.AuthUser); err != nil {
+		t.Error(err)
+	}
+
+	// failed node marks its backends as failed
+	fake.lock.Lock()
+	fake.fail = true
+	fake.lock.Unlock()
+	res = query("GET log\nColumns: peer_key message\n\n")
+	if err = assertEq(numLocal, len(res.Result)); err != nil {
+		t.Error(err)
+	}
+	if err = assertEq(2, len(res.Failed)); err != nil {
+		t.Fatal(err)
+	}
+	for _, backend := range []string{"mockid2", "mockid3"} {
+		if err = assertLike(fmt.Sprintf("^cluster node 127.0.0.2:8902 failed: %s$", "node is broken"), res.Failed[backend]); err != nil {
+			t.Error(err)
+		}
+	}
+
+}
+
+func TestNodePassthroughForwardQueryLimit(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping nodes test in short mode")
+	}
+	mocklmd, fake, cleanup := startTestCluster(t)
+	defer cleanup()
+
+	// both nodes only allow a single query, the other node is answered by the same lmd,
+	// so the forwarded sub-request must not wait for the slot held by the originating query
+	mocklmd.queryLimiter = NewLimiter(1)
+	mocklmd.Config.MaxConcurrentQueries = 1
+	mocklmd.Config.MaxQueuedQueries = 1
+	mocklmd.Config.QueryQueueTimeout = 3
+	defer func() { mocklmd.queryLimiter = nil }()
+	fake.lock.Lock()
+	fake.forward = initializeHTTPRouter(mocklmd)
+	fake.lock.Unlock()
+
+	start := time.Now()
+	res := testClusterQuery(t, mocklmd, "GET log\nColumns: peer_key message\n\n")
+	if err := assertEq(200, res.Code); err != nil {
+		t.Error(err)
+	}
+	if time.Since(start) >= 3*time.Second {
+		t.Errorf("forwarded query waited for the query queue: %s", time.Since(start))
+	}
+	// the sub-request has been answered, this lmd just does not own the remote backends
+	for _, backend := range []string{"mockid2", "mockid3"} {
+		if err := assertEq("backend is not handled by this cluster node", res.Failed[backend]); err != nil {
+			t.Error(err)
+		}
+	}
+	fake.lock.Lock()
+	fake.forward = nil
+	fake.lock.Unlock()
+}
+
+func TestNodeUnhandledBackends(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping nodes test in short mode")
+	}
+	mocklmd, _, cleanup := startTestCluster(t)
+	defer cleanup()
+
+	// mockid3 is not answered by any node, ex.: its node failed and no other node took it over yet
+	mocklmd.nodeAccessor.lock.Lock()
+	mocklmd.nodeAccessor.nodeBackends["1:fakenode"] = []string{"mockid2"}
+	mocklmd.nodeAccessor.lock.Unlock()
+
+	expect := map[string]string{"mockid3": errBackendNotHandled.Error()}
+	for _, query := range []string{
+		"GET hosts\nColumns: name peer_key\n\n",
+		"GET log\nColumns: peer_key message time\n\n",
+		"GET hosts\nColumns: name\nBackends: mockid0 mockid3\n\n",
+	} {
+		res := testClusterQuery(t, mocklmd, query)
+		if err := assertEq(expect, res.Failed); err != nil {
+			t.Errorf("%s: %s", query, err)
+		}
+	}
+
+	// requests from other nodes report the backends this node does not answer
+	node := mocklmd.nodeAccessor.thisNode
+	requestData := map[string]interface{}{
+		"table":        "hosts",
+		"columns":      []string{"name"},
+		"backends":     []string{"mockid0", "mockid2"},
+		"distributed":  true,
+		"outputformat": "wrapped_json",
+	}
+	done := make(chan *distributedResult)
+	err := mocklmd.nodeAccessor.SendQuery(node, "table", requestData, func(responseData interface{}) {
+		result, _ := parseDistributedResult(responseData)
+		done <- result
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	result := <-done
+	if result == nil {
+		t.Fatal("got invalid response")
+	}
+	if err = assertEq(map[string]string{"mockid2": errBackendNotThisNode.Error()}, result.failed); err != nil {
+		t.Error(err)
+	}
+	if err = assertEq(10, len(result.rows)); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestNodeSlowQuery(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping nodes test in short mode")
+	}
+	mocklmd, _, cleanup := startTestCluster(t)
+	defer cleanup()
+	mocklmd.Config.LogSlowQueryThreshold = 0
+	mocklmd.Config.SlowQueryLogSize = 10
+
+	req, _, err := NewRequest(context.TODO(), mocklmd, bufio.NewReader(bytes.NewBufferString("GET hosts\nColumns: name peer_key\n\n")), ParseDefault)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = req.ExpandRequestedBackends(); err != nil {
+		t.Fatal(err)
+	}
+	server, client := net.Pipe()
+	output := make(chan []byte, 1)
+	go func() {
+		data, _ := io.ReadAll(client)
+		output <- data
+	}()
+	size, err := req.BuildResponseSend(context.TODO(), server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.Close()
+	data := <-output
+
+	// the merged response is logged once with the total duration and size, the local part is not logged separately
+	list := mocklmd.slowQueries.List()
+	if err = assertEq(1, len(list)); err != nil {
+		t.Fatal(err)
+	}
+	if err = assertEq(int64(len(data)), size); err != nil {
+		t.Error(err)
+	}
+	if err = assertEq(size, list[0].Size); err != nil {
+		t.Error(err)
+	}
+	// 10 hosts for each local backend and one row for each backend of the other node
+	if err = assertEq(22, list[0].RowsReturned); err != nil {
+		t.Error(err)
+	}
+	if err = assertEq(TableHosts, list[0].Table); err != nil {
+		t.Error(err)
+	}
+}
@@ -36,7 +36,10 @@ func InitObjects() {
 	Objects.AddTable(TableBackends, NewBackendsTable())
 	Objects.Tables[TableSites] = Objects.Tables[TableBackends]
 	Objects.AddTable(TableColumns, NewColumnsTable())
-	Objects.Tables[TableTables] = Objects.Tables[TableColumns]
+	Objects.AddTable(TableTables, NewTablesTable())
+	Objects.AddTable(TableSlowqueries, NewSlowqueriesTable())
+	Objects.AddTable(TableQueries, NewQueriesTable())
+	Objects.AddTable(TableNodes, NewNodesTable())
 
 	// add remaining tables in an order where they can resolve the inter-table dependencies
 	Objects.AddTable(TableStatus, NewStatusTable())
@@ -83,7 +86,7 @@ func (o *ObjectsType) AddTable(name TableName, table *Table) {
 
 // NewBackendsTable returns a new backends table
 func NewBackendsTable() (t *Table) {
-	t = &Table{Virtual: GetTableBackendsStore, WorksUnlocked: true, PeerLockMode: PeerLockModeFull}
+	t = &Table{Virtual: GetTableBackendsStore, PeerLockMode: PeerLockModeFull}
 	t.AddPeerInfoColumn("peer_key", StringCol, "Id of this peer")
 	t.AddPeerInfoColumn("peer_name", StringCol, "Name of this peer")
 	t.AddPeerInfoColumn("key", StringCol, "Id of this peer")
@@ -92,10 +95,29 @@ func NewBackendsTable() (t *Table) {
 	t.AddPeerInfoColumn("status", IntCol, "Status of this peer (0 - UP, 1 - Stale, 2 - Down, 4 - Pending)")
 	t.AddPeerInfoColumn("bytes_send", Int64Col, "Bytes send to this peer")
 	t.AddPeerInfoColumn("bytes_received", Int64Col, "Bytes received from this peer")
+	t.AddPeerInfoColumn("bytes_received_wire", Int64Col, "Bytes received from this peer before decompression")
 	t.AddPeerInfoColumn("queries", IntCol, "Number of queries sent to this peer")
+	t.AddPeerInfoColumn("client_queries", Int64Col, "Number of client queries routed to this peer")
+	t.AddPeerInfoColumn("rows_scanned", Int64Col, "Number of rows scanned by client queries for this peer")
+	t.AddPeerInfoColumn("update_queries", Int64Col, "Number of update queries sent to this peer")
+	t.AddPeerInfoColumn("avg_response_time", FloatCol, "Average response time of queries sent to this peer in seconds")
+	t.AddPeerInfoColumn("queries_in_flight", IntCol, "Number of on-demand queries currently running against this peer")
+	t.AddPeerInfoColumn("queries_queued", IntCol, "Number of on-demand queries waiting for a free query slot")
+	t.AddPeerInfoColumn("passthrough_in_flight", IntCol, "Number of passthrough queries currently running against this peer")
+	t.AddPeerInfoColumn("command_queue_depth", IntCol, "Number of commands waiting to be sent to this peer")
+	t.AddPeerInfoColumn("commands_dropped", Int64Col, "Number of commands dropped because the queue was full or the peer stayed unavailable")
+	t.AddPeerInfoColumn("commands_retried", Int64Col, "Number of commands retried because the peer was unavailable")
+	t.AddPeerInfoColumn("last_full_update_duration", FloatCol, "Duration of the last full update in seconds")
+	t.AddPeerInfoColumn("last_delta_update_duration", FloatCol, "Duration of the last delta update in seconds")
+	t.AddPeerInfoColumn("last_delta_updated_objects", Int64Col, "Number of hosts and services updated by the last delta update")
+	t.AddPeerInfoColumn("sources", StringListCol, "List of all configured source addresses of this peer")
+	t.AddPeerInfoColumn("source_index", IntCol, "Index of the currently active address in the sources list")
 	t.AddPeerInfoColumn("last_error", StringCol, "Last error message or empty if up")
+	t.AddPeerInfoColumn("last_errors", InterfaceListCol, "List of the last errors as timestamp/message pairs, newest first")
+	t.AddPeerInfoColumn("last_errors_hour", IntCol, "Number of errors during the last hour")
 	t.AddPeerInfoColumn("last_update", FloatCol, "Timestamp of last update")
 	t.AddPeerInfoColumn("last_online", FloatCol, "Timestamp when peer was last online")
+	t.AddPeerInfoColumn("last_update_age", FloatCol, "Seconds since the last successful update or -1 if never updated")
 	t.AddPeerInfoColumn("response_time", FloatCol, "Duration of last update in seconds")
 	t.AddPeerInfoColumn("idling", IntCol, "Idle status of this backend (0 - Not idling, 1 - idling)")
 	t.AddPeerInfoColumn("last_query", Int64Col, "Timestamp of the last incoming request")
@@ -109,13 +131,30 @@ func NewBackendsTable() (t *Table) {
 	t.AddPeerInfoColumn("federation_name", StringListCol, "original names when using nested federation")
 	t.AddPeerInfoColumn("federation_addr", StringListCol, "original addresses when using nested federation")
 	t.AddPeerInfoColumn("federation_type", StringListCol, "original types when using nested federation")
+	t.AddPeerInfoColumn("node", StringCol, "Address of the cluster node currently answering for this peer, empty in single mode")
 	t.AddExtraColumn("localtime", VirtualStore, None, FloatCol, NoFlags, "The unix timestamp of the local lmd host.")
 	return
 }
 
 // NewColumnsTable returns a new columns table
 func NewColumnsTable() (t *Table) {
-	t = &Table{Virtual: GetTableColumnsStore, DefaultSort: []string{"table", "name"}, WorksUnlocked: true}
+	t = &Table{Virtual: GetTableColumnsStore, DefaultSort: []string{"table", "name"}}
+	addSchemaColumns(t)
+	return
+}
+
+// NewTablesTable returns a new tables table
+func NewTablesTable() (t *Table) {
+	t = &Table{Virtual: GetTableTablesStore, DefaultSort: []string{"table", "name"}}
+	addSchemaColumns(t)
+	t.AddExtraColumn("rows", LocalStore, None, IntCol, NoFlags, "Number of rows currently stored for the table of this column")
+	t.AddExtraColumn("last_update", LocalStore, None, FloatCol, NoFlags, "Timestamp of the last successful update of the table of this column")
+	t.AddExtraColumn("size_bytes_estimate", LocalStore, None, Int64Col, NoFlags, "Estimated memory usage of the stored rows of the table of this column in bytes")
+	return
+}
+
+// addSchemaColumns adds the columns describing the columns of all tables
+func addSchemaColumns(t *Table) {
 	t.AddExtraColumn("name", LocalStore, None, StringCol, NoFlags, "The name of the column within the table")
 	t.AddExtraColumn("table", LocalStore, None, StringCol, NoFlags, "The name of the table")
 	t.AddExtraColumn("type", LocalStore, None, StringCol, NoFlags, "The data type of the column (int, float, string, list)")
@@ -124,6 +163,58 @@ func NewColumnsTable() (t *Table) {
 	t.AddExtraColumn("lmd_datatype", LocalStore, None, StringCol, NoFlags, "The lmd column type")
 	t.AddExtraColumn("lmd_storagetype", LocalStore, None, StringCol, NoFlags, "The lmd storage type")
 	t.AddExtraColumn("lmd_flags", LocalStore, None, StringListCol, NoFlags, "The lmd flags for this column")
+	t.AddExtraColumn("missing_backends", LocalStore, None, StringListCol, NoFlags, "List of backend ids which do not provide this column")
+}
+
+// NewSlowqueriesTable returns a new slowqueries table
+func NewSlowqueriesTable() (t *Table) {
+	t = &Table{Virtual: GetTableSlowqueriesStore}
+	t.AddExtraColumn("time", LocalStore, None, FloatCol, NoFlags, "Timestamp when the query finished")
+	t.AddExtraColumn("duration", LocalStore, None, FloatCol, NoFlags, "Duration of the query in seconds")
+	t.AddExtraColumn("table", LocalStore, None, StringCol, NoFlags, "The name of the queried table")
+	t.AddExtraColumn("query", LocalStore, None, StringCol, NoFlags, "The raw request text with masked headers")
+	t.AddExtraColumn("backends", LocalStore, None, StringListCol, NoFlags, "List of selected backend ids")
+	t.AddExtraColumn("rows_scanned", LocalStore, None, Int64Col, NoFlags, "Number of data rows scanned")
+	t.AddExtraColumn("rows_returned", LocalStore, None, Int64Col, NoFlags, "Number of result rows returned")
+	t.AddExtraColumn("response_size", LocalStore, None, Int64Col, NoFlags, "Size of the sent response in bytes")
+	t.AddExtraColumn("peer_durations", LocalStore, None, InterfaceListCol, NoFlags, "List of peer name/duration pairs")
+	t.AddExtraColumn("post_processing", LocalStore, None, FloatCol, NoFlags, "Duration of sorting and final stats calculation in seconds")
+	t.AddExtraColumn("post_processing_dominated", LocalStore, None, IntCol, NoFlags, "Whether post processing took more than half of the query duration (0/1)")
+	t.AddExtraColumn("code", LocalStore, None, IntCol, NoFlags, "The response code")
+	t.AddExtraColumn("request_id", LocalStore, None, StringCol, NoFlags, "The id of the request")
+	return
+}
+
+// NewQueriesTable returns a new lmd_queries table
+func NewQueriesTable() (t *Table) {
+	t = &Table{Virtual: GetTableQueriesStore}
+	t.AddExtraColumn("id", LocalStore, None, StringCol, NoFlags, "The id of the query, used to kill it with the LMD_KILL_QUERY command")
+	t.AddExtraColumn("query", LocalStore, None, StringCol, NoFlags, "The raw request text with masked headers")
+	t.AddExtraColumn("client", LocalStore, None, StringCol, NoFlags, "The address of the client")
+	t.AddExtraColumn("table", LocalStore, None, StringCol, NoFlags, "The name of the queried table")
+	t.AddExtraColumn("start", LocalStore, None, FloatCol, NoFlags, "Timestamp when the query started")
+	t.AddExtraColumn("duration", LocalStore, None, FloatCol, NoFlags, "Seconds since the query started")
+	t.AddExtraColumn("backends", LocalStore, None, StringListCol, NoFlags, "List of selected backend ids")
+	t.AddExtraColumn("rows_scanned", LocalStore, None, Int64Col, NoFlags, "Approximate number of data rows scanned so far")
+	return
+}
+
+// NewNodesTable returns a new nodes table
+func NewNodesTable() (t *Table) {
+	t = &Table{Virtual: GetTableNodesStore}
+	t.AddExtraColumn("id", LocalStore, None, StringCol, NoFlags, "The id of the node, changes whenever the node restarts")
+	t.AddExtraColumn("address", LocalStore, None, StringCol, NoFlags, "The address of the node")
+	t.AddExtraColumn("url", LocalStore, None, StringCol, NoFlags, "The url used to contact the node")
+	t.AddExtraColumn("this_node", LocalStore, None, IntCol, NoFlags, "Whether this is the node answering the query (0/1)")
+	t.AddExtraColumn("online", LocalStore, None, IntCol, NoFlags, "Whether the node is online (0/1)")
+	t.AddExtraColumn("missed_heartbeats", LocalStore, None, IntCol, NoFlags, "Number of consecutive missed heartbeats")
+	t.AddExtraColumn("last_heartbeat", LocalStore, None, Int64Col, NoFlags, "Timestamp of the last answered heartbeat")
+	t.AddExtraColumn("last_heartbeat_age", LocalStore, None, FloatCol, NoFlags, "Seconds since the last answered heartbeat, -1 if the node never answered")
+	t.AddExtraColumn("version", LocalStore, None, StringCol, NoFlags, "The lmd version of the node")
+	t.AddExtraColumn("program_start", LocalStore, None, Int64Col, NoFlags, "Timestamp when the node started")
+	t.AddExtraColumn("uptime", LocalStore, None, Int64Col, NoFlags, "Seconds since the node started")
+	t.AddExtraColumn("num_backends", LocalStore, None, IntCol, NoFlags, "Number of backends answered by the node")
+	t.AddExtraColumn("backends", LocalStore, None, StringListCol, NoFlags, "List of backend ids answered by the node")
 	return
 }
 
@@ -167,6 +258,7 @@ func NewStatusTable() (t *Table) {
 	t.AddColumn("service_checks_rate", Dynamic, FloatCol, "The number of completed service checks since program start")
 
 	t.AddPeerInfoColumn("lmd_last_cache_update", FloatCol, "Timestamp of the last LMD update of this object")
+	t.AddPeerInfoColumn("lmd_data_age", FloatCol, "Seconds since the last successful update of the backend of this object or -1 if never updated")
 	t.AddPeerInfoColumn("peer_key", StringCol, "Id of this peer")
 	t.AddPeerInfoColumn("peer_name", StringCol, "Name of this peer")
 	t.AddPeerInfoColumn("peer_section", StringCol, "Section information when having cascaded LMDs")
@@ -204,6 +296,7 @@ func NewTimeperiodsTable() (t *Table) {
 	t.AddExtraColumn("id", LocalStore, Static, IntCol, Naemon, "The id of the timeperiods")
 
 	t.AddPeerInfoColumn("lmd_last_cache_update", FloatCol, "Timestamp of the last LMD update of this object")
+	t.AddPeerInfoColumn("lmd_data_age", FloatCol, "Seconds since the last successful update of the backend of this object or -1 if never updated")
 	t.AddPeerInfoColumn("peer_key", StringCol, "Id of this peer")
 	t.AddPeerInfoColumn("peer_name", StringCol, "Name of this peer")
 	return
@@ -246,6 +339,7 @@ func NewContactsTable() (t *Table) {
 	t.AddExtraColumn("service_notification_commands", LocalStore, Static, StringListCol, HasContactsCommandsColumn, "A list of all service notification commands.")
 
 	t.AddPeerInfoColumn("lmd_last_cache_update", FloatCol, "Timestamp of the last LMD update of this object")
+	t.AddPeerInfoColumn("lmd_data_age", FloatCol, "Seconds since the last successful update of the backend of this object or -1 if never updated")
 	t.AddPeerInfoColumn("peer_key", StringCol, "Id of this peer")
 	t.AddPeerInfoColumn("peer_name", StringCol, "Name of this peer")
 	return
@@ -408,9 +502,11 @@ func NewHostsTable() (t *Table) {
 	t.AddExtraColumn("comments_with_info", VirtualStore, None, InterfaceListCol, NoFlags, "A list of all comments of the host with id, author and comment")
 	t.AddExtraColumn("downtimes_with_info", VirtualStore, None, InterfaceListCol, NoFlags, "A list of all downtimes of the host with id, author and comment")
 	t.AddPeerInfoColumn("lmd_last_cache_update", FloatCol, "Timestamp of the last LMD update of this object")
+	t.AddPeerInfoColumn("lmd_data_age", FloatCol, "Seconds since the last successful update of the backend of this object or -1 if never updated")
 	t.AddPeerInfoColumn("peer_key", StringCol, "Id of this peer")
 	t.AddPeerInfoColumn("peer_name", StringCol, "Name of this peer")
 	t.AddExtraColumn("last_state_change_order", VirtualStore, None, Int64Col, NoFlags, "The last_state_change of this host suitable for sorting. Returns program_start from the core if host has been never checked")
+	t.AddExtraColumn("state_order", VirtualStore, None, IntCol, NoFlags, "The host state suitable for sorting by severity. Ranking can be changed by the HostStateOrder option")
 	t.AddExtraColumn("has_long_plugin_output", VirtualStore, None, IntCol, NoFlags, "Flag wether this host has long_plugin_output or not")
 	t.AddExtraColumn("total_services", VirtualStore, None, IntCol, NoFlags, "The total number of services of the host")
 	return
@@ -445,6 +541,7 @@ func NewHostgroupsTable() (t *Table) {
 	t.AddColumn("worst_service_state", Dynamic, IntCol, "The worst service state of the hostgroup")
 
 	t.AddPeerInfoColumn("lmd_last_cache_update", FloatCol, "Timestamp of the last LMD update of this object")
+	t.AddPeerInfoColumn("lmd_data_age", FloatCol, "Seconds since the last successful update of the backend of this object or -1 if never updated")
 	t.AddPeerInfoColumn("peer_key", StringCol, "Id of this peer")
 	t.AddPeerInfoColumn("peer_name", StringCol, "Name of this peer")
 
@@ -568,10 +665,11 @@ func NewServicesTable() (t *Table) {
 	t.AddExtraColumn("comments_with_info", VirtualStore, None, InterfaceListCol, NoFlags, "A list of all comments of the host with id, author and comment")
 	t.AddExtraColumn("downtimes_with_info", VirtualStore, None, InterfaceListCol, NoFlags, "A list of all downtimes of the service with id, author and comment")
 	t.AddPeerInfoColumn("lmd_last_cache_update", FloatCol, "Timestamp of the last LMD update of this object")
+	t.AddPeerInfoColumn("lmd_data_age", FloatCol, "Seconds since the last successful update of the backend of this object or -1 if never updated")
 	t.AddPeerInfoColumn("peer_key", StringCol, "Id of this peer")
 	t.AddPeerInfoColumn("peer_name", StringCol, "Name of this peer")
 	t.AddExtraColumn("last_state_change_order", VirtualStore, None, Int64Col, NoFlags, "The last_state_change of this host suitable for sorting. Returns program_start from the core if host has been never checked")
-	t.AddExtraColumn("state_order", VirtualStore, None, IntCol, NoFlags, "The service state suitable for sorting. Unknown and Critical state are switched")
+	t.AddExtraColumn("state_order", VirtualStore, None, IntCol, NoFlags, "The service state suitable for sorting by severity. Ranking can be changed by the ServiceStateOrder option")
 	t.AddExtraColumn("has_long_plugin_output", VirtualStore, None, IntCol, NoFlags, "Flag wether this service has long_plugin_output or not")
 	return
 }
@@ -598,6 +696,7 @@ func NewServicegroupsTable() (t *Table) {
 	t.AddColumn("worst_service_state", Dynamic, IntCol, "The worst service state of the service group")
 
 	t.AddPeerInfoColumn("lmd_last_cache_update", FloatCol, "Timestamp of the last LMD update of this object")
+	t.AddPeerInfoColumn("lmd_data_age", FloatCol, "Seconds since the last successful update of the backend of this object or -1 if never updated")
 	t.AddPeerInfoColumn("peer_key", StringCol, "Id of this peer")
 	t.AddPeerInfoColumn("peer_name", StringCol, "Name of this peer")
 
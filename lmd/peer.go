@@ -18,6 +18,7 @@ import (
 	"os"
 	"regexp"
 	"runtime/debug"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -49,6 +50,9 @@ const (
 	// WaitTimeoutDefault sets the default timeout if nothing specified (1 minute in milliseconds)
 	WaitTimeoutDefault = 60000
 
+	// WaitTimeoutMax sets the default maximum timeout for wait queries (5 minutes in milliseconds)
+	WaitTimeoutMax = 300000
+
 	// WaitTimeoutCheckInterval set interval in which wait condition is checked
 	WaitTimeoutCheckInterval = 200 * time.Millisecond
 
@@ -60,6 +64,9 @@ const (
 
 	// TemporaryNetworkErrorMaxRetries is the number of retries
 	TemporaryNetworkErrorMaxRetries = 3
+
+	// QueryQueueLogThreshold sets the wait time for a free query slot after which a message will be logged
+	QueryQueueLogThreshold = 1 * time.Second
 )
 
 // Peer is the object which handles collecting and updating data and connections.
@@ -81,6 +88,17 @@ type Peer struct {
 	stopChannel     chan bool                     // channel to stop this peer
 	Config          *Connection                   // reference to the peer configuration from the config file
 	lmd             *LMDInstance                  // reference to main lmd instance
+	errorHistory    *PeerErrorHistory             // ring buffer of the last errors
+	queryLimiter    *Limiter                      // limits concurrent on-demand queries to the remote site
+	queriesInFlight int32                         // number of currently running on-demand queries
+	queriesQueued   int32                         // number of on-demand queries waiting for a free query slot
+	passthroughs    int32                         // number of currently running passthrough queries
+	rowsScanned     int64                         // number of rows scanned by client queries, can be read without the peer lock
+	lastOnline      uint64                        // cached LastOnline timestamp as float64 bits, can be read without the peer lock
+	logCache        *LogCache                     // optional cache of recent log entries
+	noSortSupport   int32                         // set to 1 if the backend rejected the sort header of passthrough queries
+	commandNotifier *CommandNotifier              // wakes up wait queries once commands for their objects have been sent
+	commandQueue    *PeerCommandQueue             // sends commands in background with rate limit and retries
 	last            struct {
 		Request  *Request // reference to last query (used in error reports)
 		Response []byte   // reference to last response
@@ -89,6 +107,7 @@ type Peer struct {
 		HTTPClient             *http.Client  // cached http client for http backends
 		connectionPool         chan net.Conn // tcp connection get stored here for reuse
 		maxParallelConnections chan bool     // limit max parallel connections
+		compressionRejected    bool          // remote site does not support compressed responses
 	}
 }
 
@@ -181,6 +200,13 @@ const (
 	ThrukExtras
 	ForceFull
 	LastHTTPRequestSuccessful
+	ClientQueries
+	UpdateQueries
+	QueryDuration
+	BytesReceivedWire
+	LastFullUpdateDuration
+	LastDeltaUpdateDuration
+	LastDeltaUpdatedObjects
 )
 
 // HTTPResult contains the livestatus result as long with some meta data.
@@ -250,7 +276,11 @@ func NewPeer(lmd *LMDInstance, config *Connection) *Peer {
 		Config:          config,
 		lmd:             lmd,
 		Flags:           uint32(NoFlags),
+		errorHistory:    NewPeerErrorHistory(PeerErrorHistorySize),
+		queryLimiter:    NewLimiter(lmd.Config.MaxParallelQueries),
+		commandNotifier: NewCommandNotifier(),
 	}
+	p.commandQueue = NewPeerCommandQueue(&p)
 	p.cache.connectionPool = make(chan net.Conn, lmd.Config.MaxParallelPeerConnections)
 	p.cache.maxParallelConnections = make(chan bool, lmd.Config.MaxParallelPeerConnections)
 	if len(p.Source) == 0 {
@@ -275,8 +305,15 @@ func NewPeer(lmd *LMDInstance, config *Connection) *Peer {
 	p.Status[LastPid] = 0
 	p.Status[BytesSend] = int64(0)
 	p.Status[BytesReceived] = int64(0)
+	p.Status[BytesReceivedWire] = int64(0)
 	p.Status[Queries] = int64(0)
 	p.Status[ResponseTime] = float64(0)
+	p.Status[ClientQueries] = int64(0)
+	p.Status[UpdateQueries] = int64(0)
+	p.Status[QueryDuration] = float64(0)
+	p.Status[LastFullUpdateDuration] = float64(0)
+	p.Status[LastDeltaUpdateDuration] = float64(0)
+	p.Status[LastDeltaUpdatedObjects] = int64(0)
 	p.Status[Idling] = false
 	p.Status[Paused] = true
 	p.Status[Section] = config.Section
@@ -287,6 +324,10 @@ func NewPeer(lmd *LMDInstance, config *Connection) *Peer {
 	p.Status[SubAddr] = []string{}
 	p.Status[SubType] = []string{}
 
+	if config.LogCacheWindow > 0 {
+		p.logCache = NewLogCache(&p, p.fetchLogEntries)
+	}
+
 	/* initialize http client if there are any http(s) connections */
 	p.SetHTTPClient()
 
@@ -389,6 +430,7 @@ func (p *Peer) updateLoop() {
 			}
 		}
 		duration := time.Since(t1)
+		promPeerDataAge.WithLabelValues(p.Name).Set(p.DataAge())
 		err = p.initTablesIfRestartRequiredError(err)
 		if err != nil {
 			if !p.ErrorLogged {
@@ -704,6 +746,85 @@ func (p *Peer) StatusGet(key PeerStatusKey) interface{} {
 	return value
 }
 
+// DataAge returns the number of seconds since the last successful update or -1 if the peer has never been online.
+func (p *Peer) DataAge() float64 {
+	lastOnline := math.Float64frombits(atomic.LoadUint64(&p.lastOnline))
+	if lastOnline <= 0 {
+		return -1
+	}
+	return currentUnixTime() - lastOnline
+}
+
+// setLastOnline sets the LastOnline status and its lock free cached copy.
+// Peer lock must be held.
+func (p *Peer) setLastOnline(timestamp float64) {
+	p.Status[LastOnline] = timestamp
+	atomic.StoreUint64(&p.lastOnline, math.Float64bits(timestamp))
+}
+
+// countWireBytes increases the number of bytes received from the network, before decompression.
+func (p *Peer) countWireBytes(size int) {
+	p.Lock.Lock()
+	total := p.Status[BytesReceivedWire].(int64) + int64(size)
+	p.Status[BytesReceivedWire] = total
+	p.Lock.Unlock()
+	promPeerBytesReceivedWire.WithLabelValues(p.Name).Set(float64(total))
+}
+
+// useResponseCompression returns true if compressed responses should be requested from this peer.
+func (p *Peer) useResponseCompression() bool {
+	if !p.Config.Compression {
+		return false
+	}
+	p.Lock.RLock()
+	rejected := p.cache.compressionRejected
+	p.Lock.RUnlock()
+	return !rejected
+}
+
+// reCompressionHeaderRejected matches the error message of backends which do not support the compression header,
+// ex.: "Invalid header: ResponseCompression" or "Undefined request header 'ResponseCompression'".
+var reCompressionHeaderRejected = regexp.MustCompile(`(?i)\bheader\W+ResponseCompression\b`)
+
+// checkCompressionRejected disables compression if the remote site does not understand the compression header.
+// It returns true if the query should be sent again without compression.
+func (p *Peer) checkCompressionRejected(req *Request, err error) bool {
+	if err == nil || !req.ResponseCompression {
+		return false
+	}
+	var peerErr *PeerError
+	if !errors.As(err, &peerErr) || peerErr.code != 400 || !reCompressionHeaderRejected.Match(peerErr.resBytes) {
+		return false
+	}
+	logWith(p, req).Warnf("remote site does not support compressed responses, disabling compression: %s", err.Error())
+	p.Lock.Lock()
+	p.cache.compressionRejected = true
+	p.Lock.Unlock()
+	return true
+}
+
+// countClientQuery increases the number of client queries routed to this peer.
+func (p *Peer) countClientQuery() {
+	p.Lock.Lock()
+	p.Status[ClientQueries] = p.Status[ClientQueries].(int64) + 1
+	p.Lock.Unlock()
+	promPeerClientQueries.WithLabelValues(p.Name).Inc()
+}
+
+// countRowsScanned increases the number of rows scanned by client queries for this peer.
+func (p *Peer) countRowsScanned(rows int) {
+	if p == nil || rows == 0 {
+		return
+	}
+	// the peer might be read locked already while building the result
+	atomic.AddInt64(&p.rowsScanned, int64(rows))
+}
+
+// RowsScanned returns the number of rows scanned by client queries for this peer.
+func (p *Peer) RowsScanned() int64 {
+	return atomic.LoadInt64(&p.rowsScanned)
+}
+
 // ScheduleImmediateUpdate resets all update timer so the next updateloop iteration
 // will performan an update.
 func (p *Peer) ScheduleImmediateUpdate() {
@@ -762,6 +883,7 @@ func (p *Peer) InitAllTables() (err error) {
 	p.Lock.Lock()
 	p.SetDataStoreSet(data, false)
 	p.Status[ResponseTime] = duration.Seconds()
+	p.Status[LastFullUpdateDuration] = duration.Seconds()
 	peerStatus := p.Status[PeerState].(PeerStatus)
 	logWith(p).Infof("objects created in: %s", duration.String())
 	if peerStatus != PeerStatusUp {
@@ -891,6 +1013,7 @@ func (p *Peer) updateInitialStatus(store *DataStore) (err error) {
 		p.Lock.Lock()
 		p.Status[PeerState] = PeerStatusDown
 		p.Status[LastError] = "peered partner not ready yet"
+		p.errorHistory.Add(time.Now().Unix(), "peered partner not ready yet")
 		p.ClearData(false)
 		p.Lock.Unlock()
 		return fmt.Errorf("peered partner not ready yet")
@@ -935,8 +1058,11 @@ func (p *Peer) updateInitialStatus(store *DataStore) (err error) {
 
 // resetErrors reset the error counter after the site has recovered
 func (p *Peer) resetErrors() {
+	if p.Status[PeerState].(PeerStatus) != PeerStatusUp && p.lmd.Config.ClearErrorHistoryOnRecover {
+		p.errorHistory.Clear()
+	}
 	p.Status[LastError] = ""
-	p.Status[LastOnline] = currentUnixTime()
+	p.setLastOnline(currentUnixTime())
 	p.ErrorCount = 0
 	p.ErrorLogged = false
 	p.Status[PeerState] = PeerStatusUp
@@ -982,6 +1108,10 @@ func (p *Peer) query(req *Request) (ResultSet, *ResultMetaData, error) {
 	if connType == ConnTypeHTTP {
 		req.KeepAlive = false
 	}
+	// http connections use http compression instead
+	if connType != ConnTypeHTTP && req.ResponseFixed16 && p.useResponseCompression() {
+		req.ResponseCompression = true
+	}
 	query := req.String()
 	if log.IsV(LogVerbosityTrace) {
 		logWith(p, req).Tracef("query: %s", query)
@@ -993,6 +1123,10 @@ func (p *Peer) query(req *Request) (ResultSet, *ResultMetaData, error) {
 		p.last.Response = nil
 	}
 	p.Status[Queries] = p.Status[Queries].(int64) + 1
+	if req.Command == "" && !req.passthrough {
+		p.Status[UpdateQueries] = p.Status[UpdateQueries].(int64) + 1
+		promPeerUpdateQueries.WithLabelValues(p.Name).Inc()
+	}
 	totalBytesSend := p.Status[BytesSend].(int64) + int64(len(query))
 	p.Status[BytesSend] = totalBytesSend
 	peerAddr := p.Status[PeerAddr].(string)
@@ -1002,7 +1136,25 @@ func (p *Peer) query(req *Request) (ResultSet, *ResultMetaData, error) {
 
 	t1 := time.Now()
 	resBytes, newConn, err := p.getQueryResponse(req, query, peerAddr, conn, connType)
+	if p.checkCompressionRejected(req, err) {
+		// retry the same query once without compression on a new connection
+		var oErr error
+		addr, cType := extractConnType(peerAddr)
+		conn.Close()
+		conn, oErr = p.OpenConnection(addr, cType)
+		if oErr != nil {
+			err = fmt.Errorf("%w, retry without compression failed as well: %s", err, oErr.Error())
+		} else {
+			req.ResponseCompression = false
+			query = req.String()
+			resBytes, newConn, err = p.getQueryResponse(req, query, peerAddr, conn, connType)
+		}
+	}
 	duration := time.Since(t1)
+	p.Lock.Lock()
+	p.Status[QueryDuration] = p.Status[QueryDuration].(float64) + duration.Seconds()
+	p.Lock.Unlock()
+	promPeerQueryDuration.WithLabelValues(p.Name).Observe(duration.Seconds())
 	if err != nil {
 		logWith(p, req).Debugf("backend query failed: %w", err)
 		return nil, nil, err
@@ -1088,11 +1240,24 @@ func (p *Peer) getHTTPQueryResponse(req *Request, query string, peerAddr string)
 
 func (p *Peer) getSocketQueryResponse(req *Request, query string, conn net.Conn) ([]byte, error) {
 	// tcp/unix connections
-	n, err := p.socketSendQuery(query, conn)
+	n, err := p.socketSendQuery(req, query, conn)
 	if err != nil {
 		return nil, fmt.Errorf("connection error, send %d of %d bytes: %w", n, len(query), err)
 	}
 
+	if req.abort != nil {
+		// unblock reading the response once the request has been aborted, overrides the deadline from sending the query
+		finished := make(chan struct{})
+		defer close(finished)
+		go func() {
+			select {
+			case <-req.abort:
+				LogErrors(conn.SetDeadline(time.Now()))
+			case <-finished:
+			}
+		}()
+	}
+
 	// close write part of connection
 	// but only on commands, it'll breaks larger responses with stunnel / xinetd constructs
 	if req.Command != "" && !req.KeepAlive {
@@ -1182,9 +1347,13 @@ func CloseWrite(conn net.Conn) (err error) {
 	return err
 }
 
-func (p *Peer) socketSendQuery(query string, conn net.Conn) (int, error) {
+func (p *Peer) socketSendQuery(req *Request, query string, conn net.Conn) (int, error) {
 	// set read timeout
-	err := conn.SetDeadline(time.Now().Add(time.Duration(p.lmd.Config.NetTimeout) * time.Second))
+	deadline := time.Now().Add(time.Duration(p.lmd.Config.NetTimeout) * time.Second)
+	if !req.deadline.IsZero() && req.deadline.Before(deadline) {
+		deadline = req.deadline
+	}
+	err := conn.SetDeadline(deadline)
 	if err != nil {
 		return 0, fmt.Errorf("conn.SetDeadline: %w", err)
 	}
@@ -1224,6 +1393,7 @@ func (p *Peer) parseResponseUndefinedSize(conn io.Reader) ([]byte, error) {
 		}
 	}
 	res := body.Bytes()
+	p.countWireBytes(len(res))
 	return res, nil
 }
 
@@ -1256,12 +1426,19 @@ func (p *Peer) parseResponseFixedSize(req *Request, conn io.ReadCloser) ([]byte,
 	}
 
 	res := body.Bytes()
+	p.countWireBytes(len(res))
 	err = p.validateResponseHeader(res, req, code, expSize)
 	if err != nil {
 		logWith(p, req).Debugf("LastQuery:")
 		logWith(p, req).Debugf("%s", req.String())
 		return nil, err
 	}
+	if req.ResponseCompression && bytes.HasPrefix(res, gzipMagic) {
+		res, err = gunzipBytes(res)
+		if err != nil {
+			return nil, &PeerError{msg: err.Error(), kind: ResponseError, req: req, srcErr: err}
+		}
+	}
 	return res, nil
 }
 
@@ -1485,6 +1662,7 @@ func (p *Peer) setNextAddrFromErr(err error, req *Request) {
 	}
 	logWith(logContext...).Debugf("connection error %s: %s", peerAddr, err)
 	p.Status[LastError] = strings.TrimSpace(err.Error())
+	p.errorHistory.Add(time.Now().Unix(), p.Status[LastError].(string))
 	p.ErrorCount++
 
 	numSources := len(p.Source)
@@ -1776,12 +1954,9 @@ func (p *Peer) fetchRemotePeersFromAddr(peerAddr string) (sites []interface{}, e
 }
 
 // WaitCondition waits for a given condition.
-// It returns when the condition matches successfully or after a timeout
-func (p *Peer) WaitCondition(ctx context.Context, req *Request) {
-	// wait up to one minute if nothing specified
-	if req.WaitTimeout <= 0 {
-		req.WaitTimeout = WaitTimeoutDefault
-	}
+// It returns when the condition matches successfully or after a timeout,
+// timedOut is true if the condition did not match in time.
+func (p *Peer) WaitCondition(ctx context.Context, req *Request) (timedOut bool) {
 	c := make(chan struct{})
 	go func(p *Peer, c chan struct{}, req *Request) {
 		// make sure we log panics properly
@@ -1789,22 +1964,26 @@ func (p *Peer) WaitCondition(ctx context.Context, req *Request) {
 
 		p.LogErrors(p.waitcondition(ctx, c, req))
 	}(p, c, req)
-	timeout := time.NewTimer(time.Duration(req.WaitTimeout) * time.Millisecond)
+	timeout := time.NewTimer(p.lmd.Config.GetWaitTimeout(req.WaitTimeout))
 	select {
 	case <-c:
 		// finished with condition met
 		timeout.Stop()
 	case <-timeout.C:
 		// timed out
+		timedOut = true
 	case <-ctx.Done():
 		// contxt closed
 	}
 
 	safeCloseWaitChannel(c)
+	return timedOut
 }
 
 func (p *Peer) waitcondition(ctx context.Context, c chan struct{}, req *Request) (err error) {
 	var lastUpdate float64
+	wake := p.commandNotifier.Register(req.Table, req.WaitObject)
+	defer p.commandNotifier.Unregister(wake)
 	for {
 		select {
 		case <-c:
@@ -1830,39 +2009,25 @@ func (p *Peer) waitcondition(ctx context.Context, c chan struct{}, req *Request)
 
 		data, err := p.GetDataStoreSet()
 		if err != nil {
-			time.Sleep(WaitTimeoutCheckInterval)
-			continue
+			// peer went down, no need to wait any longer
+			logWith(p, req).Debugf("stopped waiting: %s", err.Error())
+			safeCloseWaitChannel(c)
+			return nil
 		}
 
 		store, err := p.GetDataStore(req.Table)
 		if err != nil {
-			time.Sleep(WaitTimeoutCheckInterval)
-			continue
+			logWith(p, req).Debugf("stopped waiting: %s", err.Error())
+			safeCloseWaitChannel(c)
+			return nil
 		}
 
-		// get object to watch
-		found := false
-		if req.WaitObject != "" {
-			obj, ok := store.GetWaitObject(req)
-			if !ok {
-				logWith(p, req).Warnf("WaitObject did not match any object: %s", req.WaitObject)
-				safeCloseWaitChannel(c)
-				return nil
-			}
-
-			found = true
-			for i := range req.WaitCondition {
-				if !obj.MatchFilter(req.WaitCondition[i], false) {
-					found = false
-				}
-			}
-		} else if p.waitConditionTableMatches(store, req.WaitCondition) {
-			found = true
-		}
-
-		// invert wait condition logic
-		if req.WaitConditionNegate {
-			found = !found
+		// get objects to watch
+		found, err := p.waitConditionMatches(store, req)
+		if err != nil {
+			logWith(p, req).Warnf("%s", err.Error())
+			safeCloseWaitChannel(c)
+			return nil
 		}
 
 		if found {
@@ -1874,22 +2039,29 @@ func (p *Peer) waitcondition(ctx context.Context, c chan struct{}, req *Request)
 			continue
 		}
 
-		// nothing matched, update tables
-		time.Sleep(WaitTimeoutCheckInterval)
-		switch req.Table {
-		case TableHosts:
-			err = data.UpdateDeltaHosts(fmt.Sprintf("Filter: name = %s\n", req.WaitObject), false, 0)
-		case TableServices:
-			tmp := strings.SplitN(req.WaitObject, ";", 2)
-			if len(tmp) < 2 {
-				logWith(p, req).Errorf("unsupported service wait object: %s", req.WaitObject)
-				safeCloseWaitChannel(c)
-				return nil
-			}
-			err = data.UpdateDeltaServices(fmt.Sprintf("Filter: host_name = %s\nFilter: description = %s\n", tmp[0], tmp[1]), false, 0)
+		// nothing matched, update tables after the check interval or once a command for the wait objects has been sent
+		timer := time.NewTimer(WaitTimeoutCheckInterval)
+		select {
+		case <-wake:
+			logWith(p, req).Debugf("command sent, checking wait condition")
+			timer.Stop()
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return nil
+		}
+		if !p.acquireQuerySlot(ctx, req) {
+			return nil
+		}
+		switch {
+		case len(req.WaitObject) > 0 && req.Table == TableHosts:
+			err = data.UpdateDeltaHosts(waitObjectFilter(req), false, 0)
+		case len(req.WaitObject) > 0 && req.Table == TableServices:
+			err = data.UpdateDeltaServices(waitObjectFilter(req), false, 0)
 		default:
 			err = data.UpdateFullTable(req.Table)
 		}
+		p.releaseQuerySlot()
 		if err != nil {
 			if p.scheduleUpdateIfRestartRequiredError(err) {
 				// backend is going to restart, wait a bit and try again
@@ -1953,6 +2125,10 @@ func (p *Peer) HTTPQuery(req *Request, peerAddr string, query string) (res []byt
 	if p.StatusGet(ThrukVersion).(float64) >= ThrukMultiBackendMinVersion {
 		headers["Accept"] = "application/livestatus"
 	}
+	// setting the header manually disables transparent decompression, so we can count the compressed size
+	if p.Config.Compression {
+		headers["Accept-Encoding"] = "gzip"
+	}
 
 	output, result, err := p.HTTPPostQuery(req, peerAddr, url.Values{
 		"data": {fmt.Sprintf("{\"credential\": %q, \"options\": %s}", p.Config.Auth, optionStr)},
@@ -1998,6 +2174,12 @@ func (p *Peer) HTTPPostQueryResult(query *Request, peerAddr string, postData url
 	}
 	p.StatusSet(LastHTTPRequestSuccessful, true)
 	contents, err := ExtractHTTPResponse(response)
+	if err == nil {
+		p.countWireBytes(len(contents))
+		if response.Header.Get("Content-Encoding") == "gzip" {
+			contents, err = gunzipBytes(contents)
+		}
+	}
 	p.logHTTPResponse(query, response, contents)
 	if err != nil {
 		logWith(p, query).Debugf("http(s) error: %s", fmtHTTPerr(req, err))
@@ -2150,23 +2332,109 @@ func ExtractHTTPResponse(response *http.Response) (contents []byte, err error) {
 }
 
 // PassThroughQuery runs a passthrough query on a single peer and appends the result
-func (p *Peer) PassThroughQuery(res *Response, passthroughRequest *Request, virtualColumns []*Column, columnsIndex map[*Column]int) {
+func (p *Peer) PassThroughQuery(ctx context.Context, res *Response, num int, passthroughRequest *Request, virtualColumns []*Column, columnsIndex map[*Column]int, countIndex int) {
 	req := res.Request
-	// do not use Query here, might be a log query with log
-	result, _, queryErr := p.query(passthroughRequest)
+	defer res.observePeerResponseDuration(p.ID, p.Name, req.Table, time.Now())
+	if !p.acquireQuerySlot(ctx, passthroughRequest) {
+		res.setPassThroughFailed(num, p, "request canceled while waiting for a free query slot")
+		return
+	}
+	atomic.AddInt32(&p.passthroughs, 1)
+	total := -1
+	var countErr error
+	countDone := make(chan bool)
+	countRequest := res.passthroughCountRequest(passthroughRequest)
+	if countRequest != nil {
+		// count all matching rows in parallel, the data query is limited
+		go func() {
+			defer logPanicExitPeer(p)
+			defer close(countDone)
+			total, countErr = p.passThroughCount(res, countRequest)
+		}()
+	} else {
+		close(countDone)
+	}
+	result, cached, queryErr := p.passThroughFetch(res, passthroughRequest, virtualColumns, columnsIndex)
+	// cached results are not sorted and limited by the log cache, they are sorted below
+	if len(passthroughRequest.Sort) > 0 && !cached && p.passThroughSortRejected(res, passthroughRequest, result, queryErr) {
+		// fetch everything and sort locally, otherwise the limit would cut off wrong rows
+		logWith(p, req).Debugf("backend does not support sorting, falling back to unlimited passthrough query")
+		headerRejected := queryErr != nil
+		passthroughRequest.Sort = nil
+		passthroughRequest.Limit = nil
+		result, _, queryErr = p.passThroughFetch(res, passthroughRequest, virtualColumns, columnsIndex)
+		if queryErr == nil && headerRejected {
+			atomic.StoreInt32(&p.noSortSupport, 1)
+		}
+	}
+	<-countDone
+	atomic.AddInt32(&p.passthroughs, -1)
+	p.releaseQuerySlot()
 	logWith(p, req).Tracef("req done")
+	if queryErr == nil && countErr != nil {
+		logWith(p, req).Debugf("passthrough count req errored %s", countErr.Error())
+		res.setPassThroughFailed(num, p, fmt.Sprintf("total count query failed: %s", countErr.Error()))
+	}
 	if queryErr != nil {
-		if peerErr, ok := queryErr.(*PeerError); !ok || peerErr.kind != ResponseError {
+		abortErr := ctx.Err()
+		if abortErr == nil && !passthroughRequest.deadline.IsZero() && !time.Now().Before(passthroughRequest.deadline) {
+			// the connection deadline might expire before the context
+			abortErr = context.DeadlineExceeded
+		}
+		if peerErr, ok := queryErr.(*PeerError); (!ok || peerErr.kind != ResponseError) && abortErr == nil {
 			// connection issue, need to reset current connection
+			// but not if the query has been aborted by the passthrough timeout
 			p.setNextAddrFromErr(queryErr, passthroughRequest)
 		}
 		logWith(p, req).Tracef("passthrough req errored %s", queryErr.Error())
-		res.Lock.Lock()
-		res.Failed[p.ID] = queryErr.Error()
-		res.Lock.Unlock()
+		msg := queryErr.Error()
+		if abortErr != nil {
+			msg = passThroughAbortMessage(abortErr)
+		}
+		res.setPassThroughFailed(num, p, msg)
 		return
 	}
-	// insert virtual values, like peer_addr or name
+	if len(req.Stats) == 0 && len(req.Sort) > 0 && !res.isSortedResult(result) {
+		sort.SliceStable(result, func(i, j int) bool {
+			return res.compareRows(result[i], result[j]) < 0
+		})
+	}
+	logWith(p, req).Tracef("result ready")
+	res.trace.AddPeerRows(p.ID, p.Name, len(result))
+	if len(req.Stats) > 0 {
+		res.mergePassThroughStats(num, result, countIndex)
+		return
+	}
+	if countErr != nil {
+		total = -1
+	}
+	res.setPassThroughResult(num, result, total)
+}
+
+// passThroughCount returns the number of rows matching the count request.
+func (p *Peer) passThroughCount(res *Response, countRequest *Request) (int, error) {
+	result, _, err := p.passThroughFetch(res, countRequest, nil, nil)
+	if err != nil {
+		return -1, err
+	}
+	if len(result) != 1 || len(result[0]) != 1 {
+		return -1, &PeerError{msg: fmt.Sprintf("unexpected count result: %v", result), kind: ResponseError}
+	}
+	return interface2int(result[0][0]), nil
+}
+
+// passThroughFetch fetches the result of a passthrough query from the log cache or the remote site
+// and inserts virtual values, like peer_addr or name. It returns true if the result came from the log cache.
+func (p *Peer) passThroughFetch(res *Response, passthroughRequest *Request, virtualColumns []*Column, columnsIndex map[*Column]int) (ResultSet, bool, error) {
+	result, cached := p.queryLogCache(passthroughRequest)
+	if !cached {
+		// do not use Query here, might be a log query with log
+		var err error
+		result, _, err = p.query(passthroughRequest)
+		if err != nil {
+			return nil, false, err
+		}
+	}
 	if len(virtualColumns) > 0 {
 		table := Objects.Tables[res.Request.Table]
 		store := NewDataStore(table, p)
@@ -2183,24 +2451,108 @@ func (p *Peer) PassThroughQuery(res *Response, passthroughRequest *Request, virt
 			result[rowNum] = *row
 		}
 	}
-	logWith(p, req).Tracef("result ready")
-	res.Lock.Lock()
-	if len(req.Stats) == 0 {
-		res.Result = append(res.Result, result...)
-	} else {
-		if res.Request.StatsResult == nil {
-			res.Request.StatsResult = NewResultSetStats()
-			res.Request.StatsResult.Stats[""] = createLocalStatsCopy(res.Request.Stats)
-		}
-		// apply stats queries
-		if len(result) > 0 {
-			for i := range result[0] {
-				val := result[0][i].(float64)
-				res.Request.StatsResult.Stats[""][i].ApplyValue(val, int(val))
-			}
+	return result, cached, nil
+}
+
+// reSortHeaderRejected matches the error message of backends which do not support the sort header,
+// ex.: "Invalid header Sort: time asc" or "Undefined request header 'Sort'".
+var reSortHeaderRejected = regexp.MustCompile(`(?i)\bheader\W+sort\b`)
+
+// passThroughSortRejected returns true if the backend either rejected the sort header
+// or returned a limited result which is not sorted as requested.
+func (p *Peer) passThroughSortRejected(res *Response, passthroughRequest *Request, result ResultSet, queryErr error) bool {
+	if queryErr != nil {
+		// other errors would simply fail again
+		var peerErr *PeerError
+		if !errors.As(queryErr, &peerErr) || peerErr.kind != ResponseError || peerErr.code != 400 {
+			return false
 		}
+		return reSortHeaderRejected.Match(peerErr.resBytes)
 	}
-	res.Lock.Unlock()
+	if passthroughRequest.Limit == nil {
+		// unlimited results can simply be sorted locally
+		return false
+	}
+	return !res.isSortedResult(result)
+}
+
+// sortUnsupported returns true if the backend rejected sorted passthrough queries before.
+func (p *Peer) sortUnsupported() bool {
+	return atomic.LoadInt32(&p.noSortSupport) == 1
+}
+
+// queryLogCache tries to answer a passed through log query from the local log cache.
+func (p *Peer) queryLogCache(req *Request) (ResultSet, bool) {
+	if p.logCache == nil || req.Table != TableLog {
+		return nil, false
+	}
+	p.Lock.RLock()
+	programStart := p.ProgramStart
+	p.Lock.RUnlock()
+	result, ok := p.logCache.Query(req, programStart)
+	if ok {
+		logWith(p, req).Debugf("answered log query from log cache")
+	}
+	return result, ok
+}
+
+// fetchLogEntries fetches all log entries since given timestamp from the remote core.
+func (p *Peer) fetchLogEntries(columns []string, since int64) (ResultSet, error) {
+	timeFilter := &Filter{
+		Column:     Objects.Tables[TableLog].GetColumn("time"),
+		Operator:   GreaterThan,
+		StrValue:   fmt.Sprintf("%d", since),
+		FloatValue: float64(since),
+		IntValue:   int(since),
+	}
+	req := &Request{
+		Table:           TableLog,
+		Columns:         columns,
+		Filter:          []*Filter{timeFilter},
+		OutputFormat:    OutputFormatJSON,
+		ResponseFixed16: true,
+		passthrough:     true,
+	}
+	res, _, err := p.query(req)
+	return res, err
+}
+
+// acquireQuerySlot waits for a free slot to run an on-demand query against the remote site.
+// It returns false if the context has been canceled while waiting.
+func (p *Peer) acquireQuerySlot(ctx context.Context, req *Request) bool {
+	atomic.AddInt32(&p.queriesQueued, 1)
+	waited, ok := p.queryLimiter.Acquire(ctx)
+	atomic.AddInt32(&p.queriesQueued, -1)
+	if waited > QueryQueueLogThreshold {
+		logWith(p, req).Infof("waited %.2fs for a free query slot (MaxParallelQueries: %d)", waited.Seconds(), p.lmd.Config.MaxParallelQueries)
+	}
+	if !ok {
+		logWith(p, req).Debugf("request canceled while waiting for a free query slot")
+		return false
+	}
+	atomic.AddInt32(&p.queriesInFlight, 1)
+	return true
+}
+
+// releaseQuerySlot frees a slot acquired by acquireQuerySlot.
+func (p *Peer) releaseQuerySlot() {
+	atomic.AddInt32(&p.queriesInFlight, -1)
+	p.queryLimiter.Release()
+}
+
+// QueriesInFlight returns the number of currently running on-demand queries.
+func (p *Peer) QueriesInFlight() int {
+	return int(atomic.LoadInt32(&p.queriesInFlight))
+}
+
+// QueriesQueued returns the number of on-demand queries waiting for a free query slot.
+func (p *Peer) QueriesQueued() int {
+	return int(atomic.LoadInt32(&p.queriesQueued))
+}
+
+// PassthroughsInFlight returns the number of currently running passthrough queries.
+func (p *Peer) PassthroughsInFlight() int {
+	return int(atomic.LoadInt32(&p.passthroughs))
 }
 
 // isOnline returns true if this peer is online
@@ -2238,6 +2590,50 @@ func (p *Peer) getError() string {
 	return fmt.Sprintf("%v", p.StatusGet(LastError))
 }
 
+// waitConditionMatches returns true if all wait objects match the wait condition.
+// Without any wait object, any row of the table has to match.
+// It returns an error if a wait object does not exist.
+func (p *Peer) waitConditionMatches(store *DataStore, req *Request) (bool, error) {
+	found := true
+	if len(req.WaitObject) == 0 {
+		found = p.waitConditionTableMatches(store, req.WaitCondition)
+	}
+	for _, name := range req.WaitObject {
+		obj, ok := store.GetWaitObject(name)
+		if !ok {
+			return false, fmt.Errorf("WaitObject did not match any object: %s", name)
+		}
+		for _, f := range req.WaitCondition {
+			if !obj.MatchFilter(f, false) {
+				found = false
+			}
+		}
+	}
+
+	// invert wait condition logic
+	if req.WaitConditionNegate {
+		found = !found
+	}
+	return found, nil
+}
+
+// waitObjectFilter returns the filter to update all wait objects of the request.
+func waitObjectFilter(req *Request) string {
+	filter := ""
+	for _, name := range req.WaitObject {
+		if req.Table == TableServices {
+			parts := strings.SplitN(name, ";", 2)
+			filter += fmt.Sprintf("Filter: host_name = %s\nFilter: description = %s\nAnd: 2\n", parts[0], parts[1])
+			continue
+		}
+		filter += fmt.Sprintf("Filter: name = %s\n", name)
+	}
+	if len(req.WaitObject) > 1 {
+		filter += fmt.Sprintf("Or: %d\n", len(req.WaitObject))
+	}
+	return filter
+}
+
 func (p *Peer) waitConditionTableMatches(store *DataStore, filter []*Filter) bool {
 Rows:
 	for j := range store.Data {
@@ -2281,6 +2677,7 @@ func (p *Peer) setBroken(details string) {
 	p.Lock.Lock()
 	p.Status[PeerState] = PeerStatusBroken
 	p.Status[LastError] = "broken: " + details
+	p.errorHistory.Add(time.Now().Unix(), p.Status[LastError].(string))
 	p.Status[ThrukVersion] = float64(-1)
 	p.ClearData(false)
 	p.Lock.Unlock()
@@ -2293,6 +2690,24 @@ func logPanicExitPeer(p *Peer) {
 	}
 
 	log := logWith(p, p.last.Request)
+	if logStructured.Load() {
+		status := make([]string, 0)
+		p.logPeerStatus(func(format string, v ...interface{}) {
+			status = append(status, fmt.Sprintf(format, v...))
+		})
+		log.withField("panic", fmt.Sprintf("%s", r)).
+			withField("version", Version()).
+			withField("peer_status", status).
+			withField("stack", string(debug.Stack())).
+			withField("threaddump", string(threadDump()))
+		if p.last.Request != nil {
+			log.withField("last_query", p.last.Request.String()).
+				withField("last_response", string(p.last.Response))
+		}
+		log.Errorf("panic in peer %s: %s", p.Name, r)
+		deletePidFile(p.lmd.flags.flagPidfile)
+		os.Exit(1)
+	}
 	log.Errorf(">>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>")
 	log.Errorf("Panic:                 %s", r)
 	log.Errorf("LMD Version:           %s", Version())
@@ -2356,62 +2771,41 @@ func (p *Peer) getTLSClientConfig() (*tls.Config, error) {
 	return config, nil
 }
 
-// SendCommandsWithRetry sends list of commands and retries until the peer is completely down
-func (p *Peer) SendCommandsWithRetry(ctx context.Context, commands []string) (err error) {
-	ctx = context.WithValue(ctx, CtxPeer, p.Name)
+// QueueCommands queues the commands to be sent in background by the command queue of this peer.
+// It returns an error if the queue is full.
+func (p *Peer) QueueCommands(commands []string) (*CommandBatch, error) {
+	p.countClientQuery()
 	p.Lock.Lock()
 	p.Status[LastQuery] = currentUnixTime()
 	if p.Status[Idling].(bool) {
 		p.Status[Idling] = false
-		logWith(ctx).Infof("switched back to normal update interval")
+		logWith(p).Infof("switched back to normal update interval")
 	}
 	p.Lock.Unlock()
 
-	// check status of backend
-	retries := 0
-	for {
-		status := p.StatusGet(PeerState).(PeerStatus)
-		switch status {
-		case PeerStatusDown:
-			logWith(ctx).Debugf("cannot send command, peer is down")
-			return fmt.Errorf("%s", p.StatusGet(LastError))
-		case PeerStatusBroken:
-			logWith(ctx).Debugf("cannot send command, peer is broken")
-			return fmt.Errorf("%s", p.StatusGet(LastError))
-		case PeerStatusWarning, PeerStatusPending:
-			// wait till we get either a up or down
-			time.Sleep(1 * time.Second)
-		case PeerStatusUp, PeerStatusSyncing:
-			err = p.SendCommands(ctx, commands)
-			if err == nil {
-				return
-			}
-			switch err := err.(type) {
-			case *PeerError:
-				// connection error, try again
-				if err.kind == ConnectionError {
-					if retries > 0 {
-						/* this indicates a problem with the command itself:
-						   the peer is up, we send a command -> peer is down
-						   then peer comes up again, we send the command again
-						   and the peer is immediately down again. This means
-						   the command probably worked, but something else failed,
-						   so don't repeat the command in an endless loop
-						*/
-						return fmt.Errorf("sending command failed, number of retries exceeded")
-					}
-					retries++
-					time.Sleep(1 * time.Second)
-					continue
-				}
-			case *PeerCommandError:
-				return err
-			}
-			return fmt.Errorf("%s", p.StatusGet(LastError))
-		default:
-			logWith(ctx).Panicf("PeerStatus %v not implemented", status)
-		}
+	return p.commandQueue.Add(commands)
+}
+
+// sendCommandsOnce sends the commands if the peer is up.
+// It returns true if the peer is currently unavailable, so sending may be retried later.
+func (p *Peer) sendCommandsOnce(ctx context.Context, commands []string) (unavailable bool, err error) {
+	status := p.StatusGet(PeerState).(PeerStatus)
+	switch status {
+	case PeerStatusDown:
+		logWith(ctx).Debugf("cannot send command, peer is down")
+		return true, fmt.Errorf("%s", p.StatusGet(LastError))
+	case PeerStatusBroken:
+		logWith(ctx).Debugf("cannot send command, peer is broken")
+		return true, fmt.Errorf("%s", p.StatusGet(LastError))
+	case PeerStatusWarning, PeerStatusPending:
+		// wait till we get either a up or down
+		return true, fmt.Errorf("%s", p.StatusGet(LastError))
+	case PeerStatusUp, PeerStatusSyncing:
+		return false, p.SendCommands(ctx, commands)
+	default:
+		logWith(ctx).Panicf("PeerStatus %v not implemented", status)
 	}
+	return false, nil
 }
 
 // SendCommands sends list of commands
@@ -2421,7 +2815,11 @@ func (p *Peer) SendCommands(ctx context.Context, commands []string) (err error)
 	}
 	ctx = context.WithValue(ctx, CtxRequest, commandRequest.ID())
 	p.setQueryOptions(commandRequest)
+	if !p.acquireQuerySlot(ctx, commandRequest) {
+		return ctx.Err()
+	}
 	_, _, err = p.Query(commandRequest)
+	p.releaseQuerySlot()
 	if err != nil {
 		switch err := err.(type) {
 		case *PeerCommandError:
@@ -2436,6 +2834,9 @@ func (p *Peer) SendCommands(ctx context.Context, commands []string) (err error)
 	// schedule immediate update
 	p.ScheduleImmediateUpdate()
 
+	// wake up wait queries for the affected objects
+	p.commandNotifier.Notify(ParseCommandTargets(commands))
+
 	if !p.HasFlag(HasLastUpdateColumn) {
 		p.StatusSet(ForceFull, true)
 	}
@@ -2483,8 +2884,10 @@ func (p *Peer) SetFlag(flag OptionalFlags) {
 }
 
 // ResetFlags removes all flags and sets the initial flags from config
+// Sub peer flags are set on creation and will be kept.
 func (p *Peer) ResetFlags() {
-	atomic.StoreUint32(&p.Flags, uint32(NoFlags))
+	subFlags := OptionalFlags(atomic.LoadUint32(&p.Flags)) & (LMDSub | HTTPSub)
+	atomic.StoreUint32(&p.Flags, uint32(subFlags))
 
 	// add default flags
 	for _, flag := range p.Config.Flags {
@@ -2744,6 +3147,7 @@ func (p *Peer) addSubPeer(subFlag OptionalFlags, key string, subName string, dat
 		TLSCA:          p.Config.TLSCA,
 		TLSSkipVerify:  p.Config.TLSSkipVerify,
 		Auth:           p.Config.Auth,
+		Compression:    p.Config.Compression,
 	}
 	subPeer = NewPeer(p.lmd, &c)
 	subPeer.ParentID = p.ID
@@ -2769,7 +3173,7 @@ func (p *Peer) addSubPeer(subFlag OptionalFlags, key string, subName string, dat
 		}
 		subPeer.setQueryOptions(req)
 		res, _, err := subPeer.query(req)
-		if err == nil {
+		if err == nil && len(res) > 0 && len(res[0]) > 0 {
 			section = interface2stringNoDedup(res[0][0])
 		}
 	default:
@@ -2782,7 +3186,7 @@ func (p *Peer) addSubPeer(subFlag OptionalFlags, key string, subName string, dat
 
 	p.lmd.PeerMap[subID] = subPeer
 	p.lmd.PeerMapOrder = append(p.lmd.PeerMapOrder, c.ID)
-	p.lmd.nodeAccessor.assignedBackends = append(p.lmd.nodeAccessor.assignedBackends, subID)
+	p.lmd.nodeAccessor.addAssignedBackend(subID)
 
 	if !p.StatusGet(Paused).(bool) {
 		subPeer.Start()
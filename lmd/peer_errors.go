@@ -0,0 +1,85 @@
+package main
+
+import (
+	"github.com/sasha-s/go-deadlock"
+)
+
+const (
+	// PeerErrorHistorySize sets the number of errors kept per peer
+	PeerErrorHistorySize = 20
+
+	// PeerErrorHistoryRecentSeconds sets the time range used to count recent errors
+	PeerErrorHistoryRecentSeconds = 3600
+)
+
+// PeerErrorHistoryEntry contains a single error along with its timestamp.
+type PeerErrorHistoryEntry struct {
+	Time    int64
+	Message string
+}
+
+// PeerErrorHistory is a fixed size ring buffer containing the last errors of a peer.
+// It uses its own lock, so it can be accessed while the peer lock is held.
+type PeerErrorHistory struct {
+	noCopy  noCopy
+	lock    *deadlock.Mutex
+	entries []PeerErrorHistoryEntry
+	next    int
+}
+
+// NewPeerErrorHistory creates a new error history with the given size.
+func NewPeerErrorHistory(size int) *PeerErrorHistory {
+	return &PeerErrorHistory{
+		lock:    new(deadlock.Mutex),
+		entries: make([]PeerErrorHistoryEntry, 0, size),
+	}
+}
+
+// Add appends an error, overwriting the oldest entry once the buffer is full.
+func (h *PeerErrorHistory) Add(now int64, msg string) {
+	if msg == "" {
+		return
+	}
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	entry := PeerErrorHistoryEntry{Time: now, Message: msg}
+	if len(h.entries) < cap(h.entries) {
+		h.entries = append(h.entries, entry)
+		return
+	}
+	h.entries[h.next] = entry
+	h.next = (h.next + 1) % len(h.entries)
+}
+
+// Clear removes all entries.
+func (h *PeerErrorHistory) Clear() {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.entries = h.entries[:0]
+	h.next = 0
+}
+
+// List returns all entries, newest first.
+func (h *PeerErrorHistory) List() []PeerErrorHistoryEntry {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	num := len(h.entries)
+	list := make([]PeerErrorHistoryEntry, 0, num)
+	for i := 1; i <= num; i++ {
+		list = append(list, h.entries[(h.next-i+num)%num])
+	}
+	return list
+}
+
+// CountSince returns the number of entries newer or equal than the given timestamp.
+func (h *PeerErrorHistory) CountSince(since int64) int {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	count := 0
+	for i := range h.entries {
+		if h.entries[i].Time >= since {
+			count++
+		}
+	}
+	return count
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestPeerErrorHistory(t *testing.T) {
+	h := NewPeerErrorHistory(3)
+	h.Add(1, "err1")
+	h.Add(2, "")
+	h.Add(3, "err3")
+
+	list := h.List()
+	if err := assertEq(2, len(list)); err != nil {
+		t.Fatal(err)
+	}
+	if err := assertEq("err3", list[0].Message); err != nil {
+		t.Error(err)
+	}
+
+	h.Add(4, "err4")
+	h.Add(5, "err5")
+	list = h.List()
+	if err := assertEq(3, len(list)); err != nil {
+		t.Fatal(err)
+	}
+	if err := assertEq([]int64{5, 4, 3}, []int64{list[0].Time, list[1].Time, list[2].Time}); err != nil {
+		t.Error(err)
+	}
+	if err := assertEq(2, h.CountSince(4)); err != nil {
+		t.Error(err)
+	}
+
+	h.Clear()
+	if err := assertEq(0, len(h.List())); err != nil {
+		t.Error(err)
+	}
+}
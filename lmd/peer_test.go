@@ -5,6 +5,8 @@ import (
 	"bytes"
 	"context"
 	"fmt"
+	"net"
+	"os"
 	"testing"
 	"time"
 )
@@ -196,7 +198,7 @@ func TestPeerUpdate(t *testing.T) {
 	svcTbl, _ := peer.GetDataStore(TableServices)
 	lastCheckCol := svcTbl.GetColumn("last_check")
 	for _, row := range svcTbl.Data {
-		row.dataInt64[lastCheckCol.Index] = 2
+		row.vals().dataInt64[lastCheckCol.Index] = 2
 	}
 	err = data.UpdateDelta(float64(5), float64(time.Now().Unix()+5))
 	if err != nil {
@@ -257,6 +259,70 @@ func TestPeerDeltaUpdate(t *testing.T) {
 	}
 }
 
+func TestPeerQueryDuringUpdate(t *testing.T) {
+	peer, cleanup, _ := StartTestPeer(1, 10, 10)
+	PauseTestPeers(peer)
+
+	data, err := peer.GetDataStoreSet()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// queries must not wait for running updates
+	data.Lock.Lock()
+	done := make(chan error, 1)
+	go func() {
+		_, _, qErr := peer.QueryString("GET services\nColumns: host_name description\n\n")
+		done <- qErr
+	}()
+	select {
+	case err = <-done:
+		if err != nil {
+			t.Error(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("query blocked by update lock")
+	}
+	data.Lock.Unlock()
+
+	// updates replace the row values, so running queries keep a consistent snapshot
+	svcTbl, _ := peer.GetDataStore(TableServices)
+	lastCheckCol := svcTbl.GetColumn("last_check")
+	row := svcTbl.Data[0]
+	snapshot := row.vals()
+	lastCheck := snapshot.dataInt64[lastCheckCol.Index]
+	err = row.UpdateValuesNumberOnly(0, []interface{}{lastCheck + 10}, ColumnList{lastCheckCol}, currentUnixTime())
+	if err != nil {
+		t.Error(err)
+	}
+	if err := assertEq(lastCheck, snapshot.dataInt64[lastCheckCol.Index]); err != nil {
+		t.Error(err)
+	}
+	if err := assertEq(lastCheck+10, row.GetInt64(lastCheckCol)); err != nil {
+		t.Error(err)
+	}
+
+	// pinned rows keep their values for filter, sort and output
+	snapshots := &rowSnapshots{}
+	pinned := snapshots.pin(row)
+	snapshots.keep()
+	err = row.UpdateValuesNumberOnly(0, []interface{}{lastCheck + 20}, ColumnList{lastCheckCol}, currentUnixTime())
+	if err != nil {
+		t.Error(err)
+	}
+	snapshots.pin(svcTbl.Data[1])
+	if err := assertEq(lastCheck+10, pinned.GetInt64(lastCheckCol)); err != nil {
+		t.Error(err)
+	}
+	if err := assertEq(row.GetID(), pinned.GetID()); err != nil {
+		t.Error(err)
+	}
+
+	if err := cleanup(); err != nil {
+		panic(err.Error())
+	}
+}
+
 func TestPeerUpdateResume(t *testing.T) {
 	peer, cleanup, _ := StartTestPeer(1, 10, 10)
 	PauseTestPeers(peer)
@@ -328,3 +394,201 @@ func TestPeerLog(t *testing.T) {
 		panic(err.Error())
 	}
 }
+
+func TestLMDPeerPassthrough(t *testing.T) {
+	peer, cleanup, _ := StartTestPeer(3, 10, 10)
+	PauseTestPeers(peer)
+
+	// use the test peer as federated lmd parent, which creates sub peers for all remote backends
+	peer.lmd.PeerMapLock.Lock()
+	peer.lmd.PeerMap[peer.ID] = peer
+	peer.lmd.PeerMapOrder = append(peer.lmd.PeerMapOrder, peer.ID)
+	peer.lmd.PeerMapLock.Unlock()
+	peer.StatusSet(LastUpdate, float64(0))
+	peer.SetFlag(LMD)
+	peer.SetFlag(MultiBackend)
+	err := peer.periodicUpdateLMD(nil, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = assertEq(4, len(peer.lmd.PeerMap)); err != nil {
+		t.Fatal(err)
+	}
+
+	// mark one sub backend as down
+	subPeer := peer.lmd.PeerMap["mockid2"]
+	subPeer.StatusSet(SubPeerStatus, map[string]interface{}{"status": float64(PeerStatusDown), "last_error": "sub backend down"})
+
+	query := "GET log\nColumns: peer_key time type\nSort: peer_key asc\nOutputFormat: wrapped_json\n\n"
+	req, _, err := NewRequest(context.TODO(), peer.lmd, bufio.NewReader(bytes.NewBufferString(query)), ParseDefault)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = req.ExpandRequestedBackends()
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := req.BuildResponse(context.TODO())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = assertEq(map[string]string{"mockid2": "sub backend down"}, res.Failed); err != nil {
+		t.Error(err)
+	}
+	keys := map[string]int{}
+	for _, row := range res.Result {
+		keys[*(row[0].(*string))]++
+	}
+	if err = assertEq(2, len(keys)); err != nil {
+		t.Error(err)
+	}
+
+	// each sub peer must only return its own log entries
+	direct, _, err := peer.QueryString("GET log\nColumns: time\nBackends: mockid0\n\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = assertEq(len(direct), keys["mockid0"]); err != nil {
+		t.Error(err)
+	}
+	if err = assertEq(keys["mockid0"], keys["mockid1"]); err != nil {
+		t.Error(err)
+	}
+
+	if err := cleanup(); err != nil {
+		panic(err.Error())
+	}
+}
+
+func TestPeerCompression(t *testing.T) {
+	peer, cleanup, _ := StartTestPeer(1, 10, 100)
+	PauseTestPeers(peer)
+
+	peer.Config.Compression = true
+	received := peer.StatusGet(BytesReceived).(int64)
+	receivedWire := peer.StatusGet(BytesReceivedWire).(int64)
+
+	res, _, err := peer.QueryString("GET services\nColumns: host_name description plugin_output\nResponseHeader: fixed16\n\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = assertEq(100, len(res)); err != nil {
+		t.Error(err)
+	}
+
+	received = peer.StatusGet(BytesReceived).(int64) - received
+	receivedWire = peer.StatusGet(BytesReceivedWire).(int64) - receivedWire
+	if err = assertEq(true, receivedWire > 0 && receivedWire < received); err != nil {
+		t.Errorf("expected compressed transfer, received %d bytes, %d bytes on wire: %s", received, receivedWire, err)
+	}
+
+	if err := cleanup(); err != nil {
+		panic(err.Error())
+	}
+}
+
+func TestPeerCompressionRejected(t *testing.T) {
+	lmd := createTestLMDInstance()
+
+	// minimal livestatus source which does not know the compression header
+	listen := fmt.Sprintf("mockcompression_%d.sock", time.Now().Nanosecond())
+	l, err := net.Listen("unix", listen)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(listen)
+	defer l.Close()
+	queries := make(chan bool, 10)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			req, err := ParseRequest(context.TODO(), lmd, conn)
+			if err != nil {
+				panic(err.Error())
+			}
+			queries <- req.ResponseCompression
+			code, body := 200, "[[\"host1\"]]\n"
+			switch {
+			case req.Columns[0] == "unknown":
+				code, body = 400, "Table 'hosts' has no column 'unknown'\n"
+			case req.ResponseCompression:
+				code, body = 400, "Invalid header: ResponseCompression\n"
+			}
+			_checkErr2(fmt.Fprintf(conn, "%d %11d\n%s", code, len(body), body))
+			_checkErr(conn.Close())
+		}
+	}()
+
+	connection := Connection{Name: "Test", ID: "testid", Source: []string{listen}, Compression: true}
+	peer := NewPeer(lmd, &connection)
+
+	// other errors neither disable compression nor resend the query
+	_, _, err = peer.QueryString("GET hosts\nColumns: unknown\nResponseHeader: fixed16\n\n")
+	if err == nil {
+		t.Fatalf("expected error for unknown column")
+	}
+	if err = assertEq(true, <-queries); err != nil {
+		t.Error(err)
+	}
+	if err = assertEq(true, peer.useResponseCompression()); err != nil {
+		t.Error(err)
+	}
+
+	res, _, err := peer.QueryString("GET hosts\nColumns: name\nResponseHeader: fixed16\n\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = assertEq(ResultSet{{"host1"}}, res); err != nil {
+		t.Error(err)
+	}
+
+	// the query has been sent again without compression
+	if err = assertEq([]bool{true, false}, []bool{<-queries, <-queries}); err != nil {
+		t.Error(err)
+	}
+	select {
+	case compressed := <-queries:
+		t.Errorf("unexpected query, compressed: %v", compressed)
+	default:
+	}
+	if err = assertEq(false, peer.useResponseCompression()); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestPeerQuerySlots(t *testing.T) {
+	lmd := createTestLMDInstance()
+	lmd.Config.MaxParallelQueries = 1
+	connection := Connection{Name: "Test", Source: []string{"http://localhost/test/"}}
+	peer := NewPeer(lmd, &connection)
+	req := &Request{Table: TableHosts}
+
+	if err := assertEq(true, peer.acquireQuerySlot(context.TODO(), req)); err != nil {
+		t.Error(err)
+	}
+	if err := assertEq(1, peer.QueriesInFlight()); err != nil {
+		t.Error(err)
+	}
+
+	// second query must wait and give up once the context is canceled
+	ctx, cancel := context.WithTimeout(context.TODO(), 50*time.Millisecond)
+	defer cancel()
+	if err := assertEq(false, peer.acquireQuerySlot(ctx, req)); err != nil {
+		t.Error(err)
+	}
+	if err := assertEq(1, peer.QueriesInFlight()); err != nil {
+		t.Error(err)
+	}
+
+	peer.releaseQuerySlot()
+	if err := assertEq(0, peer.QueriesInFlight()); err != nil {
+		t.Error(err)
+	}
+	if err := assertEq(true, peer.acquireQuerySlot(context.TODO(), req)); err != nil {
+		t.Error(err)
+	}
+	peer.releaseQuerySlot()
+}
@@ -79,6 +79,15 @@ var (
 		},
 		[]string{"listen"},
 	)
+	promFrontendQueryResults = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: NAME,
+			Subsystem: "frontend",
+			Name:      "query_results",
+			Help:      "Listener Queries by Result (completed, client_gone, deadline, memory_budget, killed or shutdown)",
+		},
+		[]string{"listen", "result"},
+	)
 	promFrontendBytesSend = prometheus.NewCounterVec(
 		prometheus.CounterOpts{
 			Namespace: NAME,
@@ -106,6 +115,33 @@ var (
 		},
 		[]string{"listen"},
 	)
+	promFrontendRejectedConnections = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: NAME,
+			Subsystem: "frontend",
+			Name:      "rejected_connections",
+			Help:      "Rejected Frontend Connections and Queries by Reason (max_connections, max_connections_per_ip or rate_limit)",
+		},
+		[]string{"listen", "reason"},
+	)
+	promFrontendIdleClosedConnections = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: NAME,
+			Subsystem: "frontend",
+			Name:      "idle_closed_connections",
+			Help:      "Frontend Connections closed by the ClientIdleTimeout",
+		},
+		[]string{"listen"},
+	)
+	promFrontendTLSHandshakeErrors = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: NAME,
+			Subsystem: "frontend",
+			Name:      "tls_handshake_errors",
+			Help:      "Failed TLS Handshakes of Frontend Clients",
+		},
+		[]string{"listen"},
+	)
 	promFrontendRequestDuration = prometheus.NewHistogram(
 		prometheus.HistogramOpts{
 			Namespace: NAME,
@@ -114,6 +150,91 @@ var (
 			Help:      "Request duration in seconds",
 		},
 	)
+	promFrontendQueryDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: NAME,
+			Subsystem: "frontend",
+			Name:      "query_duration_seconds",
+			Help:      "Query Duration in Seconds by Table and Result Code, the count is the number of queries",
+		},
+		[]string{"table", "code"},
+	)
+	promFrontendRowsScanned = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: NAME,
+			Subsystem: "frontend",
+			Name:      "rows_scanned",
+			Help:      "Number of Rows Scanned by Table",
+		},
+		[]string{"table"},
+	)
+	promFrontendRowsReturned = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: NAME,
+			Subsystem: "frontend",
+			Name:      "rows_returned",
+			Help:      "Number of Rows Returned by Table",
+		},
+		[]string{"table"},
+	)
+	promFrontendResponseSpills = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: NAME,
+			Subsystem: "frontend",
+			Name:      "response_spills",
+			Help:      "Number of huge responses buffered in a temporary file",
+		},
+	)
+	promFrontendQueryMemory = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: NAME,
+			Subsystem: "frontend",
+			Name:      "query_memory_bytes",
+			Help:      "Approximate memory retained by all running queries in bytes",
+		},
+	)
+	promFrontendResponseWorkerQueue = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: NAME,
+			Subsystem: "frontend",
+			Name:      "response_worker_queue_depth",
+			Help:      "Number of response workers waiting for a free slot",
+		},
+	)
+	promFrontendResponseWorkerWait = prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Namespace: NAME,
+			Subsystem: "frontend",
+			Name:      "response_worker_wait_seconds",
+			Help:      "Time response workers spent waiting for a free slot in seconds",
+		},
+	)
+
+	promFrontendQueryQueueLength = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: NAME,
+			Subsystem: "frontend",
+			Name:      "query_queue_length",
+			Help:      "Number of queries waiting for a free slot (MaxConcurrentQueries)",
+		},
+	)
+	promFrontendQueryQueueWait = prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Namespace: NAME,
+			Subsystem: "frontend",
+			Name:      "query_queue_wait_seconds",
+			Help:      "Time queries spent waiting for a free slot in seconds",
+		},
+	)
+	promFrontendQueryQueueRejected = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: NAME,
+			Subsystem: "frontend",
+			Name:      "query_queue_rejected",
+			Help:      "Number of queries rejected because of overload by Reason",
+		},
+		[]string{"reason"},
+	)
 
 	promPeerUpdateInterval = prometheus.NewGauge(
 		prometheus.GaugeOpts{
@@ -158,6 +279,42 @@ var (
 		},
 		[]string{"peer"},
 	)
+	promPeerClientQueries = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: NAME,
+			Subsystem: "peer",
+			Name:      "client_queries",
+			Help:      "Peer Client Query Counter",
+		},
+		[]string{"peer"},
+	)
+	promPeerUpdateQueries = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: NAME,
+			Subsystem: "peer",
+			Name:      "update_queries",
+			Help:      "Peer Update Query Counter",
+		},
+		[]string{"peer"},
+	)
+	promPeerQueryDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: NAME,
+			Subsystem: "peer",
+			Name:      "backend_query_duration_seconds",
+			Help:      "Peer Backend Query Duration in Seconds",
+		},
+		[]string{"peer"},
+	)
+	promPeerResponseDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: NAME,
+			Subsystem: "peer",
+			Name:      "response_duration_seconds",
+			Help:      "Duration in Seconds to build the Result of a Peer by Table, either locally or by passthrough queries",
+		},
+		[]string{"peer", "table"},
+	)
 	promPeerBytesSend = prometheus.NewGaugeVec(
 		prometheus.GaugeOpts{
 			Namespace: NAME,
@@ -176,6 +333,15 @@ var (
 		},
 		[]string{"peer"},
 	)
+	promPeerBytesReceivedWire = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: NAME,
+			Subsystem: "peer",
+			Name:      "received_wire_bytes",
+			Help:      "Peer Bytes Received from Backend Sites before Decompression",
+		},
+		[]string{"peer"},
+	)
 	promPeerUpdates = prometheus.NewCounterVec(
 		prometheus.CounterOpts{
 			Namespace: NAME,
@@ -185,6 +351,15 @@ var (
 		},
 		[]string{"peer"},
 	)
+	promPeerDataAge = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: NAME,
+			Subsystem: "peer",
+			Name:      "data_age_seconds",
+			Help:      "Seconds since the last successful Peer Update",
+		},
+		[]string{"peer"},
+	)
 	promPeerUpdateDuration = prometheus.NewGaugeVec(
 		prometheus.GaugeOpts{
 			Namespace: NAME,
@@ -195,6 +370,34 @@ var (
 		[]string{"peer"},
 	)
 
+	promPeerCommandQueueDepth = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: NAME,
+			Subsystem: "peer",
+			Name:      "command_queue_depth",
+			Help:      "Number of commands waiting to be sent to the Backend",
+		},
+		[]string{"peer"},
+	)
+	promPeerCommandsDropped = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: NAME,
+			Subsystem: "peer",
+			Name:      "commands_dropped",
+			Help:      "Peer Dropped Commands Counter",
+		},
+		[]string{"peer"},
+	)
+	promPeerCommandsRetried = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: NAME,
+			Subsystem: "peer",
+			Name:      "commands_retried",
+			Help:      "Peer Retried Commands Counter",
+		},
+		[]string{"peer"},
+	)
+
 	promObjectCount = prometheus.NewGaugeVec(
 		prometheus.GaugeOpts{
 			Namespace: NAME,
@@ -235,6 +438,27 @@ var (
 			Name:      "string_dedup_index_bytes",
 			Help:      "total bytes for storing the index",
 		})
+
+	promStringDedupHitRate = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: NAME,
+			Name:      "string_dedup_hit_rate",
+			Help:      "ratio of strings which have been found in the deduplication index",
+		})
+
+	promStringListDedupCount = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: NAME,
+			Name:      "string_list_dedup_count",
+			Help:      "total number of shared string lists",
+		})
+
+	promStringListDedupHitRate = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: NAME,
+			Name:      "string_list_dedup_hit_rate",
+			Help:      "ratio of string lists which have been found in the shared string lists pool",
+		})
 )
 
 func initPrometheus(lmd *LMDInstance) (prometheusListener io.Closer) {
@@ -273,26 +497,74 @@ func initPrometheus(lmd *LMDInstance) (prometheusListener io.Closer) {
 	prometheus.MustRegister(promBackendKeepAlive)
 	prometheus.MustRegister(promFrontendConnections)
 	prometheus.MustRegister(promFrontendQueries)
+	prometheus.MustRegister(promFrontendQueryResults)
 	prometheus.MustRegister(promFrontendBytesSend)
 	prometheus.MustRegister(promFrontendBytesReceived)
 	prometheus.MustRegister(promFrontendOpenConnections)
+	prometheus.MustRegister(promFrontendRejectedConnections)
+	prometheus.MustRegister(promFrontendIdleClosedConnections)
+	prometheus.MustRegister(promFrontendQueryQueueLength)
+	prometheus.MustRegister(promFrontendQueryQueueWait)
+	prometheus.MustRegister(promFrontendQueryQueueRejected)
+	prometheus.MustRegister(promFrontendTLSHandshakeErrors)
 	prometheus.MustRegister(promFrontendRequestDuration)
+	prometheus.MustRegister(promFrontendQueryDuration)
+	prometheus.MustRegister(promFrontendRowsScanned)
+	prometheus.MustRegister(promFrontendRowsReturned)
+	prometheus.MustRegister(promFrontendResponseSpills)
+	prometheus.MustRegister(promFrontendQueryMemory)
+	prometheus.MustRegister(promFrontendResponseWorkerQueue)
+	prometheus.MustRegister(promFrontendResponseWorkerWait)
 	prometheus.MustRegister(promPeerUpdateInterval)
 	prometheus.MustRegister(promPeerFullUpdateInterval)
 	prometheus.MustRegister(promPeerConnections)
 	prometheus.MustRegister(promPeerFailedConnections)
 	prometheus.MustRegister(promPeerQueries)
+	prometheus.MustRegister(promPeerClientQueries)
+	prometheus.MustRegister(promPeerUpdateQueries)
+	prometheus.MustRegister(promPeerQueryDuration)
+	prometheus.MustRegister(promPeerResponseDuration)
 	prometheus.MustRegister(promPeerBytesSend)
 	prometheus.MustRegister(promPeerBytesReceived)
+	prometheus.MustRegister(promPeerBytesReceivedWire)
 	prometheus.MustRegister(promPeerUpdates)
 	prometheus.MustRegister(promPeerUpdateDuration)
+	prometheus.MustRegister(promPeerDataAge)
+	prometheus.MustRegister(promPeerCommandQueueDepth)
+	prometheus.MustRegister(promPeerCommandsDropped)
+	prometheus.MustRegister(promPeerCommandsRetried)
 	prometheus.MustRegister(promObjectUpdate)
 	prometheus.MustRegister(promObjectCount)
 	prometheus.MustRegister(promStringDedupCount)
 	prometheus.MustRegister(promStringDedupBytes)
 	prometheus.MustRegister(promStringDedupIndexBytes)
+	prometheus.MustRegister(promStringDedupHitRate)
+	prometheus.MustRegister(promStringListDedupCount)
+	prometheus.MustRegister(promStringListDedupHitRate)
 
 	promInfoCount.WithLabelValues(VERSION).Set(1)
 
 	return prometheusListener
 }
+
+// removePeerMetrics removes all metrics of a removed peer
+func removePeerMetrics(name string) {
+	promPeerConnections.DeleteLabelValues(name)
+	promPeerFailedConnections.DeleteLabelValues(name)
+	promPeerQueries.DeleteLabelValues(name)
+	promPeerClientQueries.DeleteLabelValues(name)
+	promPeerUpdateQueries.DeleteLabelValues(name)
+	promPeerQueryDuration.DeleteLabelValues(name)
+	promPeerBytesSend.DeleteLabelValues(name)
+	promPeerBytesReceived.DeleteLabelValues(name)
+	promPeerBytesReceivedWire.DeleteLabelValues(name)
+	promPeerUpdates.DeleteLabelValues(name)
+	promPeerUpdateDuration.DeleteLabelValues(name)
+	promPeerDataAge.DeleteLabelValues(name)
+	promPeerCommandQueueDepth.DeleteLabelValues(name)
+	promPeerCommandsDropped.DeleteLabelValues(name)
+	promPeerCommandsRetried.DeleteLabelValues(name)
+	promObjectCount.DeletePartialMatch(prometheus.Labels{"peer": name})
+	promObjectUpdate.DeletePartialMatch(prometheus.Labels{"peer": name})
+	promPeerResponseDuration.DeletePartialMatch(prometheus.Labels{"peer": name})
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+)
+
+// QueryMemoryBatchRows sets the number of retained rows which are accounted at once
+const QueryMemoryBatchRows = 1000
+
+// QueryMemoryError is returned if a query exceeds its memory budget.
+type QueryMemoryError struct {
+	Budget int64 // budget in bytes
+}
+
+// Error returns the error message.
+func (e *QueryMemoryError) Error() string {
+	return fmt.Sprintf("query exceeds the memory budget of %s (MaxQueryMemory), use filters or limits to reduce the result", ByteCountBinary(e.Budget))
+}
+
+// QueryMemory accounts the approximate memory retained by a single query, ex.: result rows
+// and buffers. The query is canceled once the budget is exceeded.
+type QueryMemory struct {
+	noCopy   noCopy
+	used     atomic.Int64
+	exceeded atomic.Bool
+	budget   int64 // budget in bytes, zero disables the limit
+	cancel   context.CancelCauseFunc
+}
+
+// NewQueryMemory creates a new QueryMemory which calls cancel once the budget is exceeded.
+func NewQueryMemory(budget int64, cancel context.CancelCauseFunc) *QueryMemory {
+	return &QueryMemory{
+		budget: budget,
+		cancel: cancel,
+	}
+}
+
+// Reserve adds size bytes to the used memory and returns false if the budget is exceeded.
+func (m *QueryMemory) Reserve(size int64) bool {
+	if m == nil || size <= 0 {
+		return true
+	}
+	used := m.used.Add(size)
+	promFrontendQueryMemory.Add(float64(size))
+	if m.budget > 0 && used > m.budget {
+		if m.exceeded.CompareAndSwap(false, true) {
+			m.cancel(&QueryMemoryError{Budget: m.budget})
+		}
+		return false
+	}
+	return true
+}
+
+// Exceeded returns true if the query exceeded its budget.
+func (m *QueryMemory) Exceeded() bool {
+	return m != nil && m.exceeded.Load()
+}
+
+// Used returns the accounted memory in bytes.
+func (m *QueryMemory) Used() int64 {
+	if m == nil {
+		return 0
+	}
+	return m.used.Load()
+}
+
+// Release removes the accounted memory from the in-flight memory once the query is done.
+func (m *QueryMemory) Release() {
+	if m == nil {
+		return
+	}
+	promFrontendQueryMemory.Sub(float64(m.used.Swap(0)))
+}
+
+// resultRowSizeEstimate returns the estimated memory usage of a passthrough result row in bytes.
+func resultRowSizeEstimate(row []interface{}) (size int64) {
+	const sliceHeader = 24
+	const interfaceHeader = 16
+	size = sliceHeader
+	for _, val := range row {
+		size += interfaceHeader
+		switch v := val.(type) {
+		case string:
+			size += int64(len(v))
+		case []interface{}:
+			size += resultRowSizeEstimate(v)
+		case []string:
+			size += sliceHeader
+			for _, s := range v {
+				size += interfaceHeader + int64(len(s))
+			}
+		}
+	}
+	return size
+}
+
+// resultSetSizeEstimate returns the estimated memory usage of a passthrough result in bytes
+// based on a sample of up to 10 rows.
+func resultSetSizeEstimate(result ResultSet) int64 {
+	if len(result) == 0 {
+		return 0
+	}
+	step := max(1, len(result)/10)
+	sampled := int64(0)
+	size := int64(0)
+	for i := 0; i < len(result); i += step {
+		size += resultRowSizeEstimate(result[i])
+		sampled++
+	}
+	return size * int64(len(result)) / sampled
+}
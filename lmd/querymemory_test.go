@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestQueryMemory(t *testing.T) {
+	ctx, cancel := context.WithCancelCause(context.Background())
+	defer cancel(nil)
+	mem := NewQueryMemory(100, cancel)
+
+	if err := assertEq(true, mem.Reserve(60)); err != nil {
+		t.Error(err)
+	}
+	if err := assertEq(nil, ctx.Err()); err != nil {
+		t.Error(err)
+	}
+	if err := assertEq(false, mem.Reserve(60)); err != nil {
+		t.Error(err)
+	}
+	if err := assertEq(true, mem.Exceeded()); err != nil {
+		t.Error(err)
+	}
+	var memErr *QueryMemoryError
+	if err := assertEq(true, errors.As(context.Cause(ctx), &memErr)); err != nil {
+		t.Error(err)
+	}
+	if err := assertEq(int64(120), mem.Used()); err != nil {
+		t.Error(err)
+	}
+	mem.Release()
+	if err := assertEq(int64(0), mem.Used()); err != nil {
+		t.Error(err)
+	}
+
+	// disabled budget and nil accounting never reject
+	unlimited := NewQueryMemory(0, cancel)
+	if err := assertEq(true, unlimited.Reserve(1<<40)); err != nil {
+		t.Error(err)
+	}
+	unlimited.Release()
+	var nilMem *QueryMemory
+	if err := assertEq(true, nilMem.Reserve(1)); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestResultSetSizeEstimate(t *testing.T) {
+	result := ResultSet{
+		{"host", 1, []interface{}{"a", "b"}},
+		{"host", 2, []interface{}{"c"}},
+	}
+	if err := assertEq(int64(0), resultSetSizeEstimate(nil)); err != nil {
+		t.Error(err)
+	}
+	if err := assertEq(resultRowSizeEstimate(result[0])+resultRowSizeEstimate(result[1]), resultSetSizeEstimate(result)); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"slices"
+	"sync"
+	"time"
+
+	jsoniter "github.com/json-iterator/go"
+)
+
+// QueryTrace collects the timings of all phases of a single query. It is only created if the
+// client sent AddTrace: on along with a wrapped_json query, all methods are safe to call on nil.
+// The trace starts with the AddTrace header, so it should be sent right after the GET line to
+// include the complete request parsing.
+type QueryTrace struct {
+	noCopy         noCopy
+	lock           sync.Mutex
+	start          time.Time
+	parse          time.Duration
+	peerSelection  time.Duration // selecting peers and waking up idling peers
+	postProcessing time.Duration // sorting, limits and final stats calculation
+	serialization  time.Duration // writing the response
+	peers          map[string]*PeerTrace
+}
+
+// PeerTrace contains the trace of building the result of a single peer.
+type PeerTrace struct {
+	Name        string
+	Duration    time.Duration
+	RowsScanned int
+}
+
+// NewQueryTrace creates a new QueryTrace starting now.
+func NewQueryTrace() *QueryTrace {
+	return &QueryTrace{
+		start: time.Now(),
+		peers: make(map[string]*PeerTrace),
+	}
+}
+
+// peer returns the trace of the given peer, the lock must be held.
+func (t *QueryTrace) peer(peerKey, peerName string) *PeerTrace {
+	peer, ok := t.peers[peerKey]
+	if !ok {
+		peer = &PeerTrace{Name: peerName}
+		t.peers[peerKey] = peer
+	}
+	return peer
+}
+
+// AddPeerDuration adds the duration of building the result of a single peer.
+func (t *QueryTrace) AddPeerDuration(peerKey, peerName string, duration time.Duration) {
+	if t == nil || peerKey == "" {
+		return
+	}
+	t.lock.Lock()
+	t.peer(peerKey, peerName).Duration += duration
+	t.lock.Unlock()
+}
+
+// AddPeerRows adds the number of rows scanned for a single peer.
+func (t *QueryTrace) AddPeerRows(peerKey, peerName string, rows int) {
+	if t == nil || peerKey == "" {
+		return
+	}
+	t.lock.Lock()
+	t.peer(peerKey, peerName).RowsScanned += rows
+	t.lock.Unlock()
+}
+
+// WriteJSON writes the trace as json object.
+func (t *QueryTrace) WriteJSON(json *jsoniter.Stream) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	json.WriteObjectStart()
+	json.WriteObjectField("parse")
+	json.WriteFloat64(t.parse.Seconds())
+	json.WriteMore()
+	json.WriteObjectField("peer_selection")
+	json.WriteFloat64(t.peerSelection.Seconds())
+	json.WriteMore()
+	json.WriteObjectField("peers")
+	json.WriteObjectStart()
+	keys := make([]string, 0, len(t.peers))
+	for key := range t.peers {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	for i, key := range keys {
+		if i > 0 {
+			json.WriteMore()
+		}
+		peer := t.peers[key]
+		json.WriteObjectField(key)
+		json.WriteObjectStart()
+		json.WriteObjectField("name")
+		json.WriteString(peer.Name)
+		json.WriteMore()
+		json.WriteObjectField("duration")
+		json.WriteFloat64(peer.Duration.Seconds())
+		json.WriteMore()
+		json.WriteObjectField("rows_scanned")
+		json.WriteInt(peer.RowsScanned)
+		json.WriteObjectEnd()
+	}
+	json.WriteObjectEnd()
+	json.WriteMore()
+	json.WriteObjectField("post_processing")
+	json.WriteFloat64(t.postProcessing.Seconds())
+	json.WriteMore()
+	json.WriteObjectField("serialization")
+	json.WriteFloat64(t.serialization.Seconds())
+	json.WriteMore()
+	json.WriteObjectField("total")
+	json.WriteFloat64(time.Since(t.start).Seconds())
+	json.WriteObjectEnd()
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"testing"
+
+	jsoniter "github.com/json-iterator/go"
+)
+
+func TestQueryTrace(t *testing.T) {
+	peer, cleanup, mocklmd := StartTestPeer(2, 10, 10)
+	PauseTestPeers(peer)
+
+	query := "GET hosts\nAddTrace: on\nColumns: name\nSort: name asc\nOutputFormat: wrapped_json\n\n"
+	req, _, err := NewRequest(context.TODO(), mocklmd, bufio.NewReader(bytes.NewBufferString(query)), ParseOptimize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = req.ExpandRequestedBackends(); err != nil {
+		t.Fatal(err)
+	}
+	res, _, err := NewResponse(context.TODO(), req, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf, err := res.Buffer()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var result struct {
+		Trace struct {
+			Parse          float64 `json:"parse"`
+			PostProcessing float64 `json:"post_processing"`
+			Serialization  float64 `json:"serialization"`
+			Total          float64 `json:"total"`
+			Peers          map[string]struct {
+				Name        string  `json:"name"`
+				Duration    float64 `json:"duration"`
+				RowsScanned int     `json:"rows_scanned"`
+			} `json:"peers"`
+		} `json:"trace"`
+	}
+	if err = jsoniter.Unmarshal(buf.Bytes(), &result); err != nil {
+		t.Fatal(err)
+	}
+	if err = assertEq(2, len(result.Trace.Peers)); err != nil {
+		t.Fatal(err)
+	}
+	for key, peerTrace := range result.Trace.Peers {
+		if err = assertEq(10, peerTrace.RowsScanned); err != nil {
+			t.Errorf("%s: %s", key, err)
+		}
+		if err = assertEq(mocklmd.PeerMap[key].Name, peerTrace.Name); err != nil {
+			t.Error(err)
+		}
+	}
+	if result.Trace.Total < result.Trace.Parse || result.Trace.Total <= 0 {
+		t.Errorf("unexpected trace timings: %#v", result.Trace)
+	}
+
+	// plain json ignores the trace
+	query = "GET hosts\nAddTrace: on\nColumns: name\nOutputFormat: json\n\n"
+	req, _, err = NewRequest(context.TODO(), mocklmd, bufio.NewReader(bytes.NewBufferString(query)), ParseOptimize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if req.trace != nil {
+		t.Errorf("trace should not be created for plain json output")
+	}
+
+	if err := cleanup(); err != nil {
+		panic(err.Error())
+	}
+}
@@ -1,19 +1,74 @@
 package main
 
 import (
-	"fmt"
-	"sort"
+	"cmp"
+	"container/heap"
+	"sync"
 	"time"
 )
 
+// PooledResultMaxRows sets the maximum capacity of row buffers which are put back into the pool,
+// larger buffers are left to the garbage collector to not keep huge results in memory.
+const PooledResultMaxRows = 100000
+
+var (
+	dataResultPool   = sync.Pool{New: func() interface{} { return new([]*DataRow) }}
+	peerResponsePool = sync.Pool{New: func() interface{} { return new(PeerResponse) }}
+)
+
 // RawResultSet contains references to the result rows or stats objects
 type RawResultSet struct {
 	noCopy      noCopy
 	Total       int            // total number of results for this set
 	RowsScanned int            // total number of scanned rows for this set
+	PeerScanned map[string]int // number of scanned rows per peer id
 	DataResult  []*DataRow     // references to the data rows required for the result
 	StatsResult ResultSetStats // intermediate result of stats query
 	Sort        []*SortField   // columns required for sorting
+	buffer      *[]*DataRow    // pooled row buffer, nil if the result set does not own a pooled buffer
+	sortedRuns  []int          // number of rows of each already sorted backend result, nil if unsorted
+}
+
+// NewRawResultSet creates a result set which collects its rows in a pooled buffer.
+// The buffer must be returned with Release once the result has been sent.
+func NewRawResultSet(sortFields []*SortField) *RawResultSet {
+	buffer, _ := dataResultPool.Get().(*[]*DataRow)
+	return &RawResultSet{
+		Sort:       sortFields,
+		DataResult: (*buffer)[:0],
+		buffer:     buffer,
+	}
+}
+
+// Grow makes sure the result set has capacity for at least size additional rows.
+func (raw *RawResultSet) Grow(size int) {
+	if cap(raw.DataResult)-len(raw.DataResult) >= size {
+		return
+	}
+	rows := make([]*DataRow, len(raw.DataResult), len(raw.DataResult)+size)
+	copy(rows, raw.DataResult)
+	raw.DataResult = rows
+}
+
+// disown drops the pooled buffer without returning it, ex. because it might still be written to.
+func (raw *RawResultSet) disown() {
+	raw.buffer = nil
+}
+
+// Release returns the row buffer into the pool. The data rows must not be accessed afterwards.
+// Only call this once the response has been written completely.
+func (raw *RawResultSet) Release() {
+	buffer := raw.buffer
+	raw.buffer = nil
+	raw.DataResult = nil
+	if buffer == nil || cap(*buffer) > PooledResultMaxRows {
+		return
+	}
+	// remove all references, pooled buffers must not keep data rows alive
+	rows := (*buffer)[:cap(*buffer)]
+	clear(rows)
+	*buffer = rows[:0]
+	dataResultPool.Put(buffer)
 }
 
 // PostProcessing does all the post processing required for a request like sorting
@@ -24,34 +79,94 @@ func (raw *RawResultSet) PostProcessing(res *Response) {
 	}
 	log.Tracef("PostProcessing")
 
+	// the total is the number of matches before applying offset and limit
+	res.ResultTotal = raw.Total
+
 	// offset outside
-	if res.Request.Offset > raw.Total {
-		raw.DataResult = make([]*DataRow, 0)
+	if res.Request.Offset >= raw.Total {
+		raw.DataResult = raw.DataResult[:0]
 		return
 	}
 
 	// sort our result
 	if len(res.Request.Sort) > 0 {
+		switch {
+		case raw.sortedRuns != nil:
+			// results of each backend are sorted already, so only merge the required rows
+			maxRows := len(raw.DataResult)
+			if res.Request.Limit != nil && *res.Request.Limit >= 0 {
+				maxRows = min(maxRows, res.Request.Offset+*res.Request.Limit)
+			}
+			raw.mergeSortedRuns(maxRows)
 		// skip sorting if there is only one backend requested and we want the default sort order
-		if len(res.Request.BackendsMap) >= 1 || !res.Request.IsDefaultSortOrder() {
+		case len(res.Request.BackendsMap) >= 1 || !res.Request.IsDefaultSortOrder():
 			t1 := time.Now()
-			sort.Sort(raw)
+			raw.sortRows()
 			duration := time.Since(t1)
 			log.Debugf("sorting result took %s", duration.String())
 		}
 	}
 
-	// apply request offset
-	if res.Request.Offset > 0 {
-		raw.DataResult = raw.DataResult[res.Request.Offset:]
+	raw.DataResult = applyOffsetLimit(res.Request, raw.DataResult)
+}
+
+// mergeSortedRuns merges the already sorted results of all backends and keeps the first maxRows rows only.
+func (raw *RawResultSet) mergeSortedRuns(maxRows int) {
+	merge := &sortedRunsMerge{raw: raw}
+	start := 0
+	for _, size := range raw.sortedRuns {
+		if size > 0 {
+			merge.runs = append(merge.runs, raw.DataResult[start:start+size])
+		}
+		start += size
+	}
+	if len(merge.runs) <= 1 {
+		return
+	}
+
+	t1 := time.Now()
+	merged := make([]*DataRow, 0, maxRows)
+	heap.Init(merge)
+	for len(merged) < maxRows && merge.Len() > 0 {
+		run := merge.runs[0]
+		merged = append(merged, run[0])
+		if len(run) == 1 {
+			heap.Pop(merge)
+		} else {
+			merge.runs[0] = run[1:]
+			heap.Fix(merge, 0)
+		}
 	}
+	raw.DataResult = merged
+	log.Debugf("merging %d sorted results took %s", len(raw.sortedRuns), time.Since(t1).String())
+}
+
+// sortedRunsMerge is a heap of sorted row lists ordered by their first row.
+type sortedRunsMerge struct {
+	raw  *RawResultSet
+	runs [][]*DataRow
+}
+
+func (m *sortedRunsMerge) Len() int { return len(m.runs) }
+
+func (m *sortedRunsMerge) Less(i, j int) bool {
+	return m.raw.compareRows(m.runs[i][0], m.runs[j][0]) < 0
+}
+
+func (m *sortedRunsMerge) Swap(i, j int) { m.runs[i], m.runs[j] = m.runs[j], m.runs[i] }
 
-	// apply request limit
-	if res.Request.Limit != nil && *res.Request.Limit >= 0 && *res.Request.Limit < len(raw.DataResult) {
-		raw.DataResult = raw.DataResult[0:*res.Request.Limit]
+func (m *sortedRunsMerge) Push(x interface{}) {
+	if run, ok := x.([]*DataRow); ok {
+		m.runs = append(m.runs, run)
 	}
 }
 
+func (m *sortedRunsMerge) Pop() interface{} {
+	last := m.runs[len(m.runs)-1]
+	m.runs = m.runs[:len(m.runs)-1]
+	return last
+}
+
 // Len returns the result length used for sorting results.
 func (raw *RawResultSet) Len() int {
 	return len(raw.DataResult)
@@ -59,47 +174,38 @@ func (raw *RawResultSet) Len() int {
 
 // Less returns the sort result of two data rows
 func (raw *RawResultSet) Less(i, j int) bool {
+	return raw.compareRows(raw.DataResult[i], raw.DataResult[j]) <= 0
+}
+
+// compareRows returns -1 if row a is sorted before row b, 1 if it is sorted after and 0 if both are equal.
+func (raw *RawResultSet) compareRows(rowA, rowB *DataRow) int {
 	for _, s := range raw.Sort {
+		result := 0
 		switch s.Column.DataType {
-		case IntCol:
-			fallthrough
-		case Int64Col:
-			fallthrough
-		case FloatCol:
-			valueA := raw.DataResult[i].GetFloat(s.Column)
-			valueB := raw.DataResult[j].GetFloat(s.Column)
-			if valueA == valueB {
-				continue
-			}
-			if s.Direction == Asc {
-				return valueA < valueB
-			}
-			return valueA > valueB
-		case StringCol, StringLargeCol, StringListCol, ServiceMemberListCol, InterfaceListCol, JSONCol, CustomVarCol:
-			s1 := raw.DataResult[i].GetString(s.Column)
-			s2 := raw.DataResult[j].GetString(s.Column)
-			if s1 == s2 {
-				continue
+		case IntCol, Int64Col, FloatCol:
+			result = cmp.Compare(rowA.GetFloat(s.Column), rowB.GetFloat(s.Column))
+		case CustomVarCol:
+			if s.Args == "" {
+				// no variable name given, sort by string representation
+				result = cmp.Compare(rowA.GetString(s.Column), rowB.GetString(s.Column))
+			} else {
+				result = cmp.Compare(rowA.GetCustomVarValue(s.Column, s.Args), rowB.GetCustomVarValue(s.Column, s.Args))
 			}
-			if s.Direction == Asc {
-				return s1 < s2
-			}
-			return s1 > s2
-		case Int64ListCol:
-			// join numbers to string
-			s1 := raw.DataResult[i].GetString(s.Column)
-			s2 := raw.DataResult[j].GetString(s.Column)
-			if s1 == s2 {
-				continue
-			}
-			if s.Direction == Asc {
-				return s1 < s2
-			}
-			return s1 > s2
+		case StringCol, StringLargeCol, StringListCol, ServiceMemberListCol, InterfaceListCol, JSONCol, Int64ListCol:
+			// number lists are compared by their joined string representation
+			result = cmp.Compare(rowA.GetString(s.Column), rowB.GetString(s.Column))
+		default:
+			// other types are rejected when parsing the sort header
+		}
+		if result == 0 {
+			continue
+		}
+		if s.Direction == Asc {
+			return result
 		}
-		panic(fmt.Sprintf("sorting not implemented for type %s", s.Column.DataType))
+		return -result
 	}
-	return true
+	return 0
 }
 
 // Swap replaces two data rows while sorting.
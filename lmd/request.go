@@ -4,7 +4,6 @@ import (
 	"bufio"
 	"bytes"
 	"context"
-	"crypto/sha256"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -13,46 +12,60 @@ import (
 	"net"
 	"reflect"
 	"regexp"
+	"slices"
 	"strconv"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/buger/jsonparser"
+	"github.com/sasha-s/go-deadlock"
 )
 
 // Request defines a livestatus request object.
 type Request struct {
-	noCopy              noCopy
-	id                  string
-	lmd                 *LMDInstance
-	Table               TableName
-	Command             string
-	Columns             []string  // parsed columns field
-	RequestColumns      []*Column // calculated/expanded columns list
-	Filter              []*Filter
-	FilterStr           string
-	NumFilter           int
-	Stats               []*Filter
-	StatsGrouped        []*Filter // optimized stats groups
-	StatsResult         *ResultSetStats
-	Limit               *int
-	Offset              int
-	Sort                []*SortField
-	ResponseFixed16     bool
-	OutputFormat        OutputFormat
-	Backends            []string
-	BackendsMap         map[string]string
-	BackendErrors       map[string]string
-	ColumnsHeaders      bool
-	SendStatsData       bool
-	WaitTimeout         int // milliseconds
-	WaitTrigger         string
-	WaitCondition       []*Filter
-	WaitObject          string
-	WaitConditionNegate bool
-	KeepAlive           bool
-	AuthUser            string
+	noCopy               noCopy
+	id                   string // set by the RequestID header or generated, local only and not sent to the backends
+	lmd                  *LMDInstance
+	Table                TableName
+	Command              string
+	CommandMode          string    // optional CommandModeSync or CommandModeAsync
+	Columns              []string  // parsed columns field
+	RequestColumns       []*Column // calculated/expanded columns list
+	resolvedColumns      []*Column // cached columns of the Columns header, shared between requests
+	Filter               []*Filter
+	FilterStr            string
+	NumFilter            int
+	Stats                []*Filter
+	StatsGrouped         []*Filter // optimized stats groups
+	StatsResult          *ResultSetStats
+	Limit                *int
+	Offset               int
+	Sort                 []*SortField
+	ResponseFixed16      bool
+	OutputFormat         OutputFormat
+	Backends             []string
+	BackendsMap          map[string]string
+	BackendErrors        map[string]string
+	ColumnsHeaders       bool
+	SendStatsData        bool
+	WaitTimeout          int // milliseconds
+	WaitTrigger          string
+	WaitCondition        []*Filter
+	WaitObject           []string
+	WaitConditionNegate  bool // negates the complete wait condition, only set if negated before any condition
+	KeepAlive            bool
+	AuthUser             string
+	StaleDataAccept      bool
+	ResponseCompression  bool            // gzip compress the response body, requires fixed16 response header
+	AddTrace             bool            // add the timings of all query phases to wrapped_json responses
+	trace                *QueryTrace     // query trace, nil unless requested
+	RowsScannedByBackend bool            // add the number of scanned rows per backend to wrapped_json responses
+	passthrough          bool            // request is passed through to the backend on behalf of a client
+	distributed          bool            // request has been sent by another cluster node and must be answered locally
+	localPart            bool            // request is answered for the local backends only and merged with the other nodes results
+	deadline             time.Time       // optional deadline for the backend query
+	abort                <-chan struct{} // optional channel to abort the backend query once closed
 }
 
 // SortDirection can be either Asc or Desc
@@ -162,8 +175,17 @@ type ResultMetaData struct {
 	Request     *Request      // the request itself
 }
 
+const (
+	// RequestIDMaxLength is the maximum length of client supplied request ids
+	RequestIDMaxLength = 64
+
+	// generated request ids are 6 characters in base 36
+	RequestIDMin = 60466176   // 36^5
+	RequestIDMax = 2176782336 // 36^6
+)
+
 var (
-	reRequestAction  = regexp.MustCompile(`^GET +([a-z]+)$`)
+	reRequestAction  = regexp.MustCompile(`^GET +([a-z_]+)$`)
 	reRequestCommand = regexp.MustCompile(`^COMMAND +(\[\d+\].*)$`)
 )
 
@@ -178,10 +200,10 @@ func ParseRequest(ctx context.Context, lmd *LMDInstance, c net.Conn) (req *Reque
 }
 
 // ParseRequests reads from a connection and returns all requests read.
-// It returns a list of requests and any errors encountered.
-func ParseRequests(ctx context.Context, lmd *LMDInstance, c net.Conn) (reqs []*Request, err error) {
-	b := bufio.NewReader(c)
-	localAddr := c.LocalAddr().String()
+// It returns a list of requests and any errors encountered. In case of errors, the last
+// request is the partially parsed failed request if available.
+// The reader is kept across calls, so pipelined requests which have been buffered already are not lost.
+func ParseRequests(ctx context.Context, lmd *LMDInstance, b *bufio.Reader, localAddr string) (reqs []*Request, err error) {
 	eof := false
 	for {
 		req, size, err := NewRequest(ctx, lmd, b, lmd.defaultReqestParseOption)
@@ -190,7 +212,10 @@ func ParseRequests(ctx context.Context, lmd *LMDInstance, c net.Conn) (reqs []*R
 			if errors.Is(err, io.EOF) {
 				eof = true
 			} else {
-				return nil, err
+				if req != nil {
+					reqs = append(reqs, req)
+				}
+				return reqs, err
 			}
 		}
 		if req == nil {
@@ -198,13 +223,17 @@ func ParseRequests(ctx context.Context, lmd *LMDInstance, c net.Conn) (reqs []*R
 		}
 		err = req.ExpandRequestedBackends()
 		if err != nil {
-			return nil, err
+			return append(reqs, req), err
 		}
 		reqs = append(reqs, req)
 		// only multiple commands are allowed
 		if req.Command == "" {
 			break
 		}
+		// do not block waiting for more commands if the client waits for the answer of this one
+		if req.expectsAnswer() && b.Buffered() == 0 {
+			break
+		}
 	}
 	if eof {
 		if len(reqs) == 0 {
@@ -259,32 +288,80 @@ func (req *Request) String() (str string) {
 	if req.WaitTrigger != "" {
 		str += fmt.Sprintf("WaitTrigger: %s\n", req.WaitTrigger)
 	}
-	if req.WaitObject != "" {
-		str += fmt.Sprintf("WaitObject: %s\n", req.WaitObject)
+	for _, obj := range req.WaitObject {
+		str += fmt.Sprintf("WaitObject: %s\n", obj)
 	}
 	if req.WaitTimeout > 0 {
 		str += fmt.Sprintf("WaitTimeout: %d\n", req.WaitTimeout)
 	}
 	if req.WaitConditionNegate {
-		str += "WaitConditionNegate\n"
+		str += "WaitConditionNegate:\n"
 	}
 	if req.AuthUser != "" {
 		str += fmt.Sprintf("AuthUser: %s\n", req.AuthUser)
 	}
+	if req.StaleDataAccept {
+		str += "StaleData: accept\n"
+	}
+	if req.ResponseCompression {
+		str += "ResponseCompression: gzip\n"
+	}
+	if req.SendStatsData {
+		str += "SendStatsData: on\n"
+	}
 	for i := range req.WaitCondition {
 		str += req.WaitCondition[i].String("WaitCondition")
 	}
 	for i := range req.Sort {
+		if req.Sort[i].Args != "" {
+			str += fmt.Sprintf("Sort: %s %s %s\n", req.Sort[i].Name, req.Sort[i].Args, req.Sort[i].Direction.String())
+			continue
+		}
 		str += fmt.Sprintf("Sort: %s %s\n", req.Sort[i].Name, req.Sort[i].Direction.String())
 	}
 	str += "\n"
 	return
 }
 
+// RequestLimitError is returned if a request exceeds one of the request limits.
+type RequestLimitError struct {
+	Limit string // name of the config option
+	Value int    // configured limit
+	Unit  string // what has been counted
+}
+
+// Error returns the error message.
+func (e *RequestLimitError) Error() string {
+	return fmt.Sprintf("bad request: request exceeds %s of %d %s", e.Limit, e.Value, e.Unit)
+}
+
+// readRequestLine reads a single line from the request. It never reads more than the remaining
+// bytes allowed by MaxRequestSize, a negative remaining size means unlimited.
+func readRequestLine(b *bufio.Reader, remaining int, maxSize int) (line []byte, err error) {
+	for {
+		chunk, rErr := b.ReadSlice('\n')
+		if remaining >= 0 && len(line)+len(chunk) > remaining {
+			return nil, &RequestLimitError{Limit: "MaxRequestSize", Value: maxSize, Unit: "bytes"}
+		}
+		line = append(line, chunk...)
+		if !errors.Is(rErr, bufio.ErrBufferFull) {
+			return line, rErr
+		}
+	}
+}
+
 // NewRequest reads a buffer and creates a new request object.
 // It returns the request as long with the number of bytes read and any error.
 func NewRequest(ctx context.Context, lmd *LMDInstance, b *bufio.Reader, options ParseOptions) (req *Request, size int, err error) {
-	firstLine, err := b.ReadString('\n')
+	maxSize := lmd.Config.MaxRequestSize
+	remaining := func() int {
+		if maxSize <= 0 {
+			return -1
+		}
+		return maxSize - size
+	}
+	firstLineBytes, err := readRequestLine(b, remaining(), maxSize)
+	firstLine := string(firstLineBytes)
 	if err == io.EOF {
 		if firstLine == "" {
 			return
@@ -296,6 +373,9 @@ func NewRequest(ctx context.Context, lmd *LMDInstance, b *bufio.Reader, options
 	if _, ok := err.(net.Error); ok {
 		return
 	}
+	if err != nil {
+		return
+	}
 
 	req = &Request{lmd: lmd, ColumnsHeaders: false, KeepAlive: false}
 	ctx = context.WithValue(ctx, CtxRequest, req.ID())
@@ -312,8 +392,9 @@ func NewRequest(ctx context.Context, lmd *LMDInstance, b *bufio.Reader, options
 		return
 	}
 
+	numHeaders := 0
 	for {
-		line, berr := b.ReadBytes('\n')
+		line, berr := readRequestLine(b, remaining(), maxSize)
 		if berr != nil && berr != io.EOF {
 			err = berr
 			return
@@ -323,6 +404,11 @@ func NewRequest(ctx context.Context, lmd *LMDInstance, b *bufio.Reader, options
 		if len(line) == 0 {
 			break
 		}
+		numHeaders++
+		if lmd.Config.MaxRequestHeaders > 0 && numHeaders > lmd.Config.MaxRequestHeaders {
+			err = &RequestLimitError{Limit: "MaxRequestHeaders", Value: lmd.Config.MaxRequestHeaders, Unit: "header lines"}
+			return
+		}
 
 		logWith(ctx).Debugf("request: %s", line)
 		perr := req.ParseRequestHeaderLine(line, options)
@@ -330,8 +416,16 @@ func NewRequest(ctx context.Context, lmd *LMDInstance, b *bufio.Reader, options
 			err = fmt.Errorf("bad request: %s in: %s", perr.Error(), line)
 			return
 		}
+		if req.id != ctx.Value(CtxRequest) {
+			// client supplied its own request id
+			ctx = context.WithValue(ctx, CtxRequest, req.id)
+		}
 		if lmd.Config.MaxQueryFilter > 0 && req.NumFilter > lmd.Config.MaxQueryFilter {
-			err = fmt.Errorf("bad request: maximum number of query filter reached")
+			err = &RequestLimitError{Limit: "MaxQueryFilter", Value: lmd.Config.MaxQueryFilter, Unit: "filter and stats lines"}
+			return
+		}
+		if lmd.Config.MaxQueryColumns > 0 && len(req.Columns) > lmd.Config.MaxQueryColumns {
+			err = &RequestLimitError{Limit: "MaxQueryColumns", Value: lmd.Config.MaxQueryColumns, Unit: "columns"}
 			return
 		}
 		if errors.Is(berr, io.EOF) {
@@ -340,6 +434,16 @@ func NewRequest(ctx context.Context, lmd *LMDInstance, b *bufio.Reader, options
 		}
 	}
 
+	err = req.applyTimeFilterPolicy()
+	if err != nil {
+		return
+	}
+
+	err = req.validateStats()
+	if err != nil {
+		return
+	}
+
 	// remove unnecessary filter indentation
 	if options&ParseOptimize != 0 {
 		req.optimizeFilterIndentation()
@@ -348,18 +452,107 @@ func NewRequest(ctx context.Context, lmd *LMDInstance, b *bufio.Reader, options
 
 	req.SetRequestColumns()
 	err = req.SetSortColumns()
+
+	// only wrapped_json responses have a place for the trace
+	if req.AddTrace && req.OutputFormat == OutputFormatWrappedJSON {
+		req.trace.parse = time.Since(req.trace.start)
+	} else {
+		req.trace = nil
+	}
 	return
 }
 
+// validateStats returns an error if any stats header cannot be calculated.
+func (req *Request) validateStats() error {
+	for _, s := range req.Stats {
+		switch s.StatsType {
+		case Counter, Sum, Average, Min, Max:
+		default:
+			return fmt.Errorf("bad request: stats type %d is not supported", s.StatsType)
+		}
+	}
+	return nil
+}
+
+// applyTimeFilterPolicy rejects or limits queries on passthrough tables without any time filter,
+// which would make the backends scan their complete history.
+func (req *Request) applyTimeFilterPolicy() error {
+	table := Objects.Tables[req.Table]
+	if req.Command != "" || table == nil || !table.PassthroughOnly {
+		return nil
+	}
+	timeCol := table.GetColumn("time")
+	if timeCol == nil || hasTimeRangeFilter(req.Filter) {
+		return nil
+	}
+	since := time.Now().Unix() - int64(req.lmd.Config.PassThroughLookback)
+	switch req.lmd.Config.PassThroughTimeFilter {
+	case TimeFilterPolicyReject:
+		return fmt.Errorf("bad request: queries on the %s table require a time filter, ex.: Filter: time >= %d", req.Table.String(), since)
+	case TimeFilterPolicyLookback:
+		req.Filter = append(req.Filter, &Filter{
+			Column:     timeCol,
+			Operator:   GreaterThan,
+			StrValue:   fmt.Sprintf("%d", since),
+			FloatValue: float64(since),
+			IntValue:   int(since),
+		})
+		req.NumFilter++
+	}
+	return nil
+}
+
+// hasTimeRangeFilter returns true if the (and combined) filters limit the time column.
+// Or groups only limit the time range if all of their filters do.
+func hasTimeRangeFilter(filter []*Filter) bool {
+	for _, f := range filter {
+		switch {
+		case f.Negate:
+			continue
+		case f.GroupOperator == And:
+			if hasTimeRangeFilter(f.Filter) {
+				return true
+			}
+		case f.GroupOperator == Or:
+			limited := len(f.Filter) > 0
+			for _, sub := range f.Filter {
+				if !hasTimeRangeFilter([]*Filter{sub}) {
+					limited = false
+					break
+				}
+			}
+			if limited {
+				return true
+			}
+		case f.Column != nil && f.Column.Name == "time":
+			switch f.Operator {
+			case Equal, Less, LessThan, Greater, GreaterThan:
+				return true
+			}
+		}
+	}
+	return false
+}
+
 // ID returns the uniq request id
 func (req *Request) ID() string {
 	if req.id != "" {
 		return req.id
 	}
-	req.id = fmt.Sprintf("r:%x", sha256.Sum256([]byte(fmt.Sprintf("%d-%d", time.Now().Nanosecond(), rand.Int()))))[0:8]
+	// ids only need to be unique for a short time to correlate log messages
+	req.id = "r:" + strconv.FormatInt(RequestIDMin+rand.Int63n(RequestIDMax-RequestIDMin), 36)
 	return req.id
 }
 
+// waitDuration returns the time the request might have spent waiting for its wait condition,
+// which does not count as slow query.
+func (req *Request) waitDuration() time.Duration {
+	if req.WaitTrigger != "" && req.lmd != nil {
+		return req.lmd.Config.GetWaitTimeout(req.WaitTimeout)
+	}
+	return time.Duration(req.WaitTimeout) * time.Millisecond
+}
+
 // ParseRequestAction parses the first line from a request which
 // may start with GET or COMMAND
 func (req *Request) ParseRequestAction(firstLine *string) (valid bool, err error) {
@@ -407,25 +600,14 @@ func (req *Request) ParseRequestAction(firstLine *string) (valid bool, err error
 // It returns the Response object and any error encountered.
 func (req *Request) BuildResponse(ctx context.Context) (*Response, error) {
 	// Run single request if possible
-	if req.lmd.nodeAccessor == nil || !req.lmd.nodeAccessor.IsClustered() {
+	if req.answeredLocally() {
 		// Single mode (send request and return response)
 		res, _, err := NewResponse(ctx, req, nil)
 		return res, err
 	}
 
-	// Determine if request for this node only (if backends specified)
-	allBackendsRequested := len(req.Backends) == 0
-	isForOurBackends := false // request for our own backends only
-	if !allBackendsRequested {
-		isForOurBackends = true
-		for _, backend := range req.Backends {
-			isOurs := req.lmd.nodeAccessor.IsOurBackend(backend)
-			isForOurBackends = isForOurBackends && isOurs
-		}
-	}
-
 	// Return local result if its not distributed at all
-	if isForOurBackends {
+	if req.isForOurBackends() {
 		res, _, err := NewResponse(ctx, req, nil)
 		return res, err
 	}
@@ -434,21 +616,90 @@ func (req *Request) BuildResponse(ctx context.Context) (*Response, error) {
 	return req.getDistributedResponse(ctx)
 }
 
+// isForOurBackends returns true if only backends of this node have been requested.
+func (req *Request) isForOurBackends() bool {
+	if len(req.Backends) == 0 {
+		return false
+	}
+	for _, backend := range req.Backends {
+		if !req.lmd.nodeAccessor.IsOurBackend(backend) {
+			return false
+		}
+	}
+	return true
+}
+
+// answeredLocally returns true if the request is not distributed to the other cluster nodes.
+// The nodes table is built from the local cluster state and passthrough tables forward the
+// foreign backends to their nodes themselves.
+func (req *Request) answeredLocally() bool {
+	if req.lmd.nodeAccessor == nil || !req.lmd.nodeAccessor.IsClustered() {
+		return true
+	}
+	return req.Table == TableNodes || Objects.Tables[req.Table].PassthroughOnly
+}
+
+// backendsRequired returns false for tables which are built without any backend, ex.: the columns table.
+func (req *Request) backendsRequired() bool {
+	switch req.Table {
+	case TableColumns, TableSlowqueries, TableQueries, TableNodes:
+		return false
+	default:
+		return true
+	}
+}
+
+// unhandledBackends returns the requested backends which are not answered by any cluster node,
+// ex.: backends of a failed node which have not been taken over yet.
+func (req *Request) unhandledBackends(nodeBackends map[string][]string) (unhandled []string) {
+	handled := make(map[string]bool)
+	for _, backends := range nodeBackends {
+		for _, id := range backends {
+			handled[id] = true
+		}
+	}
+	req.lmd.PeerMapLock.RLock()
+	defer req.lmd.PeerMapLock.RUnlock()
+	for _, id := range req.lmd.PeerMapOrder {
+		if _, ok := req.BackendsMap[id]; !ok || handled[id] {
+			continue
+		}
+		if p, ok := req.lmd.PeerMap[id]; !ok || p.HasFlag(MultiBackend) {
+			continue
+		}
+		unhandled = append(unhandled, id)
+	}
+	return unhandled
+}
+
 // BuildResponseSend builds the response and sends to the given connection.
 // It returns the transferred size or an error.
 func (req *Request) BuildResponseSend(ctx context.Context, w net.Conn) (int64, error) {
 	// Run single request if possible
-	if req.lmd.nodeAccessor == nil || !req.lmd.nodeAccessor.IsClustered() {
+	if req.answeredLocally() || req.isForOurBackends() {
 		// Single mode (send request)
 		_, size, err := NewResponse(ctx, req, w)
 		return size, err
 	}
 
-	res, err := req.BuildResponse(ctx)
+	start := time.Now()
+	res, err := req.getDistributedResponse(ctx)
 	if err != nil {
 		return 0, err
 	}
-	return res.Send(w)
+	size, err := res.Send(w)
+	// distributed responses are not built by NewResponse as a whole, so check the total duration here
+	res.checkSlowQuery(time.Since(start), size)
+
+	return size, err
+}
+
+// distributedResult contains the result of a single node in a distributed setup.
+type distributedResult struct {
+	rows        ResultSet
+	failed      map[string]string // failed backends by peer id
+	total       int               // total number of matched rows regardless of any limits
+	rowsScanned int
 }
 
 // getDistributedResponse builds the response from a distributed setup
@@ -458,9 +709,9 @@ func (req *Request) getDistributedResponse(ctx context.Context) (*Response, erro
 
 	// Cluster mode (don't send this request; send sub-requests, build response)
 	var wg sync.WaitGroup
-	collectedDatasets := make(chan ResultSet, len(req.lmd.nodeAccessor.nodeBackends))
-	collectedFailedHashes := make(chan map[string]string, len(req.lmd.nodeAccessor.nodeBackends))
-	for nodeID, nodeBackends := range req.lmd.nodeAccessor.nodeBackends {
+	allNodeBackends := req.lmd.nodeAccessor.NodeBackends()
+	collected := make(chan *distributedResult, len(allNodeBackends))
+	for nodeID, nodeBackends := range allNodeBackends {
 		node := req.lmd.nodeAccessor.Node(nodeID)
 		// limit to requested backends if necessary
 		// nodeBackends: all backends handled by current node
@@ -468,66 +719,33 @@ func (req *Request) getDistributedResponse(ctx context.Context) (*Response, erro
 
 		// skip node if it doesn't have relevant backends
 		if len(subBackends) == 0 {
-			collectedDatasets <- ResultSet{}
-			collectedFailedHashes <- map[string]string{}
+			collected <- &distributedResult{}
 			continue
 		}
 
 		if node.isMe {
 			// answer locally
-			req.SendStatsData = true
-			res, _, err := NewResponse(ctx, req, nil)
+			result, err := req.getLocalDistributedResult(ctx)
 			if err != nil {
 				return nil, err
 			}
-			req.SendStatsData = false
-			if res.Result == nil {
-				res.SetResultData()
-			}
-			collectedDatasets <- res.Result
-			collectedFailedHashes <- res.Failed
+			collected <- result
 			continue
 		}
 
-		requestData := req.buildDistributedRequestData(subBackends)
+		requestData := req.buildDistributedRequestData(subBackends, req.Columns)
 		wg.Add(1)
 		// Send query to remote node
 		err := req.lmd.nodeAccessor.SendQuery(node, "table", requestData, func(responseData interface{}) {
 			defer wg.Done()
 
-			// Hash containing metadata in addition to rows
-			hash, ok := responseData.(map[string]interface{})
-			if !ok {
-				return
-			}
-
-			// Hash containing error messages
-			failedHash, ok := hash["failed"].(map[string]interface{})
+			result, ok := parseDistributedResult(responseData)
 			if !ok {
 				return
 			}
-			failedHashStrings := make(map[string]string, len(failedHash))
-			for key, val := range failedHash {
-				failedHashStrings[key] = fmt.Sprintf("%v", val)
-			}
-
-			// Parse data (table rows)
-			rowsVariants, ok := hash["data"].([]interface{})
-			if !ok {
-				return
-			}
-			rows := make(ResultSet, len(rowsVariants))
-			for i, rowVariant := range rowsVariants {
-				rowVariants, ok := rowVariant.([]interface{})
-				if !ok {
-					return
-				}
-				rows[i] = rowVariants
-			}
 
 			// Collect data
-			collectedDatasets <- rows
-			collectedFailedHashes <- failedHashStrings
+			collected <- result
 		})
 		if err != nil {
 			return nil, err
@@ -540,27 +758,116 @@ func (req *Request) getDistributedResponse(ctx context.Context) (*Response, erro
 		err := fmt.Errorf("timeout waiting for partner nodes")
 		return nil, err
 	}
-	close(collectedDatasets)
+	close(collected)
 
 	// Double-check that we have the right number of datasets
-	if len(collectedDatasets) != len(req.lmd.nodeAccessor.nodeBackends) {
-		err := fmt.Errorf("got %d instead of %d datasets", len(collectedDatasets), len(req.lmd.nodeAccessor.nodeBackends))
+	if len(collected) != len(allNodeBackends) {
+		err := fmt.Errorf("got %d instead of %d datasets", len(collected), len(allNodeBackends))
 		return nil, err
 	}
 
-	res := req.mergeDistributedResponse(collectedDatasets, collectedFailedHashes)
+	res := req.mergeDistributedResponse(collected)
+	if req.backendsRequired() {
+		for _, id := range req.unhandledBackends(allNodeBackends) {
+			res.Failed[id] = errBackendNotHandled.Error()
+		}
+	}
 
 	// Process results
 	// This also applies sort/offset/limit settings
 	if len(res.Request.Stats) > 0 {
-		res.CalculateFinalStats()
+		if err := res.CalculateFinalStats(); err != nil {
+			return nil, err
+		}
 	} else {
 		res.PostProcessing()
 	}
+	res.rowsReturned = res.numResultRows()
 
 	return res, nil
 }
 
+// getLocalDistributedResult answers the request for the local backends of a distributed setup.
+// Like the sub-requests sent to other nodes, stats are returned as raw sum/count pairs and the
+// offset is applied after merging all results.
+func (req *Request) getLocalDistributedResult(ctx context.Context) (*distributedResult, error) {
+	offset, limit := req.Offset, req.Limit
+	req.SendStatsData = true
+	req.localPart = true
+	req.Offset = 0
+	req.Limit = nil
+	if limit != nil && *limit != 0 {
+		subLimit := *limit + offset
+		req.Limit = &subLimit
+	}
+	defer func() {
+		req.SendStatsData = false
+		req.localPart = false
+		req.Offset, req.Limit = offset, limit
+	}()
+
+	res, _, err := NewResponse(ctx, req, nil)
+	if err != nil {
+		return nil, err
+	}
+	result := &distributedResult{
+		failed:      res.Failed,
+		total:       res.ResultTotal,
+		rowsScanned: res.RowsScanned,
+	}
+	if res.RawResults != nil {
+		result.total = res.RawResults.Total
+		result.rowsScanned = res.RawResults.RowsScanned
+	}
+	if res.Result == nil {
+		res.SetResultData()
+	}
+	result.rows = res.Result
+	if result.total == 0 {
+		result.total = len(result.rows)
+	}
+	return result, nil
+}
+
+// parseDistributedResult parses the wrapped_json response of another node.
+// It returns false if the response is invalid.
+func parseDistributedResult(responseData interface{}) (result *distributedResult, ok bool) {
+	// Hash containing metadata in addition to rows
+	hash, ok := responseData.(map[string]interface{})
+	if !ok {
+		return nil, false
+	}
+
+	// Hash containing error messages by peer id
+	failedHash, ok := hash["failed"].(map[string]interface{})
+	if !ok {
+		return nil, false
+	}
+	result = &distributedResult{
+		failed:      make(map[string]string, len(failedHash)),
+		total:       interface2int(hash["total_count"]),
+		rowsScanned: interface2int(hash["rows_scanned"]),
+	}
+	for key, val := range failedHash {
+		result.failed[key] = fmt.Sprintf("%v", val)
+	}
+
+	// Parse data (table rows)
+	rowsVariants, ok := hash["data"].([]interface{})
+	if !ok {
+		return nil, false
+	}
+	result.rows = make(ResultSet, len(rowsVariants))
+	for i, rowVariant := range rowsVariants {
+		rowVariants, ok := rowVariant.([]interface{})
+		if !ok {
+			return nil, false
+		}
+		result.rows[i] = rowVariants
+	}
+	return result, true
+}
+
 func (req *Request) getSubBackends(allBackendsRequested bool, nodeBackends []string) (subBackends []string) {
 	// nodeBackends: all backends handled by current node
 	for _, nodeBackend := range nodeBackends {
@@ -580,7 +887,7 @@ func (req *Request) getSubBackends(allBackendsRequested bool, nodeBackends []str
 	return
 }
 
-func (req *Request) buildDistributedRequestData(subBackends []string) (requestData map[string]interface{}) {
+func (req *Request) buildDistributedRequestData(subBackends, columns []string) (requestData map[string]interface{}) {
 	requestData = make(map[string]interface{})
 	if req.Table != TableNone {
 		requestData["table"] = req.Table.String()
@@ -597,8 +904,8 @@ func (req *Request) buildDistributedRequestData(subBackends []string) (requestDa
 
 	// Columns need to be defined or else response will add them
 	isStatsRequest := len(req.Stats) != 0
-	if len(req.Columns) != 0 {
-		requestData["columns"] = req.Columns
+	if len(columns) != 0 {
+		requestData["columns"] = columns
 	} else if !isStatsRequest {
 		panic("columns undefined for dispatched request")
 	}
@@ -645,69 +952,89 @@ func (req *Request) buildDistributedRequestData(subBackends []string) (requestDa
 				direction = "asc"
 			}
 			line = sortField.Name + " " + direction
+			if sortField.Args != "" {
+				line = sortField.Name + " " + sortField.Args + " " + direction
+			}
 			sort = append(sort, line)
 		}
 		requestData["sort"] = sort
 	}
 
+	// other nodes have to apply the same permissions
+	if req.AuthUser != "" {
+		requestData["auth_user"] = req.AuthUser
+	}
+
 	// Get hash with metadata in addition to table rows
-	requestData["outputformat"] = OutputFormatWrappedJSON
+	requestData["outputformat"] = "wrapped_json"
 
 	return
 }
 
 // mergeDistributedResponse returns response object with merged result from distributed requests
-func (req *Request) mergeDistributedResponse(collectedDatasets chan ResultSet, collectedFailedHashes chan map[string]string) *Response {
+func (req *Request) mergeDistributedResponse(collected chan *distributedResult) *Response {
 	// Build response object
 	res := &Response{
 		Code:    200,
 		Failed:  make(map[string]string),
 		Request: req,
+		Lock:    new(deadlock.RWMutex),
 	}
 
 	// Merge data
 	isStatsRequest := len(req.Stats) != 0
 	req.StatsResult = NewResultSetStats()
-	for currentRows := range collectedDatasets {
+	for result := range collected {
+		for id, val := range result.failed {
+			res.Failed[id] = val
+		}
 		if isStatsRequest {
-			// Stats request
-			// Value (sum), count (number of elements)
-			hasColumns := len(req.Columns)
-			for _, row := range currentRows {
-				// apply stats querys
-				key := ""
-				if hasColumns > 0 {
-					keys := []string{}
-					for x := 0; x < hasColumns; x++ {
-						keys = append(keys, *(row[x].(*string)))
-					}
-					key = strings.Join(keys, ListSepChar1)
-				}
-				if _, ok := req.StatsResult.Stats[key]; !ok {
-					req.StatsResult.Stats[key] = createLocalStatsCopy(req.Stats)
-				}
-				if hasColumns > 0 {
-					row = row[hasColumns:]
-				}
-				for i := range row {
-					data := reflect.ValueOf(row[i])
-					value := data.Index(0).Interface()
-					count := data.Index(1).Interface()
-					req.StatsResult.Stats[key][i].ApplyValue(interface2float64(value), int(interface2float64(count)))
-				}
-			}
-		} else {
-			// Regular request
-			res.Result = append(res.Result, currentRows...)
-			currentFailedHash := <-collectedFailedHashes
-			for id, val := range currentFailedHash {
-				res.Failed[id] = val
-			}
+			// Stats request, merged like the results of multiple backends
+			req.StatsResult.Merge(req.parseDistributedStats(result))
+			continue
 		}
+
+		// Regular request
+		res.Result = append(res.Result, result.rows...)
+		res.ResultTotal += result.total
+		res.RowsScanned += result.rowsScanned
 	}
+	res.setAllBackendsFailedCode()
 	return res
 }
 
+// parseDistributedStats converts the raw value (sum) and count pairs of a stats result into ResultSetStats.
+func (req *Request) parseDistributedStats(result *distributedResult) *ResultSetStats {
+	stats := NewResultSetStats()
+	stats.Total = result.total
+	stats.RowsScanned = result.rowsScanned
+	hasColumns := len(req.Columns)
+	for _, row := range result.rows {
+		// group keys are *string for local and string for remote results
+		key := ""
+		if hasColumns > 0 {
+			keys := make([]string, 0, hasColumns)
+			for x := 0; x < hasColumns; x++ {
+				keys = append(keys, interface2stringNoDedup(row[x]))
+			}
+			key = statsKey(keys)
+		}
+		if _, ok := stats.Stats[key]; !ok {
+			stats.Stats[key] = createLocalStatsCopy(req.Stats)
+		}
+		if hasColumns > 0 {
+			row = row[hasColumns:]
+		}
+		for i := range row {
+			data := reflect.ValueOf(row[i])
+			value := data.Index(0).Interface()
+			count := data.Index(1).Interface()
+			stats.Stats[key][i].ApplyValue(interface2float64(value), int(interface2float64(count)))
+		}
+	}
+	return stats
+}
+
 // ParseRequestHeaderLine parses a single request line
 // It returns any error encountered.
 func (req *Request) ParseRequestHeaderLine(line []byte, options ParseOptions) (err error) {
@@ -754,7 +1081,7 @@ func (req *Request) ParseRequestHeaderLine(line []byte, options ParseOptions) (e
 		req.Backends = strings.Fields(string(args))
 		return
 	case "columns":
-		req.Columns = append(req.Columns, strings.Fields(string(args))...)
+		err = req.parseColumns(args)
 		return
 	case "responseheader":
 		err = parseResponseHeader(&req.ResponseFixed16, args)
@@ -769,20 +1096,25 @@ func (req *Request) ParseRequestHeaderLine(line []byte, options ParseOptions) (e
 		req.WaitTrigger = string(args)
 		return
 	case "waitobject":
-		req.WaitObject = string(args)
+		req.WaitObject = append(req.WaitObject, string(args))
 		return
 	case "waitcondition":
 		err = ParseFilter(args, req.Table, &req.WaitCondition, options)
 		req.NumFilter++
 		return
 	case "waitconditionand":
-		err = parseStatsGroupOp(And, args, req.Table, &req.WaitCondition, options)
+		err = parseFilterGroupOp(And, args, &req.WaitCondition)
 		return
 	case "waitconditionor":
-		err = parseStatsGroupOp(Or, args, req.Table, &req.WaitCondition, options)
+		err = parseFilterGroupOp(Or, args, &req.WaitCondition)
 		return
 	case "waitconditionnegate":
-		req.WaitConditionNegate = true
+		if len(req.WaitCondition) == 0 {
+			// negate the complete condition, like older versions did
+			req.WaitConditionNegate = true
+			return
+		}
+		err = ParseFilterNegate(req.WaitCondition)
 		return
 	case "negate":
 		err = ParseFilterNegate(req.Filter)
@@ -804,6 +1136,30 @@ func (req *Request) ParseRequestHeaderLine(line []byte, options ParseOptions) (e
 	case "statsnegate":
 		err = ParseFilterNegate(req.Stats)
 		return
+	case "staledata":
+		err = parseStaleData(&req.StaleDataAccept, args)
+		return
+	case "responsecompression":
+		err = parseResponseCompression(&req.ResponseCompression, args)
+		return
+	case "sendstatsdata":
+		err = parseOnOff(&req.SendStatsData, args)
+		return
+	case "addtrace":
+		err = parseOnOff(&req.AddTrace, args)
+		if req.AddTrace && req.trace == nil {
+			req.trace = NewQueryTrace()
+		}
+		return
+	case "rowsscannedbybackend":
+		err = parseOnOff(&req.RowsScannedByBackend, args)
+		return
+	case "requestid":
+		err = parseRequestID(&req.id, args)
+		return
+	case "commandmode":
+		err = parseCommandMode(&req.CommandMode, args)
+		return
 	}
 	err = fmt.Errorf("unrecognized header")
 	return
@@ -909,6 +1265,46 @@ func parseOnOff(field *bool, value []byte) (err error) {
 	return
 }
 
+// parseResponseCompression parses the ResponseCompression header
+// It returns any error encountered.
+func parseResponseCompression(field *bool, value []byte) (err error) {
+	switch string(value) {
+	case "gzip":
+		*field = true
+	case "off":
+		*field = false
+	default:
+		err = fmt.Errorf("unrecognized compression, only gzip is supported")
+	}
+	return
+}
+
+// parseStaleData parses the StaleData header
+// It returns any error encountered.
+func parseStaleData(field *bool, value []byte) (err error) {
+	switch string(value) {
+	case "accept":
+		*field = true
+	case "reject":
+		*field = false
+	default:
+		err = fmt.Errorf("must be 'accept' or 'reject'")
+	}
+	return
+}
+
+// parseCommandMode parses the CommandMode header
+// It returns any error encountered.
+func parseCommandMode(field *string, value []byte) (err error) {
+	switch string(value) {
+	case CommandModeSync, CommandModeAsync:
+		*field = string(value)
+	default:
+		err = fmt.Errorf("must be '%s' or '%s'", CommandModeSync, CommandModeAsync)
+	}
+	return
+}
+
 func parseAuthUser(field *string, value []byte) (err error) {
 	user := string(value)
 	if user != "" {
@@ -919,12 +1315,59 @@ func parseAuthUser(field *string, value []byte) (err error) {
 	return
 }
 
+// parseRequestID parses the RequestID header
+// It returns any error encountered.
+func parseRequestID(field *string, value []byte) (err error) {
+	id := string(value)
+	if id == "" || len(id) > RequestIDMaxLength || strings.ContainsAny(id, " \t[]") {
+		return fmt.Errorf("request id must be a single word with up to %d characters", RequestIDMaxLength)
+	}
+	*field = id
+	return
+}
+
+// parseColumns appends the columns from the Columns header and expands wildcard patterns.
+func (req *Request) parseColumns(args []byte) error {
+	table := Objects.Tables[req.Table]
+	cacheable := table != nil && len(req.Columns) == 0
+	req.resolvedColumns = nil
+	if cacheable {
+		if entry := requestColumnCache.Get(table, args); entry != nil {
+			// copy the shared entry, requests may change their columns
+			req.Columns = slices.Clone(entry.names)
+			req.resolvedColumns = slices.Clone(entry.columns)
+			return nil
+		}
+	}
+	for _, name := range strings.Fields(string(args)) {
+		if table == nil {
+			req.Columns = append(req.Columns, name)
+			continue
+		}
+		names, err := table.ExpandColumnPattern(name)
+		if err != nil {
+			return err
+		}
+		req.Columns = append(req.Columns, names...)
+	}
+	if cacheable {
+		entry := requestColumnCache.Add(table, args, slices.Clone(req.Columns))
+		req.resolvedColumns = slices.Clone(entry.columns)
+	}
+	return nil
+}
+
 // SetRequestColumns sets  list of used indexes and columns for this request.
 func (req *Request) SetRequestColumns() {
 	logWith(req).Tracef("SetRequestColumns")
 	if req.Command != "" {
 		return
 	}
+	// columns have been resolved already while parsing the Columns header
+	if len(req.Columns) > 0 && len(req.resolvedColumns) == len(req.Columns) {
+		req.RequestColumns = req.resolvedColumns
+		return
+	}
 	table := Objects.Tables[req.Table]
 	numColumns := len(req.Columns) + len(req.Stats)
 	if numColumns == 0 {
@@ -949,6 +1392,34 @@ func (req *Request) SetRequestColumns() {
 	req.RequestColumns = columns
 }
 
+// usesColumn returns true if the column is requested, used for sorting or by any filter or stats of this request.
+func (req *Request) usesColumn(name string) bool {
+	for _, col := range req.RequestColumns {
+		if col.Name == name {
+			return true
+		}
+	}
+	for _, s := range req.Sort {
+		if s.Name == name {
+			return true
+		}
+	}
+	return filtersUseColumn(req.Filter, name) || filtersUseColumn(req.Stats, name)
+}
+
+// filtersUseColumn returns true if any of the filters or their sub filters uses the column.
+func filtersUseColumn(filter []*Filter, name string) bool {
+	for _, f := range filter {
+		if f.Column != nil && f.Column.Name == name {
+			return true
+		}
+		if filtersUseColumn(f.Filter, name) {
+			return true
+		}
+	}
+	return false
+}
+
 // SetSortColumns set the requestcolumn for the sortfields
 func (req *Request) SetSortColumns() (err error) {
 	logWith(req).Tracef("SetSortColumns")
@@ -960,8 +1431,11 @@ func (req *Request) SetSortColumns() (err error) {
 	// build array of requested columns as ResultColumn objects list
 	for j := range req.Sort {
 		col := table.GetColumn(req.Sort[j].Name)
-		if col == nil {
+		switch {
+		case col == nil:
 			err = fmt.Errorf("unknown sort column %s", req.Sort[j].Name)
+		case !col.DataType.sortable():
+			err = fmt.Errorf("sorting not supported for column %s of type %s", col.Name, col.DataType)
 		}
 		req.Sort[j].Column = col
 	}
@@ -1026,6 +1500,11 @@ func (req *Request) parseWrappedJSONMeta(resBytes []byte, meta *ResultMetaData)
 	return dataBytes, nil
 }
 
+// expectsAnswer returns true if the client waits for a response before sending more requests.
+func (req *Request) expectsAnswer() bool {
+	return req.KeepAlive || req.ResponseFixed16 || req.OutputFormat == OutputFormatWrappedJSON
+}
+
 // IsDefaultSortOrder returns true if the sortfields are the default for the given table.
 func (req *Request) IsDefaultSortOrder() bool {
 	if len(req.Sort) == 0 {
@@ -1046,8 +1525,35 @@ func (req *Request) IsDefaultSortOrder() bool {
 	return false
 }
 
+// naturalSortTables contains the tables whose data stores keep their rows sorted by primary key.
+// Comments and downtimes are not included, new entries are appended to the end.
+var naturalSortTables = map[TableName]bool{
+	TableHosts:         true,
+	TableServices:      true,
+	TableHostgroups:    true,
+	TableServicegroups: true,
+}
+
+// IsNaturalSortOrder returns true if the sortfields match the order of the rows in the data stores,
+// which is the primary key in ascending order. Results of each backend are sorted already then.
+func (req *Request) IsNaturalSortOrder() bool {
+	if len(req.Sort) == 0 || !naturalSortTables[req.Table] {
+		return false
+	}
+	primaryKey := Objects.Tables[req.Table].PrimaryKey
+	if len(req.Sort) > len(primaryKey) {
+		return false
+	}
+	for i, s := range req.Sort {
+		if s.Name != primaryKey[i] || s.Direction != Asc || s.Args != "" {
+			return false
+		}
+	}
+	return true
+}
+
 func (req *Request) optimizeResultLimit() (limit int) {
-	if req.Limit != nil && req.IsDefaultSortOrder() {
+	if req.Limit != nil && (req.IsDefaultSortOrder() || req.IsNaturalSortOrder()) {
 		limit = *req.Limit
 		if req.Offset > 0 {
 			limit += req.Offset
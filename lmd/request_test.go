@@ -5,10 +5,16 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"net"
+	"slices"
+	"strings"
 	"testing"
 	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
 )
 
 func TestRequestHeader(t *testing.T) {
@@ -24,6 +30,7 @@ func TestRequestHeader(t *testing.T) {
 		"GET hosts\nBackends: mockid0\n\n",
 		"GET hosts\nLimit: 25\nOffset: 5\n\n",
 		"GET hosts\nSort: name asc\nSort: state desc\n\n",
+		"GET hosts\nSort: custom_variables TEST asc\n\n",
 		"GET hosts\nStats: state = 1\nStats: avg latency\nStats: state = 3\nStats: state != 1\nStatsAnd: 2\n\n",
 		"GET hosts\nColumns: name\nFilter: notes ~~ test\n\n",
 		"GET hosts\nColumns: name\nFilter: notes !~ Test\n\n",
@@ -91,6 +98,47 @@ func TestRequestHeaderColumns(t *testing.T) {
 	}
 }
 
+func TestRequestHeaderColumnsWildcard(t *testing.T) {
+	lmd := createTestLMDInstance()
+	buf := bufio.NewReader(bytes.NewBufferString("GET hosts\nColumns: name last_hard_state* state\n"))
+	req, _, err := NewRequest(context.TODO(), lmd, buf, ParseOptimize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = assertEq([]string{"name", "last_hard_state", "last_hard_state_change", "state"}, req.Columns); err != nil {
+		t.Error(err)
+	}
+	if err = assertEq("last_hard_state_change", req.RequestColumns[2].Name); err != nil {
+		t.Error(err)
+	}
+
+	// virtual columns are expanded as well
+	buf = bufio.NewReader(bytes.NewBufferString("GET hosts\nColumns: name peer_*\n"))
+	req, _, err = NewRequest(context.TODO(), lmd, buf, ParseOptimize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = assertEq([]string{"name", "peer_key", "peer_name"}, req.Columns); err != nil {
+		t.Error(err)
+	}
+
+	// stats get one entry for each matching column
+	buf = bufio.NewReader(bytes.NewBufferString("GET hosts\nStats: sum last_hard_state*\n"))
+	req, _, err = NewRequest(context.TODO(), lmd, buf, ParseOptimize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = assertEq(2, len(req.Stats)); err != nil {
+		t.Error(err)
+	}
+
+	buf = bufio.NewReader(bytes.NewBufferString("GET hosts\nColumns: name nothing_*\n"))
+	_, _, err = NewRequest(context.TODO(), lmd, buf, ParseOptimize)
+	if err = assertLike("pattern nothing_\\* does not match any column", fmt.Sprintf("%v", err)); err != nil {
+		t.Error(err)
+	}
+}
+
 func TestRequestHeaderSort(t *testing.T) {
 	lmd := createTestLMDInstance()
 	req, _, _ := NewRequest(context.TODO(), lmd, bufio.NewReader(bytes.NewBufferString("GET hosts\nColumns: latency state name\nSort: name desc\nSort: state asc\n")), ParseOptimize)
@@ -446,6 +494,70 @@ func TestRequestStatsBroken(t *testing.T) {
 	}
 }
 
+func TestRequestStatsGroupSeparator(t *testing.T) {
+	// group values may contain the list separator and multi byte characters
+	values := []string{"a" + ListSepChar1 + "b", "Grüße €", "", "12:" + ListSepChar1}
+	if err := assertEq(values, splitStatsKey(statsKey(values))); err != nil {
+		t.Error(err)
+	}
+
+	lmd := createTestLMDInstance()
+	req, _, err := NewRequest(context.TODO(), lmd, bufio.NewReader(bytes.NewBufferString("GET hosts\nColumns: alias name\nStats: sum latency\n")), ParseDefault)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// identical groups of different peers are merged
+	req.StatsResult = NewResultSetStats()
+	for _, group := range [][]string{values[:2], values[2:], values[:2]} {
+		stats := NewResultSetStats()
+		stats.Stats[statsKey(group)] = createLocalStatsCopy(req.Stats)
+		stats.Stats[statsKey(group)][0].ApplyValue(1, 1)
+		req.StatsResult.Merge(stats)
+	}
+	res := &Response{Request: req}
+	if err = res.CalculateFinalStats(); err != nil {
+		t.Fatal(err)
+	}
+	if err = assertEq(2, len(res.Result)); err != nil {
+		t.Fatal(err)
+	}
+	for _, row := range res.Result {
+		group := []string{*(row[0].(*string)), *(row[1].(*string))}
+		expect := float64(1)
+		if group[0] == values[0] {
+			expect = 2
+		}
+		if err = assertEq(true, slices.Equal(group, values[:2]) || slices.Equal(group, values[2:])); err != nil {
+			t.Errorf("unexpected group %q: %s", group, err)
+		}
+		if err = assertEq(expect, row[2]); err != nil {
+			t.Error(err)
+		}
+	}
+
+	// list columns contain the separator as well
+	peer, cleanup, _ := StartTestPeer(1, 10, 10)
+	PauseTestPeers(peer)
+
+	result, _, err := peer.QueryString("GET hosts\nColumns: groups name\nStats: state = 0\n\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = assertEq(10, len(result)); err != nil {
+		t.Error(err)
+	}
+	for _, row := range result {
+		if err = assertLike("^testhost_", fmt.Sprintf("%v", row[1])); err != nil {
+			t.Error(err)
+		}
+	}
+
+	if err := cleanup(); err != nil {
+		panic(err.Error())
+	}
+}
+
 func TestRequestStatsFilter(t *testing.T) {
 	peer, cleanup, _ := StartTestPeer(4, 10, 10)
 	PauseTestPeers(peer)
@@ -568,6 +680,42 @@ func TestRequestGroupByTable(t *testing.T) {
 	}
 }
 
+func TestRequestGroupByTableFilterStats(t *testing.T) {
+	peer, cleanup, _ := StartTestPeer(1, 10, 10)
+	PauseTestPeers(peer)
+
+	res, _, err := peer.QueryString("GET hostsbygroup\nColumns: name hostgroup_name\nFilter: name = testhost_2\n\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = assertEq(1, len(res)); err != nil {
+		t.Fatal(err)
+	}
+	if err = assertEq("testhost_2", res[0][0]); err != nil {
+		t.Error(err)
+	}
+
+	res, _, err = peer.QueryString("GET servicesbyhostgroup\nColumns: host_name description\nLimit: 3\n\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = assertEq(3, len(res)); err != nil {
+		t.Error(err)
+	}
+
+	res, _, err = peer.QueryString("GET servicesbyhostgroup\nStats: state >= 0\nStats: sum state\n\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = assertEq(10.0, res[0][0]); err != nil {
+		t.Error(err)
+	}
+
+	if err := cleanup(); err != nil {
+		panic(err.Error())
+	}
+}
+
 func TestRequestBlocking(t *testing.T) {
 	peer, cleanup, _ := StartTestPeer(1, 10, 10)
 	PauseTestPeers(peer)
@@ -652,6 +800,45 @@ func TestRequestSort2(t *testing.T) {
 	}
 }
 
+func TestRequestSortMergeLimit(t *testing.T) {
+	peer, cleanup, _ := StartTestPeer(3, 10, 20)
+	PauseTestPeers(peer)
+
+	// sorting by primary key merges the sorted backend results
+	res, meta, err := peer.QueryString("GET services\nColumns: host_name description\nSort: host_name asc\nSort: description asc\nLimit: 10\nOffset: 3\nOutputFormat: wrapped_json\n\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = assertEq(int64(60), meta.Total); err != nil {
+		t.Error(err)
+	}
+
+	// additional sort columns require a full sort
+	full, _, err := peer.QueryString("GET services\nColumns: host_name description\nSort: host_name asc\nSort: description asc\nSort: peer_key asc\n\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = assertEq(full[3:13], res); err != nil {
+		t.Error(err)
+	}
+
+	res, _, err = peer.QueryString("GET hostgroups\nColumns: name\nSort: name asc\nLimit: 2\n\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	full, _, err = peer.QueryString("GET hostgroups\nColumns: name\nSort: name asc\nSort: peer_key asc\n\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = assertEq(full[0:2], res); err != nil {
+		t.Error(err)
+	}
+
+	if err := cleanup(); err != nil {
+		panic(err.Error())
+	}
+}
+
 func TestRequestSortColumnNotRequested(t *testing.T) {
 	peer, cleanup, _ := StartTestPeer(1, 10, 10)
 	PauseTestPeers(peer)
@@ -686,13 +873,13 @@ func TestRequestNoColumns(t *testing.T) {
 	if err = assertEq(2, len(res)); err != nil {
 		t.Error(err)
 	}
-	if err = assertEq(51, len(res[0])); err != nil {
+	if err = assertEq(52, len(res[0])); err != nil {
 		t.Error(err)
 	}
 	if err = assertEq("program_start", res[0][0]); err != nil {
 		t.Error(err)
 	}
-	if err = assertEq("mockid0", res[1][36]); err != nil {
+	if err = assertEq("mockid0", res[1][37]); err != nil {
 		t.Error(err)
 	}
 
@@ -967,6 +1154,21 @@ func TestRequestPassthrough(t *testing.T) {
 		t.Fatal(err)
 	}
 
+	// passthrough queries are counted as client queries
+	res, _, err = peer.QueryString("GET sites\nColumns: client_queries update_queries avg_response_time\nLimit: 1\n\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = assertEq(true, res[0][0].(float64) >= 2); err != nil {
+		t.Fatal(err)
+	}
+	if err = assertEq(true, res[0][1].(float64) > 0); err != nil {
+		t.Fatal(err)
+	}
+	if err = assertEq(true, res[0][2].(float64) > 0); err != nil {
+		t.Fatal(err)
+	}
+
 	if err := cleanup(); err != nil {
 		panic(err.Error())
 	}
@@ -1006,6 +1208,116 @@ func TestRequestSites(t *testing.T) {
 		t.Fatal(err)
 	}
 
+	res, _, err = peer.QueryString("GET sites\nColumns: name last_errors last_errors_hour\nFilter: name = offline2\n\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = assertEq(1, len(res)); err != nil {
+		t.Fatal(err)
+	}
+	lastErrors := res[0][1].([]interface{})
+	if err = assertEq(true, len(lastErrors) >= 1); err != nil {
+		t.Fatal(err)
+	}
+	if err = assertLike("connect: no such file or directory", lastErrors[0].([]interface{})[1].(string)); err != nil {
+		t.Fatal(err)
+	}
+	if err = assertEq(true, res[0][2].(float64) >= 1); err != nil {
+		t.Fatal(err)
+	}
+
+	res, _, err = peer.QueryString("GET sites\nColumns: last_full_update_duration last_delta_updated_objects queries_queued passthrough_in_flight sources source_index\nFilter: name = offline2\n\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = assertEq([]interface{}{float64(0), float64(0), float64(0), float64(0), []interface{}{"/does/not/exist.sock"}, float64(0)}, res[0]); err != nil {
+		t.Error(err)
+	}
+
+	res, _, err = peer.QueryString("GET sites\nColumns: last_full_update_duration\nFilter: key = mockid0\n\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = assertEq(true, res[0][0].(float64) > 0); err != nil {
+		t.Error(err)
+	}
+
+	if err := cleanup(); err != nil {
+		panic(err.Error())
+	}
+}
+
+func TestRequestTables(t *testing.T) {
+	peer, cleanup, _ := StartTestPeer(2, 10, 10)
+	PauseTestPeers(peer)
+
+	// same columns as the columns table
+	res, _, err := peer.QueryString("GET tables\nColumns: name table type\nFilter: table = hosts\nFilter: name = state\n\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = assertEq(ResultSet{{"state", "hosts", "int"}}, res); err != nil {
+		t.Error(err)
+	}
+
+	// summed up over all backends
+	query := "GET tables\nColumns: rows last_update size_bytes_estimate\nFilter: table = services\nFilter: name = description\n"
+	res, _, err = peer.QueryString(query + "\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = assertEq(1, len(res)); err != nil {
+		t.Fatal(err)
+	}
+	if err = assertEq(float64(20), res[0][0]); err != nil {
+		t.Error(err)
+	}
+	if err = assertEq(true, res[0][1].(float64) > 0); err != nil {
+		t.Error(err)
+	}
+	size := res[0][2].(float64)
+	if err = assertEq(true, size > 0); err != nil {
+		t.Error(err)
+	}
+
+	// single backend
+	res, _, err = peer.QueryString(query + "Backends: mockid0\n\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = assertEq(float64(10), res[0][0]); err != nil {
+		t.Error(err)
+	}
+	if err = assertEq(true, res[0][2].(float64) > 0 && res[0][2].(float64) < size); err != nil {
+		t.Error(err)
+	}
+
+	// one row per table
+	res, _, err = peer.QueryString("GET tables\nColumns: table\nStats: max rows\nFilter: table = services\n\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = assertEq(ResultSet{{"services", float64(20)}}, res); err != nil {
+		t.Error(err)
+	}
+
+	// the size is only estimated if the query uses it
+	res, _, err = peer.QueryString("GET tables\nColumns: table\nStats: max size_bytes_estimate\nFilter: table = services\n\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = assertEq(true, res[0][1].(float64) > 0); err != nil {
+		t.Error(err)
+	}
+	table := Objects.Tables[TableTables]
+	store := GetTableTablesStoreForPeers(table, []*Peer{peer}, false)
+	sizeCol := table.GetColumn("size_bytes_estimate")
+	for _, row := range store.Data {
+		if row.GetInt64(sizeCol) != 0 {
+			t.Fatalf("expected no size estimate, got %d", row.GetInt64(sizeCol))
+		}
+	}
+
 	if err := cleanup(); err != nil {
 		panic(err.Error())
 	}
@@ -1129,6 +1441,45 @@ func TestCustomVarCol(t *testing.T) {
 	}
 }
 
+func TestCustomVarColSort(t *testing.T) {
+	peer, cleanup, _ := StartTestPeer(1, 1, 9)
+	PauseTestPeers(peer)
+
+	for _, query := range []string{
+		"GET services\nColumns: description custom_variables\nSort: custom_variables TEST2 desc\n\n",
+		"GET services\nColumns: description host_custom_variables custom_variables\nSort: custom_variables TEST2 desc\nSort: host_custom_variables TEST asc\n\n",
+	} {
+		res, _, err := peer.QueryString(query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = assertEq(9, len(res)); err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 2; i++ {
+			hash := res[i][len(res[i])-1].(map[string]interface{})
+			if err = assertEq("cust var test2", hash["TEST2"]); err != nil {
+				t.Error(err)
+			}
+		}
+		if err = assertEq(map[string]interface{}{}, res[8][len(res[8])-1]); err != nil {
+			t.Error(err)
+		}
+	}
+
+	res, _, err := peer.QueryString("GET columns\nColumns: type\nFilter: table = services\nFilter: name = custom_variables\n\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = assertEq("dict", res[0][0]); err != nil {
+		t.Error(err)
+	}
+
+	if err := cleanup(); err != nil {
+		panic(err.Error())
+	}
+}
+
 func TestCustomVarColContacts(t *testing.T) {
 	peer, cleanup, _ := StartTestPeer(1, 2, 9)
 	PauseTestPeers(peer)
@@ -2036,3 +2387,713 @@ func TestServiceCustVarRegexFilter(t *testing.T) {
 		t.Error(err)
 	}
 }
+
+func TestRequestStateOrder(t *testing.T) {
+	peer, cleanup, _ := StartTestPeer(1, 10, 10)
+	PauseTestPeers(peer)
+
+	// critical services come first by default
+	res, _, err := peer.QueryString("GET services\nColumns: host_name state state_order\nSort: state_order desc\nLimit: 1\n\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = assertEq("testhost_2", res[0][0]); err != nil {
+		t.Error(err)
+	}
+	if err = assertEq(4.0, res[0][2]); err != nil {
+		t.Error(err)
+	}
+
+	res, _, err = peer.QueryString("GET services\nColumns: host_name\nFilter: state_order = 1\n\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = assertEq(2, len(res)); err != nil {
+		t.Error(err)
+	}
+
+	res, _, err = peer.QueryString("GET services\nStats: sum state_order\nStats: state_order >= 1\n\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = assertEq(6.0, res[0][0]); err != nil {
+		t.Error(err)
+	}
+	if err = assertEq(3.0, res[0][1]); err != nil {
+		t.Error(err)
+	}
+
+	res, _, err = peer.QueryString("GET hosts\nColumns: name state_order\nFilter: state_order = 0\n\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = assertEq(10, len(res)); err != nil {
+		t.Error(err)
+	}
+
+	if err := cleanup(); err != nil {
+		panic(err.Error())
+	}
+}
+
+func TestRequestStateOrderConfig(t *testing.T) {
+	extraConfig := `
+		ServiceStateOrder = [0, 4, 2, 3]
+		StateOrderHandled = true
+	`
+	peer, cleanup, _ := StartTestPeerExtra(1, 10, 10, extraConfig)
+	PauseTestPeers(peer)
+
+	// warning ranks above critical now, unhandled problems get an extra point
+	res, _, err := peer.QueryString("GET services\nColumns: state state_order\nSort: state_order desc\n\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = assertEq(1.0, res[0][0]); err != nil {
+		t.Error(err)
+	}
+	if err = assertEq(17.0, res[0][1]); err != nil {
+		t.Error(err)
+	}
+	if err = assertEq(9.0, res[2][1]); err != nil {
+		t.Error(err)
+	}
+	if err = assertEq(0.0, res[3][1]); err != nil {
+		t.Error(err)
+	}
+
+	if err := cleanup(); err != nil {
+		panic(err.Error())
+	}
+}
+
+func TestRequestTimeFilterPolicy(t *testing.T) {
+	lmd := createTestLMDInstance()
+	parse := func(query string) (*Request, error) {
+		req, _, err := NewRequest(context.TODO(), lmd, bufio.NewReader(bytes.NewBufferString(query)), ParseOptimize)
+		return req, err
+	}
+
+	lmd.Config.PassThroughTimeFilter = TimeFilterPolicyReject
+	for _, query := range []string{
+		"GET log\nColumns: time\n\n",
+		"GET log\nFilter: time >= 1\nNegate:\n\n",
+		"GET log\nFilter: time >= 1\nFilter: class = 1\nOr: 2\n\n",
+	} {
+		if _, err := parse(query); err == nil || !strings.Contains(err.Error(), "require a time filter") {
+			t.Errorf("expected query to be rejected: %q, got: %v", query, err)
+		}
+	}
+
+	// the example filter uses the configured lookback
+	lmd.Config.PassThroughLookback = 3600
+	_, err := parse("GET log\nColumns: time\n\n")
+	if err == nil {
+		t.Fatal("expected query to be rejected")
+	}
+	var example int64
+	_, filter, _ := strings.Cut(err.Error(), "Filter: ")
+	if _, sErr := fmt.Sscanf(filter, "time >= %d", &example); sErr != nil {
+		t.Fatalf("expected example filter in error, got: %s", err)
+	}
+	if since := time.Now().Unix() - 3600; example < since-1 || example > since {
+		t.Errorf("expected example filter using the configured lookback, got: %s", err)
+	}
+	for _, query := range []string{
+		"GET log\nColumns: time\nFilter: time >= 1\n\n",
+		"GET log\nFilter: time <= 100\nFilter: class = 1\n\n",
+		"GET log\nFilter: time >= 1\nFilter: time < 5\nOr: 2\n\n",
+		"GET log\nFilter: class = 1\nFilter: time > 1\nFilter: time < 5\nAnd: 2\nAnd: 2\n\n",
+		"GET hosts\nColumns: name\n\n",
+	} {
+		if _, err := parse(query); err != nil {
+			t.Errorf("expected query to pass: %q, got: %s", query, err)
+		}
+	}
+
+	lmd.Config.PassThroughTimeFilter = TimeFilterPolicyLookback
+	lmd.Config.PassThroughLookback = 3600
+	req, err := parse("GET log\nColumns: time\nFilter: class = 1\n\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = assertEq(2, len(req.Filter)); err != nil {
+		t.Fatal(err)
+	}
+	since := time.Now().Unix() - 3600
+	if lookback := int64(req.Filter[1].FloatValue); req.Filter[1].Operator != GreaterThan || lookback < since-1 || lookback > since {
+		t.Errorf("expected injected lookback filter, got: %s", req.String())
+	}
+
+	// existing time filter are passed through untouched
+	req, err = parse("GET log\nColumns: time\nFilter: time >= 5\n\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = assertEq("GET log\nColumns: time\nFilter: time >= 5\n\n", req.String()); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestRequestWaitObjects(t *testing.T) {
+	lmd := createTestLMDInstance()
+	query := "GET services\nWaitTrigger: check\nWaitObject: host1;svc1\nWaitObject: host2;svc1\n" +
+		"WaitCondition: state = 0\nWaitCondition: has_been_checked = 0\nWaitConditionNegate:\nWaitConditionOr: 2\n\n"
+	req, _, err := NewRequest(context.TODO(), lmd, bufio.NewReader(bytes.NewBufferString(query)), ParseDefault)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = assertEq([]string{"host1;svc1", "host2;svc1"}, req.WaitObject); err != nil {
+		t.Error(err)
+	}
+	if err = assertEq(1, len(req.WaitCondition)); err != nil {
+		t.Fatal(err)
+	}
+	if err = assertEq(true, req.WaitCondition[0].Filter[1].Negate); err != nil {
+		t.Error(err)
+	}
+	if err = assertEq("GET services\nWaitTrigger: check\nWaitObject: host1;svc1\nWaitObject: host2;svc1\n"+
+		"WaitCondition: state = 0\nWaitCondition: has_been_checked = 0\nWaitConditionNegate:\nWaitConditionOr: 2\n\n", req.String()); err != nil {
+		t.Error(err)
+	}
+	if err = assertEq("Filter: host_name = host1\nFilter: description = svc1\nAnd: 2\nFilter: host_name = host2\nFilter: description = svc1\nAnd: 2\nOr: 2\n", waitObjectFilter(req)); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestRequestWaitObjectsCondition(t *testing.T) {
+	peer, cleanup, _ := StartTestPeer(1, 10, 10)
+	PauseTestPeers(peer)
+
+	for _, test := range []struct {
+		condition string
+		waits     bool
+	}{
+		// only one of both objects matches, so wait till timeout
+		{"WaitCondition: name = testhost_1\n", true},
+		{"WaitCondition: name = testhost_1\nWaitConditionNegate:\n", true},
+		// both objects match
+		{"WaitCondition: name = testhost_1\nWaitCondition: name = testhost_2\nWaitConditionOr: 2\n", false},
+		{"WaitCondition: name = testhost_1\nWaitConditionNegate:\nWaitCondition: name = testhost_1\nWaitConditionOr: 2\n", false},
+	} {
+		query := "GET hosts\nColumns: name\nWaitTrigger: all\nWaitTimeout: 1000\nWaitObject: testhost_1\nWaitObject: testhost_2\n" + test.condition + "\n"
+		start := time.Now()
+		_, _, err := peer.QueryString(query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		elapsed := time.Since(start)
+		if test.waits && elapsed < 900*time.Millisecond {
+			t.Errorf("query should wait for timeout, returned after %s: %s", elapsed, test.condition)
+		}
+		if !test.waits && elapsed >= 900*time.Millisecond {
+			t.Errorf("query should return before timeout, returned after %s: %s", elapsed, test.condition)
+		}
+	}
+
+	if err := cleanup(); err != nil {
+		panic(err.Error())
+	}
+}
+
+func TestRequestClientGone(t *testing.T) {
+	peer, cleanup, mocklmd := StartTestPeer(2, 10, 10)
+	PauseTestPeers(peer)
+
+	query := "GET hosts\nColumns: name\nWaitTrigger: all\nWaitTimeout: 30000\nWaitCondition: state = 99\nKeepAlive: on\n\n"
+	req, _, err := NewRequest(context.TODO(), mocklmd, bufio.NewReader(bytes.NewBufferString(query)), ParseOptimize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = req.ExpandRequestedBackends(); err != nil {
+		t.Fatal(err)
+	}
+
+	server, client := net.Pipe()
+	cl := NewClientConnection(mocklmd, server, 60, 10, 10, nil)
+	counter := promFrontendQueryResults.WithLabelValues(cl.localAddr, "client_gone")
+	canceled := testutil.ToFloat64(counter)
+
+	done := make(chan bool)
+	go func() {
+		_, _ = cl.processRequest(context.TODO(), req)
+		close(done)
+	}()
+
+	// the waiting query is canceled once the client closes the connection
+	time.Sleep(200 * time.Millisecond)
+	t1 := time.Now()
+	client.Close()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("query has not been canceled after client closed the connection")
+	}
+	if time.Since(t1) > 2*time.Second {
+		t.Errorf("query canceled too late: %s", time.Since(t1))
+	}
+	if err := assertEq(canceled+1, testutil.ToFloat64(counter)); err != nil {
+		t.Error(err)
+	}
+	server.Close()
+
+	if err := cleanup(); err != nil {
+		panic(err.Error())
+	}
+}
+
+func TestRequestIdleTimeout(t *testing.T) {
+	peer, cleanup, mocklmd := StartTestPeer(1, 10, 10)
+	PauseTestPeers(peer)
+	mocklmd.Config.ClientIdleTimeout = 1
+
+	server, client := net.Pipe()
+	cl := NewClientConnection(mocklmd, server, 60, 10, 10, nil)
+	counter := promFrontendIdleClosedConnections.WithLabelValues(cl.localAddr)
+	closed := testutil.ToFloat64(counter)
+
+	done := make(chan bool)
+	go func() {
+		cl.Handle()
+		close(done)
+	}()
+
+	LogErrors(client.SetDeadline(time.Now().Add(5 * time.Second)))
+	reader := bufio.NewReader(client)
+	readResponse := func() (code int, body string) {
+		t.Helper()
+		header := make([]byte, 16)
+		if _, err := io.ReadFull(reader, header); err != nil {
+			t.Fatalf("reading response header failed: %s", err)
+		}
+		var size int
+		if _, err := fmt.Sscanf(string(header), "%d %d", &code, &size); err != nil {
+			t.Fatalf("parsing response header %q failed: %s", header, err)
+		}
+		data := make([]byte, size)
+		if _, err := io.ReadFull(reader, data); err != nil {
+			t.Fatalf("reading response body failed: %s", err)
+		}
+		return code, string(data)
+	}
+
+	// the idle timer is reset after each response
+	for i := 0; i < 2; i++ {
+		time.Sleep(600 * time.Millisecond)
+		if _, err := client.Write([]byte("GET hosts\nColumns: name\nKeepAlive: on\nResponseHeader: fixed16\n\n")); err != nil {
+			t.Fatal(err)
+		}
+		code, _ := readResponse()
+		if err := assertEq(200, code); err != nil {
+			t.Error(err)
+		}
+	}
+
+	// silent clients get an error and the connection is closed
+	t1 := time.Now()
+	code, body := readResponse()
+	if err := assertEq(408, code); err != nil {
+		t.Error(err)
+	}
+	if err := assertLike("closing idle connection", body); err != nil {
+		t.Error(err)
+	}
+	if time.Since(t1) < 800*time.Millisecond {
+		t.Errorf("connection closed too early: %s", time.Since(t1))
+	}
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("connection has not been closed")
+	}
+	if err := assertEq(closed+1, testutil.ToFloat64(counter)); err != nil {
+		t.Error(err)
+	}
+	client.Close()
+
+	if err := cleanup(); err != nil {
+		panic(err.Error())
+	}
+}
+
+func TestRequestID(t *testing.T) {
+	peer, cleanup, mocklmd := StartTestPeer(1, 10, 10)
+	PauseTestPeers(peer)
+
+	if err := assertLike(`^r:[0-9a-z]{6}$`, (&Request{}).ID()); err != nil {
+		t.Error(err)
+	}
+
+	query := "GET hosts\nColumns: name\nRequestID: thruk-123\nOutputFormat: wrapped_json\n\n"
+	req, _, err := NewRequest(context.TODO(), mocklmd, bufio.NewReader(bytes.NewBufferString(query)), ParseOptimize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = assertEq("thruk-123", req.ID()); err != nil {
+		t.Error(err)
+	}
+	// the request id is not sent to the backends
+	if strings.Contains(req.String(), "RequestID") {
+		t.Errorf("request id must not be forwarded: %s", req.String())
+	}
+	if err = req.ExpandRequestedBackends(); err != nil {
+		t.Fatal(err)
+	}
+	res, _, err := NewResponse(context.TODO(), req, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf, err := res.Buffer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var result struct {
+		RequestID string `json:"request_id"`
+	}
+	if err = json.Unmarshal(buf.Bytes(), &result); err != nil {
+		t.Fatal(err)
+	}
+	if err = assertEq("thruk-123", result.RequestID); err != nil {
+		t.Error(err)
+	}
+
+	for _, id := range []string{"", "a b", strings.Repeat("x", RequestIDMaxLength+1)} {
+		_, _, err = NewRequest(context.TODO(), mocklmd, bufio.NewReader(bytes.NewBufferString("GET hosts\nRequestID: "+id+"\n\n")), ParseOptimize)
+		if err == nil {
+			t.Errorf("expected error for request id %q", id)
+		}
+	}
+
+	// error responses contain the request id of the failed request
+	server, client := net.Pipe()
+	cl := NewClientConnection(mocklmd, server, 60, 10, 10, nil)
+	go cl.Handle()
+	go func() {
+		_, _ = client.Write([]byte("GET hosts\nRequestID: thruk-456\nLimit: x\n\n"))
+	}()
+	response, err := io.ReadAll(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = assertLike(`expecting a positive number in: Limit: x \(request id: thruk-456\)`, string(response)); err != nil {
+		t.Error(err)
+	}
+	client.Close()
+
+	if err := cleanup(); err != nil {
+		panic(err.Error())
+	}
+}
+
+func TestRequestKeepAlivePipelined(t *testing.T) {
+	peer, cleanup, mocklmd := StartTestPeer(2, 10, 10)
+	PauseTestPeers(peer)
+
+	server, client := net.Pipe()
+	cl := NewClientConnection(mocklmd, server, 10, 10, 10, nil)
+	done := make(chan bool)
+	go func() {
+		cl.Handle()
+		close(done)
+	}()
+
+	reader := bufio.NewReader(client)
+	readResponse := func() (code int, body string) {
+		t.Helper()
+		LogErrors(client.SetReadDeadline(time.Now().Add(5 * time.Second)))
+		header := make([]byte, 16)
+		if _, err := io.ReadFull(reader, header); err != nil {
+			t.Fatalf("reading response header failed: %s", err)
+		}
+		var size int
+		if _, err := fmt.Sscanf(string(header), "%d %d", &code, &size); err != nil {
+			t.Fatalf("parsing response header %q failed: %s", header, err)
+		}
+		data := make([]byte, size)
+		if _, err := io.ReadFull(reader, data); err != nil {
+			t.Fatalf("reading response body failed: %s", err)
+		}
+		return code, string(data)
+	}
+	send := func(query string) {
+		t.Helper()
+		if _, err := client.Write([]byte(query)); err != nil {
+			t.Fatalf("sending query failed: %s", err)
+		}
+	}
+
+	queries := []struct {
+		query string
+		codes []int
+	}{
+		// regular query
+		{"GET hosts\nColumns: name\nKeepAlive: on\nResponseHeader: fixed16\n\n", []int{200}},
+		// command followed by a query within the same packet
+		{"COMMAND [0] test_ok\n\nGET hosts\nColumns: name\nLimit: 1\nKeepAlive: on\nResponseHeader: fixed16\n\n", []int{200}},
+		// failed backend query
+		{"GET hosts\nColumns: name\nBackends: unknown\nKeepAlive: on\nResponseHeader: fixed16\n\n", []int{502}},
+		// failed command
+		{"COMMAND [0] LMD_KILL_QUERY;unknown\nKeepAlive: on\nResponseHeader: fixed16\n\n", []int{400}},
+		// pipelined queries, connection still works
+		{"GET services\nColumns: host_name description\nKeepAlive: on\nResponseHeader: fixed16\n\nGET status\nColumns: program_start\nKeepAlive: on\nResponseHeader: fixed16\n\n", []int{200, 200}},
+	}
+	for _, q := range queries {
+		send(q.query)
+		for _, expect := range q.codes {
+			code, body := readResponse()
+			if err := assertEq(expect, code); err != nil {
+				t.Fatalf("query %q: %s\n%s", q.query, err, body)
+			}
+		}
+	}
+
+	client.Close()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("connection has not been closed")
+	}
+
+	if err := cleanup(); err != nil {
+		panic(err.Error())
+	}
+}
+
+func TestRequestLimits(t *testing.T) {
+	lmd := createTestLMDInstance()
+	sizeQuery := "GET hosts\nColumns: name\n\n"
+
+	tests := []struct {
+		limit     string
+		set       func(conf *Config, value int)
+		value     int
+		atLimit   string
+		overLimit string
+	}{
+		{"MaxRequestSize", func(conf *Config, value int) { conf.MaxRequestSize = value }, len(sizeQuery), sizeQuery, "GET hosts\nColumns: name \n\n"},
+		{
+			"MaxRequestHeaders", func(conf *Config, value int) { conf.MaxRequestHeaders = value }, 3,
+			"GET hosts\nColumns: name\nFilter: name = a\nLimit: 1\n\n",
+			"GET hosts\nColumns: name\nFilter: name = a\nLimit: 1\nOffset: 1\n\n",
+		},
+		{
+			"MaxQueryFilter", func(conf *Config, value int) { conf.MaxQueryFilter = value }, 2,
+			"GET hosts\nFilter: name = a\nStats: state = 0\n\n",
+			"GET hosts\nFilter: name = a\nStats: state = 0\nStats: state = 1\n\n",
+		},
+		{
+			"MaxQueryColumns", func(conf *Config, value int) { conf.MaxQueryColumns = value }, 2,
+			"GET hosts\nColumns: name state\n\n",
+			"GET hosts\nColumns: name state alias\n\n",
+		},
+	}
+	for _, test := range tests {
+		lmd.Config = NewConfig([]string{})
+		test.set(lmd.Config, test.value)
+
+		_, _, err := NewRequest(context.TODO(), lmd, bufio.NewReader(bytes.NewBufferString(test.atLimit)), ParseOptimize)
+		if err != nil {
+			t.Errorf("%s: request at the limit failed: %s", test.limit, err)
+		}
+
+		_, _, err = NewRequest(context.TODO(), lmd, bufio.NewReader(bytes.NewBufferString(test.overLimit)), ParseOptimize)
+		limitErr := &RequestLimitError{}
+		if !errors.As(err, &limitErr) {
+			t.Errorf("%s: expected limit error, got: %v", test.limit, err)
+			continue
+		}
+		if err = assertEq(test.limit, limitErr.Limit); err != nil {
+			t.Error(err)
+		}
+		if err = assertLike(test.limit, limitErr.Error()); err != nil {
+			t.Error(err)
+		}
+	}
+
+	// lines are not read beyond the limit
+	lmd.Config = NewConfig([]string{})
+	lmd.Config.MaxRequestSize = 100
+	_, size, err := NewRequest(context.TODO(), lmd, bufio.NewReader(bytes.NewBufferString("GET hosts\nColumns: "+strings.Repeat("a", 10000)+"\n\n")), ParseOptimize)
+	if !errors.As(err, new(*RequestLimitError)) {
+		t.Errorf("expected limit error, got: %v", err)
+	}
+	if size > 100 {
+		t.Errorf("read %d bytes, more than allowed", size)
+	}
+}
+
+func TestRequestLimitsConnection(t *testing.T) {
+	lmd := createTestLMDInstance()
+	lmd.Config.MaxRequestHeaders = 2
+
+	server, client := net.Pipe()
+	cl := NewClientConnection(lmd, server, 10, 10, 10, nil)
+	done := make(chan bool)
+	go func() {
+		cl.Handle()
+		close(done)
+	}()
+
+	// the rest of the request is not read anymore, so do not wait for the write
+	go func() {
+		_, _ = client.Write([]byte("GET hosts\nColumns: name\nFilter: name = a\nLimit: 1\n\n"))
+	}()
+	LogErrors(client.SetReadDeadline(time.Now().Add(5 * time.Second)))
+	data, err := io.ReadAll(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = assertLike(`^400\s+\d+\nbad request: request exceeds MaxRequestHeaders of 2 header lines`, string(data)); err != nil {
+		t.Error(err)
+	}
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("connection has not been closed")
+	}
+}
+
+func TestRequestMergeDistributed(t *testing.T) {
+	peer, cleanup, mocklmd := StartTestPeer(1, 10, 10)
+	PauseTestPeers(peer)
+
+	query := "GET hosts\nColumns: name\nStats: state = 0\nStats: sum latency\nStats: min latency\n\n"
+	req, _, err := NewRequest(context.TODO(), mocklmd, bufio.NewReader(bytes.NewBufferString(query)), ParseOptimize)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// local results use *string group keys, remote results are parsed from json
+	host1, host2 := "host1", "host2"
+	collected := make(chan *distributedResult, 3)
+	collected <- &distributedResult{
+		rows: ResultSet{
+			{&host1, []interface{}{float64(2), 2}, []interface{}{float64(3), 2}, []interface{}{float64(1), 2}},
+		},
+		failed:      map[string]string{"peer1": "connection refused"},
+		total:       1,
+		rowsScanned: 10,
+	}
+	collected <- &distributedResult{
+		rows: ResultSet{
+			{"host1", []interface{}{float64(1), float64(1)}, []interface{}{float64(0.5), float64(1)}, []interface{}{float64(0.5), float64(1)}},
+			{"host2", []interface{}{float64(0), float64(0)}, []interface{}{float64(0), float64(0)}, []interface{}{float64(-1), float64(0)}},
+		},
+		failed:      map[string]string{"peer2": "timeout"},
+		total:       2,
+		rowsScanned: 20,
+	}
+	collected <- &distributedResult{}
+	close(collected)
+
+	res := req.mergeDistributedResponse(collected)
+	res.CalculateFinalStats()
+	if err = assertEq(2, len(res.Result)); err != nil {
+		t.Fatal(err)
+	}
+	if err = assertEq(ResultSet{
+		{&host1, float64(3), 3.5, 0.5},
+		{&host2, float64(0), float64(0), float64(0)},
+	}, res.Result); err != nil {
+		t.Error(err)
+	}
+	if err = assertEq(map[string]string{"peer1": "connection refused", "peer2": "timeout"}, res.Failed); err != nil {
+		t.Error(err)
+	}
+	if err = assertEq(30, res.RowsScanned); err != nil {
+		t.Error(err)
+	}
+
+	// regular requests sum up the totals of all nodes before applying the limit
+	req, _, err = NewRequest(context.TODO(), mocklmd, bufio.NewReader(bytes.NewBufferString("GET hosts\nColumns: name\nSort: name asc\nLimit: 2\n\n")), ParseOptimize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	collected = make(chan *distributedResult, 2)
+	collected <- &distributedResult{rows: ResultSet{{&host1}, {&host2}}, total: 5, rowsScanned: 5}
+	collected <- &distributedResult{rows: ResultSet{{"host0"}}, failed: map[string]string{"peer2": "timeout"}, total: 3, rowsScanned: 3}
+	close(collected)
+
+	res = req.mergeDistributedResponse(collected)
+	res.PostProcessing()
+	if err = assertEq(2, len(res.Result)); err != nil {
+		t.Error(err)
+	}
+	if err = assertEq(8, res.ResultTotal); err != nil {
+		t.Error(err)
+	}
+	if err = assertEq(8, res.RowsScanned); err != nil {
+		t.Error(err)
+	}
+	if err = assertEq("timeout", res.Failed["peer2"]); err != nil {
+		t.Error(err)
+	}
+
+	if err := cleanup(); err != nil {
+		panic(err.Error())
+	}
+}
+
+func TestRequestPanic(t *testing.T) {
+	peer, cleanup, mocklmd := StartTestPeer(1, 10, 10)
+	PauseTestPeers(peer)
+
+	// column which cannot be read from any row
+	broken := &Column{Name: "broken", DataType: StringCol, Table: Objects.Tables[TableHosts]}
+
+	query := func(modify func(req *Request)) string {
+		t.Helper()
+		req, _, err := NewRequest(context.TODO(), mocklmd, bufio.NewReader(bytes.NewBufferString("GET hosts\nColumns: name\nFilter: name = testhost_1\nResponseHeader: fixed16\n\n")), ParseOptimize)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = req.ExpandRequestedBackends(); err != nil {
+			t.Fatal(err)
+		}
+		modify(req)
+		server, client := net.Pipe()
+		output := make(chan string, 1)
+		go func() {
+			data, _ := io.ReadAll(client)
+			output <- string(data)
+		}()
+		cl := NewClientConnection(mocklmd, server, 10, 10, 10, nil)
+		err = cl.processRequests(context.WithValue(context.Background(), CtxClient, "test"), []*Request{req})
+		if !errors.Is(err, errQueryPanic) {
+			t.Errorf("expected query panic error, got: %v", err)
+		}
+		server.Close()
+		return <-output
+	}
+
+	// panic in a response worker
+	res := query(func(req *Request) {
+		req.Filter[0].Column = broken
+		req.Filter[0].ColumnIndex = -1
+	})
+	if err := assertLike(`^500\s+\d+\ninternal error while processing the query`, res); err != nil {
+		t.Error(err)
+	}
+
+	// panic while sending the response
+	res = query(func(req *Request) {
+		req.RequestColumns = []*Column{{Name: "broken", DataType: StringCol, StorageType: LocalStore, Index: 9999, Table: Objects.Tables[TableHosts]}}
+	})
+	if err := assertLike(`500\s+\d+\ninternal error while processing the query`, res); err != nil {
+		t.Error(err)
+	}
+
+	// following queries still work
+	result, _, err := peer.QueryString("GET hosts\nColumns: name\nFilter: name = testhost_1\n\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = assertEq(1, len(result)); err != nil {
+		t.Error(err)
+	}
+
+	if err := cleanup(); err != nil {
+		panic(err.Error())
+	}
+}
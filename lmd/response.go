@@ -2,15 +2,24 @@ package main
 
 import (
 	"bytes"
+	"compress/gzip"
+	"container/heap"
 	"context"
+	"errors"
 	"fmt"
+	"hash/fnv"
 	"io"
+	"maps"
+	"math"
 	"net"
+	"runtime/debug"
 	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
+	"unsafe"
 
 	jsoniter "github.com/json-iterator/go"
 	"github.com/sasha-s/go-deadlock"
@@ -22,21 +31,49 @@ const (
 
 	// Number of processes rows after which the context is checked again
 	RowContextCheck = 10000
+
+	// RowContextCheckMin sets the minimum number of rows between context checks of slow queries
+	RowContextCheckMin = 10
 )
 
 // Response contains the livestatus response data as long with some meta data
 type Response struct {
-	noCopy        noCopy
-	Lock          *deadlock.RWMutex // must be used for Result and Failed access
-	Request       *Request          // the initial request
-	Result        ResultSet         // final processed result table
-	Code          int               // 200 if the query was successful
-	Error         error             // error object if the query was not successful
-	RawResults    *RawResultSet     // collected results from peers
-	ResultTotal   int
-	RowsScanned   int // total number of data rows scanned for this result
-	Failed        map[string]string
-	SelectedPeers []*Peer
+	noCopy         noCopy
+	Lock           *deadlock.RWMutex // must be used for Result and Failed access
+	Request        *Request          // the initial request
+	Result         ResultSet         // final processed result table
+	Code           int               // 200 if the query was successful
+	Error          error             // error object if the query was not successful
+	RawResults     *RawResultSet     // collected results from peers
+	ResultTotal    int
+	RowsScanned    int  // total number of data rows scanned for this result
+	Duplicates     int  // number of duplicate passthrough rows removed from the result
+	WaitTimedOut   bool // wait condition did not match within the WaitTimeout
+	Failed         map[string]string
+	Stale          map[string]float64 // age in seconds of peers serving stale data
+	SelectedPeers  []*Peer
+	columnsPeers   []*Peer                  // all selected peers for the columns and tables table
+	localSchema    bool                     // build result from the table schema without any backend
+	memory         *QueryMemory             // approximate memory retained by this query
+	rowsReturned   int                      // number of result rows after applying limit and offset
+	peerDurations  map[string]time.Duration // duration of building the result per peer name
+	postProcessing time.Duration            // duration of sorting and final stats calculation
+	trace          *QueryTrace              // optional trace of all query phases
+	running        *RunningQuery            // entry in the registry of running queries
+	cancel         context.CancelCauseFunc  // cancels the query, ex.: after a panic in one of its workers
+
+	passthroughResults []ResultSet        // sorted results of passthrough queries, one per selected peer and forwarding node
+	passthroughTotals  []int              // exact number of matching rows per selected peer or -1 if unknown
+	passthroughDone    []bool             // passthrough query of the selected peer has finished
+	passthroughClosed  bool               // late passthrough results are dropped after a timeout
+	passthroughNodes   []*passthroughNode // cluster nodes answering the passthrough query for foreign backends
+	resultSorted       bool               // result is sorted already
+}
+
+// passthroughNode contains the requested backends of another cluster node for a passthrough query.
+type passthroughNode struct {
+	node     *NodeAddress
+	backends []string
 }
 
 // PeerResponse is the sub result from a peer before merged into the end result
@@ -44,6 +81,38 @@ type PeerResponse struct {
 	Rows        []*DataRow // set of datarows
 	Total       int        // total number of matched rows regardless of any limits or offsets
 	RowsScanned int        // total number of rows scanned to create result
+	PeerKey     string     // id of the peer which created this result
+	reserved    int        // number of rows accounted in the query memory
+}
+
+// newPeerResponse returns an empty peer response from the pool.
+func newPeerResponse() *PeerResponse {
+	result, _ := peerResponsePool.Get().(*PeerResponse)
+	return result
+}
+
+// grow makes sure the rows have capacity for at least size additional rows.
+func (subRes *PeerResponse) grow(size int) {
+	if cap(subRes.Rows)-len(subRes.Rows) >= size {
+		return
+	}
+	rows := make([]*DataRow, len(subRes.Rows), len(subRes.Rows)+size)
+	copy(rows, subRes.Rows)
+	subRes.Rows = rows
+}
+
+// release returns the peer response into the pool once its rows have been copied.
+func (subRes *PeerResponse) release() {
+	if cap(subRes.Rows) > PooledResultMaxRows {
+		return
+	}
+	clear(subRes.Rows)
+	subRes.Rows = subRes.Rows[:0]
+	subRes.Total = 0
+	subRes.RowsScanned = 0
+	subRes.PeerKey = ""
+	subRes.reserved = 0
+	peerResponsePool.Put(subRes)
 }
 
 // NewResponse creates a new response object for a given request
@@ -55,8 +124,39 @@ func NewResponse(ctx context.Context, req *Request, w net.Conn) (res *Response,
 		Failed:  req.BackendErrors,
 		Request: req,
 		Lock:    new(deadlock.RWMutex),
+		trace:   req.trace,
+	}
+	// res is nil once the response has been sent, so keep a reference for the deferred metrics
+	start, built := time.Now(), res
+	defer func() {
+		built.updateQueryMetrics(start)
+		built.checkSlowQuery(time.Since(start), size)
+	}()
+
+	// limit the number of concurrently executing queries, excess queries wait in a queue
+	release, err := res.acquireQuerySlot(ctx)
+	if err != nil {
+		res.Code = responseErrorCode(err)
+		return
 	}
+	defer release()
+
+	// abort the query once it exceeds its memory budget
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+	res.cancel = cancel
+	res.memory = NewQueryMemory(res.memoryBudget(), cancel)
+	defer res.memory.Release()
+
+	// deferred, so the query is removed from the running queries even if it panics
+	res.running = req.lmd.runningQueries.Register(ctx, req, cancel)
+	defer req.lmd.runningQueries.Unregister(res.running)
+
 	res.prepareResponse(ctx, req)
+	if res.trace != nil {
+		res.trace.peerSelection = time.Since(start)
+	}
+	req.lmd.runningQueries.SetBackends(res.running, res.SelectedPeers)
 
 	// if all backends are down, send an error instead of an empty result
 	if res.Request.OutputFormat != OutputFormatWrappedJSON && len(res.Failed) > 0 && len(res.Failed) == len(req.Backends) {
@@ -68,24 +168,26 @@ func NewResponse(ctx context.Context, req *Request, w net.Conn) (res *Response,
 	table := Objects.Tables[req.Table]
 
 	switch {
-	case len(res.SelectedPeers) == 0:
+	case res.localSchema:
+		// schema queries, ex.: columns table
+		res.buildSchemaResponse(ctx, table)
+	case len(res.SelectedPeers) == 0 && len(res.passthroughNodes) == 0:
 		// no backends selected, return empty result
 		res.Result = make(ResultSet, 0)
 	case table.PassthroughOnly:
 		// passthrough requests, ex.: log table
-		res.BuildPassThroughResult()
+		res.BuildPassThroughResult(ctx)
+		t1 := time.Now()
 		res.PostProcessing()
+		res.postProcessing += time.Since(t1)
 	default:
 		// normal requests
 
 		if res.Request.WaitTrigger != "" {
-			for i := range res.SelectedPeers {
-				p := res.SelectedPeers[i]
-				res.waitTrigger(ctx, p)
-			}
+			res.waitTriggerAll(ctx)
 		}
 
-		// set locks for required stores
+		// stores are immutable snapshots, updates replace them or their row values, so no locks are required
 		stores := make(map[*Peer]*DataStore)
 		for i := range res.SelectedPeers {
 			p := res.SelectedPeers[i]
@@ -96,35 +198,129 @@ func NewResponse(ctx context.Context, req *Request, w net.Conn) (res *Response,
 				res.Lock.Unlock()
 				continue
 			}
-			if !table.WorksUnlocked {
-				store.DataSet.Lock.RLock()
-			}
 			stores[p] = store
 		}
-		if !table.WorksUnlocked {
-			defer func() {
-				for _, s := range stores {
-					s.DataSet.Lock.RUnlock()
-				}
-			}()
-		}
 
-		res.RawResults = &RawResultSet{}
-		res.RawResults.Sort = req.Sort
+		res.RawResults = NewRawResultSet(req.Sort)
+		res.RawResults.Grow(res.expectedResultRows(stores))
 		res.buildLocalResponse(ctx, stores)
+		t1 := time.Now()
 		res.RawResults.PostProcessing(res)
+		res.postProcessing += time.Since(t1)
+	}
+
+	if errors.Is(context.Cause(ctx), errQueryKilled) {
+		err = errQueryKilled
+		res.releaseResult()
+		res.Code = 400
+		logWith(res).Warnf("query killed")
+		return
+	}
+
+	if errors.Is(context.Cause(ctx), errQueryPanic) {
+		err = errQueryPanic
+		res.releaseResult()
+		res.Code = 500
+		return
+	}
+
+	if errors.Is(context.Cause(ctx), errQueryShutdown) {
+		err = errQueryShutdown
+		res.releaseResult()
+		res.Code = 503
+		logWith(res).Warnf("query canceled by shutdown")
+		return
+	}
+
+	if res.memory.Exceeded() {
+		err = &QueryMemoryError{Budget: res.memory.budget}
+		res.releaseResult()
+		res.Code = 413
+		logWith(res).Warnf("query rejected: %s", err.Error())
+		return
 	}
 
-	res.CalculateFinalStats()
+	t1 := time.Now()
+	err = res.CalculateFinalStats()
+	res.postProcessing += time.Since(t1)
+	if err != nil {
+		res.releaseResult()
+		res.Code = 400
+		logWith(res).Warnf("query rejected: %s", err.Error())
+		return
+	}
+	res.rowsReturned = res.numResultRows()
+	if res.trace != nil {
+		res.trace.postProcessing = res.postProcessing
+	}
+	res.setAllBackendsFailedCode()
 
 	if w != nil {
 		size, err = res.Send(w)
+		// the response is written synchronously, so the rows are not referenced anymore
+		if res.RawResults != nil {
+			res.RawResults.Release()
+		}
 		return nil, size, err
 	}
 
 	return res, 0, err
 }
 
+// updateQueryMetrics updates the per table query metrics once the response has been built or sent.
+func (res *Response) updateQueryMetrics(start time.Time) {
+	table := res.Request.Table.String()
+	code := strconv.Itoa(res.Code)
+	promFrontendQueryDuration.WithLabelValues(table, code).Observe(time.Since(start).Seconds())
+	rowsScanned := res.RowsScanned
+	if res.RawResults != nil {
+		rowsScanned = res.RawResults.RowsScanned
+	}
+	promFrontendRowsScanned.WithLabelValues(table).Add(float64(rowsScanned))
+	promFrontendRowsReturned.WithLabelValues(table).Add(float64(res.rowsReturned))
+}
+
+// numResultRows returns the number of result rows.
+func (res *Response) numResultRows() int {
+	if res.RawResults != nil && len(res.Request.Stats) == 0 {
+		return len(res.RawResults.DataResult)
+	}
+	return len(res.Result)
+}
+
+// memoryBudget returns the memory budget of a single query in bytes, zero disables the limit.
+func (res *Response) memoryBudget() int64 {
+	if res.Request.lmd == nil {
+		return 0
+	}
+	return int64(res.Request.lmd.Config.MaxQueryMemory) * 1024 * 1024
+}
+
+// releaseResult drops all collected rows, ex.: if the query has been rejected.
+func (res *Response) releaseResult() {
+	if res.RawResults != nil {
+		res.RawResults.Release()
+		res.RawResults = nil
+	}
+	res.Lock.Lock()
+	res.Result = nil
+	res.passthroughResults = nil
+	res.passthroughClosed = true
+	res.Lock.Unlock()
+}
+
+// reserveRows accounts the rows added to the peer response since the last call in the query memory.
+// The size of the last row is used for all new rows, so the estimate averages out over all batches.
+// It returns false if the query exceeds its memory budget.
+func (res *Response) reserveRows(subRes *PeerResponse) bool {
+	num := len(subRes.Rows) - subRes.reserved
+	if num <= 0 || res.memory == nil {
+		return true
+	}
+	subRes.reserved = len(subRes.Rows)
+	return res.memory.Reserve(int64(num) * subRes.Rows[len(subRes.Rows)-1].SizeEstimate())
+}
+
 func (res *Response) prepareResponse(ctx context.Context, req *Request) {
 	if res.Failed == nil {
 		res.Failed = make(map[string]string)
@@ -136,16 +332,18 @@ func (res *Response) prepareResponse(ctx context.Context, req *Request) {
 	res.SelectedPeers = make([]*Peer, 0)
 	spinUpPeers := make([]*Peer, 0)
 	// iterate over PeerMap instead of BackendsMap to retain backend order
+	foreignBackends := make([]string, 0)
 	req.lmd.PeerMapLock.RLock()
 	for _, id := range req.lmd.PeerMapOrder {
 		p := req.lmd.PeerMap[id]
 		if _, ok := req.BackendsMap[p.ID]; !ok {
 			continue
 		}
-		if req.lmd.nodeAccessor == nil || !req.lmd.nodeAccessor.IsOurBackend(p.ID) {
+		if p.HasFlag(MultiBackend) {
 			continue
 		}
-		if p.HasFlag(MultiBackend) {
+		if req.lmd.nodeAccessor == nil || !req.lmd.nodeAccessor.IsOurBackend(p.ID) {
+			foreignBackends = append(foreignBackends, p.ID)
 			continue
 		}
 		res.SelectedPeers = append(res.SelectedPeers, p)
@@ -158,14 +356,59 @@ func (res *Response) prepareResponse(ctx context.Context, req *Request) {
 	}
 	req.lmd.PeerMapLock.RUnlock()
 
-	// only use the first backend when requesting table or columns table
-	if table.Name == TableTables || table.Name == TableColumns {
-		res.SelectedPeers = []*Peer{req.lmd.PeerMap[req.lmd.PeerMapOrder[0]]}
+	switch table.Name {
+	case TableColumns, TableTables:
+		// columns and tables table are built once from the merged columns of all selected backends
+		res.columnsPeers = res.SelectedPeers
+		res.localSchema = true
+	case TableSlowqueries, TableQueries:
+		// slow and running queries are tracked locally and do not depend on any backend
+		res.localSchema = true
+	case TableNodes:
+		// answered from the local cluster state
+		res.localSchema = true
+	}
+
+	if table.PassthroughOnly {
+		res.passthroughNodes = res.passthroughForeignNodes()
 	}
 
+	res.setUnhandledBackendsFailed(foreignBackends)
+
 	if !table.PassthroughOnly && len(spinUpPeers) > 0 {
 		SpinUpPeers(ctx, spinUpPeers)
 	}
+
+	if !table.PassthroughOnly && table.Virtual == nil {
+		res.checkStaleData()
+	}
+}
+
+// checkStaleData removes peers from the selected peers if their data is older than MaxStaleAge.
+// If the request accepts stale data, the peers will be kept and marked as stale instead.
+func (res *Response) checkStaleData() {
+	maxAge := float64(res.Request.lmd.Config.MaxStaleAge)
+	if maxAge <= 0 {
+		return
+	}
+	selected := make([]*Peer, 0, len(res.SelectedPeers))
+	for _, p := range res.SelectedPeers {
+		age := p.DataAge()
+		if age <= maxAge {
+			selected = append(selected, p)
+			continue
+		}
+		if res.Request.StaleDataAccept {
+			if res.Stale == nil {
+				res.Stale = make(map[string]float64)
+			}
+			res.Stale[p.ID] = age
+			selected = append(selected, p)
+			continue
+		}
+		res.Failed[p.ID] = fmt.Sprintf("data too old, last successful update %.0f seconds ago", age)
+	}
+	res.SelectedPeers = selected
 }
 
 // Len returns the result length used for sorting results.
@@ -175,13 +418,23 @@ func (res *Response) Len() int {
 
 // Less returns the sort result of two data rows
 func (res *Response) Less(i, j int) bool {
+	return res.compareRows(res.Result[i], res.Result[j]) <= 0
+}
+
+// compareRows compares two result rows by the sort header of the request.
+// It returns a negative number if rowA comes first, a positive one if rowB comes first and 0 if both are equal.
+func (res *Response) compareRows(rowA, rowB []interface{}) int {
 	for k := range res.Request.Sort {
 		s := res.Request.Sort[k]
 		var sortType DataType
-		if s.Group {
+		switch {
+		case s.Group:
 			sortType = StringCol
-		} else {
+		case s.Index < len(res.Request.RequestColumns):
 			sortType = res.Request.RequestColumns[s.Index].DataType
+		default:
+			// sort column has been added to the passthrough columns
+			sortType = s.Column.DataType
 		}
 		switch sortType {
 		case IntCol:
@@ -189,43 +442,60 @@ func (res *Response) Less(i, j int) bool {
 		case Int64Col:
 			fallthrough
 		case FloatCol:
-			valueA := interface2float64(res.Result[i][s.Index])
-			valueB := interface2float64(res.Result[j][s.Index])
+			valueA := interface2float64(rowA[s.Index])
+			valueB := interface2float64(rowB[s.Index])
 			if valueA == valueB {
 				continue
 			}
-			if s.Direction == Asc {
-				return valueA < valueB
-			}
-			return valueA > valueB
-		case JSONCol:
-			fallthrough
-		case StringCol:
+			return sortDirectionResult(s.Direction, valueA < valueB)
+		case JSONCol, StringCol, StringLargeCol, ServiceMemberListCol, InterfaceListCol:
 			index := s.Index
 			if s.Group {
 				index = 0
 			}
-			s1 := interface2stringNoDedup(res.Result[i][index])
-			s2 := interface2stringNoDedup(res.Result[j][index])
+			s1 := interface2stringNoDedup(rowA[index])
+			s2 := interface2stringNoDedup(rowB[index])
 			if s1 == s2 {
 				continue
 			}
-			if s.Direction == Asc {
-				return s1 < s2
+			return sortDirectionResult(s.Direction, s1 < s2)
+		case CustomVarCol:
+			s1 := interface2hashmap(rowA[s.Index])[s.Args]
+			s2 := interface2hashmap(rowB[s.Index])[s.Args]
+			if s1 == s2 {
+				continue
 			}
-			return s1 > s2
+			return sortDirectionResult(s.Direction, s1 < s2)
 		case StringListCol:
 			// not implemented
-			return s.Direction == Asc
+			return sortDirectionResult(s.Direction, true)
 		case Int64ListCol:
 			// not implemented
-			return s.Direction == Asc
+			return sortDirectionResult(s.Direction, true)
+		}
+		// other types are rejected when parsing the sort header
+	}
+	return 0
+}
+
+// isSortedResult returns true if the result rows are sorted by the sort header of the request.
+func (res *Response) isSortedResult(result ResultSet) bool {
+	for i := 1; i < len(result); i++ {
+		if res.compareRows(result[i-1], result[i]) > 0 {
+			return false
 		}
-		panic(fmt.Sprintf("sorting not implemented for type %s", sortType))
 	}
 	return true
 }
 
+// sortDirectionResult converts the ascending comparison of two values into a compareRows result.
+func sortDirectionResult(direction SortDirection, ascLess bool) int {
+	if ascLess == (direction == Asc) {
+		return -1
+	}
+	return 1
+}
+
 // Swap replaces two data rows while sorting.
 func (res *Response) Swap(i, j int) {
 	res.Result[i], res.Result[j] = res.Result[j], res.Result[i]
@@ -269,11 +539,11 @@ func (res *Response) PostProcessing() {
 		res.Result = make(ResultSet, 0)
 	}
 	// sort our result
-	if len(res.Request.Sort) > 0 {
+	if len(res.Request.Sort) > 0 && !res.resultSorted {
 		// skip sorting if there is only one backend requested and we want the default sort order
 		if len(res.Request.BackendsMap) >= 1 || !res.Request.IsDefaultSortOrder() {
 			t1 := time.Now()
-			sort.Sort(res)
+			res.sortResult()
 			duration := time.Since(t1)
 			logWith(res).Debugf("sorting result took %s", duration.String())
 		}
@@ -283,25 +553,28 @@ func (res *Response) PostProcessing() {
 		res.ResultTotal = len(res.Result)
 	}
 
-	// apply request offset
-	if res.Request.Offset > 0 {
-		if res.Request.Offset > res.ResultTotal {
-			res.Result = make(ResultSet, 0)
-		} else {
-			res.Result = res.Result[res.Request.Offset:]
+	res.Result = applyOffsetLimit(res.Request, res.Result)
+}
+
+// applyOffsetLimit returns the rows left after applying the request offset and limit. An offset at or
+// beyond the end returns no rows. The total is counted before, so it does not depend on the offset.
+func applyOffsetLimit[T any](req *Request, rows []T) []T {
+	if req.Offset > 0 {
+		if req.Offset >= len(rows) {
+			return rows[:0]
 		}
+		rows = rows[req.Offset:]
 	}
-
-	// apply request limit
-	if res.Request.Limit != nil && *res.Request.Limit >= 0 && *res.Request.Limit < len(res.Result) {
-		res.Result = res.Result[0:*res.Request.Limit]
+	if req.Limit != nil && *req.Limit >= 0 && *req.Limit < len(rows) {
+		rows = rows[:*req.Limit]
 	}
+	return rows
 }
 
 // CalculateFinalStats calculates final averages and sums from stats queries
-func (res *Response) CalculateFinalStats() {
+func (res *Response) CalculateFinalStats() error {
 	if len(res.Request.Stats) == 0 {
-		return
+		return nil
 	}
 	if res.Request.StatsResult == nil {
 		res.Request.StatsResult = NewResultSetStats()
@@ -312,25 +585,33 @@ func (res *Response) CalculateFinalStats() {
 	}
 	res.Result = make(ResultSet, len(res.Request.StatsResult.Stats))
 
+	// use a single backing array for all rows instead of allocating each row separately
+	numValues := 0
+	for _, stats := range res.Request.StatsResult.Stats {
+		numValues += len(stats) + hasColumns
+	}
+	values := make([]interface{}, numValues)
 	j := 0
 	for key, stats := range res.Request.StatsResult.Stats {
 		rowSize := len(stats)
 		rowSize += hasColumns
-		res.Result[j] = make([]interface{}, rowSize)
+		res.Result[j] = values[:rowSize:rowSize]
+		values = values[rowSize:]
 		if hasColumns > 0 {
-			parts := strings.Split(key, ListSepChar1)
-			for i := range parts {
+			parts := splitStatsKey(key)
+			for i := range parts[:min(len(parts), hasColumns)] {
 				res.Result[j][i] = &parts[i]
-				if i >= hasColumns {
-					break
-				}
 			}
 		}
 		for i := range stats {
 			s := stats[i]
 			i += hasColumns
 
-			res.Result[j][i] = finalStatsApply(s)
+			value, err := finalStatsApply(s)
+			if err != nil {
+				return err
+			}
+			res.Result[j][i] = value
 
 			if res.Request.SendStatsData {
 				res.Result[j][i] = []interface{}{s.Stats, s.StatsCount}
@@ -338,8 +619,8 @@ func (res *Response) CalculateFinalStats() {
 			}
 		}
 		j++
-		res.RowsScanned += res.Request.StatsResult.RowsScanned
 	}
+	res.RowsScanned += res.Request.StatsResult.RowsScanned
 
 	if hasColumns > 0 {
 		// Sort by stats key
@@ -347,12 +628,15 @@ func (res *Response) CalculateFinalStats() {
 		for i := range res.Request.Columns {
 			res.Request.Sort = append(res.Request.Sort, &SortField{Index: i, Group: true, Direction: Asc})
 		}
-		sort.Sort(res)
+		res.sortResult()
 	}
 	res.ResultTotal += len(res.Result)
+
+	return nil
 }
 
-func finalStatsApply(s *Filter) (res float64) {
+// finalStatsApply returns the final value of a stats column, ex.: the average of all values.
+func finalStatsApply(s *Filter) (res float64, err error) {
 	switch s.StatsType {
 	case Counter:
 		res = s.Stats
@@ -369,12 +653,12 @@ func finalStatsApply(s *Filter) (res float64) {
 			res = 0
 		}
 	default:
-		log.Panicf("not implemented")
+		return 0, fmt.Errorf("stats type %d is not supported", s.StatsType)
 	}
 	if s.StatsCount == 0 {
 		res = 0
 	}
-	return
+	return res, nil
 }
 
 // Send converts the result object to a livestatus answer and writes the resulting bytes back to the client.
@@ -391,43 +675,121 @@ func (res *Response) Send(c net.Conn) (size int64, err error) {
 	return
 }
 
+// fixed16MaxSize is the largest body size which fits into the 11 digits of the fixed16 header.
+const fixed16MaxSize = 99999999999
+
+// errFixed16Header is returned if the response code or size do not fit into the fixed16 header.
+var errFixed16Header = errors.New("response does not fit into the fixed16 header")
+
+// errResponseWrite is returned if the response has not been written completely. The client cannot
+// tell where the next response starts, so the connection must not be used anymore.
+var errResponseWrite = errors.New("response has not been written completely")
+
+// fixed16Header returns the fixed16 header for a response with the given code and body size.
+func fixed16Header(code int, size int64) (string, error) {
+	if code < 100 || code > 999 || size < 0 || size > fixed16MaxSize {
+		return "", fmt.Errorf("%w: code %d, size %d", errFixed16Header, code, size)
+	}
+	return fmt.Sprintf("%d %11d", code, size), nil
+}
+
 // SendFixed16 converts the result object to a livestatus answer and writes the resulting bytes back to the client.
+// Huge responses are buffered in a temporary file, since the size must be known before sending the header.
 func (res *Response) SendFixed16(c io.Writer) (size int64, err error) {
-	resBuffer, err := res.Buffer()
+	resBuffer := res.newSpillBuffer()
+	defer resBuffer.Close()
+
+	// compressed responses contain the final newline within the compressed data
+	compressed := res.Request.ResponseCompression && res.Error == nil
+	if compressed {
+		err = res.gzipBody(resBuffer)
+	} else {
+		err = res.writeBody(resBuffer)
+	}
 	if err != nil {
 		return
 	}
-	size = int64(resBuffer.Len())
-	headerFixed16 := fmt.Sprintf("%d %11d", res.Code, size+1)
-	logWith(res).Tracef("write: %s", headerFixed16)
+	size = resBuffer.Len()
+	bodySize := size + 1
+	if compressed {
+		bodySize = size
+	}
+	headerFixed16, err := fixed16Header(res.Code, bodySize)
+	if err != nil {
+		// a broken header would desynchronize the client, so send a small error response instead
+		logWith(res).Errorf("cannot send response: %s", err.Error())
+		errRes := &Response{Code: 500, Request: &Request{id: res.Request.id, ResponseFixed16: true}, Error: err}
+		return errRes.SendFixed16(c)
+	}
+	if compressed {
+		logWith(res).Tracef("write: %s (gzip)", headerFixed16)
+	} else {
+		logWith(res).Tracef("write: %s", headerFixed16)
+	}
 	_, err = fmt.Fprintf(c, "%s\n", headerFixed16)
 	if err != nil {
 		logWith(res).Warnf("write error: %s", err.Error())
-		return
+		return 0, fmt.Errorf("%w: %w", errResponseWrite, err)
 	}
-	if log.IsV(LogVerbosityTrace) {
+	if log.IsV(LogVerbosityTrace) && !compressed && !resBuffer.Spilled() {
 		logWith(res).Tracef("write: %s", resBuffer.Bytes())
 	}
 	written, err := resBuffer.WriteTo(c)
 	if err != nil {
 		logWith(res).Warnf("write error: %s", err.Error())
-		return
+		return written, fmt.Errorf("%w: %w", errResponseWrite, err)
 	}
 	if written != size {
 		logWith(res).Warnf("write error: written %d, size: %d", written, size)
-		return
+		return written, fmt.Errorf("%w: written %d of %d bytes", errResponseWrite, written, size)
+	}
+	if !compressed {
+		_, err = c.Write([]byte("\n"))
+		if err != nil {
+			logWith(res).Warnf("write error: %s", err.Error())
+			return size, fmt.Errorf("%w: %w", errResponseWrite, err)
+		}
 	}
-	_, err = c.Write([]byte("\n"))
 
 	return
 }
 
+// newSpillBuffer returns a buffer for the response which spills to a temporary file as configured.
+func (res *Response) newSpillBuffer() *SpillBuffer {
+	if res.Request.lmd == nil {
+		return NewSpillBuffer(0, "")
+	}
+	conf := res.Request.lmd.Config
+	return NewSpillBuffer(int64(conf.ResponseSpillThreshold)*1024*1024, conf.ResponseSpillDir)
+}
+
+// gzipBody writes the gzip compressed response including the final newline.
+func (res *Response) gzipBody(w io.Writer) error {
+	gz, err := gzip.NewWriterLevel(w, gzip.BestSpeed)
+	if err != nil {
+		return fmt.Errorf("gzip error: %w", err)
+	}
+	err = res.writeBody(gz)
+	if err != nil {
+		return err
+	}
+	_, err = gz.Write([]byte("\n"))
+	if err != nil {
+		return fmt.Errorf("gzip error: %w", err)
+	}
+	err = gz.Close()
+	if err != nil {
+		return fmt.Errorf("gzip error: %w", err)
+	}
+	return nil
+}
+
 // SendUnbuffered directly prints the result to the client connection
 func (res *Response) SendUnbuffered(c io.Writer) (size int64, err error) {
 	countingWriter := NewWriteCounter(c)
 	if res.Error != nil {
 		logWith(res).Warnf("sending error response: %d - %s", res.Code, res.Error.Error())
-		_, err = countingWriter.Write([]byte(res.Error.Error()))
+		_, err = countingWriter.Write([]byte(res.errorMessage()))
 		if err != nil {
 			return
 		}
@@ -452,16 +814,49 @@ func (res *Response) SendUnbuffered(c io.Writer) (size int64, err error) {
 // Buffer fills buffer with the response as bytes array
 func (res *Response) Buffer() (*bytes.Buffer, error) {
 	buf := new(bytes.Buffer)
+	return buf, res.writeBody(buf)
+}
+
+// writeBody writes the response without final newline
+func (res *Response) writeBody(w io.Writer) error {
 	if res.Error != nil {
 		logWith(res).Warnf("sending error response: %d - %s", res.Code, res.Error.Error())
-		buf.WriteString(res.Error.Error())
-		return buf, nil
+		_, err := w.Write([]byte(res.errorMessage()))
+		if err != nil {
+			return fmt.Errorf("write error: %w", err)
+		}
+		return nil
 	}
 
 	if res.Request.OutputFormat == OutputFormatWrappedJSON {
-		return buf, res.WrappedJSON(buf)
+		return res.WrappedJSON(w)
+	}
+	return res.JSON(w)
+}
+
+// responseErrorCode returns the response code for errors from building a response.
+func responseErrorCode(err error) int {
+	if _, ok := err.(net.Error); ok {
+		return 502
+	}
+	if peerErr, ok := err.(*PeerError); ok && peerErr.kind == ConnectionError {
+		return 502
+	}
+	if _, ok := err.(*QueryMemoryError); ok {
+		return 413
+	}
+	if errors.Is(err, errQueryShutdown) || errors.Is(err, errQueryOverloaded) {
+		return 503
+	}
+	if errors.Is(err, errQueryPanic) {
+		return 500
 	}
-	return buf, res.JSON(buf)
+	return 400
+}
+
+// errorMessage returns the error message along with the request id, so errors can be found in the log.
+func (res *Response) errorMessage() string {
+	return fmt.Sprintf("%s (request id: %s)", res.Error.Error(), res.Request.ID())
 }
 
 // JSON converts the response into a json structure
@@ -496,6 +891,11 @@ func (res *Response) WrappedJSON(buf io.Writer) error {
 	json := jsoniter.ConfigCompatibleWithStandardLibrary.BorrowStream(buf)
 	defer jsoniter.ConfigCompatibleWithStandardLibrary.ReturnStream(json)
 
+	var started time.Time
+	if res.trace != nil {
+		started = time.Now()
+	}
+
 	json.WriteRaw("{\"data\":\n[")
 	res.WriteDataResponse(json)
 	json.WriteRaw("]\n,\"failed\": {")
@@ -510,14 +910,54 @@ func (res *Response) WrappedJSON(buf io.Writer) error {
 	}
 	json.WriteObjectEnd()
 
+	if len(res.Stale) > 0 {
+		json.WriteRaw("\n,\"stale\": {")
+		num = 0
+		for k, v := range res.Stale {
+			if num > 0 {
+				json.WriteMore()
+			}
+			json.WriteObjectField(k)
+			json.WriteFloat64(v)
+			num++
+		}
+		json.WriteObjectEnd()
+	}
+
 	// add optional columns header as first row
 	if res.SendColumnsHeader() {
 		json.WriteRaw("\n,\"columns\":")
 		res.WriteColumnsResponse(json)
 	}
 
+	if res.Duplicates > 0 {
+		json.WriteRaw(fmt.Sprintf("\n,\"duplicates\":%d", res.Duplicates))
+	}
+
+	if res.WaitTimedOut {
+		json.WriteRaw("\n,\"wait_timeout\":true")
+	}
+
+	if res.trace != nil {
+		res.trace.serialization = time.Since(started)
+		json.WriteRaw("\n,\"trace\":")
+		res.trace.WriteJSON(json)
+	}
+
+	json.WriteRaw("\n,\"request_id\":")
+	json.WriteString(res.Request.ID())
 	json.WriteRaw(fmt.Sprintf("\n,\"rows_scanned\":%d", res.RowsScanned))
-	json.WriteRaw(fmt.Sprintf("\n,\"total_count\":%d}", res.ResultTotal))
+	if res.Request.RowsScannedByBackend {
+		json.WriteRaw("\n,\"rows_scanned_by_backend\":")
+		json.WriteVal(res.peerRowsScanned())
+	}
+	total := res.ResultTotal
+	if res.allBackendsFailed() {
+		// there is no data at all, signal the error besides the failed backends
+		json.WriteRaw("\n,\"code\":502")
+		total = 0
+	}
+	json.WriteRaw(fmt.Sprintf("\n,\"total_count\":%d}", total))
 	err := json.Flush()
 	if err != nil {
 		return fmt.Errorf("WrappedJSON: %w", err)
@@ -541,7 +981,7 @@ func (res *Response) WriteDataResponse(json *jsoniter.Stream) {
 				if k > 0 {
 					json.WriteMore()
 				}
-				json.WriteVal(res.Result[i][k])
+				writeJSONValue(json, res.Result[i][k])
 			}
 			json.WriteArrayEnd()
 		}
@@ -568,6 +1008,72 @@ func (res *Response) WriteDataResponse(json *jsoniter.Stream) {
 	}
 }
 
+// writeJSONValue writes a result value with the typed stream writers and only uses
+// reflection for unknown types. The output is the same as from WriteVal, ex.: strings are html escaped.
+func writeJSONValue(json *jsoniter.Stream, value interface{}) {
+	switch val := value.(type) {
+	case nil:
+		json.WriteNil()
+	case string:
+		json.WriteStringWithHTMLEscaped(val)
+	case *string:
+		if val == nil {
+			json.WriteNil()
+			return
+		}
+		json.WriteStringWithHTMLEscaped(*val)
+	case float64:
+		json.WriteFloat64(val)
+	case int:
+		json.WriteInt(val)
+	case int64:
+		json.WriteInt64(val)
+	case bool:
+		json.WriteBool(val)
+	case []string:
+		if val == nil {
+			json.WriteNil()
+			return
+		}
+		json.WriteArrayStart()
+		for i, s := range val {
+			if i > 0 {
+				json.WriteMore()
+			}
+			json.WriteStringWithHTMLEscaped(s)
+		}
+		json.WriteArrayEnd()
+	case []int64:
+		if val == nil {
+			json.WriteNil()
+			return
+		}
+		json.WriteArrayStart()
+		for i, v := range val {
+			if i > 0 {
+				json.WriteMore()
+			}
+			json.WriteInt64(v)
+		}
+		json.WriteArrayEnd()
+	case []interface{}:
+		if val == nil {
+			json.WriteNil()
+			return
+		}
+		json.WriteArrayStart()
+		for i, v := range val {
+			if i > 0 {
+				json.WriteMore()
+			}
+			writeJSONValue(json, v)
+		}
+		json.WriteArrayEnd()
+	default:
+		json.WriteVal(value)
+	}
+}
+
 // WriteDataResponseRowLocked appends each row but locks the peer before doing so. We don't have to lock for each column then
 func (res *Response) WriteDataResponseRowLocked(json *jsoniter.Stream) {
 	for i := range res.RawResults.DataResult {
@@ -614,15 +1120,39 @@ func (res *Response) buildLocalResponse(ctx context.Context, stores map[*Peer]*D
 	var resultcollector chan *PeerResponse
 	var waitChan chan bool
 	if len(res.Request.Stats) == 0 {
-		waitChan = make(chan bool)
+		waitChan = make(chan bool, 1)
 		resultcollector = make(chan *PeerResponse, len(res.SelectedPeers))
+		// the collector keeps its own references, the response might drop the result set on cancellation
+		result := res.RawResults
+		buffer := result.buffer
 		go func() {
-			result := res.RawResults
+			// remember the size of each backend result if they are sorted already
+			var sortedRuns []int
+			if res.Request.IsNaturalSortOrder() {
+				sortedRuns = make([]int, 0, len(res.SelectedPeers))
+			}
 			for subRes := range resultcollector {
+				if ctx.Err() != nil {
+					// query canceled, skip remaining results
+					subRes.release()
+					continue
+				}
+				// the rows itself have been accounted already, only the references are added here
+				res.memory.Reserve(int64(len(subRes.Rows)) * int64(unsafe.Sizeof((*DataRow)(nil))))
 				result.Total += subRes.Total
 				result.RowsScanned += subRes.RowsScanned
+				result.PeerScanned = addPeerRowsScanned(result.PeerScanned, subRes.PeerKey, subRes.RowsScanned)
 				result.DataResult = append(result.DataResult, subRes.Rows...)
+				if sortedRuns != nil {
+					sortedRuns = append(sortedRuns, len(subRes.Rows))
+				}
+				subRes.release()
 			}
+			if buffer != nil {
+				// keep the complete slice, offsets are applied later
+				*buffer = result.DataResult
+			}
+			result.sortedRuns = sortedRuns
 			waitChan <- true
 		}()
 	}
@@ -631,6 +1161,7 @@ func (res *Response) buildLocalResponse(ctx context.Context, stores map[*Peer]*D
 	for i := range res.SelectedPeers {
 		p := res.SelectedPeers[i]
 		p.StatusSet(LastQuery, currentUnixTime())
+		p.countClientQuery()
 
 		store, ok := stores[p]
 		if !ok {
@@ -645,11 +1176,16 @@ func (res *Response) buildLocalResponse(ctx context.Context, stores map[*Peer]*D
 
 		waitgroup.Add(1)
 		go func(peer *Peer, wg *sync.WaitGroup) {
-			// make sure we log panics properly
-			defer logPanicExitPeer(peer)
+			// a panic only fails this query
+			defer res.recoverQueryPanic()
 
 			defer wg.Done()
 
+			if !res.acquireResponseWorker(ctx, peer) {
+				return
+			}
+			defer res.Request.lmd.responseWorkers.Release()
+
 			res.buildLocalResponseData(ctx, store, resultcollector)
 		}(p, waitgroup)
 	}
@@ -661,12 +1197,97 @@ func (res *Response) buildLocalResponse(ctx context.Context, stores map[*Peer]*D
 		select {
 		case <-waitChan:
 		case <-ctx.Done():
+			// the collector might still append rows, never put this buffer back into the pool
+			// and leave the abandoned result set to the collector
+			res.RawResults.disown()
+			res.RawResults = &RawResultSet{Sort: res.RawResults.Sort}
 		}
 	}
 
 	logWith(res).Tracef("waiting for all local data computations done")
 }
 
+// peerRowsScanned returns the number of scanned rows per peer id.
+func (res *Response) peerRowsScanned() map[string]int {
+	scanned := make(map[string]int)
+	if len(res.Request.Stats) > 0 {
+		if res.Request.StatsResult != nil {
+			maps.Copy(scanned, res.Request.StatsResult.PeerScanned)
+		}
+	} else if res.RawResults != nil {
+		maps.Copy(scanned, res.RawResults.PeerScanned)
+	}
+	return scanned
+}
+
+// observePeerResponseDuration updates the duration of building the result of a single peer.
+func (res *Response) observePeerResponseDuration(peerKey, peerName string, table TableName, start time.Time) {
+	duration := time.Since(start)
+	promPeerResponseDuration.WithLabelValues(peerName, table.String()).Observe(duration.Seconds())
+	res.trace.AddPeerDuration(peerKey, peerName, duration)
+	if peerName == "" {
+		return
+	}
+	res.Lock.Lock()
+	if res.peerDurations == nil {
+		res.peerDurations = make(map[string]time.Duration)
+	}
+	res.peerDurations[peerName] += duration
+	res.Lock.Unlock()
+}
+
+// buildSchemaResponse builds the result for schema tables from a single local store which does not require any backend.
+func (res *Response) buildSchemaResponse(ctx context.Context, table *Table) {
+	var store *DataStore
+	switch table.Name {
+	case TableColumns:
+		store = GetTableColumnsStoreForPeers(table, res.columnsPeers)
+	case TableTables:
+		// estimating the size requires walking through all rows of all stores
+		store = GetTableTablesStoreForPeers(table, res.columnsPeers, res.Request.usesColumn("size_bytes_estimate"))
+	case TableSlowqueries:
+		store = GetTableSlowqueriesStoreForLog(table, res.Request.lmd.slowQueries, res.Request.AuthUser)
+	case TableQueries:
+		store = GetTableQueriesStoreForRegistry(table, res.Request.lmd.runningQueries, res.Request.AuthUser)
+	case TableNodes:
+		store = GetTableNodesStoreForNodes(table, res.Request.lmd.nodeAccessor)
+	default:
+		log.Panicf("buildSchemaResponse not implemented for table: %s", table.Name)
+	}
+
+	res.RawResults = &RawResultSet{}
+	res.RawResults.Sort = res.Request.Sort
+	resultcollector := make(chan *PeerResponse, 1)
+	res.buildLocalResponseData(ctx, store, resultcollector)
+	if len(res.Request.Stats) == 0 {
+		select {
+		case subRes := <-resultcollector:
+			res.RawResults.Total = subRes.Total
+			res.RawResults.RowsScanned = subRes.RowsScanned
+			res.RawResults.DataResult = subRes.Rows
+		default:
+		}
+	}
+	res.RawResults.PostProcessing(res)
+}
+
+// waitTriggerAll waits for the trigger of all selected peers in parallel
+func (res *Response) waitTriggerAll(ctx context.Context) {
+	waitgroup := &sync.WaitGroup{}
+	for i := range res.SelectedPeers {
+		p := res.SelectedPeers[i]
+		waitgroup.Add(1)
+		go func(peer *Peer) {
+			// make sure we log panics properly
+			defer logPanicExitPeer(peer)
+			defer waitgroup.Done()
+
+			res.waitTrigger(ctx, peer)
+		}(p)
+	}
+	waitgroup.Wait()
+}
+
 // waitTrigger waits till all trigger are fulfilled
 func (res *Response) waitTrigger(ctx context.Context, p *Peer) {
 	// if a WaitTrigger is supplied, wait max ms till the condition is true
@@ -674,7 +1295,13 @@ func (res *Response) waitTrigger(ctx context.Context, p *Peer) {
 		return
 	}
 
-	p.WaitCondition(ctx, res.Request)
+	if p.WaitCondition(ctx, res.Request) {
+		// return current data anyway, like livestatus does
+		logWith(res, p).Debugf("wait condition timed out after %s", p.lmd.Config.GetWaitTimeout(res.Request.WaitTimeout))
+		res.Lock.Lock()
+		res.WaitTimedOut = true
+		res.Lock.Unlock()
+	}
 
 	// peer might have gone down meanwhile, ex. after waiting for a waittrigger, so check again
 	_, err := p.GetDataStore(res.Request.Table)
@@ -696,30 +1323,19 @@ func (res *Response) MergeStats(stats *ResultSetStats) {
 	if res.Request.StatsResult == nil {
 		res.Request.StatsResult = NewResultSetStats()
 	}
-	// apply stats queries
-	for key, stats := range stats.Stats {
-		if _, ok := res.Request.StatsResult.Stats[key]; !ok {
-			res.Request.StatsResult.Stats[key] = stats
-		} else {
-			for i := range stats {
-				s := stats[i]
-				res.Request.StatsResult.Stats[key][i].ApplyValue(s.Stats, s.StatsCount)
-			}
-		}
-	}
-	res.Request.StatsResult.Total += stats.Total
-	res.Request.StatsResult.RowsScanned += stats.RowsScanned
+	res.Request.StatsResult.Merge(stats)
 }
 
 // BuildPassThroughResult passes a query transparently to one or more remote sites and builds the response
 // from that.
-func (res *Response) BuildPassThroughResult() {
+func (res *Response) BuildPassThroughResult(ctx context.Context) {
 	res.Result = make(ResultSet, 0)
 
 	// build columns list
 	backendColumns := []string{}
 	virtualColumns := []*Column{}
 	columnsIndex := make(map[*Column]int)
+	rowColumns := []string{} // all columns of a result row, used for forwarded queries
 	for i := range res.Request.RequestColumns {
 		col := res.Request.RequestColumns[i]
 		if col.StorageType == VirtualStore {
@@ -728,14 +1344,20 @@ func (res *Response) BuildPassThroughResult() {
 			backendColumns = append(backendColumns, col.Name)
 		}
 		columnsIndex[col] = i
+		rowColumns = append(rowColumns, col.Name)
 	}
 	for i := range res.Request.Sort {
 		s := res.Request.Sort[i]
+		if len(res.Request.Stats) > 0 {
+			// stats results are sorted by their group columns
+			break
+		}
 		if j, ok := columnsIndex[s.Column]; ok {
 			// sort column does exist in the request columns
 			s.Index = j
 		} else {
 			s.Index = len(backendColumns) + len(virtualColumns)
+			rowColumns = append(rowColumns, s.Column.Name)
 			if s.Column.StorageType == VirtualStore {
 				virtualColumns = append(virtualColumns, s.Column)
 			} else {
@@ -744,16 +1366,26 @@ func (res *Response) BuildPassThroughResult() {
 		}
 	}
 	req := res.Request
-	passthroughRequest := &Request{
-		Table:           req.Table,
-		Filter:          req.Filter,
-		Stats:           req.Stats,
-		Columns:         backendColumns,
-		Limit:           req.Limit,
-		OutputFormat:    OutputFormatJSON,
-		ResponseFixed16: true,
-		AuthUser:        req.AuthUser,
-	}
+	numBackendColumns := len(backendColumns)
+	dedupIndexes := res.passthroughDedupIndexes(columnsIndex, &backendColumns, len(virtualColumns))
+	rowColumns = append(rowColumns, backendColumns[numBackendColumns:]...)
+	sortFields, limit := res.passthroughSortLimit()
+	numResults := len(res.SelectedPeers) + len(res.passthroughNodes)
+	res.passthroughResults = make([]ResultSet, numResults)
+	res.passthroughTotals = make([]int, numResults)
+	for i := range res.passthroughTotals {
+		res.passthroughTotals[i] = -1
+	}
+	res.passthroughDone = make([]bool, numResults)
+
+	// hanging backends must not block the whole response
+	peerCtx := ctx
+	if timeout := req.lmd.Config.PassThroughTimeout; timeout > 0 {
+		var cancel context.CancelFunc
+		peerCtx, cancel = context.WithTimeout(ctx, time.Duration(timeout)*time.Second)
+		defer cancel()
+	}
+	deadline, _ := peerCtx.Deadline()
 
 	waitgroup := &sync.WaitGroup{}
 
@@ -762,28 +1394,700 @@ func (res *Response) BuildPassThroughResult() {
 
 		if !p.isOnline() {
 			res.Lock.Lock()
-			res.Failed[p.ID] = fmt.Sprintf("%v", p.StatusGet(LastError))
+			res.Failed[p.ID] = p.getError()
 			res.Lock.Unlock()
 			continue
 		}
 
+		// each peer needs its own request, federated sub peers set their own backends header
+		stats, countIndex := res.passthroughStats(p)
+		passthroughRequest := &Request{
+			Table:           req.Table,
+			Filter:          req.Filter,
+			Stats:           stats,
+			SendStatsData:   len(stats) > 0 && (p.HasFlag(LMD) || p.HasFlag(LMDSub)),
+			Columns:         backendColumns,
+			Sort:            sortFields,
+			Limit:           limit,
+			OutputFormat:    OutputFormatJSON,
+			ResponseFixed16: true,
+			AuthUser:        req.AuthUser,
+			passthrough:     true,
+			deadline:        deadline,
+			abort:           peerCtx.Done(),
+		}
+		if len(sortFields) > 0 && p.sortUnsupported() {
+			passthroughRequest.Sort = nil
+			passthroughRequest.Limit = nil
+		}
+
 		waitgroup.Add(1)
-		go func(peer *Peer, wg *sync.WaitGroup) {
+		go func(peer *Peer, num int, wg *sync.WaitGroup) {
 			// make sure we log panics properly
 			defer logPanicExitPeer(peer)
 
-			logWith(peer, passthroughRequest).Debugf("starting passthrough request")
 			defer wg.Done()
 
-			peer.PassThroughQuery(res, passthroughRequest, virtualColumns, columnsIndex)
-		}(p, waitgroup)
+			if !res.acquireResponseWorker(peerCtx, peer) {
+				return
+			}
+			defer res.Request.lmd.responseWorkers.Release()
+
+			logWith(peer, passthroughRequest).Debugf("starting passthrough request")
+			peer.countClientQuery()
+			peer.PassThroughQuery(peerCtx, res, num, passthroughRequest, virtualColumns, columnsIndex, countIndex)
+		}(p, i, waitgroup)
 	}
-	logWith(passthroughRequest).Tracef("waiting...")
-	waitgroup.Wait()
-	logWith(passthroughRequest).Debugf("waiting for passed through requests done")
-}
 
-// SendColumnsHeader determines if the response should contain the columns header
+	// backends of other cluster nodes are answered by those nodes
+	for i, forward := range res.passthroughNodes {
+		waitgroup.Add(1)
+		go func(forward *passthroughNode, num int, wg *sync.WaitGroup) {
+			defer req.lmd.logPanicExit()
+			defer wg.Done()
+
+			res.passThroughForward(forward, num, rowColumns)
+		}(forward, len(res.SelectedPeers)+i, waitgroup)
+	}
+	logWith(res).Tracef("waiting...")
+	done := make(chan bool)
+	go func() {
+		waitgroup.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		logWith(res).Debugf("waiting for passed through requests done")
+	case <-peerCtx.Done():
+		res.closePassThrough(peerCtx.Err())
+	}
+
+	if len(req.Stats) > 0 {
+		return
+	}
+	if res.memory.Exceeded() {
+		return
+	}
+	res.ResultTotal = res.passthroughTotal()
+	// merged results only add the references to the rows
+	numRows := 0
+	for _, result := range res.passthroughResults {
+		numRows += len(result)
+	}
+	res.memory.Reserve(int64(numRows) * int64(unsafe.Sizeof([]interface{}(nil))))
+	if len(req.Sort) > 0 {
+		maxRows := -1
+		if req.Limit != nil && *req.Limit >= 0 && len(dedupIndexes) == 0 {
+			maxRows = *req.Limit + req.Offset
+		}
+		res.Result = res.mergeSortedResults(res.passthroughResults, maxRows)
+		res.resultSorted = true
+	} else {
+		for _, result := range res.passthroughResults {
+			res.Result = append(res.Result, result...)
+		}
+	}
+	res.dedupPassThroughResult(dedupIndexes)
+	res.stripPassThroughColumns()
+}
+
+// passthroughDedupIndexes returns the row indexes of the columns used to detect duplicate rows.
+// Dedup columns which are not requested are appended to the backend columns.
+func (res *Response) passthroughDedupIndexes(columnsIndex map[*Column]int, backendColumns *[]string, numVirtual int) (indexes []int) {
+	req := res.Request
+	if !req.lmd.Config.PassThroughDedup || len(req.Stats) > 0 {
+		return nil
+	}
+	table := Objects.Tables[req.Table]
+	for _, name := range req.lmd.Config.PassThroughDedupColumns {
+		col := table.GetColumn(name)
+		if col == nil || col.StorageType == VirtualStore {
+			continue
+		}
+		index, ok := columnsIndex[col]
+		if !ok {
+			index = len(*backendColumns) + numVirtual
+			*backendColumns = append(*backendColumns, col.Name)
+		}
+		indexes = append(indexes, index)
+	}
+	return indexes
+}
+
+// passthroughDedupHash creates the hash used to find duplicate passthrough rows.
+var passthroughDedupHash = fnv.New64a
+
+// dedupPassThroughResult removes rows with identical values in the dedup columns, ex.: log entries
+// received directly and through a federated lmd. Only PassThroughDedupMaxEntries rows are tracked,
+// remaining rows are kept unchanged once this limit is reached.
+func (res *Response) dedupPassThroughResult(indexes []int) {
+	if len(indexes) == 0 {
+		return
+	}
+	maxEntries := res.Request.lmd.Config.PassThroughDedupMaxEntries
+	// rows are grouped by the hash of their dedup values, rows within a group are compared by value
+	seen := make(map[uint64][][]interface{})
+	numSeen := 0
+	hash := passthroughDedupHash()
+	result := res.Result[:0]
+	for i, row := range res.Result {
+		if numSeen >= maxEntries {
+			logWith(res).Warnf("passthrough deduplication stopped after %d rows, consider increasing PassThroughDedupMaxEntries", maxEntries)
+			result = append(result, res.Result[i:]...)
+			break
+		}
+		hash.Reset()
+		for _, j := range indexes {
+			_, _ = hash.Write([]byte(interface2stringNoDedup(row[j])))
+			_, _ = hash.Write([]byte(ListSepChar1))
+		}
+		key := hash.Sum64()
+		if containsDedupRow(seen[key], row, indexes) {
+			res.Duplicates++
+			continue
+		}
+		seen[key] = append(seen[key], row)
+		numSeen++
+		result = append(result, row)
+	}
+	res.Result = result
+	if res.Duplicates > 0 {
+		logWith(res).Debugf("removed %d duplicate passthrough rows", res.Duplicates)
+		res.ResultTotal -= res.Duplicates
+		if res.ResultTotal < len(res.Result) {
+			res.ResultTotal = len(res.Result)
+		}
+	}
+}
+
+// containsDedupRow returns true if one of the rows has the same values in the dedup columns as row.
+func containsDedupRow(rows [][]interface{}, row []interface{}, indexes []int) bool {
+	for _, other := range rows {
+		same := true
+		for _, j := range indexes {
+			if interface2stringNoDedup(other[j]) != interface2stringNoDedup(row[j]) {
+				same = false
+				break
+			}
+		}
+		if same {
+			return true
+		}
+	}
+	return false
+}
+
+// stripPassThroughColumns removes the sort and dedup columns which have been appended to the
+// requested columns, so they are not sent to the client.
+func (res *Response) stripPassThroughColumns() {
+	numColumns := len(res.Request.RequestColumns)
+	for i, row := range res.Result {
+		if len(row) > numColumns {
+			res.Result[i] = row[:numColumns:numColumns]
+		}
+	}
+}
+
+// passThroughAbortMessage returns the failed message for backends of aborted passthrough queries.
+func passThroughAbortMessage(err error) string {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return "timeout: backend did not answer in time"
+	}
+	return "request canceled"
+}
+
+// closePassThrough marks all unfinished passthrough queries as failed and drops their late results,
+// so the response can be sent with the results of the remaining backends.
+func (res *Response) closePassThrough(err error) {
+	msg := passThroughAbortMessage(err)
+	res.Lock.Lock()
+	defer res.Lock.Unlock()
+	res.passthroughClosed = true
+	for i, p := range res.SelectedPeers {
+		if res.passthroughDone[i] {
+			continue
+		}
+		if _, ok := res.Failed[p.ID]; ok {
+			continue
+		}
+		logWith(res, p).Debugf("passthrough query failed: %s", msg)
+		res.Failed[p.ID] = msg
+	}
+	for i, forward := range res.passthroughNodes {
+		if res.passthroughDone[len(res.SelectedPeers)+i] {
+			continue
+		}
+		logWith(res).Debugf("forwarded passthrough query to node %s failed: %s", forward.node, msg)
+		for _, id := range forward.backends {
+			if _, ok := res.Failed[id]; !ok {
+				res.Failed[id] = msg
+			}
+		}
+	}
+}
+
+// setPassThroughFailed records the error of the passthrough query of the selected peer num.
+func (res *Response) setPassThroughFailed(num int, p *Peer, msg string) {
+	res.Lock.Lock()
+	defer res.Lock.Unlock()
+	if res.passthroughClosed {
+		return
+	}
+	res.passthroughDone[num] = true
+	res.Failed[p.ID] = msg
+}
+
+// setUnhandledBackendsFailed marks the requested backends as failed which are not answered by any
+// cluster node, so they do not silently return an empty result. Requests sent by other nodes are
+// only answered for the own backends, all other backends are marked as failed.
+func (res *Response) setUnhandledBackendsFailed(foreignBackends []string) {
+	req := res.Request
+	if req.lmd.nodeAccessor == nil || !req.lmd.nodeAccessor.IsClustered() || !req.backendsRequired() {
+		return
+	}
+	if req.distributed {
+		for _, id := range foreignBackends {
+			res.Failed[id] = errBackendNotThisNode.Error()
+		}
+		return
+	}
+	for _, id := range req.unhandledBackends(req.lmd.nodeAccessor.NodeBackends()) {
+		res.Failed[id] = errBackendNotHandled.Error()
+	}
+}
+
+// setAllBackendsFailedCode sets the code 502 for wrapped_json responses without any data because all
+// backends failed. Other output formats return an error instead.
+func (res *Response) setAllBackendsFailedCode() {
+	if res.Code == 200 && res.Request.OutputFormat == OutputFormatWrappedJSON && res.allBackendsFailed() {
+		res.Code = 502
+	}
+}
+
+// allBackendsFailed returns true if all selected backends have failed, so the result contains
+// no data at all.
+func (res *Response) allBackendsFailed() bool {
+	if len(res.Failed) == 0 {
+		return false
+	}
+	req := res.Request
+	req.lmd.PeerMapLock.RLock()
+	defer req.lmd.PeerMapLock.RUnlock()
+	for id := range req.BackendsMap {
+		if p, ok := req.lmd.PeerMap[id]; ok && p.HasFlag(MultiBackend) {
+			continue
+		}
+		if _, ok := res.Failed[id]; !ok {
+			return false
+		}
+	}
+
+	return true
+}
+
+// passthroughForeignNodes returns the cluster nodes answering the requested backends which are
+// not handled by this node. Requests sent by other nodes are always answered locally.
+func (res *Response) passthroughForeignNodes() (nodes []*passthroughNode) {
+	req := res.Request
+	nodeAccessor := req.lmd.nodeAccessor
+	if req.distributed || nodeAccessor == nil || !nodeAccessor.IsClustered() {
+		return nil
+	}
+	for nodeID, nodeBackends := range nodeAccessor.NodeBackends() {
+		node := nodeAccessor.Node(nodeID)
+		if node.isMe {
+			continue
+		}
+		backends := []string{}
+		for _, id := range nodeBackends {
+			if _, ok := req.BackendsMap[id]; ok {
+				backends = append(backends, id)
+			}
+		}
+		if len(backends) > 0 {
+			nodes = append(nodes, &passthroughNode{node: node, backends: backends})
+		}
+	}
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i].node.id < nodes[j].node.id })
+	return nodes
+}
+
+// passThroughForward sends the passthrough query for the backends of another cluster node to this
+// node. The result rows contain the given columns, so they can be merged with the local results.
+// Errors are recorded for all backends of that node.
+func (res *Response) passThroughForward(forward *passthroughNode, num int, columns []string) {
+	req := res.Request
+	if len(req.Stats) > 0 {
+		columns = req.Columns
+	}
+	requestData := req.buildDistributedRequestData(forward.backends, columns)
+	var result *distributedResult
+	done := make(chan bool)
+	err := req.lmd.nodeAccessor.SendQuery(forward.node, "table", requestData, func(responseData interface{}) {
+		defer close(done)
+		result, _ = parseDistributedResult(responseData)
+	})
+	if err == nil {
+		<-done
+		if result == nil {
+			err = fmt.Errorf("invalid response")
+		}
+	}
+	if err != nil {
+		logWith(res).Debugf("forwarded passthrough query to node %s failed: %s", forward.node, err.Error())
+		res.setPassThroughNodeFailed(num, forward, fmt.Sprintf("cluster node %s:%d failed: %s", forward.node.ip, forward.node.port, err.Error()))
+		return
+	}
+
+	res.Lock.Lock()
+	if !res.passthroughClosed {
+		for id, msg := range result.failed {
+			res.Failed[id] = msg
+		}
+	}
+	res.Lock.Unlock()
+
+	if len(req.Stats) > 0 {
+		// stats are returned as raw stats and count pairs
+		res.mergePassThroughStats(num, result.rows, -1)
+		return
+	}
+	total := result.total
+	if total < len(result.rows) {
+		total = -1
+	}
+	res.setPassThroughResult(num, result.rows, total)
+}
+
+// setPassThroughNodeFailed records the error of a forwarded passthrough query for all backends of that node.
+func (res *Response) setPassThroughNodeFailed(num int, forward *passthroughNode, msg string) {
+	res.Lock.Lock()
+	defer res.Lock.Unlock()
+	if res.passthroughClosed {
+		return
+	}
+	res.passthroughDone[num] = true
+	for _, id := range forward.backends {
+		res.Failed[id] = msg
+	}
+}
+
+// setPassThroughResult stores the result of the passthrough query of the selected peer num.
+func (res *Response) setPassThroughResult(num int, result ResultSet, total int) {
+	res.Lock.Lock()
+	defer res.Lock.Unlock()
+	if res.passthroughClosed {
+		return
+	}
+	res.passthroughDone[num] = true
+	if !res.memory.Reserve(resultSetSizeEstimate(result)) {
+		// query has been canceled, drop the result right away
+		return
+	}
+	res.passthroughResults[num] = result
+	res.passthroughTotals[num] = total
+}
+
+// passthroughSortLimit returns the sort header and the limit which can be passed to the backends.
+// Backends can only apply the limit if they sort the result the same way, so all sort columns
+// must be backend columns. The offset is applied after merging all results.
+func (res *Response) passthroughSortLimit() (sortFields []*SortField, limit *int) {
+	req := res.Request
+	if len(req.Stats) > 0 {
+		// limits are not applied to stats queries, same as for local tables
+		return nil, nil
+	}
+	for _, s := range req.Sort {
+		if s.Group || s.Column == nil || s.Column.StorageType == VirtualStore {
+			return nil, nil
+		}
+	}
+	if req.Limit != nil && *req.Limit >= 0 {
+		peerLimit := *req.Limit + req.Offset
+		limit = &peerLimit
+	}
+	return req.Sort, limit
+}
+
+// passthroughStats returns the stats header for the passthrough query of given peer.
+// Averages can only be merged weighted by their number of rows. Other lmd backends return
+// the raw stats and count pairs. For all other backends the averages are replaced by sums and
+// an extra counter for the number of rows is appended, its position is returned as countIndex.
+func (res *Response) passthroughStats(p *Peer) (stats []*Filter, countIndex int) {
+	req := res.Request
+	countIndex = -1
+	if len(req.Stats) == 0 || p.HasFlag(LMD) || p.HasFlag(LMDSub) {
+		return req.Stats, countIndex
+	}
+	counter := res.passthroughCounter()
+	if counter == nil {
+		return req.Stats, countIndex
+	}
+	stats = make([]*Filter, 0, len(req.Stats)+1)
+	for _, s := range req.Stats {
+		if s.StatsType == Average {
+			s = &Filter{Column: s.Column, StatsType: Sum, StatsPos: s.StatsPos}
+		}
+		stats = append(stats, s)
+	}
+	countIndex = len(stats)
+	stats = append(stats, counter)
+	return stats, countIndex
+}
+
+// passthroughCounter returns a stats counter matching all rows of the requested table
+// or nil if the table has no time column.
+func (res *Response) passthroughCounter() *Filter {
+	timeCol := Objects.Tables[res.Request.Table].GetColumn("time")
+	if timeCol == nil {
+		return nil
+	}
+	return &Filter{Column: timeCol, Operator: GreaterThan, StrValue: "0", StatsType: Counter}
+}
+
+// passthroughCountRequest returns the request counting all matching rows of a limited
+// passthrough query. It returns nil if the exact total is not required, which is the case
+// unless PassThroughExactTotal is enabled and the total count is sent to the client.
+func (res *Response) passthroughCountRequest(passthroughRequest *Request) *Request {
+	req := res.Request
+	if !req.lmd.Config.PassThroughExactTotal || req.OutputFormat != OutputFormatWrappedJSON {
+		return nil
+	}
+	if passthroughRequest.Limit == nil || len(passthroughRequest.Stats) > 0 {
+		// unlimited results contain all rows anyway
+		return nil
+	}
+	counter := res.passthroughCounter()
+	if counter == nil {
+		return nil
+	}
+	return &Request{
+		Table:           req.Table,
+		Filter:          req.Filter,
+		Stats:           []*Filter{counter},
+		OutputFormat:    OutputFormatJSON,
+		ResponseFixed16: true,
+		AuthUser:        req.AuthUser,
+		passthrough:     true,
+		deadline:        passthroughRequest.deadline,
+		abort:           passthroughRequest.abort,
+	}
+}
+
+// passthroughTotal returns the total number of matching rows of all successful backends.
+// Backends without exact total contribute the number of returned rows.
+func (res *Response) passthroughTotal() (total int) {
+	for i, result := range res.passthroughResults {
+		if res.passthroughTotals[i] >= 0 {
+			total += res.passthroughTotals[i]
+			continue
+		}
+		total += len(result)
+	}
+	return total
+}
+
+// mergePassThroughStats merges the stats rows of a single backend into the stats result.
+// Rows are keyed by their group columns, so groups from different backends are combined.
+func (res *Response) mergePassThroughStats(num int, result ResultSet, countIndex int) {
+	req := res.Request
+	numColumns := len(req.RequestColumns)
+	res.Lock.Lock()
+	defer res.Lock.Unlock()
+	if res.passthroughClosed {
+		return
+	}
+	res.passthroughDone[num] = true
+	if req.StatsResult == nil {
+		req.StatsResult = NewResultSetStats()
+	}
+	for _, row := range result {
+		if len(row) < numColumns+len(req.Stats) {
+			continue
+		}
+		keyValues := make([]string, numColumns)
+		for i := range keyValues {
+			keyValues[i] = interface2stringNoDedup(row[i])
+		}
+		key := statsKey(keyValues)
+		stats, ok := req.StatsResult.Stats[key]
+		if !ok {
+			stats = createLocalStatsCopy(req.Stats)
+			req.StatsResult.Stats[key] = stats
+		}
+		rowCount := -1
+		if countIndex >= 0 && len(row) > numColumns+countIndex {
+			rowCount = interface2int(row[numColumns+countIndex])
+		}
+		for i := range req.Stats {
+			switch val := row[numColumns+i].(type) {
+			case []interface{}:
+				// raw stats and count pairs from lmd backends
+				if len(val) == 2 && interface2int(val[1]) > 0 {
+					stats[i].ApplyValue(interface2float64(val[0]), interface2int(val[1]))
+				}
+			default:
+				value := interface2float64(val)
+				switch {
+				case req.Stats[i].StatsType == Counter:
+					stats[i].ApplyValue(value, int(value))
+				case rowCount == 0:
+					// no matching rows on this backend
+				case rowCount > 0:
+					stats[i].ApplyValue(value, rowCount)
+				default:
+					stats[i].ApplyValue(value, 1)
+				}
+			}
+		}
+	}
+}
+
+// mergeSortedResults merges the sorted results of all backends with a k-way merge.
+// Merging stops after maxRows rows unless maxRows is negative.
+func (res *Response) mergeSortedResults(results []ResultSet, maxRows int) ResultSet {
+	merge := &resultMergeHeap{res: res}
+	total := 0
+	for i, result := range results {
+		total += len(result)
+		if len(result) > 0 {
+			merge.items = append(merge.items, resultMergeItem{rows: result, num: i})
+		}
+	}
+	if maxRows < 0 || maxRows > total {
+		maxRows = total
+	}
+	heap.Init(merge)
+	merged := make(ResultSet, 0, maxRows)
+	for merge.Len() > 0 && len(merged) < maxRows {
+		top := &merge.items[0]
+		merged = append(merged, top.rows[0])
+		top.rows = top.rows[1:]
+		if len(top.rows) == 0 {
+			heap.Pop(merge)
+			continue
+		}
+		heap.Fix(merge, 0)
+	}
+	return merged
+}
+
+// resultMergeItem contains the remaining sorted rows of a single backend.
+type resultMergeItem struct {
+	rows ResultSet
+	num  int // position of the backend, used to keep the merge stable
+}
+
+// resultMergeHeap implements heap.Interface to merge sorted backend results.
+type resultMergeHeap struct {
+	res   *Response
+	items []resultMergeItem
+}
+
+func (h *resultMergeHeap) Len() int { return len(h.items) }
+
+func (h *resultMergeHeap) Less(i, j int) bool {
+	cmp := h.res.compareRows(h.items[i].rows[0], h.items[j].rows[0])
+	if cmp == 0 {
+		return h.items[i].num < h.items[j].num
+	}
+	return cmp < 0
+}
+
+func (h *resultMergeHeap) Swap(i, j int) { h.items[i], h.items[j] = h.items[j], h.items[i] }
+
+func (h *resultMergeHeap) Push(x interface{}) {
+	h.items = append(h.items, x.(resultMergeItem))
+}
+
+func (h *resultMergeHeap) Pop() interface{} {
+	last := h.items[len(h.items)-1]
+	h.items = h.items[:len(h.items)-1]
+	return last
+}
+
+// recoverQueryPanic recovers from a panic in one of the workers of this query. The query is canceled
+// and answered with an error instead of taking down the whole daemon.
+func (res *Response) recoverQueryPanic() {
+	r := recover()
+	if r == nil {
+		return
+	}
+	if res.cancel == nil {
+		// not a running query
+		panic(r)
+	}
+	logWith(res).Errorf("panic while processing query: %s\n%s\n%s", r, strings.TrimSpace(res.Request.String()), debug.Stack())
+	res.cancel(errQueryPanic)
+}
+
+// acquireQuerySlot waits for a free slot if the number of concurrently executing queries is limited by
+// MaxConcurrentQueries. Queries are rejected with errQueryOverloaded if the queue is full or the slot
+// has not been acquired within the QueryQueueTimeout. Schema queries, the lmd_queries and the nodes table are
+// never limited, so it is still possible to see what is going on. Sub-requests from other cluster nodes have been
+// counted on the originating node already and are not limited either, otherwise both nodes could wait for each other.
+// The returned function frees the slot again.
+func (res *Response) acquireQuerySlot(ctx context.Context) (release func(), err error) {
+	lmd := res.Request.lmd
+	limiter := lmd.queryLimiter
+	switch {
+	case limiter == nil:
+		return func() {}, nil
+	case res.Request.Table == TableColumns, res.Request.Table == TableTables, res.Request.Table == TableQueries, res.Request.Table == TableNodes:
+		return func() {}, nil
+	case res.Request.distributed:
+		return func() {}, nil
+	case limiter.TryAcquire():
+		return limiter.Release, nil
+	}
+
+	if int(lmd.queuedQueries.Add(1)) > lmd.Config.MaxQueuedQueries {
+		lmd.queuedQueries.Add(-1)
+		promFrontendQueryQueueRejected.WithLabelValues("queue_full").Inc()
+		return nil, fmt.Errorf("%w: query queue is full (MaxQueuedQueries: %d)", errQueryOverloaded, lmd.Config.MaxQueuedQueries)
+	}
+	promFrontendQueryQueueLength.Inc()
+	timeout := time.Duration(lmd.Config.QueryQueueTimeout) * time.Second
+	waitCtx, cancel := context.WithTimeout(ctx, timeout)
+	waited, ok := limiter.Acquire(waitCtx)
+	cancel()
+	promFrontendQueryQueueLength.Dec()
+	lmd.queuedQueries.Add(-1)
+	promFrontendQueryQueueWait.Observe(waited.Seconds())
+
+	switch {
+	case ok:
+		return limiter.Release, nil
+	case ctx.Err() != nil:
+		logWith(res).Debugf("request canceled while waiting for a free query slot")
+		return nil, context.Cause(ctx)
+	default:
+		promFrontendQueryQueueRejected.WithLabelValues("timeout").Inc()
+		return nil, fmt.Errorf("%w: no free query slot within %s (MaxConcurrentQueries: %d)", errQueryOverloaded, timeout, lmd.Config.MaxConcurrentQueries)
+	}
+}
+
+// acquireResponseWorker waits for a free slot in the global response worker pool.
+// It returns false if the request has been canceled meanwhile, the peer is marked as failed then.
+func (res *Response) acquireResponseWorker(ctx context.Context, peer *Peer) bool {
+	promFrontendResponseWorkerQueue.Inc()
+	waited, ok := res.Request.lmd.responseWorkers.Acquire(ctx)
+	promFrontendResponseWorkerQueue.Dec()
+	promFrontendResponseWorkerWait.Observe(waited.Seconds())
+	if ok {
+		return true
+	}
+	msg := fmt.Sprintf("request canceled while waiting for a response worker: %s", context.Cause(ctx).Error())
+	logWith(res, peer).Debugf("%s", msg)
+	res.Lock.Lock()
+	if _, failed := res.Failed[peer.ID]; !failed {
+		res.Failed[peer.ID] = msg
+	}
+	res.Lock.Unlock()
+	return false
+}
+
+// SendColumnsHeader determines if the response should contain the columns header
 func (res *Response) SendColumnsHeader() bool {
 	if len(res.Request.Stats) > 0 {
 		return false
@@ -794,13 +2098,17 @@ func (res *Response) SendColumnsHeader() bool {
 	return false
 }
 
-// SetResultData populates Result table with data from the RawResultSet
+// SetResultData populates Result table with data from the RawResultSet.
+// This is only required if later steps need mutable rows, ex. merging results from
+// other nodes. Otherwise the response is written directly from the RawResultSet.
 func (res *Response) SetResultData() {
 	res.Result = make(ResultSet, 0, len(res.RawResults.DataResult))
 	rowSize := len(res.Request.RequestColumns)
+	// use a single backing array for all rows instead of allocating each row separately
+	values := make([]interface{}, len(res.RawResults.DataResult)*rowSize)
 	for i := range res.RawResults.DataResult {
 		datarow := res.RawResults.DataResult[i]
-		row := make([]interface{}, rowSize)
+		row := values[i*rowSize : (i+1)*rowSize : (i+1)*rowSize]
 		for j := range res.Request.RequestColumns {
 			row[j] = datarow.GetValueByColumn(res.Request.RequestColumns[j])
 		}
@@ -828,8 +2136,9 @@ func SpinUpPeers(ctx context.Context, peers []*Peer) {
 // buildLocalResponseData returns the result data for a given request
 func (res *Response) buildLocalResponseData(ctx context.Context, store *DataStore, resultcollector chan *PeerResponse) {
 	logWith(store.PeerName, res).Tracef("BuildLocalResponseData")
+	defer res.observePeerResponseDuration(store.PeerKey, store.PeerName, store.Table.Name, time.Now())
 
-	if len(store.Data) == 0 {
+	if store.IsEmpty() {
 		return
 	}
 
@@ -842,54 +2151,223 @@ func (res *Response) buildLocalResponseData(ctx context.Context, store *DataStor
 
 	if len(res.Request.Stats) > 0 {
 		// stats queries
-		res.MergeStats(res.gatherStatsResult(ctx, store))
+		stats := res.gatherStatsResult(ctx, store)
+		if stats != nil {
+			stats.PeerScanned = addPeerRowsScanned(stats.PeerScanned, store.PeerKey, stats.RowsScanned)
+			res.trace.AddPeerRows(store.PeerKey, store.PeerName, stats.RowsScanned)
+			store.Peer.countRowsScanned(stats.RowsScanned)
+		}
+		res.MergeStats(stats)
 	} else {
 		// data queries
-		res.gatherResultRows(ctx, store, resultcollector)
+		rowsScanned := res.gatherResultRows(ctx, store, resultcollector)
+		res.trace.AddPeerRows(store.PeerKey, store.PeerName, rowsScanned)
+		store.Peer.countRowsScanned(rowsScanned)
 	}
 }
 
-func (res *Response) gatherResultRows(ctx context.Context, store *DataStore, resultcollector chan *PeerResponse) {
-	result := &PeerResponse{}
-	defer func() {
-		resultcollector <- result
-	}()
+// gatherResultRows sends the matching rows of the store to the resultcollector and returns the number of scanned rows.
+func (res *Response) gatherResultRows(ctx context.Context, store *DataStore, resultcollector chan *PeerResponse) (rowsScanned int) {
 	req := res.Request
 
 	// if there is no sort header or sort by name only,
 	// we can drastically reduce the result set by applying the limit here already
 	limit := req.optimizeResultLimit()
 	if limit <= 0 {
-		limit = len(store.Data) + 1
+		limit = math.MaxInt
 	}
 
-	// no need to count all the way to the end unless the total number is required in wrapped_json output
-	breakOnLimit := res.Request.OutputFormat != OutputFormatWrappedJSON
-
-	done := ctx.Done()
-Rows:
-	for i, row := range store.GetPreFilteredData(req.Filter) {
-		// only check every couple of rows
-		if i%RowContextCheck == 0 {
-			select {
-			case <-done:
-				// request canceled
-				return
-			default:
+	if store.rowGenerator != nil {
+		// virtual tables generate their rows on the fly
+		result := newPeerResponse()
+		store.ForEachRow(req.Filter, res.rowGatherer(ctx, result, limit))
+		res.reserveRows(result)
+		rowsScanned = result.RowsScanned
+		result.PeerKey = store.PeerKey
+		resultcollector <- result
+
+		return rowsScanned
+	}
+
+	rows := store.GetPreFilteredData(req.Filter)
+	expected := res.expectedRows(store, rows, limit)
+	chunks := res.scanChunks(store, rows)
+	if chunks == nil {
+		result := newPeerResponse()
+		result.grow(expected)
+		forEachChunkRow(rows, res.rowGatherer(ctx, result, limit))
+		res.reserveRows(result)
+		rowsScanned = result.RowsScanned
+		result.PeerKey = store.PeerKey
+		resultcollector <- result
+
+		return rowsScanned
+	}
+
+	// scan chunks in parallel and merge them in their original order afterwards
+	partials := make([]*PeerResponse, len(chunks))
+	res.scanParallel(chunks, func(num int, chunk []*DataRow) {
+		partial := newPeerResponse()
+		if expected > 0 {
+			partial.grow(min(len(chunk), limit))
+		}
+		forEachChunkRow(chunk, res.rowGatherer(ctx, partial, limit))
+		res.reserveRows(partial)
+		partials[num] = partial
+	})
+	numRows := 0
+	for _, partial := range partials {
+		if partial == nil {
+			// the query has been canceled by a panic
+			return rowsScanned
+		}
+		numRows += len(partial.Rows)
+	}
+	result := newPeerResponse()
+	result.grow(min(numRows, limit))
+	for _, partial := range partials {
+		result.Total += partial.Total
+		result.RowsScanned += partial.RowsScanned
+		if remaining := limit - len(result.Rows); remaining > 0 {
+			result.Rows = append(result.Rows, partial.Rows[:min(remaining, len(partial.Rows))]...)
+		}
+		partial.release()
+	}
+	// rows of all partials have been accounted already
+	result.reserved = len(result.Rows)
+	rowsScanned = result.RowsScanned
+	result.PeerKey = store.PeerKey
+	resultcollector <- result
+
+	return rowsScanned
+}
+
+// expectedRows returns the number of result rows to reserve for the pre-filtered rows of a store.
+// The pre-filtered rows are only a useful hint if the index reduced them, otherwise remaining filters
+// and authorization make the number of results unpredictable.
+func (res *Response) expectedRows(store *DataStore, rows []*DataRow, limit int) int {
+	if res.Request.AuthUser != "" || (len(res.Request.Filter) > 0 && len(rows) == len(store.Data)) {
+		return 0
+	}
+
+	return min(len(rows), limit)
+}
+
+// expectedResultRows returns the number of rows to reserve for the merged result of all stores.
+// Filtered results are not pre-sized, since their size is unknown.
+func (res *Response) expectedResultRows(stores map[*Peer]*DataStore) int {
+	req := res.Request
+	if len(req.Stats) > 0 || len(req.Filter) > 0 || req.AuthUser != "" {
+		return 0
+	}
+	limit := req.optimizeResultLimit()
+	if limit <= 0 {
+		limit = math.MaxInt
+	}
+	numRows := 0
+	for _, store := range stores {
+		numRows += min(len(store.Data), limit)
+	}
+
+	return numRows
+}
+
+// contextChecker checks for canceled requests every couple of rows. The number of rows
+// between checks adapts to the time spent per row, so expensive filters notice canceled
+// requests within the target latency while cheap rows are not slowed down.
+type contextChecker struct {
+	done     <-chan struct{}
+	target   time.Duration // target latency, zero checks every RowContextCheck rows
+	interval int           // rows between checks
+	rows     int           // rows since last check
+	last     time.Time     // time of last check
+	scanned  *atomic.Int64 // optional counter of the rows scanned so far, updated on every check
+	checked  bool          // the first check has been done already
+}
+
+func (res *Response) newContextChecker(ctx context.Context) *contextChecker {
+	target := time.Duration(DefaultCancelCheckLatency) * time.Millisecond
+	if res.Request.lmd != nil {
+		target = time.Duration(res.Request.lmd.Config.CancelCheckLatency) * time.Millisecond
+	}
+	check := newContextChecker(ctx, target)
+	check.scanned = res.running.scannedCounter()
+	return check
+}
+
+func newContextChecker(ctx context.Context, target time.Duration) *contextChecker {
+	check := &contextChecker{
+		done:     ctx.Done(),
+		target:   target,
+		interval: RowContextCheck,
+	}
+	if target > 0 {
+		// start small, the interval grows quickly for cheap rows
+		check.interval = RowContextCheckMin
+	}
+	// check the first row right away
+	check.rows = check.interval
+	return check
+}
+
+// canceled returns true if the request has been canceled, it is called for every row.
+func (c *contextChecker) canceled() bool {
+	if c.rows < c.interval {
+		c.rows++
+		return false
+	}
+	select {
+	case <-c.done:
+		return true
+	default:
+	}
+	if c.scanned != nil && c.checked {
+		c.scanned.Add(int64(c.rows))
+	}
+	c.checked = true
+	c.rows = 1
+	if c.target > 0 {
+		now := time.Now()
+		if !c.last.IsZero() {
+			// aim for half the target latency to catch up with slower rows
+			scaled := float64(RowContextCheck)
+			if elapsed := now.Sub(c.last); elapsed > 0 {
+				scaled = float64(c.interval) * float64(c.target/2) / float64(elapsed)
 			}
+			c.interval = int(min(float64(RowContextCheck), max(float64(RowContextCheckMin), scaled)))
+		}
+		c.last = now
+	}
+	return false
+}
+
+// rowGatherer returns a function which adds all matching rows to the result until the limit is reached.
+func (res *Response) rowGatherer(ctx context.Context, result *PeerResponse, limit int) func(row *DataRow) bool {
+	req := res.Request
+
+	// no need to count all the way to the end unless the total number is required in wrapped_json output
+	breakOnLimit := req.OutputFormat != OutputFormatWrappedJSON
+
+	check := res.newContextChecker(ctx)
+	snapshots := &rowSnapshots{}
+
+	return func(row *DataRow) bool {
+		if check.canceled() {
+			return false
 		}
 
 		result.RowsScanned++
+		row = snapshots.pin(row)
 
 		// does our filter match?
 		for _, f := range req.Filter {
 			if !row.MatchFilter(f, false) {
-				continue Rows
+				return true
 			}
 		}
 
 		if !row.checkAuth(req.AuthUser) {
-			continue Rows
+			return true
 		}
 
 		result.Total++
@@ -897,42 +2375,256 @@ Rows:
 		// check if we have enough result rows already
 		// we still need to count how many result we would have...
 		if result.Total > limit {
-			if breakOnLimit {
-				return
-			}
-			continue Rows
+			return !breakOnLimit
 		}
+		snapshots.keep()
 		result.Rows = append(result.Rows, row)
+		if len(result.Rows)-result.reserved >= QueryMemoryBatchRows && !res.reserveRows(result) {
+			return false
+		}
+
+		return true
 	}
 }
 
 func (res *Response) gatherStatsResult(ctx context.Context, store *DataStore) *ResultSetStats {
+	if res.isCounterOnlyStats() {
+		return res.gatherCounterStats(ctx, store)
+	}
+	if store.rowGenerator != nil {
+		return res.countStats(ctx, func(fn func(row *DataRow) bool) {
+			store.ForEachRow(res.Request.Filter, fn)
+		})
+	}
+	rows := store.GetPreFilteredData(res.Request.Filter)
+	chunks := res.scanChunks(store, rows)
+	if chunks == nil {
+		return res.countStats(ctx, func(fn func(row *DataRow) bool) {
+			forEachChunkRow(rows, fn)
+		})
+	}
+
+	// count chunks in parallel and merge them afterwards, just like results from different peers
+	partials := make([]*ResultSetStats, len(chunks))
+	res.scanParallel(chunks, func(num int, chunk []*DataRow) {
+		partials[num] = res.countStats(ctx, func(fn func(row *DataRow) bool) {
+			forEachChunkRow(chunk, fn)
+		})
+	})
+	for _, partial := range partials {
+		if partial == nil {
+			return nil
+		}
+	}
+	// merge into the first partial, so the returned stats contain all rows scanned for this peer
+	for _, partial := range partials[1:] {
+		partials[0].Merge(partial)
+	}
+
+	return partials[0]
+}
+
+// countStats counts all rows passed by forEach into new result stats.
+// It returns nil if the request has been canceled.
+func (res *Response) countStats(ctx context.Context, forEach func(fn func(row *DataRow) bool)) *ResultSetStats {
 	result := NewResultSetStats()
+	canceled := false
+	forEach(res.statsCounter(ctx, result, &canceled))
+	if canceled {
+		return nil
+	}
+
+	return result
+}
+
+// isCounterOnlyStats returns true if the request only counts rows without any group columns,
+// which is the most common stats query and can be counted into plain counters.
+func (res *Response) isCounterOnlyStats() bool {
 	req := res.Request
-	localStats := result.Stats
+	if len(req.RequestColumns) > 0 || len(req.Stats) == 0 {
+		return false
+	}
+	for _, s := range req.Stats {
+		if s.StatsType != Counter {
+			return false
+		}
+	}
 
-	done := ctx.Done()
-Rows:
-	for i, row := range store.GetPreFilteredData(req.Filter) {
-		// only check every couple of rows
-		if i%RowContextCheck == 0 {
-			select {
-			case <-done:
-				// request canceled
-				return nil
-			default:
+	return true
+}
+
+// counterStats contains the plain counters of counter only stats queries.
+type counterStats struct {
+	counts      []int
+	total       int
+	rowsScanned int
+}
+
+// merge adds the counters of other.
+func (c *counterStats) merge(other *counterStats) {
+	for i := range other.counts {
+		c.counts[i] += other.counts[i]
+	}
+	c.total += other.total
+	c.rowsScanned += other.rowsScanned
+}
+
+// resultSetStats converts the counters into result stats just like counted by countStats.
+// It returns nil if the counting has been canceled.
+func (c *counterStats) resultSetStats(stats []*Filter) *ResultSetStats {
+	if c == nil {
+		return nil
+	}
+	result := NewResultSetStats()
+	result.Total = c.total
+	result.RowsScanned = c.rowsScanned
+	if c.total == 0 {
+		// stats are created with the first matching row
+		return result
+	}
+	localStats := createLocalStatsCopy(stats)
+	for i, count := range c.counts {
+		localStats[i].Stats = float64(count)
+		localStats[i].StatsCount = count
+	}
+	result.Stats[""] = localStats
+
+	return result
+}
+
+// gatherCounterStats is the fast path of gatherStatsResult for counter only stats.
+func (res *Response) gatherCounterStats(ctx context.Context, store *DataStore) *ResultSetStats {
+	if store.rowGenerator != nil {
+		return res.countCounterStats(ctx, func(fn func(row *DataRow) bool) {
+			store.ForEachRow(res.Request.Filter, fn)
+		}).resultSetStats(res.Request.Stats)
+	}
+	rows := store.GetPreFilteredData(res.Request.Filter)
+	chunks := res.scanChunks(store, rows)
+	if chunks == nil {
+		return res.countCounterStats(ctx, func(fn func(row *DataRow) bool) {
+			forEachChunkRow(rows, fn)
+		}).resultSetStats(res.Request.Stats)
+	}
+
+	// count chunks in parallel and merge the plain counters afterwards
+	partials := make([]*counterStats, len(chunks))
+	res.scanParallel(chunks, func(num int, chunk []*DataRow) {
+		partials[num] = res.countCounterStats(ctx, func(fn func(row *DataRow) bool) {
+			forEachChunkRow(chunk, fn)
+		})
+	})
+	for _, partial := range partials {
+		if partial == nil {
+			return nil
+		}
+	}
+	for _, partial := range partials[1:] {
+		partials[0].merge(partial)
+	}
+
+	return partials[0].resultSetStats(res.Request.Stats)
+}
+
+// countCounterStats counts all rows passed by forEach into plain counters.
+// It returns nil if the request has been canceled.
+func (res *Response) countCounterStats(ctx context.Context, forEach func(fn func(row *DataRow) bool)) *counterStats {
+	req := res.Request
+	stats := req.Stats
+	if req.StatsGrouped != nil {
+		stats = req.StatsGrouped
+	}
+	result := &counterStats{counts: make([]int, len(req.Stats))}
+	counters := intCounterStats(req.Stats)
+	check := res.newContextChecker(ctx)
+	snapshots := &rowSnapshots{}
+	canceled := false
+	forEach(func(row *DataRow) bool {
+		if check.canceled() {
+			canceled = true
+			return false
+		}
+		result.rowsScanned++
+		row = snapshots.pin(row)
+		// does our filter match?
+		for _, f := range req.Filter {
+			if !row.MatchFilter(f, false) {
+				return true
 			}
 		}
+
+		if !row.checkAuth(req.AuthUser) {
+			return true
+		}
+
+		result.total++
+		if counters == nil {
+			row.CountCounterStats(stats, result.counts)
+
+			return true
+		}
+		// load the row values only once for all counters
+		values := row.vals()
+		for i := range counters {
+			c := &counters[i]
+			if c.filter.MatchInt(values.dataInt[c.index]) != c.filter.Negate {
+				result.counts[i]++
+			}
+		}
+
+		return true
+	})
+	if canceled {
+		return nil
+	}
+
+	return result
+}
+
+// intCounter matches a counter stats against a local int column of the row values.
+type intCounter struct {
+	filter *Filter
+	index  int
+}
+
+// intCounterStats returns the counters for stats which only compare local int columns, ex.: Stats: state = 0.
+// It returns nil if any of the stats requires the generic filter match.
+func intCounterStats(stats []*Filter) []intCounter {
+	counters := make([]intCounter, len(stats))
+	for i, s := range stats {
+		if s.GroupOperator == And || s.GroupOperator == Or || s.ColumnIndex == -1 || s.Column.DataType != IntCol {
+			return nil
+		}
+		counters[i] = intCounter{filter: s, index: s.ColumnIndex}
+	}
+
+	return counters
+}
+
+// statsCounter returns a function which counts all matching rows into the result stats.
+func (res *Response) statsCounter(ctx context.Context, result *ResultSetStats, canceled *bool) func(row *DataRow) bool {
+	req := res.Request
+	localStats := result.Stats
+
+	check := res.newContextChecker(ctx)
+	snapshots := &rowSnapshots{}
+
+	return func(row *DataRow) bool {
+		if check.canceled() {
+			*canceled = true
+			return false
+		}
 		result.RowsScanned++
+		row = snapshots.pin(row)
 		// does our filter match?
 		for _, f := range req.Filter {
 			if !row.MatchFilter(f, false) {
-				continue Rows
+				return true
 			}
 		}
 
 		if !row.checkAuth(req.AuthUser) {
-			continue Rows
+			return true
 		}
 
 		result.Total++
@@ -950,7 +2642,53 @@ Rows:
 		} else {
 			row.CountStats(req.StatsGrouped, stat)
 		}
+
+		return true
 	}
+}
 
-	return result
+// scanChunks splits the pre-filtered rows of large stores into chunks which are scanned in parallel.
+// It returns nil if the rows should be scanned by a single worker.
+func (res *Response) scanChunks(store *DataStore, rows []*DataRow) [][]*DataRow {
+	conf := res.Request.lmd.Config
+	if conf.MaxParallelScanWorkers <= 1 || conf.ParallelScanMinRows <= 0 || len(rows) < conf.ParallelScanMinRows {
+		return nil
+	}
+	if store.DataSet == nil || store.DataSet.peer == nil {
+		return nil
+	}
+
+	chunkSize := (len(rows) + conf.MaxParallelScanWorkers - 1) / conf.MaxParallelScanWorkers
+	chunks := make([][]*DataRow, 0, conf.MaxParallelScanWorkers)
+	for start := 0; start < len(rows); start += chunkSize {
+		chunks = append(chunks, rows[start:min(start+chunkSize, len(rows))])
+	}
+
+	return chunks
+}
+
+// scanParallel runs fn for every chunk in its own go routine and waits till all of them are done.
+func (res *Response) scanParallel(chunks [][]*DataRow, fn func(num int, chunk []*DataRow)) {
+	waitgroup := &sync.WaitGroup{}
+	for i := range chunks {
+		waitgroup.Add(1)
+		go func(num int) {
+			// a panic only fails this query
+			defer res.recoverQueryPanic()
+
+			defer waitgroup.Done()
+
+			fn(num, chunks[num])
+		}(i)
+	}
+	waitgroup.Wait()
+}
+
+// forEachChunkRow calls fn for each row of the chunk until fn returns false.
+func forEachChunkRow(chunk []*DataRow, fn func(row *DataRow) bool) {
+	for _, row := range chunk {
+		if !fn(row) {
+			return
+		}
+	}
 }
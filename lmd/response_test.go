@@ -4,8 +4,26 @@ import (
 	"bufio"
 	"bytes"
 	"context"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"hash"
+	"hash/fnv"
+	"io"
+	"math/rand"
+	"net"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
+
+	jsoniter "github.com/json-iterator/go"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/sasha-s/go-deadlock"
 )
 
 func TestRequestHeaderTableFail(t *testing.T) {
@@ -16,3 +34,1718 @@ func TestRequestHeaderTableFail(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func TestResponseStaleData(t *testing.T) {
+	extraConfig := `
+		MaxStaleAge = 60
+	`
+	peer, cleanup, mocklmd := StartTestPeerExtra(2, 10, 10, extraConfig)
+	PauseTestPeers(peer)
+
+	// stop backend updates and pretend the last update happened 2 minutes ago
+	mocklmd.PeerMapLock.RLock()
+	for id := range mocklmd.PeerMap {
+		p := mocklmd.PeerMap[id]
+		p.Stop()
+		p.Lock.Lock()
+		p.setLastOnline(currentUnixTime() - 120)
+		p.Lock.Unlock()
+	}
+	mocklmd.PeerMapLock.RUnlock()
+
+	res, meta, err := peer.QueryString("GET hosts\nColumns: name\n\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = assertEq(0, len(res)); err != nil {
+		t.Error(err)
+	}
+
+	_, _, err = peer.QueryString("GET hosts\nColumns: name\nBackends: mockid0\n\n")
+	if err = assertLike("data too old", fmt.Sprintf("%v", err)); err != nil {
+		t.Error(err)
+	}
+
+	res, meta, err = peer.QueryString("GET hosts\nColumns: name\nStaleData: accept\nOutputFormat: wrapped_json\n\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = assertEq(20, len(res)); err != nil {
+		t.Error(err)
+	}
+	if err = assertEq(int64(20), meta.Total); err != nil {
+		t.Error(err)
+	}
+
+	res, _, err = peer.QueryString("GET sites\nColumns: last_update_age\n\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = assertEq(true, res[0][0].(float64) >= 120); err != nil {
+		t.Error(err)
+	}
+
+	res, _, err = peer.QueryString("GET hosts\nColumns: name lmd_data_age\nFilter: lmd_data_age >= 120\nSort: lmd_data_age desc\nStaleData: accept\n\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = assertEq(20, len(res)); err != nil {
+		t.Error(err)
+	}
+
+	if err := cleanup(); err != nil {
+		panic(err.Error())
+	}
+}
+
+func TestResponseSchemaWithoutPeers(t *testing.T) {
+	lmd := createTestLMDInstance()
+
+	queries := []struct {
+		query  string
+		column string
+	}{
+		{"GET columns\nColumns: table name type\nFilter: table = hosts\nFilter: name = state\n\n", "table"},
+		{"GET tables\nColumns: table name rows\nFilter: table = hosts\nFilter: name = state\n\n", "table"},
+	}
+	for _, q := range queries {
+		buf := bufio.NewReader(bytes.NewBufferString(q.query))
+		req, _, err := NewRequest(context.TODO(), lmd, buf, ParseOptimize)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res, _, err := NewResponse(context.TODO(), req, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = assertEq(1, len(res.RawResults.DataResult)); err != nil {
+			t.Fatalf("%s: %s", q.query, err)
+		}
+		if err = assertEq("hosts", res.RawResults.DataResult[0].GetStringByName(q.column)); err != nil {
+			t.Error(err)
+		}
+	}
+
+	// stats queries work as well
+	buf := bufio.NewReader(bytes.NewBufferString("GET columns\nStats: table = hosts\n\n"))
+	req, _, err := NewRequest(context.TODO(), lmd, buf, ParseOptimize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, _, err := NewResponse(context.TODO(), req, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = assertEq(float64(len(Objects.Tables[TableHosts].Columns)), interface2float64(res.Result[0][0])); err != nil {
+		t.Error(err)
+	}
+}
+
+// startTestLogSource starts a minimal livestatus source answering log queries with given timestamps.
+// Depending on the mode it rejects the sort header ("reject"), ignores it ("ignore") or sorts the result.
+// Stats queries are answered with the number of rows, unless the mode is "nocount". The mode "nodata"
+// rejects all other queries and "hang" never answers at all.
+func startTestLogSource(t *testing.T, lmd *LMDInstance, timestamps []int64, mode string) (listen string, limits chan int) {
+	t.Helper()
+	listen = fmt.Sprintf("mocklog_%s_%d.sock", mode, time.Now().Nanosecond())
+	l, err := net.Listen("unix", listen)
+	if err != nil {
+		t.Fatal(err)
+	}
+	limits = make(chan int, 10)
+	t.Cleanup(func() {
+		l.Close()
+		os.Remove(listen)
+	})
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			req, err := ParseRequest(context.TODO(), lmd, conn)
+			if err != nil {
+				panic(err.Error())
+			}
+			if mode == "hang" {
+				continue
+			}
+			times := append([]int64{}, timestamps...)
+			limit := -1
+			if req.Limit != nil {
+				limit = *req.Limit
+			}
+			switch {
+			case len(req.Stats) == 0 && mode == "nodata":
+				limits <- limit
+				fallthrough
+			case len(req.Stats) > 0 && mode == "nocount":
+				_checkErr2(fmt.Fprintf(conn, "400 %11d\n%s\n", 14, "query rejected"))
+				_checkErr(conn.Close())
+				continue
+			case len(req.Stats) > 0:
+				_checkErr2(fmt.Fprintf(conn, "200 %11d\n[[%d]]\n", len(fmt.Sprintf("[[%d]]\n", len(times))), len(times)))
+				_checkErr(conn.Close())
+				continue
+			}
+			limits <- limit
+			if len(req.Sort) > 0 {
+				switch mode {
+				case "reject":
+					_checkErr2(fmt.Fprintf(conn, "400 %11d\n%s\n", 29, "Invalid header Sort: time asc"))
+					_checkErr(conn.Close())
+					continue
+				case "ignore":
+				default:
+					sort.Slice(times, func(i, j int) bool {
+						if req.Sort[0].Direction == Asc {
+							return times[i] < times[j]
+						}
+						return times[i] > times[j]
+					})
+				}
+			}
+			if limit >= 0 && limit < len(times) {
+				times = times[:limit]
+			}
+			result := make([][]interface{}, 0, len(times))
+			for _, ts := range times {
+				row := make([]interface{}, 0, len(req.Columns))
+				for _, col := range req.Columns {
+					switch col {
+					case "time":
+						row = append(row, ts)
+					default:
+						row = append(row, fmt.Sprintf("%s_%d", col, ts))
+					}
+				}
+				result = append(result, row)
+			}
+			dat, _ := json.Marshal(result)
+			_checkErr2(fmt.Fprintf(conn, "200 %11d\n", len(dat)+1))
+			_checkErr2(conn.Write(dat))
+			_checkErr2(conn.Write([]byte("\n")))
+			_checkErr(conn.Close())
+		}
+	}()
+	return listen, limits
+}
+
+func TestResponsePassthroughSortMerge(t *testing.T) {
+	for _, mode := range []string{"sort", "reject", "ignore"} {
+		lmd := createTestLMDInstance()
+		sourceA, limitsA := startTestLogSource(t, lmd, []int64{10, 50, 30, 70}, "sort")
+		sourceB, limitsB := startTestLogSource(t, lmd, []int64{60, 20, 80, 40}, mode)
+		peers := []*Peer{
+			NewPeer(lmd, &Connection{Source: []string{sourceA}, Name: "PeerA", ID: "ida"}),
+			NewPeer(lmd, &Connection{Source: []string{sourceB}, Name: "PeerB", ID: "idb"}),
+		}
+		for _, p := range peers {
+			p.StatusSet(PeerState, PeerStatusUp)
+			lmd.PeerMap[p.ID] = p
+			lmd.PeerMapOrder = append(lmd.PeerMapOrder, p.ID)
+		}
+
+		query := "GET log\nColumns: time message\nSort: time desc\nLimit: 3\nOffset: 1\n\n"
+		req, _, err := NewRequest(context.TODO(), lmd, bufio.NewReader(bytes.NewBufferString(query)), ParseDefault)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = req.ExpandRequestedBackends(); err != nil {
+			t.Fatal(err)
+		}
+		res, err := req.BuildResponse(context.TODO())
+		if err != nil {
+			t.Fatal(err)
+		}
+		times := []int64{}
+		for _, row := range res.Result {
+			times = append(times, interface2int64(row[0]))
+		}
+		if err = assertEq([]int64{70, 60, 50}, times); err != nil {
+			t.Errorf("mode %s: %s", mode, err)
+		}
+
+		// each backend only has to return limit + offset rows
+		if err = assertEq(4, <-limitsA); err != nil {
+			t.Errorf("mode %s: %s", mode, err)
+		}
+		if err = assertEq(4, <-limitsB); err != nil {
+			t.Errorf("mode %s: %s", mode, err)
+		}
+		if mode != "sort" {
+			// refetched without limit
+			if err = assertEq(-1, <-limitsB); err != nil {
+				t.Errorf("mode %s: %s", mode, err)
+			}
+		}
+		if err = assertEq(mode == "reject", peers[1].sortUnsupported()); err != nil {
+			t.Errorf("mode %s: %s", mode, err)
+		}
+	}
+}
+
+func TestResponsePassthroughSortLogCache(t *testing.T) {
+	lmd := createTestLMDInstance()
+	peer := NewPeer(lmd, &Connection{Source: []string{"test.sock"}, Name: "TestPeer", ID: "testid", LogCacheWindow: 3600})
+	now := time.Now().Unix()
+	source := &testLogSource{}
+	source.add(now-300, "first")
+	source.add(now-200, "second")
+	source.add(now-100, "third")
+	peer.logCache = NewLogCache(peer, source.fetch)
+	peer.StatusSet(PeerState, PeerStatusUp)
+	lmd.PeerMap[peer.ID] = peer
+	lmd.PeerMapOrder = append(lmd.PeerMapOrder, peer.ID)
+
+	// the log cache returns unsorted and unlimited results, which are sorted locally
+	query := fmt.Sprintf("GET log\nColumns: plugin_output\nFilter: time >= %d\nSort: time asc\nLimit: 2\n\n", now-1000)
+	req, _, err := NewRequest(context.TODO(), lmd, bufio.NewReader(bytes.NewBufferString(query)), ParseDefault)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = req.ExpandRequestedBackends(); err != nil {
+		t.Fatal(err)
+	}
+	res, err := req.BuildResponse(context.TODO())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = assertEq(ResultSet{{"first"}, {"second"}}, res.Result); err != nil {
+		t.Error(err)
+	}
+	if err = assertEq(1, len(source.fetches)); err != nil {
+		t.Error(err)
+	}
+	if err = assertEq(false, peer.sortUnsupported()); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestResponsePassthroughSortError(t *testing.T) {
+	lmd := createTestLMDInstance()
+	sourceA, _ := startTestLogSource(t, lmd, []int64{10, 50, 30, 70}, "sort")
+	sourceB, limitsB := startTestLogSource(t, lmd, []int64{60, 20, 80, 40}, "nodata")
+	peers := []*Peer{
+		NewPeer(lmd, &Connection{Source: []string{sourceA}, Name: "PeerA", ID: "ida"}),
+		NewPeer(lmd, &Connection{Source: []string{sourceB}, Name: "PeerB", ID: "idb"}),
+	}
+	for _, p := range peers {
+		p.StatusSet(PeerState, PeerStatusUp)
+		lmd.PeerMap[p.ID] = p
+		lmd.PeerMapOrder = append(lmd.PeerMapOrder, p.ID)
+	}
+
+	query := "GET log\nColumns: time message\nSort: time desc\nLimit: 3\n\n"
+	req, _, err := NewRequest(context.TODO(), lmd, bufio.NewReader(bytes.NewBufferString(query)), ParseDefault)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = req.ExpandRequestedBackends(); err != nil {
+		t.Fatal(err)
+	}
+	res, err := req.BuildResponse(context.TODO())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(res.Failed["idb"], "bad response code: 400 - query rejected") {
+		t.Errorf("unexpected failed message: %q", res.Failed["idb"])
+	}
+
+	// errors unrelated to sorting must not be retried without the sort header
+	if err = assertEq(3, <-limitsB); err != nil {
+		t.Error(err)
+	}
+	select {
+	case limit := <-limitsB:
+		t.Errorf("unexpected retry with limit %d", limit)
+	default:
+	}
+	if err = assertEq(false, peers[1].sortUnsupported()); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestResponsePassthroughExactTotal(t *testing.T) {
+	for _, mode := range []string{"sort", "nocount", "nodata"} {
+		lmd := createTestLMDInstance()
+		lmd.Config.PassThroughExactTotal = true
+		sourceA, _ := startTestLogSource(t, lmd, []int64{10, 50, 30, 70}, "sort")
+		sourceB, _ := startTestLogSource(t, lmd, []int64{60, 20, 80, 40, 90}, mode)
+		for _, p := range []*Peer{
+			NewPeer(lmd, &Connection{Source: []string{sourceA}, Name: "PeerA", ID: "ida"}),
+			NewPeer(lmd, &Connection{Source: []string{sourceB}, Name: "PeerB", ID: "idb"}),
+		} {
+			p.StatusSet(PeerState, PeerStatusUp)
+			lmd.PeerMap[p.ID] = p
+			lmd.PeerMapOrder = append(lmd.PeerMapOrder, p.ID)
+		}
+
+		query := "GET log\nColumns: time\nSort: time desc\nLimit: 2\nOffset: 1\nOutputFormat: wrapped_json\n\n"
+		req, _, err := NewRequest(context.TODO(), lmd, bufio.NewReader(bytes.NewBufferString(query)), ParseDefault)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = req.ExpandRequestedBackends(); err != nil {
+			t.Fatal(err)
+		}
+		res, err := req.BuildResponse(context.TODO())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		expect := map[string]struct {
+			total  int
+			failed string
+		}{
+			"sort":    {9, ""},
+			"nocount": {4 + 3, "total count query failed: bad response code: 400 - query rejected"},
+			"nodata":  {4, "bad response code: 400 - query rejected"},
+		}[mode]
+		if err = assertEq(expect.total, res.ResultTotal); err != nil {
+			t.Errorf("mode %s: %s", mode, err)
+		}
+		if !strings.HasPrefix(res.Failed["idb"], expect.failed) || (expect.failed == "") != (res.Failed["idb"] == "") {
+			t.Errorf("mode %s: unexpected failed message: %q", mode, res.Failed["idb"])
+		}
+		if err = assertEq(2, len(res.Result)); err != nil {
+			t.Errorf("mode %s: %s", mode, err)
+		}
+	}
+}
+
+func TestResponsePassthroughTimeout(t *testing.T) {
+	lmd := createTestLMDInstance()
+	lmd.Config.PassThroughTimeout = 1
+	sourceA, _ := startTestLogSource(t, lmd, []int64{10, 50, 30, 70}, "sort")
+	sourceB, _ := startTestLogSource(t, lmd, []int64{60, 20}, "hang")
+	for _, p := range []*Peer{
+		NewPeer(lmd, &Connection{Source: []string{sourceA}, Name: "PeerA", ID: "ida"}),
+		NewPeer(lmd, &Connection{Source: []string{sourceB}, Name: "PeerB", ID: "idb"}),
+	} {
+		p.StatusSet(PeerState, PeerStatusUp)
+		lmd.PeerMap[p.ID] = p
+		lmd.PeerMapOrder = append(lmd.PeerMapOrder, p.ID)
+	}
+
+	query := "GET log\nColumns: time\nSort: time desc\nOutputFormat: wrapped_json\n\n"
+	req, _, err := NewRequest(context.TODO(), lmd, bufio.NewReader(bytes.NewBufferString(query)), ParseDefault)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = req.ExpandRequestedBackends(); err != nil {
+		t.Fatal(err)
+	}
+	started := time.Now()
+	res, err := req.BuildResponse(context.TODO())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(started); elapsed > 3*time.Second {
+		t.Errorf("response took %s, expected to return after the passthrough timeout", elapsed)
+	}
+
+	times := []int64{}
+	for _, row := range res.Result {
+		times = append(times, interface2int64(row[0]))
+	}
+	if err = assertEq([]int64{70, 50, 30, 10}, times); err != nil {
+		t.Error(err)
+	}
+	if !strings.HasPrefix(res.Failed["idb"], "timeout") {
+		t.Errorf("expected timeout for hanging backend, got: %q", res.Failed["idb"])
+	}
+	if err = assertEq(1, len(res.Failed)); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestResponsePassthroughDedup(t *testing.T) {
+	lmd := createTestLMDInstance()
+	lmd.Config.PassThroughDedup = true
+	sourceA, _ := startTestLogSource(t, lmd, []int64{10, 50, 30, 70}, "sort")
+	sourceB, _ := startTestLogSource(t, lmd, []int64{50, 70, 80}, "sort")
+	for _, p := range []*Peer{
+		NewPeer(lmd, &Connection{Source: []string{sourceA}, Name: "PeerA", ID: "ida"}),
+		NewPeer(lmd, &Connection{Source: []string{sourceB}, Name: "PeerB", ID: "idb"}),
+	} {
+		p.StatusSet(PeerState, PeerStatusUp)
+		lmd.PeerMap[p.ID] = p
+		lmd.PeerMapOrder = append(lmd.PeerMapOrder, p.ID)
+	}
+
+	query := "GET log\nColumns: time\nSort: time desc\nLimit: 3\nOutputFormat: wrapped_json\n\n"
+	req, _, err := NewRequest(context.TODO(), lmd, bufio.NewReader(bytes.NewBufferString(query)), ParseDefault)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = req.ExpandRequestedBackends(); err != nil {
+		t.Fatal(err)
+	}
+	res, err := req.BuildResponse(context.TODO())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	times := []int64{}
+	for _, row := range res.Result {
+		times = append(times, interface2int64(row[0]))
+	}
+	if err = assertEq([]int64{80, 70, 50}, times); err != nil {
+		t.Error(err)
+	}
+	if err = assertEq(2, res.Duplicates); err != nil {
+		t.Error(err)
+	}
+
+	buf := new(bytes.Buffer)
+	if err = res.WrappedJSON(buf); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buf.String(), `"duplicates":2`) {
+		t.Errorf("expected duplicates in wrapped_json meta data, got: %s", buf.String())
+	}
+
+	// dedup and sort columns are not sent to the client
+	query = "GET log\nColumns: message\nSort: time desc\nLimit: 3\nOutputFormat: wrapped_json\n\n"
+	req, _, err = NewRequest(context.TODO(), lmd, bufio.NewReader(bytes.NewBufferString(query)), ParseDefault)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = req.ExpandRequestedBackends(); err != nil {
+		t.Fatal(err)
+	}
+	res, err = req.BuildResponse(context.TODO())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = assertEq(ResultSet{{"message_80"}, {"message_70"}, {"message_50"}}, res.Result); err != nil {
+		t.Error(err)
+	}
+
+	// rows with the same hash are compared by their values
+	passthroughDedupHash = func() hash.Hash64 { return collidingHash{fnv.New64a()} }
+	defer func() { passthroughDedupHash = fnv.New64a }()
+	res.Duplicates = 0
+	res.Result = ResultSet{{int64(5)}, {int64(6)}, {int64(5)}}
+	res.dedupPassThroughResult([]int{0})
+	if err = assertEq(ResultSet{{int64(5)}, {int64(6)}}, res.Result); err != nil {
+		t.Error(err)
+	}
+
+	// number of tracked rows is limited
+	lmd.Config.PassThroughDedupMaxEntries = 2
+	res.Duplicates = 0
+	res.Result = ResultSet{{int64(5)}, {int64(5)}, {int64(6)}, {int64(5)}}
+	res.dedupPassThroughResult([]int{0})
+	if err = assertEq(ResultSet{{int64(5)}, {int64(6)}, {int64(5)}}, res.Result); err != nil {
+		t.Error(err)
+	}
+}
+
+// collidingHash returns the same hash for all values.
+type collidingHash struct {
+	hash.Hash64
+}
+
+func (h collidingHash) Write(p []byte) (int, error) {
+	return len(p), nil
+}
+
+func TestResponsePassthroughStatsMerge(t *testing.T) {
+	lmd := createTestLMDInstance()
+	query := "GET log\nColumns: host_name\nStats: state = 2\nStats: avg state\nStats: max time\n\n"
+	req, _, err := NewRequest(context.TODO(), lmd, bufio.NewReader(bytes.NewBufferString(query)), ParseDefault)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res := &Response{Request: req, Lock: new(deadlock.RWMutex), Failed: map[string]string{}, passthroughDone: make([]bool, 1)}
+
+	// plain backends get averages replaced by sums plus a row counter
+	peer := NewPeer(lmd, &Connection{Source: []string{"test.sock"}, Name: "PeerA", ID: "ida"})
+	stats, countIndex := res.passthroughStats(peer)
+	if err = assertEq(3, countIndex); err != nil {
+		t.Fatal(err)
+	}
+	if err = assertEq(Sum, stats[1].StatsType); err != nil {
+		t.Error(err)
+	}
+	if err = assertEq(Counter, stats[3].StatsType); err != nil {
+		t.Error(err)
+	}
+
+	// host "a" moved between both backends
+	res.mergePassThroughStats(0, ResultSet{
+		{"a", 1.0, 2.0, 100.0, 2.0},
+		{"b", 0.0, 0.0, 50.0, 1.0},
+	}, countIndex)
+	res.mergePassThroughStats(0, ResultSet{
+		{"a", 0.0, 0.0, 200.0, 2.0},
+	}, countIndex)
+	// lmd backends return raw stats and count pairs
+	res.mergePassThroughStats(0, ResultSet{
+		{"a", []interface{}{1.0, 1.0}, []interface{}{2.0, 2.0}, []interface{}{150.0, 2.0}},
+	}, -1)
+	res.CalculateFinalStats()
+
+	if err = assertEq(2, len(res.Result)); err != nil {
+		t.Fatal(err)
+	}
+	if err = assertEq("a", *(res.Result[0][0].(*string))); err != nil {
+		t.Error(err)
+	}
+	// 2 criticals, average of 4 over 6 rows and maximum time of all backends
+	if err = assertEq([]interface{}{2.0, 4.0 / 6.0, 200.0}, res.Result[0][1:]); err != nil {
+		t.Error(err)
+	}
+	if err = assertEq([]interface{}{0.0, 0.0, 50.0}, res.Result[1][1:]); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestResponseWaitTimeout(t *testing.T) {
+	peer, cleanup, mocklmd := StartTestPeer(1, 10, 10)
+	PauseTestPeers(peer)
+
+	build := func(query string) (*Response, time.Duration) {
+		t.Helper()
+		req, _, err := NewRequest(context.TODO(), mocklmd, bufio.NewReader(bytes.NewBufferString(query)), ParseDefault)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = req.ExpandRequestedBackends(); err != nil {
+			t.Fatal(err)
+		}
+		started := time.Now()
+		res, err := req.BuildResponse(context.TODO())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res, time.Since(started)
+	}
+
+	// trigger fired
+	res, _ := build("GET hosts\nColumns: name\nWaitTrigger: all\nWaitObject: testhost_1\nWaitCondition: name = testhost_1\nWaitTimeout: 5000\nOutputFormat: wrapped_json\n\n")
+	if err := assertEq(false, res.WaitTimedOut); err != nil {
+		t.Error(err)
+	}
+
+	// timed out, data is returned anyway
+	res, _ = build("GET hosts\nColumns: name\nWaitTrigger: all\nWaitObject: testhost_1\nWaitCondition: name = none\nWaitTimeout: 300\nOutputFormat: wrapped_json\n\n")
+	if err := assertEq(true, res.WaitTimedOut); err != nil {
+		t.Error(err)
+	}
+	if err := assertEq(10, len(res.RawResults.DataResult)); err != nil {
+		t.Error(err)
+	}
+	buf := new(bytes.Buffer)
+	if err := res.WrappedJSON(buf); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buf.String(), `"wait_timeout":true`) {
+		t.Errorf("expected wait_timeout in wrapped_json meta data, got: %s", buf.String())
+	}
+
+	// requested timeout is capped
+	mocklmd.Config.MaxWaitTimeout = 300
+	res, elapsed := build("GET hosts\nColumns: name\nWaitTrigger: all\nWaitObject: testhost_1\nWaitCondition: name = none\nWaitTimeout: 60000\n\n")
+	if err := assertEq(true, res.WaitTimedOut); err != nil {
+		t.Error(err)
+	}
+	if elapsed > 3*time.Second {
+		t.Errorf("wait timeout should be capped, request took %s", elapsed)
+	}
+	mocklmd.Config.MaxWaitTimeout = WaitTimeoutMax
+
+	// peer went down while waiting
+	for _, p := range mocklmd.PeerMap {
+		go func(p *Peer) {
+			time.Sleep(300 * time.Millisecond)
+			p.ClearData(true)
+		}(p)
+	}
+	res, elapsed = build("GET hosts\nColumns: name\nWaitTrigger: all\nWaitObject: testhost_1\nWaitCondition: name = none\nWaitTimeout: 5000\nOutputFormat: wrapped_json\n\n")
+	if err := assertEq(false, res.WaitTimedOut); err != nil {
+		t.Error(err)
+	}
+	if err := assertEq(1, len(res.Failed)); err != nil {
+		t.Error(err)
+	}
+	if elapsed > 3*time.Second {
+		t.Errorf("wait should stop once the peer is down, request took %s", elapsed)
+	}
+
+	if err := cleanup(); err != nil {
+		panic(err.Error())
+	}
+}
+
+func TestResponseWaitTriggerParallel(t *testing.T) {
+	peer, cleanup, mocklmd := StartTestPeer(2, 10, 10)
+	PauseTestPeers(peer)
+
+	// only the second peer fulfills the condition, the first one times out
+	query := fmt.Sprintf("GET hosts\nColumns: name\nWaitTrigger: all\nWaitObject: testhost_1\nWaitCondition: peer_key = %s\nWaitTimeout: 1000\nOutputFormat: wrapped_json\n\n", mocklmd.PeerMapOrder[1])
+	req, _, err := NewRequest(context.TODO(), mocklmd, bufio.NewReader(bytes.NewBufferString(query)), ParseDefault)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = req.ExpandRequestedBackends(); err != nil {
+		t.Fatal(err)
+	}
+	started := time.Now()
+	res, err := req.BuildResponse(context.TODO())
+	if err != nil {
+		t.Fatal(err)
+	}
+	elapsed := time.Since(started)
+	if elapsed < 900*time.Millisecond || elapsed > 1800*time.Millisecond {
+		t.Errorf("expected request to wait for a single timeout, took %s", elapsed)
+	}
+	if err = assertEq(true, res.WaitTimedOut); err != nil {
+		t.Error(err)
+	}
+	if err = assertEq(0, len(res.Failed)); err != nil {
+		t.Error(err)
+	}
+
+	// both peers time out in parallel
+	query = "GET hosts\nColumns: name\nWaitTrigger: all\nWaitObject: testhost_1\nWaitCondition: name = none\nWaitTimeout: 1000\n\n"
+	req, _, err = NewRequest(context.TODO(), mocklmd, bufio.NewReader(bytes.NewBufferString(query)), ParseDefault)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = req.ExpandRequestedBackends(); err != nil {
+		t.Fatal(err)
+	}
+	started = time.Now()
+	if _, err = req.BuildResponse(context.TODO()); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed = time.Since(started); elapsed > 1800*time.Millisecond {
+		t.Errorf("expected request to wait for a single timeout, took %s", elapsed)
+	}
+
+	if err := cleanup(); err != nil {
+		panic(err.Error())
+	}
+}
+
+func TestResponseSetResultData(t *testing.T) {
+	peer, cleanup, mocklmd := StartTestPeer(1, 10, 10)
+	PauseTestPeers(peer)
+
+	query := "GET services\nColumns: host_name description state plugin_output last_check perf_data\nOutputFormat: wrapped_json\n\n"
+	req, _, err := NewRequest(context.TODO(), mocklmd, bufio.NewReader(bytes.NewBufferString(query)), ParseOptimize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = req.ExpandRequestedBackends(); err != nil {
+		t.Fatal(err)
+	}
+	res, _, err := NewResponse(context.TODO(), req, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, err := res.Buffer()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// materialized rows must result in the same output
+	res.SetResultData()
+	if err = assertEq(10, len(res.Result)); err != nil {
+		t.Fatal(err)
+	}
+	materialized, err := res.Buffer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = assertEq(raw.String(), materialized.String()); err != nil {
+		t.Error(err)
+	}
+
+	if err := cleanup(); err != nil {
+		panic(err.Error())
+	}
+}
+
+func TestRawResultSetRelease(t *testing.T) {
+	peer, cleanup, mocklmd := StartTestPeer(1, 10, 10)
+	PauseTestPeers(peer)
+
+	store, err := mocklmd.PeerMap[mocklmd.PeerMapOrder[0]].GetDataStore(TableServices)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	raw := NewRawResultSet(nil)
+	raw.DataResult = append(raw.DataResult, store.Data...)
+	*raw.buffer = raw.DataResult
+	buffer := raw.buffer
+	raw.DataResult = raw.DataResult[5:]
+
+	// released buffers must not reference any data rows
+	raw.Release()
+	if err = assertEq(0, len(raw.DataResult)); err != nil {
+		t.Error(err)
+	}
+	for i, row := range (*buffer)[:cap(*buffer)] {
+		if row != nil {
+			t.Errorf("row %d still referenced after release", i)
+		}
+	}
+	if err = assertEq(0, len(*buffer)); err != nil {
+		t.Error(err)
+	}
+
+	// disowned buffers are not put back into the pool
+	raw = NewRawResultSet(nil)
+	raw.DataResult = append(raw.DataResult, store.Data...)
+	*raw.buffer = raw.DataResult
+	buffer = raw.buffer
+	raw.disown()
+	raw.Release()
+	if err = assertEq(len(store.Data), len(*buffer)); err != nil {
+		t.Error(err)
+	}
+
+	if err := cleanup(); err != nil {
+		panic(err.Error())
+	}
+}
+
+func TestResponseParallelScan(t *testing.T) {
+	peer, cleanup, mocklmd := StartTestPeer(1, 10, 100)
+	PauseTestPeers(peer)
+
+	queries := []string{
+		"GET services\nColumns: host_name description state\n\n",
+		"GET services\nColumns: host_name description\nFilter: state = 0\nLimit: 7\nOutputFormat: wrapped_json\n\n",
+		"GET services\nColumns: host_name description\nSort: description asc\nLimit: 12\n\n",
+		"GET services\nColumns: host_name\nStats: state = 0\nStats: state != 0\nStats: max latency\nStats: min latency\n\n",
+		"GET services\nStats: state = 0\nStats: max execution_time\n\n",
+	}
+	for _, query := range queries {
+		mocklmd.Config.MaxParallelScanWorkers = 1
+		serial, serialMeta, err := peer.QueryString(query)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		mocklmd.Config.MaxParallelScanWorkers = 4
+		mocklmd.Config.ParallelScanMinRows = 10
+		parallel, parallelMeta, err := peer.QueryString(query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = assertEq(serial, parallel); err != nil {
+			t.Errorf("%s: %s", query, err)
+		}
+		if err = assertEq([]int64{serialMeta.Total, serialMeta.RowsScanned}, []int64{parallelMeta.Total, parallelMeta.RowsScanned}); err != nil {
+			t.Errorf("%s: %s", query, err)
+		}
+	}
+
+	if err := cleanup(); err != nil {
+		panic(err.Error())
+	}
+}
+
+func TestWriteJSONValue(t *testing.T) {
+	str := "<b>&\"test\"</b>"
+	values := []interface{}{
+		nil,
+		"",
+		str,
+		&str,
+		(*string)(nil),
+		0.0,
+		0.1,
+		-1.5,
+		1e-7,
+		1e21,
+		123456789.123,
+		3,
+		int64(-5),
+		true,
+		[]string{"a", str},
+		[]string(nil),
+		[]int64{1, 2},
+		[]int64(nil),
+		[]interface{}{1.5, str, []interface{}{"x", nil}, map[string]interface{}{"b": 1, "a": str}},
+		[]interface{}(nil),
+		map[string]interface{}{"z": 1.0, "a": []string{"<"}},
+	}
+	for _, value := range values {
+		expect := jsoniter.ConfigCompatibleWithStandardLibrary.BorrowStream(nil)
+		expect.WriteVal(value)
+		got := jsoniter.ConfigCompatibleWithStandardLibrary.BorrowStream(nil)
+		writeJSONValue(got, value)
+		if err := assertEq(string(expect.Buffer()), string(got.Buffer())); err != nil {
+			t.Errorf("%#v: %s", value, err)
+		}
+		jsoniter.ConfigCompatibleWithStandardLibrary.ReturnStream(expect)
+		jsoniter.ConfigCompatibleWithStandardLibrary.ReturnStream(got)
+	}
+}
+
+func TestContextCheckerSlowRows(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// artificially slow filter, the fixed interval would notice the cancel only after 10 seconds
+	check := newContextChecker(ctx, 20*time.Millisecond)
+	slowFilter := func() { time.Sleep(time.Millisecond) }
+
+	var canceledAt time.Time
+	rows := 0
+	for ; rows < RowContextCheck; rows++ {
+		if rows == 100 {
+			cancel()
+			canceledAt = time.Now()
+		}
+		if check.canceled() {
+			break
+		}
+		slowFilter()
+	}
+	if rows == RowContextCheck {
+		t.Fatalf("cancel has not been noticed")
+	}
+	if latency := time.Since(canceledAt); latency > 200*time.Millisecond {
+		t.Errorf("cancel noticed too late: %s", latency)
+	}
+
+	// cheap rows are checked at the maximum interval
+	check = newContextChecker(context.Background(), 20*time.Millisecond)
+	for i := 0; i < 3*RowContextCheck; i++ {
+		check.canceled()
+	}
+	if err := assertEq(RowContextCheck, check.interval); err != nil {
+		t.Error(err)
+	}
+
+	// zero disables the adaptive interval
+	check = newContextChecker(ctx, 0)
+	if err := assertEq(RowContextCheck, check.interval); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestResponseFixed16Spill(t *testing.T) {
+	peer, cleanup, mocklmd := StartTestPeer(2, 100, 1000)
+	PauseTestPeers(peer)
+
+	mocklmd.Config.ResponseSpillThreshold = 1
+	mocklmd.Config.ResponseSpillDir = t.TempDir()
+	query := "GET services\nResponseHeader: fixed16\n\n"
+	req, _, err := NewRequest(context.TODO(), mocklmd, bufio.NewReader(bytes.NewBufferString(query)), ParseOptimize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = req.ExpandRequestedBackends(); err != nil {
+		t.Fatal(err)
+	}
+	res, _, err := NewResponse(context.TODO(), req, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	spills := testutil.ToFloat64(promFrontendResponseSpills)
+	out := new(bytes.Buffer)
+	size, err := res.SendFixed16(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := assertEq(spills+1, testutil.ToFloat64(promFrontendResponseSpills)); err != nil {
+		t.Error(err)
+	}
+	if size < 1024*1024 {
+		t.Fatalf("response too small to be spilled: %d bytes", size)
+	}
+	if err := assertEq(fmt.Sprintf("200 %11d\n", size+1), out.String()[:16]); err != nil {
+		t.Error(err)
+	}
+	// virtual columns change over time, so compare the number of rows
+	var rows []interface{}
+	if err = json.Unmarshal(out.Bytes()[16:], &rows); err != nil {
+		t.Fatal(err)
+	}
+	if err := assertEq(len(res.RawResults.DataResult)+1, len(rows)); err != nil {
+		t.Error(err)
+	}
+
+	// compressed responses are streamed into the buffer as well
+	spillBuffer := NewSpillBuffer(1000, t.TempDir())
+	defer spillBuffer.Close()
+	if err = res.gzipBody(spillBuffer); err != nil {
+		t.Fatal(err)
+	}
+	if err := assertEq(true, spillBuffer.Spilled()); err != nil {
+		t.Error(err)
+	}
+	compressed := new(bytes.Buffer)
+	if _, err = spillBuffer.WriteTo(compressed); err != nil {
+		t.Fatal(err)
+	}
+	uncompressed, err := gunzipBytes(compressed.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	rows = nil
+	if err = json.Unmarshal(uncompressed, &rows); err != nil {
+		t.Fatal(err)
+	}
+	if err := assertEq(len(res.RawResults.DataResult)+1, len(rows)); err != nil {
+		t.Error(err)
+	}
+
+	if err := cleanup(); err != nil {
+		panic(err.Error())
+	}
+}
+
+// failingWriter fails once more than limit bytes have been written, ex.: if the client disconnects.
+type failingWriter struct {
+	io.Writer
+	limit   int
+	written int
+}
+
+func (w *failingWriter) Write(data []byte) (int, error) {
+	if w.written+len(data) > w.limit {
+		num, _ := w.Writer.Write(data[:w.limit-w.written])
+		w.written += num
+		return num, errors.New("connection reset by peer")
+	}
+	num, err := w.Writer.Write(data)
+	w.written += num
+	return num, err
+}
+
+// failingConn is a connection which fails to write once more than limit bytes have been written.
+type failingConn struct {
+	net.Conn
+	writer *failingWriter
+}
+
+func (c *failingConn) Write(data []byte) (int, error) {
+	return c.writer.Write(data)
+}
+
+func TestResponseFixed16WriteErrors(t *testing.T) {
+	res := &Response{Code: 400, Request: &Request{ResponseFixed16: true}, Error: errors.New("bad request: test")}
+	body := res.errorMessage() + "\n"
+	size := 16 + len(body)
+
+	for _, limit := range []int{0, 10, 16, size - 1, size} {
+		buf := &bytes.Buffer{}
+		_, err := res.SendFixed16(&failingWriter{Writer: buf, limit: limit})
+		if limit == size {
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err = assertEq(fmt.Sprintf("400 %11d\n%s", len(body), body), buf.String()); err != nil {
+				t.Error(err)
+			}
+			continue
+		}
+		if !errors.Is(err, errResponseWrite) {
+			t.Errorf("limit %d: expected incomplete response error, got: %v", limit, err)
+		}
+	}
+
+	// responses which do not fit into the header are replaced by a well-formed error
+	for _, size := range []int64{-1, fixed16MaxSize + 1} {
+		if _, err := fixed16Header(200, size); !errors.Is(err, errFixed16Header) {
+			t.Errorf("size %d: expected header error, got: %v", size, err)
+		}
+	}
+	header, err := fixed16Header(200, fixed16MaxSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = assertEq(15, len(header)); err != nil {
+		t.Error(err)
+	}
+	buf := &bytes.Buffer{}
+	_, err = (&Response{Code: 1000, Request: &Request{ResponseFixed16: true}, Error: errors.New("test")}).SendFixed16(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = assertLike("^500 +\\d+\n.*does not fit into the fixed16 header", buf.String()); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestResponseFixed16ClientDisconnect(t *testing.T) {
+	peer, cleanup, mocklmd := StartTestPeer(1, 10, 10)
+	PauseTestPeers(peer)
+
+	// the connection fails right after the response header has been sent
+	server, client := net.Pipe()
+	conn := &failingConn{Conn: server, writer: &failingWriter{Writer: server, limit: 16}}
+	cl := NewClientConnection(mocklmd, conn, 60, 10, 10, nil)
+	done := make(chan bool)
+	go func() {
+		cl.Handle()
+		close(done)
+	}()
+
+	LogErrors(client.SetDeadline(time.Now().Add(5 * time.Second)))
+	if _, err := client.Write([]byte("GET hosts\nColumns: name\nKeepAlive: on\nResponseHeader: fixed16\n\n")); err != nil {
+		t.Fatal(err)
+	}
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(client, header); err != nil {
+		t.Fatal(err)
+	}
+	if err := assertLike("^200 ", string(header)); err != nil {
+		t.Error(err)
+	}
+
+	// neither an error response nor the next response must be sent, the keepalive connection is closed
+	rest, err := io.ReadAll(client)
+	if err != nil {
+		t.Errorf("expected closed connection, got: %s", err)
+	}
+	if err = assertEq("", string(rest)); err != nil {
+		t.Error(err)
+	}
+	<-done
+
+	if err := cleanup(); err != nil {
+		panic(err.Error())
+	}
+}
+
+func TestResponseMemoryBudget(t *testing.T) {
+	peer, cleanup, mocklmd := StartTestPeer(2, 100, 1000)
+	PauseTestPeers(peer)
+
+	mocklmd.Config.MaxQueryMemory = 1
+	inFlight := testutil.ToFloat64(promFrontendQueryMemory)
+	for _, query := range []string{"GET services\n\n", "GET services\nLimit: 10\n\n"} {
+		req, _, err := NewRequest(context.TODO(), mocklmd, bufio.NewReader(bytes.NewBufferString(query)), ParseOptimize)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = req.ExpandRequestedBackends(); err != nil {
+			t.Fatal(err)
+		}
+		res, _, err := NewResponse(context.TODO(), req, nil)
+		if req.Limit == nil {
+			if err := assertLike("memory budget of 1.0MiB", fmt.Sprintf("%v", err)); err != nil {
+				t.Error(err)
+			}
+			if err := assertEq(413, res.Code); err != nil {
+				t.Error(err)
+			}
+			if err := assertEq(true, res.RawResults == nil); err != nil {
+				t.Error(err)
+			}
+		} else {
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := assertEq(10, len(res.RawResults.DataResult)); err != nil {
+				t.Error(err)
+			}
+		}
+		// all accounted memory is released once the response is built
+		if err := assertEq(inFlight, testutil.ToFloat64(promFrontendQueryMemory)); err != nil {
+			t.Error(err)
+		}
+	}
+
+	if err := cleanup(); err != nil {
+		panic(err.Error())
+	}
+}
+
+func TestResponseCounterStats(t *testing.T) {
+	peer, cleanup, mocklmd := StartTestPeer(1, 10, 100)
+	PauseTestPeers(peer)
+
+	store, err := peer.GetDataStore(TableServices)
+	if err != nil {
+		t.Fatal(err)
+	}
+	queries := []string{
+		"GET services\nStats: state = 0\nStats: state = 1\nStats: state = 2\nStats: state = 3\n\n",
+		"GET services\nFilter: host_name = testhost_1\nStats: state = 0\nStats: state != 0\nStats: has_been_checked = 0\n\n",
+		"GET services\nStats: state = 0\nStats: acknowledged = 1\nStatsAnd: 2\nStats: state = 1\nStats: host_name ~ 1\nStatsOr: 2\n\n",
+		"GET services\nFilter: host_name = unknown\nStats: state = 0\n\n",
+		"GET services\nStats: state = 0\nStats: host_name = testhost_1\nStats: latency > 0\n\n",
+		"GET services\nStats: state = 0\nStats: state = 1\nStatsNegate:\n\n",
+	}
+	for _, parallel := range []int{0, 10} {
+		mocklmd.Config.ParallelScanMinRows = parallel
+		for _, query := range queries {
+			req, _, err := NewRequest(context.TODO(), mocklmd, bufio.NewReader(bytes.NewBufferString(query)), ParseOptimize)
+			if err != nil {
+				t.Fatal(err)
+			}
+			res := &Response{Request: req, Lock: new(deadlock.RWMutex)}
+			if err := assertEq(true, res.isCounterOnlyStats()); err != nil {
+				t.Fatal(err)
+			}
+			expect := res.countStats(context.TODO(), func(fn func(row *DataRow) bool) {
+				forEachChunkRow(store.GetPreFilteredData(req.Filter), fn)
+			})
+			if err := assertEq(expect, res.gatherCounterStats(context.TODO(), store)); err != nil {
+				t.Errorf("query %q: %s", query, err.Error())
+			}
+		}
+	}
+
+	// group columns and other stats types use the generic path
+	req, _, err := NewRequest(context.TODO(), mocklmd, bufio.NewReader(bytes.NewBufferString("GET services\nColumns: state\nStats: state = 0\n\n")), ParseOptimize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := assertEq(false, (&Response{Request: req}).isCounterOnlyStats()); err != nil {
+		t.Error(err)
+	}
+	req, _, err = NewRequest(context.TODO(), mocklmd, bufio.NewReader(bytes.NewBufferString("GET services\nStats: state = 0\nStats: avg latency\n\n")), ParseOptimize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := assertEq(false, (&Response{Request: req}).isCounterOnlyStats()); err != nil {
+		t.Error(err)
+	}
+
+	if err := cleanup(); err != nil {
+		panic(err.Error())
+	}
+}
+
+func TestResponseQueryMetrics(t *testing.T) {
+	peer, cleanup, mocklmd := StartTestPeer(2, 10, 100)
+	PauseTestPeers(peer)
+
+	scanned := testutil.ToFloat64(promFrontendRowsScanned.WithLabelValues("services"))
+	returned := testutil.ToFloat64(promFrontendRowsReturned.WithLabelValues("services"))
+	queries := querySampleCount(t, "services", "200")
+
+	query := "GET services\nColumns: host_name description\nLimit: 5\nOutputFormat: json\n\n"
+	req, _, err := NewRequest(context.TODO(), mocklmd, bufio.NewReader(bytes.NewBufferString(query)), ParseOptimize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = req.ExpandRequestedBackends(); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = NewResponse(context.TODO(), req, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := assertEq(returned+5, testutil.ToFloat64(promFrontendRowsReturned.WithLabelValues("services"))); err != nil {
+		t.Error(err)
+	}
+	// the number of queries per table is the sample count of the duration histogram
+	if err := assertEq(queries+1, querySampleCount(t, "services", "200")); err != nil {
+		t.Error(err)
+	}
+	if scannedNow := testutil.ToFloat64(promFrontendRowsScanned.WithLabelValues("services")); scannedNow < scanned+10 {
+		t.Errorf("expected at least 10 more scanned rows, got %f", scannedNow-scanned)
+	}
+	if err := assertEq(true, testutil.CollectAndCount(promFrontendQueryDuration, "lmd_frontend_query_duration_seconds") > 0); err != nil {
+		t.Error(err)
+	}
+	// one series per peer and table
+	if err := assertEq(true, testutil.CollectAndCount(promPeerResponseDuration, "lmd_peer_response_duration_seconds") >= 2); err != nil {
+		t.Error(err)
+	}
+
+	if err := cleanup(); err != nil {
+		panic(err.Error())
+	}
+}
+
+// querySampleCount returns the number of observed queries for the given table and code.
+func querySampleCount(t *testing.T, table, code string) uint64 {
+	t.Helper()
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(promFrontendQueryDuration)
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, family := range families {
+		for _, metric := range family.GetMetric() {
+			labels := make(map[string]string)
+			for _, label := range metric.GetLabel() {
+				labels[label.GetName()] = label.GetValue()
+			}
+			if labels["table"] == table && labels["code"] == code {
+				return metric.GetHistogram().GetSampleCount()
+			}
+		}
+	}
+	return 0
+}
+
+func TestResponseRowsScannedByBackend(t *testing.T) {
+	peer, cleanup, mocklmd := StartTestPeer(2, 10, 10)
+	PauseTestPeers(peer)
+
+	// scan in parallel chunks to make sure all chunks are counted
+	mocklmd.Config.MaxParallelScanWorkers = 4
+	mocklmd.Config.ParallelScanMinRows = 2
+	queries := []string{
+		"GET hosts\nColumns: name\nRowsScannedByBackend: on\nOutputFormat: wrapped_json\n\n",
+		"GET hosts\nStats: state = 0\nRowsScannedByBackend: on\nOutputFormat: wrapped_json\n\n",
+		"GET services\nColumns: host_name\nStats: state = 0\nRowsScannedByBackend: on\nOutputFormat: wrapped_json\n\n",
+	}
+	for _, query := range queries {
+		req, _, err := NewRequest(context.TODO(), mocklmd, bufio.NewReader(bytes.NewBufferString(query)), ParseOptimize)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = req.ExpandRequestedBackends(); err != nil {
+			t.Fatal(err)
+		}
+		res, _, err := NewResponse(context.TODO(), req, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		buf, err := res.Buffer()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var result struct {
+			RowsScannedByBackend map[string]int `json:"rows_scanned_by_backend"`
+		}
+		if err = jsoniter.Unmarshal(buf.Bytes(), &result); err != nil {
+			t.Fatal(err)
+		}
+		expect := make(map[string]int)
+		for _, key := range mocklmd.PeerMapOrder {
+			expect[key] = 10
+		}
+		if err = assertEq(expect, result.RowsScannedByBackend); err != nil {
+			t.Errorf("%s: %s", query, err)
+		}
+	}
+
+	// the sites table counts all rows scanned per backend
+	res, _, err := peer.QueryString("GET sites\nColumns: rows_scanned\n\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, row := range res {
+		if interface2int(row[0]) < 30 {
+			t.Errorf("expected at least 30 scanned rows, got: %v", row[0])
+		}
+	}
+
+	if err := cleanup(); err != nil {
+		panic(err.Error())
+	}
+}
+
+func TestResponseQueryQueue(t *testing.T) {
+	peer, cleanup, mocklmd := StartTestPeer(1, 10, 10)
+	PauseTestPeers(peer)
+
+	mocklmd.queryLimiter = NewLimiter(1)
+	mocklmd.Config.MaxQueuedQueries = 1
+	mocklmd.Config.QueryQueueTimeout = 1
+	defer func() { mocklmd.queryLimiter = nil }()
+
+	query := func(table string) (*Response, error) {
+		t.Helper()
+		req, _, err := NewRequest(context.TODO(), mocklmd, bufio.NewReader(bytes.NewBufferString("GET "+table+"\nColumns: name\n\n")), ParseOptimize)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = req.ExpandRequestedBackends(); err != nil {
+			t.Fatal(err)
+		}
+		res, _, err := NewResponse(context.TODO(), req, nil)
+		return res, err
+	}
+
+	// occupy the only slot
+	if !mocklmd.queryLimiter.TryAcquire() {
+		t.Fatalf("expected free query slot")
+	}
+	timeouts := promFrontendQueryQueueRejected.WithLabelValues("timeout")
+	queueFull := promFrontendQueryQueueRejected.WithLabelValues("queue_full")
+	numTimeouts := testutil.ToFloat64(timeouts)
+	numQueueFull := testutil.ToFloat64(queueFull)
+
+	// the queued query times out, another one does not fit into the queue
+	done := make(chan error)
+	go func() {
+		_, err := query("hosts")
+		done <- err
+	}()
+	deadline := time.Now().Add(5 * time.Second)
+	for testutil.ToFloat64(promFrontendQueryQueueLength) != 1 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	res, err := query("services")
+	if !errors.Is(err, errQueryOverloaded) {
+		t.Fatalf("expected overloaded query, got: %v", err)
+	}
+	if err = assertLike("query queue is full", err.Error()); err != nil {
+		t.Error(err)
+	}
+	if err = assertEq(503, res.Code); err != nil {
+		t.Error(err)
+	}
+	err = <-done
+	if !errors.Is(err, errQueryOverloaded) {
+		t.Errorf("expected overloaded query, got: %v", err)
+	}
+	if err = assertEq(numTimeouts+1, testutil.ToFloat64(timeouts)); err != nil {
+		t.Error(err)
+	}
+	if err = assertEq(numQueueFull+1, testutil.ToFloat64(queueFull)); err != nil {
+		t.Error(err)
+	}
+
+	// schema and running queries are not limited
+	for _, table := range []string{"columns", "tables", "lmd_queries"} {
+		if _, err = query(table); err != nil {
+			t.Errorf("%s: %s", table, err)
+		}
+	}
+
+	// queued queries run once a slot is free
+	go func() {
+		_, err := query("hosts")
+		done <- err
+	}()
+	time.Sleep(100 * time.Millisecond)
+	mocklmd.queryLimiter.Release()
+	if err = <-done; err != nil {
+		t.Error(err)
+	}
+	if err = assertEq(0, mocklmd.queryLimiter.InUse()); err != nil {
+		t.Error(err)
+	}
+
+	if err := cleanup(); err != nil {
+		panic(err.Error())
+	}
+}
+
+func TestResponseAllBackendsFailed(t *testing.T) {
+	extraConfig := `
+		MaxStaleAge = 60
+	`
+	_, cleanup, mocklmd := StartTestPeerExtra(2, 10, 10, extraConfig)
+
+	query := func(format string) (*Response, error) {
+		text := "GET hosts\nColumns: name\nBackends: mockid0 mockid1\nOutputFormat: " + format + "\n\n"
+		req, _, err := NewRequest(context.TODO(), mocklmd, bufio.NewReader(bytes.NewBufferString(text)), ParseOptimize)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = req.ExpandRequestedBackends(); err != nil {
+			t.Fatal(err)
+		}
+		res, _, err := NewResponse(context.TODO(), req, nil)
+
+		return res, err
+	}
+
+	// stop backend updates and pretend the last update happened 2 minutes ago
+	failBackend := func(id string) {
+		mocklmd.PeerMapLock.RLock()
+		p := mocklmd.PeerMap[id]
+		mocklmd.PeerMapLock.RUnlock()
+		p.Stop()
+		p.Lock.Lock()
+		p.setLastOnline(currentUnixTime() - 120)
+		p.Lock.Unlock()
+	}
+
+	type wrappedResult struct {
+		Data       []interface{}     `json:"data"`
+		Failed     map[string]string `json:"failed"`
+		Code       int               `json:"code"`
+		TotalCount int               `json:"total_count"`
+	}
+
+	tests := []struct {
+		name      string
+		fail      []string
+		numFailed int
+		rows      int
+		code      int
+	}{
+		{"none failed", nil, 0, 20, 0},
+		{"some failed", []string{"mockid1"}, 1, 10, 0},
+		{"all failed", []string{"mockid0"}, 2, 0, 502},
+	}
+	for _, test := range tests {
+		for _, id := range test.fail {
+			failBackend(id)
+		}
+
+		// json returns an error if all backends failed, the data of the remaining backends otherwise
+		res, err := query("json")
+		if test.code == 502 {
+			if err = assertLike("data too old", fmt.Sprintf("%v", err)); err != nil {
+				t.Errorf("%s: %s", test.name, err)
+			}
+			if err = assertEq(502, res.Code); err != nil {
+				t.Errorf("%s: %s", test.name, err)
+			}
+		} else {
+			if err != nil {
+				t.Fatalf("%s: %s", test.name, err)
+			}
+			res.SetResultData()
+			if err = assertEq(test.rows, len(res.Result)); err != nil {
+				t.Errorf("%s: %s", test.name, err)
+			}
+		}
+
+		// wrapped_json always returns the failed backends and sets the code if all of them failed
+		res, err = query("wrapped_json")
+		if err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+		if err = assertEq(max(test.code, 200), res.Code); err != nil {
+			t.Errorf("%s: %s", test.name, err)
+		}
+		buf, err := res.Buffer()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var result wrappedResult
+		if err = jsoniter.Unmarshal(buf.Bytes(), &result); err != nil {
+			t.Fatal(err)
+		}
+		if err = assertEq(test.code, result.Code); err != nil {
+			t.Errorf("%s: %s", test.name, err)
+		}
+		if err = assertEq(test.rows, len(result.Data)); err != nil {
+			t.Errorf("%s: %s", test.name, err)
+		}
+		if err = assertEq(test.rows, result.TotalCount); err != nil {
+			t.Errorf("%s: %s", test.name, err)
+		}
+		if err = assertEq(test.numFailed, len(result.Failed)); err != nil {
+			t.Errorf("%s: %s", test.name, err)
+		}
+	}
+
+	if err := cleanup(); err != nil {
+		panic(err.Error())
+	}
+}
+
+func TestResponsePagination(t *testing.T) {
+	peer, cleanup, _ := StartTestPeer(2, 13, 10)
+	PauseTestPeers(peer)
+
+	all, _, err := peer.QueryString("GET hosts\nColumns: name peer_key\nSort: name asc\nSort: peer_key asc\n\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = assertEq(26, len(all)); err != nil {
+		t.Fatal(err)
+	}
+
+	// walk all pages including the final short page and one page past the end
+	for _, offset := range []int{0, 10, 20, 26, 30} {
+		expect := all[min(offset, len(all)):min(offset+10, len(all))]
+		query := fmt.Sprintf("GET hosts\nColumns: name peer_key\nSort: name asc\nSort: peer_key asc\nLimit: 10\nOffset: %d\nOutputFormat: wrapped_json\n\n", offset)
+		res, meta, err := peer.QueryString(query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = assertEq(len(expect), len(res)); err != nil {
+			t.Errorf("offset %d: %s", offset, err)
+		}
+		if err = assertEq(int64(26), meta.Total); err != nil {
+			t.Errorf("offset %d: %s", offset, err)
+		}
+		for i := range res {
+			if err = assertEq(expect[i], res[i]); err != nil {
+				t.Errorf("offset %d: %s", offset, err)
+			}
+		}
+
+		// results which are not built from raw data rows use the same offset handling
+		req := &Request{Offset: offset, Limit: &[]int{10}[0]}
+		result := &Response{Request: req, Result: append(ResultSet{}, all...)}
+		result.PostProcessing()
+		if err = assertEq(ResultSet(expect), result.Result); err != nil {
+			t.Errorf("offset %d: %s", offset, err)
+		}
+		if err = assertEq(26, result.ResultTotal); err != nil {
+			t.Errorf("offset %d: %s", offset, err)
+		}
+	}
+
+	if err := cleanup(); err != nil {
+		panic(err.Error())
+	}
+}
+
+func TestResponseSortFuzz(t *testing.T) {
+	peer, cleanup, mocklmd := StartTestPeer(2, 10, 10)
+	PauseTestPeers(peer)
+
+	// one bad query must not take down the whole daemon, unsupported sort headers are rejected with code 400
+	query := func(text string) (code int, msg string) {
+		t.Helper()
+		server, client := net.Pipe()
+		go NewClientConnection(mocklmd, server, 10, 10, 10, nil).Handle()
+		go func() {
+			_, _ = client.Write([]byte(text + "\n"))
+		}()
+		data, err := io.ReadAll(client)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(data) < 16 {
+			t.Fatalf("incomplete response for %q: %q", text, data)
+		}
+		code, err = strconv.Atoi(string(data[0:3]))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return code, strings.TrimSpace(string(data[16:]))
+	}
+
+	// expectedError returns the error message for the given sort name and direction pairs or an empty string.
+	expectedError := func(table *Table, sorts [][2]string) string {
+		for _, field := range sorts {
+			name, direction := field[0], field[1]
+			if direction != "asc" && direction != "desc" && (direction != "" || strings.Contains(name, " ")) {
+				return strings.TrimSpace("bad request: unrecognized sort direction, must be asc or desc in: Sort: " + name + " " + direction)
+			}
+		}
+		// the last unknown column is reported
+		msg := ""
+		for _, field := range sorts {
+			name := strings.Fields(field[0])[0]
+			if table.GetColumn(name) == nil {
+				msg = "unknown sort column " + name
+			}
+		}
+		return msg
+	}
+
+	random := rand.New(rand.NewSource(1)) //nolint:gosec // reproducible test data only
+	directions := []string{"asc", "desc", "", "sideways"}
+	for _, tableName := range []TableName{TableHosts, TableServices, TableHostgroups} {
+		table := Objects.Tables[tableName]
+		names := []string{"nonexisting", "custom_variables FOO", "host_custom_variables FOO"}
+		for _, col := range table.Columns {
+			names = append(names, col.Name)
+		}
+
+		// every column at least once, followed by random combinations
+		for i := 0; i < len(names)+100; i++ {
+			sortHeader := ""
+			columns := []string{}
+			sorts := [][2]string{}
+			numSort := 1 + random.Intn(3)
+			for j := 0; j < numSort; j++ {
+				name := names[random.Intn(len(names))]
+				if j == 0 && i < len(names) {
+					name = names[i]
+				}
+				direction := directions[random.Intn(len(directions))]
+				sortHeader += fmt.Sprintf("Sort: %s %s\n", name, direction)
+				columns = append(columns, strings.Fields(name)[0])
+				sorts = append(sorts, [2]string{name, direction})
+			}
+			// the response header must be set before any header which fails to parse
+			text := fmt.Sprintf("GET %s\nResponseHeader: fixed16\nColumns: %s\n%s", tableName.String(), strings.Join(columns, " "), sortHeader)
+			expect := expectedError(table, sorts)
+			code, msg := query(text)
+			switch expect {
+			case "":
+				if code != 200 {
+					t.Errorf("unexpected error for %q: %d %s", text, code, msg)
+				}
+			default:
+				if err := assertEq(400, code); err != nil {
+					t.Errorf("%q: %s", text, err)
+				}
+				if err := assertLike("^"+regexp.QuoteMeta(expect)+` \(request id: r:[0-9a-z]+\)$`, msg); err != nil {
+					t.Errorf("%q: %s", text, err)
+				}
+				continue
+			}
+
+			// merged results, ex.: from passthrough queries, are sorted by the result rows
+			req, _, err := NewRequest(context.TODO(), mocklmd, bufio.NewReader(bytes.NewBufferString(text+"OutputFormat: wrapped_json\n\n")), ParseOptimize)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err = req.ExpandRequestedBackends(); err != nil {
+				t.Fatal(err)
+			}
+			res, _, err := NewResponse(context.TODO(), req, nil)
+			if err != nil {
+				t.Fatalf("unexpected error for %q: %s", text, err)
+			}
+			res.SetResultData()
+			for k, s := range req.Sort {
+				s.Index = k
+			}
+			res.sortResult()
+		}
+	}
+
+	// aggregations of non numeric columns are zero
+	res, _, err := peer.QueryString("GET hosts\nStats: sum name\nStats: avg contacts\nStats: min plugin_output\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = assertEq(float64(0), res[0][0]); err != nil {
+		t.Error(err)
+	}
+
+	if err := cleanup(); err != nil {
+		panic(err.Error())
+	}
+}
+
+func TestResponseWorkerCanceled(t *testing.T) {
+	_, cleanup, mocklmd := StartTestPeer(2, 10, 10)
+
+	// occupy the only response worker, so the query has to wait
+	mocklmd.responseWorkers = NewLimiter(1)
+	_, ok := mocklmd.responseWorkers.Acquire(context.TODO())
+	if err := assertEq(true, ok); err != nil {
+		t.Fatal(err)
+	}
+
+	req, _, err := NewRequest(context.TODO(), mocklmd, bufio.NewReader(bytes.NewBufferString("GET hosts\nColumns: name\n\n")), ParseOptimize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = req.ExpandRequestedBackends(); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.TODO(), 100*time.Millisecond)
+	defer cancel()
+	res, _, _ := NewResponse(ctx, req, nil)
+	if err := assertEq(2, len(res.Failed)); err != nil {
+		t.Error(err)
+	}
+	for id, msg := range res.Failed {
+		if err := assertEq("request canceled while waiting for a response worker: context deadline exceeded", msg); err != nil {
+			t.Errorf("%s: %s", id, err)
+		}
+	}
+
+	mocklmd.responseWorkers.Release()
+	if err := cleanup(); err != nil {
+		panic(err.Error())
+	}
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"fmt"
 	"sort"
+	"strconv"
 	"strings"
 
 	"github.com/a8m/djson"
@@ -15,8 +16,9 @@ type ResultSet [][]interface{}
 // ResultSetStats contains a result from a stats query
 type ResultSetStats struct {
 	Stats       map[string][]*Filter
-	Total       int // total number of matched rows regardless of any limits or offsets
-	RowsScanned int // total number of rows scanned to create result
+	Total       int            // total number of matched rows regardless of any limits or offsets
+	RowsScanned int            // total number of rows scanned to create result
+	PeerScanned map[string]int // number of rows scanned per peer id
 }
 
 func NewResultSetStats() *ResultSetStats {
@@ -25,6 +27,77 @@ func NewResultSetStats() *ResultSetStats {
 	return &res
 }
 
+// statsKey returns the key of the stats group for the given group column values.
+func statsKey(values []string) string {
+	key := strings.Builder{}
+	for _, value := range values {
+		appendStatsKey(&key, value)
+	}
+	return key.String()
+}
+
+// appendStatsKey appends a group column value to the stats key. Each value is prefixed with its
+// length, so splitStatsKey restores the values regardless of their content.
+func appendStatsKey(key *strings.Builder, value string) {
+	key.WriteString(strconv.Itoa(len(value)))
+	key.WriteByte(':')
+	key.WriteString(value)
+}
+
+// splitStatsKey returns the group column values of a stats key.
+func splitStatsKey(key string) []string {
+	values := []string{}
+	for key != "" {
+		sep := strings.IndexByte(key, ':')
+		if sep < 0 {
+			break
+		}
+		size, err := strconv.Atoi(key[:sep])
+		if err != nil || size < 0 || sep+1+size > len(key) {
+			break
+		}
+		values = append(values, key[sep+1:sep+1+size])
+		key = key[sep+1+size:]
+	}
+	return values
+}
+
+// Merge merges the stats from other into this stats result.
+func (s *ResultSetStats) Merge(other *ResultSetStats) {
+	for key, stats := range other.Stats {
+		if _, ok := s.Stats[key]; !ok {
+			s.Stats[key] = stats
+		} else {
+			for i := range stats {
+				st := stats[i]
+				// stats without any matching row would reset min values
+				if st.StatsCount == 0 {
+					continue
+				}
+				s.Stats[key][i].ApplyValue(st.Stats, st.StatsCount)
+			}
+		}
+	}
+	s.Total += other.Total
+	s.RowsScanned += other.RowsScanned
+	for peerKey, rows := range other.PeerScanned {
+		s.PeerScanned = addPeerRowsScanned(s.PeerScanned, peerKey, rows)
+	}
+}
+
+// addPeerRowsScanned adds the number of scanned rows for the given peer id to the map and returns it.
+// Rows from virtual stores without peer are ignored.
+func addPeerRowsScanned(scanned map[string]int, peerKey string, rows int) map[string]int {
+	if peerKey == "" {
+		return scanned
+	}
+	if scanned == nil {
+		scanned = make(map[string]int)
+	}
+	scanned[peerKey] += rows
+	return scanned
+}
+
 // NewResultSet parses resultset from given bytes
 func NewResultSet(data []byte) (res ResultSet, err error) {
 	res = make(ResultSet, 0)
@@ -131,7 +204,8 @@ func (res *ResultSetSorted) Less(i, j int) bool {
 				continue
 			}
 			return valueA < valueB
-		case StringCol:
+		default:
+			// strings and all other types are compared by their string representation
 			s1 := interface2stringNoDedup(res.Data[i][dataIndex])
 			s2 := interface2stringNoDedup(res.Data[j][dataIndex])
 			if s1 == s2 {
@@ -139,7 +213,6 @@ func (res *ResultSetSorted) Less(i, j int) bool {
 			}
 			return s1 < s2
 		}
-		panic(fmt.Sprintf("sorting not implemented for type %s", sortType))
 	}
 	return true
 }
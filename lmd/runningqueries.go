@@ -0,0 +1,251 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/sasha-s/go-deadlock"
+)
+
+// errQueryKilled is the cancel cause of queries killed by the LMD_KILL_QUERY command
+var errQueryKilled = errors.New("query has been killed")
+
+// errQueryKillDenied is returned if a client with an AuthUser tries to kill the query of another user
+var errQueryKillDenied = errors.New("not authorized to kill query")
+
+// errQueryShutdown is the cancel cause of queries still running after the drain timeout on shutdown or reload
+var errQueryShutdown = errors.New("query canceled by shutdown")
+
+// errQueryPanic is the cancel cause of queries which panicked in one of their workers
+var errQueryPanic = errors.New("internal error while processing the query")
+
+// errQueryOverloaded is returned for queries rejected because MaxConcurrentQueries and the query queue are exhausted
+var errQueryOverloaded = errors.New("too many concurrent queries, please retry later")
+
+const (
+	// DefaultShutdownDrainTimeout sets the default time in seconds to wait for in-flight queries on shutdown and reload
+	DefaultShutdownDrainTimeout = 30
+
+	// DrainCheckInterval sets the interval at which draining checks for remaining queries
+	DrainCheckInterval = 50 * time.Millisecond
+
+	// DrainLogInterval sets the interval at which the number of remaining queries is logged while draining
+	DrainLogInterval = 2 * time.Second
+
+	// DrainCancelTimeout sets how long to wait for canceled queries to finish after the drain timeout
+	DrainCancelTimeout = 3 * time.Second
+)
+
+// RunningQuery contains a single query which is currently being processed.
+type RunningQuery struct {
+	noCopy      noCopy
+	key         uint64 // internal key in the registry, the ID is not unique if supplied by the client
+	ID          string
+	Query       string // raw request text, masked headers have been replaced
+	Client      string
+	AuthUser    string // only this user or unrestricted clients may kill or list the query
+	Table       TableName
+	Start       time.Time
+	Backends    []string     // ids of the selected backends, set once the peers have been selected
+	rowsScanned atomic.Int64 // approximate number of rows scanned so far
+	cancel      context.CancelCauseFunc
+}
+
+// QueryRegistry keeps track of all running queries, they can be inspected with the lmd_queries table
+// and canceled with the LMD_KILL_QUERY command.
+type QueryRegistry struct {
+	noCopy  noCopy
+	lock    *deadlock.RWMutex
+	queries map[uint64]*RunningQuery
+	lastKey uint64
+}
+
+// NewQueryRegistry creates a new QueryRegistry.
+func NewQueryRegistry() *QueryRegistry {
+	return &QueryRegistry{
+		lock:    new(deadlock.RWMutex),
+		queries: make(map[uint64]*RunningQuery),
+	}
+}
+
+// Register adds the request to the running queries. cancel is called with errQueryKilled once the query gets killed.
+// The query must be removed with Unregister, ex.: in a defer to remove it even if the query panics.
+func (r *QueryRegistry) Register(ctx context.Context, req *Request, cancel context.CancelCauseFunc) *RunningQuery {
+	if r == nil {
+		return nil
+	}
+	var maskHeaders []string
+	if req.lmd != nil {
+		maskHeaders = req.lmd.Config.SlowQueryMaskHeaders
+	}
+	query := &RunningQuery{
+		ID:       req.ID(),
+		Query:    maskRequestHeaders(strings.TrimSpace(req.String()), maskHeaders),
+		Table:    req.Table,
+		AuthUser: req.AuthUser,
+		Start:    time.Now(),
+		cancel:   cancel,
+	}
+	if client, ok := ctx.Value(CtxClient).(string); ok {
+		query.Client = client
+	}
+	r.lock.Lock()
+	r.lastKey++
+	query.key = r.lastKey
+	r.queries[query.key] = query
+	r.lock.Unlock()
+	return query
+}
+
+// Unregister removes a query added by Register.
+func (r *QueryRegistry) Unregister(query *RunningQuery) {
+	if r == nil || query == nil {
+		return
+	}
+	r.lock.Lock()
+	delete(r.queries, query.key)
+	r.lock.Unlock()
+}
+
+// SetBackends sets the ids of the selected backends of a running query.
+func (r *QueryRegistry) SetBackends(query *RunningQuery, peers []*Peer) {
+	if r == nil || query == nil {
+		return
+	}
+	backends := make([]string, 0, len(peers))
+	for _, p := range peers {
+		backends = append(backends, p.ID)
+	}
+	r.lock.Lock()
+	query.Backends = backends
+	r.lock.Unlock()
+}
+
+// Kill cancels all running queries with the given id. Clients with an authUser may only kill their own queries.
+func (r *QueryRegistry) Kill(id, authUser string) error {
+	queries := r.matching(func(query *RunningQuery) bool {
+		return query.ID == id
+	})
+	if len(queries) == 0 {
+		return fmt.Errorf("no running query with id %s", id)
+	}
+	killed := 0
+	for _, query := range queries {
+		if authUser != "" && query.AuthUser != authUser {
+			continue
+		}
+		logWith(query.ID).Infof("killing query: %s", query.Query)
+		query.cancel(errQueryKilled)
+		killed++
+	}
+	if killed == 0 {
+		return fmt.Errorf("%w %s", errQueryKillDenied, id)
+	}
+	return nil
+}
+
+// Drain waits up to timeout till no running query matches anymore, queries still running afterwards are
+// canceled with errQueryShutdown. A nil match selects all queries. pending optionally returns the number of
+// all in-flight requests including the ones still sending their response, which cannot be canceled.
+// It returns the number of canceled queries.
+func (r *QueryRegistry) Drain(timeout time.Duration, match func(*RunningQuery) bool, pending func() int) (canceled int) {
+	remaining := func() int {
+		num := len(r.matching(match))
+		if pending != nil {
+			num = max(num, pending())
+		}
+		return num
+	}
+	deadline := time.Now().Add(timeout)
+	nextLog := time.Now()
+	for num := remaining(); num > 0; num = remaining() {
+		if time.Now().After(deadline) {
+			for _, query := range r.matching(match) {
+				query.cancel(errQueryShutdown)
+				canceled++
+			}
+			log.Warnf("drain timeout of %s exceeded, canceled %d remaining queries", timeout, canceled)
+			waitUntil := time.Now().Add(DrainCancelTimeout)
+			for remaining() > 0 && time.Now().Before(waitUntil) {
+				time.Sleep(DrainCheckInterval)
+			}
+			return canceled
+		}
+		if !time.Now().Before(nextLog) {
+			log.Infof("waiting for %d in-flight queries to finish", num)
+			nextLog = time.Now().Add(DrainLogInterval)
+		}
+		time.Sleep(DrainCheckInterval)
+	}
+	return canceled
+}
+
+// matching returns all running queries selected by match.
+func (r *QueryRegistry) matching(match func(*RunningQuery) bool) (list []*RunningQuery) {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	for _, query := range r.queries {
+		if match == nil || match(query) {
+			list = append(list, query)
+		}
+	}
+	return list
+}
+
+// List returns a snapshot of all running queries, oldest first.
+func (r *QueryRegistry) List() []RunningQueryInfo {
+	r.lock.RLock()
+	list := make([]RunningQueryInfo, 0, len(r.queries))
+	for _, query := range r.queries {
+		list = append(list, RunningQueryInfo{
+			ID:          query.ID,
+			Query:       query.Query,
+			Client:      query.Client,
+			AuthUser:    query.AuthUser,
+			Table:       query.Table,
+			Start:       query.Start,
+			Backends:    query.Backends,
+			RowsScanned: query.rowsScanned.Load(),
+		})
+	}
+	r.lock.RUnlock()
+	slices.SortFunc(list, func(a, b RunningQueryInfo) int {
+		return a.Start.Compare(b.Start)
+	})
+	return list
+}
+
+// RunningQueryInfo is a snapshot of a running query.
+type RunningQueryInfo struct {
+	ID          string
+	Query       string
+	Client      string
+	AuthUser    string
+	Table       TableName
+	Start       time.Time
+	Backends    []string
+	RowsScanned int64
+}
+
+// scannedCounter returns the counter for the rows scanned so far or nil.
+func (q *RunningQuery) scannedCounter() *atomic.Int64 {
+	if q == nil {
+		return nil
+	}
+	return &q.rowsScanned
+}
+
+// ParseKillQueryCommand returns the query id from a LMD_KILL_QUERY command
+// like "COMMAND [1234567890] LMD_KILL_QUERY;r:abcdef".
+func ParseKillQueryCommand(command string) (id string, ok bool) {
+	args, ok := splitCommand(command)
+	if !ok || len(args) != 2 || args[0] != "LMD_KILL_QUERY" {
+		return "", false
+	}
+	return strings.TrimSpace(args[1]), true
+}
@@ -0,0 +1,353 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestQueryRegistry(t *testing.T) {
+	lmd := createTestLMDInstance()
+	registry := NewQueryRegistry()
+
+	req, _, err := NewRequest(context.TODO(), lmd, bufio.NewReader(bytes.NewBufferString("GET hosts\nColumns: name\n\n")), ParseOptimize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancelCause(context.WithValue(context.Background(), CtxClient, "testclient"))
+	defer cancel(nil)
+	query := registry.Register(ctx, req, cancel)
+
+	list := registry.List()
+	if err = assertEq(1, len(list)); err != nil {
+		t.Fatal(err)
+	}
+	if err = assertEq(req.ID(), list[0].ID); err != nil {
+		t.Error(err)
+	}
+	if err = assertEq("testclient", list[0].Client); err != nil {
+		t.Error(err)
+	}
+	if err = assertEq("GET hosts\nColumns: name", list[0].Query); err != nil {
+		t.Error(err)
+	}
+
+	// a client supplied id does not replace other queries with the same id
+	ctx2, cancel2 := context.WithCancelCause(context.Background())
+	defer cancel2(nil)
+	req2 := &Request{Table: TableHosts, AuthUser: "other", id: req.ID()}
+	query2 := registry.Register(ctx2, req2, cancel2)
+	if err = assertEq(2, len(registry.List())); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = registry.Kill("unknown", ""); err == nil {
+		t.Errorf("expected error for unknown query id")
+	}
+	if err = registry.Kill(req.ID(), "nobody"); !errors.Is(err, errQueryKillDenied) {
+		t.Errorf("expected kill of other users query to be denied, got: %v", err)
+	}
+	if err = registry.Kill(req.ID(), "other"); err != nil {
+		t.Fatal(err)
+	}
+	if err = assertEq(nil, context.Cause(ctx)); err != nil {
+		t.Error(err)
+	}
+	if err = assertEq(errQueryKilled, context.Cause(ctx2)); err != nil {
+		t.Error(err)
+	}
+	if err = registry.Kill(req.ID(), ""); err != nil {
+		t.Fatal(err)
+	}
+	if err = assertEq(errQueryKilled, context.Cause(ctx)); err != nil {
+		t.Error(err)
+	}
+
+	registry.Unregister(query)
+	registry.Unregister(query2)
+	if err = assertEq(0, len(registry.List())); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestParseKillQueryCommand(t *testing.T) {
+	id, ok := ParseKillQueryCommand("COMMAND [1234567890] LMD_KILL_QUERY;r:abcdef")
+	if err := assertEq(true, ok); err != nil {
+		t.Error(err)
+	}
+	if err := assertEq("r:abcdef", id); err != nil {
+		t.Error(err)
+	}
+	for _, cmd := range []string{
+		"COMMAND [1234567890] SCHEDULE_HOST_CHECK;r:abcdef",
+		"COMMAND [1234567890] LMD_KILL_QUERY",
+		"COMMAND [1234567890 LMD_KILL_QUERY;r:abcdef",
+	} {
+		if _, ok := ParseKillQueryCommand(cmd); ok {
+			t.Errorf("expected no kill command: %s", cmd)
+		}
+	}
+}
+
+func TestResponseKilled(t *testing.T) {
+	peer, cleanup, mocklmd := StartTestPeer(1, 10, 10)
+	PauseTestPeers(peer)
+
+	req, _, err := NewRequest(context.TODO(), mocklmd, bufio.NewReader(bytes.NewBufferString("GET hosts\nColumns: name\n\n")), ParseOptimize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = req.ExpandRequestedBackends(); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancelCause(context.Background())
+	cancel(errQueryKilled)
+	_, _, err = NewResponse(ctx, req, nil)
+	if !errors.Is(err, errQueryKilled) {
+		t.Errorf("expected killed query, got: %v", err)
+	}
+	// the query has been removed from the running queries
+	if err = assertEq(0, len(mocklmd.runningQueries.List())); err != nil {
+		t.Error(err)
+	}
+
+	if err := cleanup(); err != nil {
+		panic(err.Error())
+	}
+}
+
+func TestRunningQueriesTable(t *testing.T) {
+	peer, cleanup, mocklmd := StartTestPeer(1, 10, 10)
+	PauseTestPeers(peer)
+
+	req, _, err := NewRequest(context.TODO(), mocklmd, bufio.NewReader(bytes.NewBufferString("GET services\nColumns: host_name\n\n")), ParseOptimize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancelCause(context.Background())
+	defer cancel(nil)
+	query := mocklmd.runningQueries.Register(ctx, req, cancel)
+	query.rowsScanned.Add(5)
+
+	res, _, err := peer.QueryString("GET lmd_queries\nColumns: id table rows_scanned\n\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the lmd_queries query itself is running as well
+	if err = assertEq(2, len(res)); err != nil {
+		t.Fatal(err)
+	}
+	if err = assertEq([]interface{}{req.ID(), "services", 5.0}, res[0]); err != nil {
+		t.Error(err)
+	}
+	if err = assertEq("lmd_queries", res[1][1]); err != nil {
+		t.Error(err)
+	}
+
+	_, _, err = peer.QueryString("COMMAND [0] LMD_KILL_QUERY;" + req.ID())
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-ctx.Done()
+	if err = assertEq(errQueryKilled, context.Cause(ctx)); err != nil {
+		t.Error(err)
+	}
+
+	_, _, err = peer.QueryString("COMMAND [0] LMD_KILL_QUERY;unknown\nResponseHeader: fixed16\n\n")
+	if err == nil {
+		t.Errorf("expected error for unknown query id")
+	}
+	// the query is not running for real, so nothing removes it on shutdown
+	mocklmd.runningQueries.Unregister(query)
+
+	if err := cleanup(); err != nil {
+		panic(err.Error())
+	}
+}
+
+func TestRunningQueriesTableAuthUser(t *testing.T) {
+	peer, cleanup, mocklmd := StartTestPeer(1, 10, 10)
+	PauseTestPeers(peer)
+	mocklmd.Config.SlowQueryMaskHeaders = []string{"AuthUser"}
+
+	req, _, err := NewRequest(context.TODO(), mocklmd, bufio.NewReader(bytes.NewBufferString("GET services\nColumns: host_name\nAuthUser: secret\n\n")), ParseOptimize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancelCause(context.Background())
+	defer cancel(nil)
+	query := mocklmd.runningQueries.Register(ctx, req, cancel)
+
+	// masked headers are not shown
+	res, _, err := peer.QueryString("GET lmd_queries\nColumns: id query\nFilter: table = services\n\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = assertEq(1, len(res)); err != nil {
+		t.Fatal(err)
+	}
+	if err = assertLike("AuthUser: \\*\\*\\*", res[0][1].(string)); err != nil {
+		t.Error(err)
+	}
+	if strings.Contains(res[0][1].(string), "secret") {
+		t.Errorf("AuthUser has not been masked: %s", res[0][1])
+	}
+
+	// other users only see their own queries
+	res, _, err = peer.QueryString("GET lmd_queries\nColumns: id table\nAuthUser: other\n\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = assertEq(1, len(res)); err != nil {
+		t.Fatal(err)
+	}
+	if err = assertEq("lmd_queries", res[0][1]); err != nil {
+		t.Error(err)
+	}
+
+	res, _, err = peer.QueryString("GET lmd_queries\nColumns: id table\nFilter: table = services\nAuthUser: secret\n\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = assertEq(1, len(res)); err != nil {
+		t.Fatal(err)
+	}
+	if err = assertEq([]interface{}{req.ID(), "services"}, res[0]); err != nil {
+		t.Error(err)
+	}
+
+	// the query is not running for real, so nothing removes it on shutdown
+	mocklmd.runningQueries.Unregister(query)
+
+	if err := cleanup(); err != nil {
+		panic(err.Error())
+	}
+}
+
+func TestKillQueryAck(t *testing.T) {
+	peer, cleanup, mocklmd := StartTestPeer(1, 10, 10)
+	PauseTestPeers(peer)
+
+	req, _, err := NewRequest(context.TODO(), mocklmd, bufio.NewReader(bytes.NewBufferString("GET services\nColumns: host_name\n\n")), ParseOptimize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancelCause(context.Background())
+	defer cancel(nil)
+	query := mocklmd.runningQueries.Register(ctx, req, cancel)
+
+	// queued commands are answered first, fixed16 clients get an acknowledgement for the kill
+	res := testSendCommands(t, mocklmd, "COMMAND [0] test_ok\nResponseHeader: fixed16\n\nCOMMAND [0] LMD_KILL_QUERY;"+req.ID()+"\nResponseHeader: fixed16\n\n")
+	if err = assertEq("200           1\n\n200           1\n\n", res); err != nil {
+		t.Error(err)
+	}
+	<-ctx.Done()
+	if err = assertEq(errQueryKilled, context.Cause(ctx)); err != nil {
+		t.Error(err)
+	}
+
+	res = testSendCommands(t, mocklmd, "COMMAND [0] test_ok\nResponseHeader: fixed16\n\nCOMMAND [0] LMD_KILL_QUERY;unknown\nResponseHeader: fixed16\n\n")
+	if err = assertLike("^200           1\n\n400 ", res); err != nil {
+		t.Error(err)
+	}
+	mocklmd.runningQueries.Unregister(query)
+
+	if err := cleanup(); err != nil {
+		panic(err.Error())
+	}
+}
+
+func TestContextCheckerRowsScanned(t *testing.T) {
+	query := &RunningQuery{}
+	check := newContextChecker(context.Background(), 0)
+	check.scanned = query.scannedCounter()
+	// the counter is updated on every check, every RowContextCheck rows
+	for i := 0; i <= RowContextCheck; i++ {
+		check.canceled()
+	}
+	if err := assertEq(int64(RowContextCheck), query.rowsScanned.Load()); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestQueryRegistryDrain(t *testing.T) {
+	lmd := createTestLMDInstance()
+	registry := NewQueryRegistry()
+
+	register := func(backends ...string) (*RunningQuery, context.Context) {
+		t.Helper()
+		req, _, err := NewRequest(context.TODO(), lmd, bufio.NewReader(bytes.NewBufferString("GET hosts\n\n")), ParseOptimize)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ctx, cancel := context.WithCancelCause(context.Background())
+		query := registry.Register(ctx, req, cancel)
+		query.Backends = backends
+		// queries finish once canceled
+		go func() {
+			<-ctx.Done()
+			registry.Unregister(query)
+		}()
+		return query, ctx
+	}
+
+	// finished queries are waited for
+	query, _ := register("a")
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		registry.Unregister(query)
+	}()
+	if err := assertEq(0, registry.Drain(5*time.Second, nil, nil)); err != nil {
+		t.Error(err)
+	}
+
+	// only matching queries are canceled after the timeout
+	_, ctxA := register("a")
+	_, ctxB := register("b")
+	canceled := registry.Drain(50*time.Millisecond, func(query *RunningQuery) bool {
+		return slices.Contains(query.Backends, "a")
+	}, nil)
+	if err := assertEq(1, canceled); err != nil {
+		t.Error(err)
+	}
+	if err := assertEq(errQueryShutdown, context.Cause(ctxA)); err != nil {
+		t.Error(err)
+	}
+	if err := assertEq(nil, ctxB.Err()); err != nil {
+		t.Error(err)
+	}
+	if err := assertEq(1, len(registry.List())); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestResponseShutdown(t *testing.T) {
+	peer, cleanup, mocklmd := StartTestPeer(1, 10, 10)
+	PauseTestPeers(peer)
+
+	req, _, err := NewRequest(context.TODO(), mocklmd, bufio.NewReader(bytes.NewBufferString("GET hosts\nColumns: name\n\n")), ParseOptimize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = req.ExpandRequestedBackends(); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancelCause(context.Background())
+	cancel(errQueryShutdown)
+	_, _, err = NewResponse(ctx, req, nil)
+	if !errors.Is(err, errQueryShutdown) {
+		t.Errorf("expected canceled query, got: %v", err)
+	}
+	if err = assertEq(503, responseErrorCode(err)); err != nil {
+		t.Error(err)
+	}
+
+	if err := cleanup(); err != nil {
+		panic(err.Error())
+	}
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SlowQueryMask replaces the values of masked headers in logged slow queries
+const SlowQueryMask = "***"
+
+// SlowQuery contains the details of a single slow query.
+type SlowQuery struct {
+	ID             string // request id
+	Time           time.Time
+	Duration       time.Duration
+	Table          TableName
+	Query          string   // raw request text, masked headers have been replaced
+	AuthUser       string   // only this user or unrestricted clients can see the query
+	Backends       []string // ids of the selected backends
+	RowsScanned    int
+	RowsReturned   int
+	Size           int64                    // response size in bytes if the response has been sent already
+	PeerDurations  map[string]time.Duration // duration of building the result per peer name
+	PostProcessing time.Duration            // duration of sorting and final stats calculation
+	Code           int
+}
+
+// PostProcessingDominated returns true if post processing took more than half of the query duration.
+func (q *SlowQuery) PostProcessingDominated() bool {
+	return q.PostProcessing > q.Duration/2
+}
+
+// String returns the slow query log message.
+func (q *SlowQuery) String() string {
+	var msg strings.Builder
+	fmt.Fprintf(&msg, "slow query finished after %s", q.Duration.String())
+	if q.Size > 0 {
+		fmt.Fprintf(&msg, ", response size: %s", ByteCountBinary(q.Size))
+	}
+	fmt.Fprintf(&msg, ", rows scanned: %d, rows returned: %d", q.RowsScanned, q.RowsReturned)
+	fmt.Fprintf(&msg, ", backends: %s", strings.Join(q.Backends, ","))
+	names := make([]string, 0, len(q.PeerDurations))
+	for name := range q.PeerDurations {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	for i, name := range names {
+		if i == 0 {
+			msg.WriteString(", peer durations:")
+		}
+		fmt.Fprintf(&msg, " %s=%s", name, q.PeerDurations[name].String())
+	}
+	fmt.Fprintf(&msg, ", post processing: %s", q.PostProcessing.String())
+	if q.PostProcessingDominated() {
+		msg.WriteString(" (dominated)")
+	}
+	msg.WriteString("\n")
+	msg.WriteString(q.Query)
+	return msg.String()
+}
+
+// SlowQueryLog keeps the most recent slow queries in memory, they can be inspected with the slowqueries table.
+type SlowQueryLog struct {
+	noCopy  noCopy
+	lock    sync.Mutex
+	entries []*SlowQuery // oldest first
+}
+
+// NewSlowQueryLog creates a new SlowQueryLog.
+func NewSlowQueryLog() *SlowQueryLog {
+	return &SlowQueryLog{
+		entries: make([]*SlowQuery, 0),
+	}
+}
+
+// Add appends a slow query and removes the oldest entries exceeding the given size.
+func (l *SlowQueryLog) Add(query *SlowQuery, size int) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.entries = append(l.entries, query)
+	if len(l.entries) > size {
+		l.entries = slices.Delete(l.entries, 0, len(l.entries)-size)
+	}
+}
+
+// List returns all logged slow queries, newest first.
+func (l *SlowQueryLog) List() []*SlowQuery {
+	l.lock.Lock()
+	list := slices.Clone(l.entries)
+	l.lock.Unlock()
+	slices.Reverse(list)
+	return list
+}
+
+// maskRequestHeaders replaces the values of the given headers in the raw request text.
+func maskRequestHeaders(query string, headers []string) string {
+	if len(headers) == 0 {
+		return query
+	}
+	lines := strings.Split(query, "\n")
+	for i, line := range lines {
+		header, _, found := strings.Cut(line, ":")
+		if !found {
+			continue
+		}
+		for _, masked := range headers {
+			if strings.EqualFold(header, masked) {
+				lines[i] = header + ": " + SlowQueryMask
+				break
+			}
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// checkSlowQuery logs the query if it took longer than the LogSlowQueryThreshold.
+// Time spent waiting for a WaitTrigger is not taken into account.
+// The local part of a distributed request is skipped, the merged response is checked instead.
+func (res *Response) checkSlowQuery(duration time.Duration, size int64) {
+	req := res.Request
+	if req.lmd == nil || req.localPart {
+		return
+	}
+	conf := req.lmd.Config
+	if duration-req.waitDuration() <= time.Duration(conf.LogSlowQueryThreshold)*time.Second {
+		return
+	}
+
+	query := &SlowQuery{
+		ID:             req.ID(),
+		Time:           time.Now(),
+		Duration:       duration,
+		Table:          req.Table,
+		Query:          maskRequestHeaders(strings.TrimSpace(req.String()), conf.SlowQueryMaskHeaders),
+		AuthUser:       req.AuthUser,
+		Backends:       make([]string, 0, len(res.SelectedPeers)),
+		RowsScanned:    res.RowsScanned,
+		RowsReturned:   res.rowsReturned,
+		Size:           size,
+		PostProcessing: res.postProcessing,
+		Code:           res.Code,
+	}
+	if res.RawResults != nil {
+		query.RowsScanned = res.RawResults.RowsScanned
+	}
+	for _, p := range res.SelectedPeers {
+		query.Backends = append(query.Backends, p.ID)
+	}
+	// the slow query log outlives the response, so keep a copy
+	res.Lock.RLock()
+	query.PeerDurations = maps.Clone(res.peerDurations)
+	res.Lock.RUnlock()
+
+	logWith(res).Warnf("%s", query.String())
+
+	if conf.SlowQueryLogSize > 0 {
+		req.lmd.slowQueries.Add(query, conf.SlowQueryLogSize)
+	}
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sasha-s/go-deadlock"
+)
+
+func TestSlowQueryLog(t *testing.T) {
+	slowQueries := NewSlowQueryLog()
+	for i := 0; i < 5; i++ {
+		slowQueries.Add(&SlowQuery{Code: 200 + i}, 3)
+	}
+
+	list := slowQueries.List()
+	codes := make([]int, 0, len(list))
+	for _, query := range list {
+		codes = append(codes, query.Code)
+	}
+	if err := assertEq([]int{204, 203, 202}, codes); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestSlowQueryString(t *testing.T) {
+	query := &SlowQuery{
+		Duration:       2 * time.Second,
+		Query:          "GET hosts",
+		Backends:       []string{"id1", "id2"},
+		RowsScanned:    100,
+		RowsReturned:   10,
+		PeerDurations:  map[string]time.Duration{"b": 300 * time.Millisecond, "a": 200 * time.Millisecond},
+		PostProcessing: 1500 * time.Millisecond,
+	}
+	expect := "slow query finished after 2s, rows scanned: 100, rows returned: 10, backends: id1,id2, peer durations: a=200ms b=300ms, post processing: 1.5s (dominated)\nGET hosts"
+	if err := assertEq(expect, query.String()); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestMaskRequestHeaders(t *testing.T) {
+	query := "GET hosts\nColumns: name\nAuthUser: secret\nauthuser: secret"
+	if err := assertEq("GET hosts\nColumns: name\nAuthUser: ***\nauthuser: ***", maskRequestHeaders(query, []string{"AuthUser"})); err != nil {
+		t.Error(err)
+	}
+	if err := assertEq(query, maskRequestHeaders(query, nil)); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestSlowQueryTable(t *testing.T) {
+	peer, cleanup, mocklmd := StartTestPeer(2, 10, 10)
+	PauseTestPeers(peer)
+
+	// log every query as slow query
+	mocklmd.Config.LogSlowQueryThreshold = 0
+	mocklmd.Config.SlowQueryMaskHeaders = []string{"AuthUser"}
+
+	_, _, err := peer.QueryString("GET services\nColumns: host_name description\nSort: description asc\nAuthUser: secret\n\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res, _, err := peer.QueryString("GET slowqueries\nColumns: table query backends rows_scanned rows_returned peer_durations code request_id\nFilter: table = services\n\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = assertEq(1, len(res)); err != nil {
+		t.Fatal(err)
+	}
+	row := res[0]
+	if err = assertEq("services", row[0]); err != nil {
+		t.Error(err)
+	}
+	if err = assertLike("AuthUser: \\*\\*\\*", row[1].(string)); err != nil {
+		t.Error(err)
+	}
+	if strings.Contains(row[1].(string), "secret") {
+		t.Errorf("AuthUser has not been masked: %s", row[1])
+	}
+	if err = assertEq(2, len(row[2].([]interface{}))); err != nil {
+		t.Error(err)
+	}
+	if err = assertEq(20.0, row[3]); err != nil {
+		t.Error(err)
+	}
+	// unknown contact, so no rows are returned
+	if err = assertEq(0.0, row[4]); err != nil {
+		t.Error(err)
+	}
+	if err = assertEq(2, len(row[5].([]interface{}))); err != nil {
+		t.Error(err)
+	}
+	if err = assertEq(200.0, row[6]); err != nil {
+		t.Error(err)
+	}
+	if err = assertLike(`^r:[0-9a-z]{6}$`, row[7].(string)); err != nil {
+		t.Error(err)
+	}
+
+	// other users only see their own slow queries
+	for user, num := range map[string]int{"other": 0, "secret": 1} {
+		res, _, err = peer.QueryString("GET slowqueries\nColumns: table query\nFilter: table = services\nAuthUser: " + user + "\n\n")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = assertEq(num, len(res)); err != nil {
+			t.Errorf("%s: %s", user, err)
+		}
+	}
+
+	if err := cleanup(); err != nil {
+		panic(err.Error())
+	}
+}
+
+func TestSlowQueryCheck(t *testing.T) {
+	lmd := createTestLMDInstance()
+	lmd.Config.LogSlowQueryThreshold = 0
+	lmd.Config.SlowQueryLogSize = 10
+	res := &Response{
+		Code:          200,
+		Request:       &Request{lmd: lmd, Table: TableHosts},
+		Lock:          new(deadlock.RWMutex),
+		peerDurations: map[string]time.Duration{"a": time.Second},
+	}
+	res.checkSlowQuery(2*time.Second, 0)
+	list := lmd.slowQueries.List()
+	if err := assertEq(1, len(list)); err != nil {
+		t.Fatal(err)
+	}
+
+	// the logged query must not change with the response
+	res.peerDurations["b"] = time.Second
+	if err := assertEq(map[string]time.Duration{"a": time.Second}, list[0].PeerDurations); err != nil {
+		t.Error(err)
+	}
+
+	// time spent waiting does not count
+	res.Request.WaitTimeout = 3000
+	res.checkSlowQuery(2*time.Second, 0)
+	if err := assertEq(1, len(lmd.slowQueries.List())); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"sort"
+)
+
+// SortKeysMinRows sets the minimum number of rows before the sort keys are extracted in advance.
+// Smaller results are sorted by converting the values on every comparison.
+const SortKeysMinRows = 1000
+
+// sortKeys sorts a permutation of row numbers by typed sort values which are extracted only once per row.
+type sortKeys struct {
+	keys []sortKey
+	perm []int // row numbers in sorted order
+}
+
+// sortKey contains the values of a single sort field for all rows.
+type sortKey struct {
+	numbers   []float64 // values of numeric columns
+	strings   []string  // values of all other columns
+	numeric   bool
+	unsorted  bool // sorting by this column is not implemented
+	direction SortDirection
+}
+
+// newResultSortKeys extracts the sort keys of the result rows just like Response.compareRows compares them.
+// It returns nil if a sort column type is not supported.
+func newResultSortKeys(res *Response) *sortKeys {
+	keys := newSortKeys(len(res.Result), len(res.Request.Sort))
+	for k, s := range res.Request.Sort {
+		var sortType DataType
+		switch {
+		case s.Group:
+			sortType = StringCol
+		case s.Index < len(res.Request.RequestColumns):
+			sortType = res.Request.RequestColumns[s.Index].DataType
+		default:
+			// sort column has been added to the passthrough columns
+			sortType = s.Column.DataType
+		}
+		key := &keys.keys[k]
+		key.direction = s.Direction
+		switch sortType {
+		case IntCol, Int64Col, FloatCol:
+			key.numeric = true
+			key.numbers = make([]float64, len(res.Result))
+			for i, row := range res.Result {
+				key.numbers[i] = interface2float64(row[s.Index])
+			}
+		case JSONCol, StringCol:
+			index := s.Index
+			if s.Group {
+				index = 0
+			}
+			key.strings = make([]string, len(res.Result))
+			for i, row := range res.Result {
+				key.strings[i] = interface2stringNoDedup(row[index])
+			}
+		case CustomVarCol:
+			key.strings = make([]string, len(res.Result))
+			for i, row := range res.Result {
+				key.strings[i] = interface2hashmap(row[s.Index])[s.Args]
+			}
+		case StringListCol, Int64ListCol:
+			key.unsorted = true
+		default:
+			return nil
+		}
+	}
+
+	return keys
+}
+
+// newRawSortKeys extracts the sort keys of the data rows just like RawResultSet.compareRows compares them.
+// It returns nil if a sort column type is not supported.
+func newRawSortKeys(raw *RawResultSet) *sortKeys {
+	keys := newSortKeys(len(raw.DataResult), len(raw.Sort))
+	for k, s := range raw.Sort {
+		key := &keys.keys[k]
+		key.direction = s.Direction
+		switch s.Column.DataType {
+		case IntCol, Int64Col, FloatCol:
+			key.numeric = true
+			key.numbers = make([]float64, len(raw.DataResult))
+			for i, row := range raw.DataResult {
+				key.numbers[i] = row.GetFloat(s.Column)
+			}
+		case CustomVarCol:
+			key.strings = make([]string, len(raw.DataResult))
+			for i, row := range raw.DataResult {
+				if s.Args == "" {
+					// no variable name given, sort by string representation
+					key.strings[i] = row.GetString(s.Column)
+				} else {
+					key.strings[i] = row.GetCustomVarValue(s.Column, s.Args)
+				}
+			}
+		case StringCol, StringLargeCol, StringListCol, ServiceMemberListCol, InterfaceListCol, JSONCol, Int64ListCol:
+			key.strings = make([]string, len(raw.DataResult))
+			for i, row := range raw.DataResult {
+				key.strings[i] = row.GetString(s.Column)
+			}
+		default:
+			return nil
+		}
+	}
+
+	return keys
+}
+
+func newSortKeys(numRows, numKeys int) *sortKeys {
+	keys := &sortKeys{
+		keys: make([]sortKey, numKeys),
+		perm: make([]int, numRows),
+	}
+	for i := range keys.perm {
+		keys.perm[i] = i
+	}
+
+	return keys
+}
+
+// Len returns the number of rows.
+func (k *sortKeys) Len() int {
+	return len(k.perm)
+}
+
+// Less returns the sort result of two rows.
+func (k *sortKeys) Less(i, j int) bool {
+	return k.compare(k.perm[i], k.perm[j]) <= 0
+}
+
+// Swap replaces two rows while sorting.
+func (k *sortKeys) Swap(i, j int) {
+	k.perm[i], k.perm[j] = k.perm[j], k.perm[i]
+}
+
+// compare returns -1 if row a is sorted before row b, 1 if it is sorted after and 0 if both are equal.
+func (k *sortKeys) compare(rowA, rowB int) int {
+	for i := range k.keys {
+		key := &k.keys[i]
+		switch {
+		case key.unsorted:
+			return sortDirectionResult(key.direction, true)
+		case key.numeric:
+			valueA, valueB := key.numbers[rowA], key.numbers[rowB]
+			if valueA == valueB {
+				continue
+			}
+			return sortDirectionResult(key.direction, valueA < valueB)
+		default:
+			// check for equal strings first, they are much cheaper to compare than their order
+			valueA, valueB := key.strings[rowA], key.strings[rowB]
+			if valueA == valueB {
+				continue
+			}
+			return sortDirectionResult(key.direction, valueA < valueB)
+		}
+	}
+
+	return 0
+}
+
+// applySortPermutation reorders the rows into the sorted order of the permutation.
+func applySortPermutation[T any](rows []T, perm []int) {
+	sorted := make([]T, len(rows))
+	for i, num := range perm {
+		sorted[i] = rows[num]
+	}
+	copy(rows, sorted)
+}
+
+// sortResult sorts the result rows, large results are sorted by precomputed sort keys.
+func (res *Response) sortResult() {
+	if len(res.Result) >= SortKeysMinRows {
+		if keys := newResultSortKeys(res); keys != nil {
+			sort.Sort(keys)
+			applySortPermutation(res.Result, keys.perm)
+			return
+		}
+	}
+	sort.Sort(res)
+}
+
+// sortRows sorts the data rows, large results are sorted by precomputed sort keys.
+func (raw *RawResultSet) sortRows() {
+	if len(raw.DataResult) >= SortKeysMinRows {
+		if keys := newRawSortKeys(raw); keys != nil {
+			sort.Sort(keys)
+			applySortPermutation(raw.DataResult, keys.perm)
+			return
+		}
+	}
+	sort.Sort(raw)
+}
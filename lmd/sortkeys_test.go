@@ -0,0 +1,72 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"slices"
+	"sort"
+	"testing"
+)
+
+func TestSortKeysResult(t *testing.T) {
+	lmd := createTestLMDInstance()
+	query := "GET services\nColumns: state description host_name\nSort: state desc\nSort: host_name asc\nSort: description asc\n\n"
+	req, _, err := NewRequest(context.TODO(), lmd, bufio.NewReader(bytes.NewBufferString(query)), ParseDefault)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, s := range req.Sort {
+		s.Index = slices.Index(req.Columns, s.Name)
+		if s.Index == -1 {
+			t.Fatalf("sort column %d not found", i)
+		}
+	}
+
+	result := make(ResultSet, 0, 3*SortKeysMinRows)
+	for i := 0; i < cap(result); i++ {
+		result = append(result, []interface{}{float64(i % 4), fmt.Sprintf("svc_%d", i), fmt.Sprintf("host_%d", i%7)})
+	}
+	expect := &Response{Request: req, Result: slices.Clone(result)}
+	sort.Sort(expect)
+	res := &Response{Request: req, Result: slices.Clone(result)}
+	res.sortResult()
+
+	if err := assertEq(expect.Result, res.Result); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestSortKeysRaw(t *testing.T) {
+	peer, cleanup, _ := StartTestPeer(1, 100, SortKeysMinRows)
+	PauseTestPeers(peer)
+
+	store, err := peer.GetDataStore(TableServices)
+	if err != nil {
+		t.Fatal(err)
+	}
+	table := store.Table
+	sortFields := []*SortField{
+		{Name: "state", Column: table.GetColumn("state"), Direction: Asc},
+		{Name: "host_name", Column: table.GetColumn("host_name"), Direction: Desc},
+		{Name: "description", Column: table.GetColumn("description"), Direction: Asc},
+	}
+	expect := &RawResultSet{Sort: sortFields, DataResult: slices.Clone(store.Data)}
+	sort.Sort(expect)
+	raw := &RawResultSet{Sort: sortFields, DataResult: slices.Clone(store.Data)}
+	raw.sortRows()
+
+	if err := assertEq(len(expect.DataResult), len(raw.DataResult)); err != nil {
+		t.Fatal(err)
+	}
+	for i := range expect.DataResult {
+		if expect.DataResult[i] != raw.DataResult[i] {
+			t.Fatalf("row %d differs: %s != %s", i, expect.DataResult[i].GetID(), raw.DataResult[i].GetID())
+		}
+	}
+
+	if err := cleanup(); err != nil {
+		panic(err.Error())
+	}
+}
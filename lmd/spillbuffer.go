@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+)
+
+// SpillBuffer keeps written data in memory until it exceeds the threshold and
+// continues in a temporary file afterwards, so huge responses do not exhaust the memory.
+type SpillBuffer struct {
+	noCopy    noCopy
+	mem       bytes.Buffer
+	file      *os.File
+	threshold int64  // spill to a temporary file once the buffer exceeds this size, zero disables spilling
+	dir       string // directory for temporary files, empty uses the default directory for temporary files
+	size      int64
+}
+
+// NewSpillBuffer creates a new SpillBuffer.
+func NewSpillBuffer(threshold int64, dir string) *SpillBuffer {
+	return &SpillBuffer{
+		threshold: threshold,
+		dir:       dir,
+	}
+}
+
+// Write appends data to the buffer.
+func (b *SpillBuffer) Write(data []byte) (int, error) {
+	if b.file != nil {
+		written, err := b.file.Write(data)
+		b.size += int64(written)
+		if err != nil {
+			return written, fmt.Errorf("writing temporary file failed: %w", err)
+		}
+		return written, nil
+	}
+	written, _ := b.mem.Write(data)
+	b.size += int64(written)
+	if b.threshold > 0 && int64(b.mem.Len()) > b.threshold {
+		b.spill()
+	}
+	return written, nil
+}
+
+// spill moves the buffered data into a temporary file. The data stays in memory if that fails.
+func (b *SpillBuffer) spill() {
+	file, err := os.CreateTemp(b.dir, "lmd-response-*")
+	if err != nil {
+		log.Warnf("cannot spill huge response to temporary file, keeping it in memory: %s", err.Error())
+		b.threshold = 0
+		return
+	}
+	// keep the buffer until the file has been written successfully
+	_, err = file.Write(b.mem.Bytes())
+	if err != nil {
+		log.Warnf("cannot spill huge response to temporary file, keeping it in memory: %s", err.Error())
+		b.threshold = 0
+		b.removeFile(file)
+		return
+	}
+	log.Debugf("spilled response of %s to temporary file %s", ByteCountBinary(b.size), file.Name())
+	promFrontendResponseSpills.Inc()
+	b.mem = bytes.Buffer{}
+	b.file = file
+}
+
+// Len returns the number of bytes written.
+func (b *SpillBuffer) Len() int64 {
+	return b.size
+}
+
+// Spilled returns true if the data has been moved into a temporary file.
+func (b *SpillBuffer) Spilled() bool {
+	return b.file != nil
+}
+
+// Bytes returns the buffered data if it has not been spilled.
+func (b *SpillBuffer) Bytes() []byte {
+	return b.mem.Bytes()
+}
+
+// WriteTo writes all buffered data to w.
+func (b *SpillBuffer) WriteTo(w io.Writer) (int64, error) {
+	if b.file == nil {
+		written, err := b.mem.WriteTo(w)
+		if err != nil {
+			return written, fmt.Errorf("write error: %w", err)
+		}
+		return written, nil
+	}
+	if _, err := b.file.Seek(0, io.SeekStart); err != nil {
+		return 0, fmt.Errorf("reading temporary file failed: %w", err)
+	}
+	written, err := io.Copy(w, b.file)
+	if err != nil {
+		return written, fmt.Errorf("write error: %w", err)
+	}
+	return written, nil
+}
+
+// Close removes the temporary file and releases the buffer.
+func (b *SpillBuffer) Close() {
+	b.mem = bytes.Buffer{}
+	if b.file != nil {
+		b.removeFile(b.file)
+		b.file = nil
+	}
+}
+
+func (b *SpillBuffer) removeFile(file *os.File) {
+	LogErrors(file.Close())
+	LogErrors(os.Remove(file.Name()))
+}
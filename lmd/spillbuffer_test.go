@@ -0,0 +1,76 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSpillBuffer(t *testing.T) {
+	dir := t.TempDir()
+	buf := NewSpillBuffer(100, dir)
+	defer buf.Close()
+
+	_, err := buf.Write([]byte(strings.Repeat("a", 50)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := assertEq(false, buf.Spilled()); err != nil {
+		t.Error(err)
+	}
+
+	_, err = buf.Write([]byte(strings.Repeat("b", 100)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = buf.Write([]byte(strings.Repeat("c", 10)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := assertEq(true, buf.Spilled()); err != nil {
+		t.Error(err)
+	}
+	if err := assertEq(int64(160), buf.Len()); err != nil {
+		t.Error(err)
+	}
+
+	out := new(bytes.Buffer)
+	_, err = buf.WriteTo(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := assertEq(strings.Repeat("a", 50)+strings.Repeat("b", 100)+strings.Repeat("c", 10), out.String()); err != nil {
+		t.Error(err)
+	}
+
+	// temporary file is removed on close
+	buf.Close()
+	files, _ := os.ReadDir(dir)
+	if err := assertEq(0, len(files)); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestSpillBufferFallback(t *testing.T) {
+	buf := NewSpillBuffer(10, filepath.Join(t.TempDir(), "missing"))
+	defer buf.Close()
+
+	// data is kept in memory if the temporary file cannot be created
+	_, err := buf.Write([]byte(strings.Repeat("a", 50)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := assertEq(false, buf.Spilled()); err != nil {
+		t.Error(err)
+	}
+	out := new(bytes.Buffer)
+	_, err = buf.WriteTo(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := assertEq(strings.Repeat("a", 50), out.String()); err != nil {
+		t.Error(err)
+	}
+}
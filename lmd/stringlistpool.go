@@ -0,0 +1,111 @@
+package main
+
+import (
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/OneOfOne/xxhash"
+)
+
+const (
+	// StringListPoolMaxSize sets the maximum number of pooled string lists
+	StringListPoolMaxSize = 500000
+
+	// StringListPoolMaxAge sets the duration after which unused string lists are removed from the pool
+	StringListPoolMaxAge = 30 * time.Minute
+)
+
+// stringListDedup shares identical static string lists, ex.: contacts or groups, between all backends
+var stringListDedup = NewStringListPool(StringListPoolMaxSize)
+
+// StringListPool shares identical string lists between rows and backends.
+// Rows keep their lists when they are removed from the pool, so lists which have not been
+// used recently can be compacted away and lists of removed backends are not kept forever.
+type StringListPool struct {
+	noCopy  noCopy
+	lock    sync.Mutex
+	lists   map[uint64]*stringListEntry
+	maxSize int   // new lists are not pooled once the maximum size is reached
+	hits    int64 // number of lists found in the pool
+	misses  int64 // number of lists not found in the pool
+}
+
+type stringListEntry struct {
+	list     []string
+	lastUsed time.Time
+}
+
+// NewStringListPool creates a new StringListPool.
+func NewStringListPool(maxSize int) *StringListPool {
+	return &StringListPool{
+		lists:   make(map[uint64]*stringListEntry),
+		maxSize: maxSize,
+	}
+}
+
+// Intern returns the pooled list with the same content or adds the given list to the pool.
+func (p *StringListPool) Intern(list []string) []string {
+	if len(list) == 0 {
+		return list
+	}
+	key := hashStringList(list)
+	now := time.Now()
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	entry, ok := p.lists[key]
+	switch {
+	case ok && slices.Equal(entry.list, list):
+		p.hits++
+		entry.lastUsed = now
+		return entry.list
+	case ok:
+		// hash collision, keep the existing entry
+	case len(p.lists) < p.maxSize:
+		p.lists[key] = &stringListEntry{list: list, lastUsed: now}
+	}
+	p.misses++
+	return list
+}
+
+// Compact removes all lists which have not been used within maxAge and returns the number of removed lists.
+func (p *StringListPool) Compact(maxAge time.Duration) (removed int) {
+	limit := time.Now().Add(-maxAge)
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	for key, entry := range p.lists {
+		if entry.lastUsed.Before(limit) {
+			delete(p.lists, key)
+			removed++
+		}
+	}
+	return removed
+}
+
+// Size returns the number of pooled lists.
+func (p *StringListPool) Size() int {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return len(p.lists)
+}
+
+// HitRate returns the ratio of lists which have been found in the pool.
+func (p *StringListPool) HitRate() float64 {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.hits+p.misses == 0 {
+		return 0
+	}
+	return float64(p.hits) / float64(p.hits+p.misses)
+}
+
+// hashStringList returns the hash of the list content
+func hashStringList(list []string) uint64 {
+	hash := xxhash.New64()
+	for _, s := range list {
+		_, _ = hash.WriteString(s)
+		_, _ = hash.WriteString(ListSepChar1)
+	}
+	return hash.Sum64()
+}
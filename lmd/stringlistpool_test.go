@@ -0,0 +1,66 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestStringListPool(t *testing.T) {
+	pool := NewStringListPool(2)
+
+	list1 := pool.Intern([]string{"a", "b"})
+	list2 := pool.Intern([]string{"a", "b"})
+	if &list1[0] != &list2[0] {
+		t.Errorf("identical lists should share storage")
+	}
+	list3 := pool.Intern([]string{"ab"})
+	if err := assertEq([]string{"ab"}, list3); err != nil {
+		t.Error(err)
+	}
+
+	// pool is full, new lists are returned unchanged
+	list4 := pool.Intern([]string{"c"})
+	list5 := pool.Intern([]string{"c"})
+	if &list4[0] == &list5[0] {
+		t.Errorf("lists should not be pooled once the pool is full")
+	}
+	if err := assertEq(2, pool.Size()); err != nil {
+		t.Error(err)
+	}
+	if err := assertEq(0.2, pool.HitRate()); err != nil {
+		t.Error(err)
+	}
+
+	// recently used lists are kept
+	if err := assertEq(0, pool.Compact(time.Minute)); err != nil {
+		t.Error(err)
+	}
+	if err := assertEq(2, pool.Compact(0)); err != nil {
+		t.Error(err)
+	}
+	if err := assertEq(0, pool.Size()); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestStringListPoolPeers(t *testing.T) {
+	peer, cleanup, mocklmd := StartTestPeer(2, 10, 10)
+	PauseTestPeers(peer)
+
+	// static string lists are shared between backends
+	var contacts [][]string
+	for _, id := range mocklmd.PeerMapOrder {
+		store, err := mocklmd.PeerMap[id].GetDataStore(TableHosts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		contacts = append(contacts, store.Data[0].GetStringListByName("contacts"))
+	}
+	if len(contacts[0]) == 0 || &contacts[0][0] != &contacts[1][0] {
+		t.Errorf("contacts of both backends should share storage")
+	}
+
+	if err := cleanup(); err != nil {
+		panic(err.Error())
+	}
+}
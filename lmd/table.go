@@ -2,6 +2,8 @@ package main
 
 import (
 	"fmt"
+	"path"
+	"sort"
 	"strings"
 
 	"github.com/sasha-s/go-deadlock"
@@ -39,6 +41,9 @@ const (
 	TableHostsbygroup
 	TableServicesbygroup
 	TableServicesbyhostgroup
+	TableSlowqueries
+	TableQueries
+	TableNodes
 )
 
 // PeerLockMode sets full or simple lock mode
@@ -93,6 +98,12 @@ func NewTableName(name string) (TableName, error) {
 		return TableServicesbygroup, nil
 	case "servicesbyhostgroup":
 		return TableServicesbyhostgroup, nil
+	case "slowqueries":
+		return TableSlowqueries, nil
+	case "lmd_queries":
+		return TableQueries, nil
+	case "nodes":
+		return TableNodes, nil
 	}
 	return TableNone, fmt.Errorf("table %s does not exist", name)
 }
@@ -138,6 +149,12 @@ func (t *TableName) String() string {
 		return "servicesbygroup"
 	case TableServicesbyhostgroup:
 		return "servicesbyhostgroup"
+	case TableSlowqueries:
+		return "slowqueries"
+	case TableQueries:
+		return "lmd_queries"
+	case TableNodes:
+		return "nodes"
 	}
 
 	log.Panicf("unsupported tablename: %v", t)
@@ -151,7 +168,6 @@ type Table struct {
 	Columns         ColumnList
 	ColumnsIndex    map[string]*Column // access columns by name
 	PassthroughOnly bool               // flag wether table will be cached or simply passed through to remote sites
-	WorksUnlocked   bool               // flag wether locking the peer.DataLock can be skipped to answer the query
 	PrimaryKey      []string
 	RefTables       []TableRef // referenced tables
 	Virtual         VirtualStoreResolveFunc
@@ -178,6 +194,40 @@ func (t *Table) GetColumnWithFallback(name string) *Column {
 	return t.ColumnsIndex[name]
 }
 
+// GetLocalColumns returns all columns with local storage.
+func (t *Table) GetLocalColumns() ColumnList {
+	columns := make(ColumnList, 0)
+	for _, col := range t.Columns {
+		if col.StorageType == LocalStore {
+			columns = append(columns, col)
+		}
+	}
+	return columns
+}
+
+// ExpandColumnPattern returns the names of all columns matching the given wildcard pattern
+// in alphabetical order. Names without wildcard are returned unchanged.
+func (t *Table) ExpandColumnPattern(pattern string) ([]string, error) {
+	if !strings.Contains(pattern, "*") {
+		return []string{pattern}, nil
+	}
+	names := make([]string, 0)
+	for i := range t.Columns {
+		matched, err := path.Match(pattern, t.Columns[i].Name)
+		if err != nil {
+			return nil, fmt.Errorf("invalid column pattern %s: %s", pattern, err.Error())
+		}
+		if matched {
+			names = append(names, t.Columns[i].Name)
+		}
+	}
+	if len(names) == 0 {
+		return nil, fmt.Errorf("column pattern %s does not match any column", pattern)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
 // GetColumns returns a column list for list of names
 func (t *Table) GetColumns(names []string) ColumnList {
 	columns := make(ColumnList, 0, len(names))
@@ -1,5 +1,10 @@
 package main
 
+import (
+	"sort"
+	"time"
+)
+
 type VirtualStoreResolveFunc func(table *Table, peer *Peer) *DataStore
 
 // GetTableBackendsStore returns the virtual data used for the backends livestatus table.
@@ -17,7 +22,19 @@ func GetTableBackendsStore(table *Table, peer *Peer) *DataStore {
 
 // GetTableColumnsStore returns the virtual data used for the columns/table livestatus table.
 func GetTableColumnsStore(table *Table, _ *Peer) *DataStore {
-	store := NewDataStore(table, nil)
+	return GetTableColumnsStoreForPeers(table, nil)
+}
+
+// GetTableColumnsStoreForPeers returns the virtual data used for the columns/table livestatus table
+// merged from all given peers. A column is listed if at least one peer provides it, the
+// missing_backends column contains the ids of all peers lacking it.
+// All columns will be listed if no peers are given.
+func GetTableColumnsStoreForPeers(table *Table, peers []*Peer) *DataStore {
+	return newSchemaStore(table, getSchemaColumnsData(peers))
+}
+
+// getSchemaColumnsData returns one row for each column of all tables provided by at least one of the given peers.
+func getSchemaColumnsData(peers []*Peer) ResultSet {
 	data := make(ResultSet, 0)
 	for _, t := range Objects.Tables {
 		for i := range t.Columns {
@@ -25,6 +42,18 @@ func GetTableColumnsStore(table *Table, _ *Peer) *DataStore {
 			if c.StorageType == RefStore {
 				continue
 			}
+			missing := make([]string, 0)
+			if c.Optional != NoFlags {
+				for _, p := range peers {
+					if !p.HasFlag(c.Optional) {
+						missing = append(missing, p.ID)
+					}
+				}
+			}
+			if len(peers) > 0 && len(missing) == len(peers) {
+				continue
+			}
+			sort.Strings(missing)
 			colTypeName := ""
 			switch c.DataType {
 			case IntCol, Int64Col:
@@ -33,8 +62,10 @@ func GetTableColumnsStore(table *Table, _ *Peer) *DataStore {
 				colTypeName = "string"
 			case FloatCol:
 				colTypeName = "float"
-			case StringListCol, Int64ListCol, ServiceMemberListCol, InterfaceListCol, CustomVarCol:
+			case StringListCol, Int64ListCol, ServiceMemberListCol, InterfaceListCol:
 				colTypeName = "list"
+			case CustomVarCol:
+				colTypeName = "dict"
 			default:
 				log.Panicf("type not handled in table %s: %#v", t.Name, c)
 			}
@@ -47,10 +78,17 @@ func GetTableColumnsStore(table *Table, _ *Peer) *DataStore {
 				c.DataType.String(),
 				c.StorageType.String(),
 				c.Optional.List(),
+				missing,
 			}
 			data = append(data, row)
 		}
 	}
+	return data
+}
+
+// newSchemaStore returns a store for the columns or tables table filled with the given data.
+func newSchemaStore(table *Table, data ResultSet) *DataStore {
+	store := NewDataStore(table, nil)
 	columns := make(ColumnList, 0)
 	for _, col := range table.Columns {
 		if col.StorageType == RefStore {
@@ -65,59 +103,256 @@ func GetTableColumnsStore(table *Table, _ *Peer) *DataStore {
 	return store
 }
 
-// GetGroupByData returns fake query result for given groupby table
+// GetTableTablesStore returns the virtual data used for the tables livestatus table.
+func GetTableTablesStore(table *Table, peer *Peer) *DataStore {
+	if peer == nil {
+		return GetTableTablesStoreForPeers(table, nil, true)
+	}
+	return GetTableTablesStoreForPeers(table, []*Peer{peer}, true)
+}
+
+// GetTableTablesStoreForPeers returns the virtual data used for the tables livestatus table. It lists
+// the columns like the columns table along with the number of rows, the last update and the estimated
+// size of the table of each column over all given peers. The size is only estimated if withSize is set,
+// otherwise it is zero.
+func GetTableTablesStoreForPeers(table *Table, peers []*Peer, withSize bool) *DataStore {
+	type tableStats struct {
+		rows       int
+		lastUpdate float64
+		size       int64
+	}
+	stats := make(map[string]*tableStats)
+	for _, p := range peers {
+		ds, err := p.GetDataStoreSet()
+		if err != nil {
+			continue
+		}
+		lastUpdate := p.StatusGet(LastUpdate).(float64)
+		for name, s := range *ds.tables.Load() {
+			st, ok := stats[name.String()]
+			if !ok {
+				st = &tableStats{}
+				stats[name.String()] = st
+			}
+			st.rows += len(s.Data)
+			st.lastUpdate = max(st.lastUpdate, lastUpdate)
+			if !withSize {
+				continue
+			}
+			for _, row := range s.Data {
+				st.size += row.SizeEstimate()
+			}
+		}
+	}
+
+	data := getSchemaColumnsData(peers)
+	for i, row := range data {
+		st, ok := stats[row[1].(string)]
+		if !ok {
+			st = &tableStats{}
+		}
+		data[i] = append(row, st.rows, st.lastUpdate, st.size)
+	}
+	return newSchemaStore(table, data)
+}
+
+// GetTableSlowqueriesStore returns the virtual data used for the slowqueries livestatus table.
+func GetTableSlowqueriesStore(table *Table, peer *Peer) *DataStore {
+	if peer == nil {
+		return GetTableSlowqueriesStoreForLog(table, nil, "")
+	}
+	return GetTableSlowqueriesStoreForLog(table, peer.lmd.slowQueries, "")
+}
+
+// GetTableSlowqueriesStoreForLog returns the virtual data used for the slowqueries livestatus table
+// from the given slow query log. If authUser is set, only the queries of this user are returned.
+func GetTableSlowqueriesStoreForLog(table *Table, slowQueries *SlowQueryLog, authUser string) *DataStore {
+	store := NewDataStore(table, nil)
+	data := make(ResultSet, 0)
+	if slowQueries != nil {
+		for _, query := range slowQueries.List() {
+			if authUser != "" && query.AuthUser != authUser {
+				continue
+			}
+			dominated := 0
+			if query.PostProcessingDominated() {
+				dominated = 1
+			}
+			peerDurations := make([]interface{}, 0, len(query.PeerDurations))
+			for name, duration := range query.PeerDurations {
+				peerDurations = append(peerDurations, []interface{}{name, duration.Seconds()})
+			}
+			data = append(data, []interface{}{
+				float64(query.Time.UnixNano()) / float64(time.Second),
+				query.Duration.Seconds(),
+				query.Table.String(),
+				query.Query,
+				query.Backends,
+				int64(query.RowsScanned),
+				int64(query.RowsReturned),
+				query.Size,
+				peerDurations,
+				query.PostProcessing.Seconds(),
+				dominated,
+				query.Code,
+				query.ID,
+			})
+		}
+	}
+	err := store.InsertData(data, store.Table.GetLocalColumns(), true)
+	if err != nil {
+		log.Errorf("store error: %s", err.Error())
+	}
+	return store
+}
+
+// GetTableQueriesStore returns the virtual data used for the lmd_queries livestatus table.
+func GetTableQueriesStore(table *Table, peer *Peer) *DataStore {
+	if peer == nil {
+		return GetTableQueriesStoreForRegistry(table, nil, "")
+	}
+	return GetTableQueriesStoreForRegistry(table, peer.lmd.runningQueries, "")
+}
+
+// GetTableQueriesStoreForRegistry returns the virtual data used for the lmd_queries livestatus table
+// from the given registry of running queries. If authUser is set, only the queries of this user are returned.
+func GetTableQueriesStoreForRegistry(table *Table, registry *QueryRegistry, authUser string) *DataStore {
+	store := NewDataStore(table, nil)
+	data := make(ResultSet, 0)
+	if registry != nil {
+		now := time.Now()
+		for _, query := range registry.List() {
+			if authUser != "" && query.AuthUser != authUser {
+				continue
+			}
+			data = append(data, []interface{}{
+				query.ID,
+				query.Query,
+				query.Client,
+				query.Table.String(),
+				float64(query.Start.UnixNano()) / float64(time.Second),
+				now.Sub(query.Start).Seconds(),
+				query.Backends,
+				query.RowsScanned,
+			})
+		}
+	}
+	err := store.InsertData(data, store.Table.GetLocalColumns(), true)
+	if err != nil {
+		log.Errorf("store error: %s", err.Error())
+	}
+	return store
+}
+
+// GetTableNodesStore returns the virtual data used for the nodes livestatus table.
+func GetTableNodesStore(table *Table, peer *Peer) *DataStore {
+	if peer == nil {
+		return GetTableNodesStoreForNodes(table, nil)
+	}
+	return GetTableNodesStoreForNodes(table, peer.lmd.nodeAccessor)
+}
+
+// GetTableNodesStoreForNodes returns the virtual data used for the nodes livestatus table
+// from the local state of the cluster, other nodes are not contacted.
+func GetTableNodesStoreForNodes(table *Table, nodes *Nodes) *DataStore {
+	store := NewDataStore(table, nil)
+	data := make(ResultSet, 0)
+	now := time.Now()
+	for _, node := range nodes.Nodes() {
+		lastSeen := int64(0)
+		lastSeenAge := float64(-1)
+		if !node.LastSeen.IsZero() {
+			lastSeen = node.LastSeen.Unix()
+			lastSeenAge = now.Sub(node.LastSeen).Seconds()
+		}
+		uptime := int64(0)
+		if node.Started > 0 {
+			uptime = now.Unix() - node.Started
+		}
+		data = append(data, []interface{}{
+			node.ID,
+			node.Address,
+			node.URL,
+			node.IsMe,
+			node.Online,
+			node.Missed,
+			lastSeen,
+			lastSeenAge,
+			node.Version,
+			node.Started,
+			uptime,
+			len(node.Backends),
+			node.Backends,
+		})
+	}
+	err := store.InsertData(data, store.Table.GetLocalColumns(), true)
+	if err != nil {
+		log.Errorf("store error: %s", err.Error())
+	}
+	return store
+}
+
+// GetGroupByData returns a lazy store for given groupby table.
+// The (group, member) rows are created on the fly while iterating the result,
+// so the full cross product is never materialized.
 func GetGroupByData(table *Table, peer *Peer) *DataStore {
 	if !peer.isOnline() {
 		return nil
 	}
 	store := NewDataStore(table, peer)
 	store.DataSet = peer.data
-	data := make(ResultSet, 0)
-	ds := store.DataSet
-	ds.Lock.RLock()
-	defer ds.Lock.RUnlock()
+	var sourceTable TableName
+	var keyCols []string
+	var groupColName string
 	switch store.Table.Name {
 	case TableHostsbygroup:
-		nameCol := ds.tables[TableHosts].GetColumn("name")
-		groupCol := ds.tables[TableHosts].GetColumn("groups")
-		for _, row := range ds.tables[TableHosts].Data {
-			name := row.GetString(nameCol)
-			groups := row.GetStringList(groupCol)
-			for i := range groups {
-				data = append(data, []interface{}{name, groups[i]})
-			}
-		}
+		sourceTable = TableHosts
+		keyCols = []string{"name"}
+		groupColName = "groups"
 	case TableServicesbygroup:
-		hostNameCol := ds.tables[TableServices].GetColumn("host_name")
-		descCol := ds.tables[TableServices].GetColumn("description")
-		groupCol := ds.tables[TableServices].GetColumn("groups")
-		for _, row := range ds.tables[TableServices].Data {
-			hostName := row.GetString(hostNameCol)
-			description := row.GetString(descCol)
-			groups := row.GetStringList(groupCol)
-			for i := range groups {
-				data = append(data, []interface{}{hostName, description, groups[i]})
-			}
-		}
+		sourceTable = TableServices
+		keyCols = []string{"host_name", "description"}
+		groupColName = "groups"
 	case TableServicesbyhostgroup:
-		hostNameCol := ds.tables[TableServices].GetColumn("host_name")
-		descCol := ds.tables[TableServices].GetColumn("description")
-		hostGroupsCol := ds.tables[TableServices].GetColumn("host_groups")
-		for _, row := range ds.tables[TableServices].Data {
-			hostName := row.GetString(hostNameCol)
-			description := row.GetString(descCol)
-			groups := row.GetStringList(hostGroupsCol)
-			for i := range groups {
-				data = append(data, []interface{}{hostName, description, groups[i]})
-			}
-		}
+		sourceTable = TableServices
+		keyCols = []string{"host_name", "description"}
+		groupColName = "host_groups"
 	default:
 		log.Panicf("GetGroupByData not implemented for table: %s", store.Table.Name)
 	}
 	_, columns := store.GetInitialColumns()
-	err := store.InsertData(data, columns, true)
-	if err != nil {
-		log.Errorf("store error: %s", err.Error())
+	store.rowGenerator = func(fn func(*DataRow) bool) {
+		source := store.DataSet.table(sourceTable)
+		if source == nil {
+			return
+		}
+		nameCols := make([]*Column, len(keyCols))
+		for i, name := range keyCols {
+			nameCols[i] = source.GetColumn(name)
+		}
+		groupCol := source.GetColumn(groupColName)
+		now := currentUnixTime()
+		for _, srcRow := range source.Data {
+			groups := srcRow.GetStringList(groupCol)
+			for i := range groups {
+				raw := make([]interface{}, 0, len(columns))
+				for _, col := range nameCols {
+					raw = append(raw, srcRow.GetString(col))
+				}
+				raw = append(raw, groups[i])
+				for j, col := range columns {
+					raw[j] = cast2Type(raw[j], col)
+				}
+				row, err := NewDataRow(store, raw, columns, now, true)
+				if err != nil {
+					log.Errorf("adding new %s failed: %s", store.Table.Name, err.Error())
+					return
+				}
+				if !fn(row) {
+					return
+				}
+			}
+		}
 	}
 	return store
 }
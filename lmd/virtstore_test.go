@@ -0,0 +1,53 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestColumnsStoreMergePeers(t *testing.T) {
+	lmd := createTestLMDInstance()
+	naemon := NewPeer(lmd, &Connection{Name: "naemon", ID: "id1", Source: []string{"test1.sock"}})
+	naemon.SetFlag(Naemon)
+	icinga := NewPeer(lmd, &Connection{Name: "icinga", ID: "id0", Source: []string{"test0.sock"}})
+	icinga.SetFlag(Icinga2)
+
+	table := Objects.Tables[TableColumns]
+	missingCol := table.GetColumn("missing_backends")
+	nameCol := table.GetColumn("name")
+	tableCol := table.GetColumn("table")
+	getMissing := func(store *DataStore, tableName, colName string) []string {
+		for _, row := range store.Data {
+			if row.GetString(tableCol) == tableName && row.GetString(nameCol) == colName {
+				return row.GetStringList(missingCol)
+			}
+		}
+		return nil
+	}
+
+	// naemon only column is listed, but missing on the icinga peer
+	store := GetTableColumnsStoreForPeers(table, []*Peer{naemon, icinga})
+	if err := assertEq([]string{"id0"}, getMissing(store, "timeperiods", "days")); err != nil {
+		t.Error(err)
+	}
+	// icinga only column is listed, but missing on the naemon peer
+	if err := assertEq([]string{"id1"}, getMissing(store, "hosts", "address6")); err != nil {
+		t.Error(err)
+	}
+	// standard column is available everywhere
+	if err := assertEq([]string{}, getMissing(store, "hosts", "name")); err != nil {
+		t.Error(err)
+	}
+
+	// column which is not provided by any peer is not listed at all
+	store = GetTableColumnsStoreForPeers(table, []*Peer{icinga})
+	if err := assertEq([]string(nil), getMissing(store, "timeperiods", "days")); err != nil {
+		t.Error(err)
+	}
+
+	// result must not depend on the peer order
+	store1 := GetTableColumnsStoreForPeers(table, []*Peer{naemon, icinga})
+	store2 := GetTableColumnsStoreForPeers(table, []*Peer{icinga, naemon})
+	if err := assertEq(len(store1.Data), len(store2.Data)); err != nil {
+		t.Error(err)
+	}
+}